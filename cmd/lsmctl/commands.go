@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"lsmstore/commitlog"
+	"lsmstore/schema"
+	"lsmstore/sst"
+	"lsmstore/store"
+	"lsmstore/utils"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// leftoverSuffixes mark files of rewrites which were interrupted before being renamed over the original.
+var leftoverSuffixes = []string{".copy", ".repair"}
+
+type dataDirectory struct {
+	commitlogPath string
+	sstPath       string
+	out           io.Writer
+}
+
+type sstFile struct {
+	tag  string
+	path string
+}
+
+// sstFiles lists SSTs as sst.Manager finds them on start, sorted by tag.
+func (d *dataDirectory) sstFiles() ([]sstFile, error) {
+	infos, err := ioutil.ReadDir(d.sstPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ans := make([]sstFile, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() || strings.Contains(info.Name(), ".") {
+			continue
+		}
+		ans = append(ans, sstFile{tag: sst.TagOfFileName(info.Name()), path: d.sstPath + "/" + info.Name()})
+	}
+	sort.Slice(ans, func(i, j int) bool {
+		return ans[i].tag < ans[j].tag
+	})
+	return ans, nil
+}
+
+func (d *dataDirectory) commitlogFiles() []string {
+	ans := make([]string, 0, 2)
+	for _, name := range []string{commitlog.FileA, commitlog.FileB} {
+		if utils.FileExists(d.commitlogPath + "/" + name) {
+			ans = append(ans, d.commitlogPath+"/"+name)
+		}
+	}
+	return ans
+}
+
+func (d *dataDirectory) leftovers() []string {
+	ans := make([]string, 0)
+	for _, dir := range []string{d.sstPath, d.commitlogPath} {
+		infos, _ := ioutil.ReadDir(dir)
+		for _, info := range infos {
+			for _, suffix := range leftoverSuffixes {
+				if !info.IsDir() && strings.HasSuffix(info.Name(), suffix) {
+					ans = append(ans, dir+"/"+info.Name())
+				}
+			}
+		}
+	}
+	return ans
+}
+
+func (d *dataDirectory) catalog() (*schema.Catalog, error) {
+	path := d.sstPath + "/" + store.CatalogFileName
+	if !utils.FileExists(path) {
+		return nil, nil
+	}
+	catalog := schema.Catalog{Path: path}
+	if err := catalog.Init(); err != nil {
+		return nil, err
+	}
+	return &catalog, nil
+}
+
+func (d *dataDirectory) tags() error {
+	files, err := d.sstFiles()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		fmt.Fprintln(d.out, f.tag)
+	}
+	return nil
+}
+
+func (d *dataDirectory) dumpSst(tag string) error {
+	path := d.sstPath + "/" + sst.FileNameForTag(tag)
+	if !utils.FileExists(path) {
+		return fmt.Errorf("no SST for tag %q in %s", tag, d.sstPath)
+	}
+	catalog, err := d.catalog()
+	if err != nil {
+		return err
+	}
+	valueType := schema.Untyped
+	if catalog != nil {
+		valueType = catalog.TypeOf(tag)
+	}
+	w := tabwriter.NewWriter(d.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "OFFSET\tTIMESTAMP\tEXPIRES_AT\tVALUE")
+	report, err := sst.ScanFile(path, func(e sst.Entry, o int64) {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%s\n", o, e.Timestamp, e.ExpiresAt, formatValue(valueType, e.Value))
+	})
+	w.Flush()
+	if err != nil {
+		return err
+	}
+	return d.printProblems(report)
+}
+
+func (d *dataDirectory) dumpCommitlog() error {
+	catalog, err := d.catalog()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(d.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tOFFSET\tTAG\tTIMESTAMP\tEXPIRES_AT\tVALUE")
+	reports := make([]utils.RecordsReport, 0, 2)
+	for _, path := range d.commitlogFiles() {
+		name := path[strings.LastIndex(path, "/")+1:]
+		report, err := commitlog.ScanFile(path, func(e commitlog.Entry, o int64) {
+			valueType := schema.Untyped
+			if catalog != nil {
+				valueType = catalog.TypeOf(string(e.Key))
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%d\t%s\n", name, o, e.Key, e.Timestamp, e.ExpiresAt, formatValue(valueType, e.Value))
+		})
+		if err != nil {
+			w.Flush()
+			return err
+		}
+		reports = append(reports, report)
+	}
+	w.Flush()
+	return d.printProblems(reports...)
+}
+
+func (d *dataDirectory) printProblems(reports ...utils.RecordsReport) error {
+	damaged := false
+	for _, report := range reports {
+		for _, problem := range report.Problems {
+			fmt.Fprintf(d.out, "%s: %s\n", report.FileName, problem)
+			damaged = true
+		}
+	}
+	if damaged {
+		return errDamaged
+	}
+	return nil
+}
+
+// scanAll scans every SST and commitlog, or repairs them if repair is set.
+func (d *dataDirectory) scanAll(repair bool) ([]utils.RecordsReport, error) {
+	files, err := d.sstFiles()
+	if err != nil {
+		return nil, err
+	}
+	reports := make([]utils.RecordsReport, 0, len(files)+2)
+	for _, f := range files {
+		var report utils.RecordsReport
+		if repair {
+			report, err = sst.RepairFile(f.path)
+		} else {
+			report, err = sst.ScanFile(f.path, func(sst.Entry, int64) {})
+		}
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	for _, path := range d.commitlogFiles() {
+		var report utils.RecordsReport
+		if repair {
+			report, err = commitlog.RepairFile(path)
+		} else {
+			report, err = commitlog.ScanFile(path, func(commitlog.Entry, int64) {})
+		}
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+func (d *dataDirectory) verify() error {
+	reports, err := d.scanAll(false)
+	if err != nil {
+		return err
+	}
+	damaged := 0
+	for _, report := range reports {
+		if !report.Clean() {
+			damaged++
+		}
+		if (report.Version < utils.RecordsVersion) && (report.FileBytes > 0) {
+			fmt.Fprintf(d.out, "%s: version %d without checksums, migrated on opening or by repair\n", report.FileName, report.Version)
+		}
+	}
+	leftovers := d.leftovers()
+	for _, path := range leftovers {
+		fmt.Fprintf(d.out, "%s: leftover of an interrupted rewrite\n", path)
+	}
+	problemsErr := d.printProblems(reports...)
+	fmt.Fprintf(d.out, "%d files checked, %d damaged, %d leftovers\n", len(reports), damaged, len(leftovers))
+	if (problemsErr != nil) || (len(leftovers) > 0) {
+		return errDamaged
+	}
+	return nil
+}
+
+func (d *dataDirectory) repair() error {
+	//leftovers go first, so that files left by an interrupted repair are not taken for damage of their own
+	leftovers := d.leftovers()
+	for _, path := range leftovers {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		fmt.Fprintf(d.out, "%s: removed leftover of an interrupted rewrite\n", path)
+	}
+	reports, err := d.scanAll(true)
+	if err != nil {
+		return err
+	}
+	repaired := 0
+	for _, report := range reports {
+		if report.Clean() {
+			continue
+		}
+		repaired++
+		fmt.Fprintf(d.out, "%s: dropped %d records, truncated %d bytes\n", report.FileName, report.Dropped, report.TornTail)
+	}
+	fmt.Fprintf(d.out, "%d files checked, %d repaired, %d leftovers removed\n", len(reports), repaired, len(leftovers))
+	return nil
+}
+
+type tagStats struct {
+	points      int
+	expired     int
+	overwritten int
+	first       uint64
+	last        uint64
+	bytes       int64
+}
+
+func (d *dataDirectory) stats() error {
+	files, err := d.sstFiles()
+	if err != nil {
+		return err
+	}
+	now := utils.GetNowMillis()
+	reports := make([]utils.RecordsReport, 0, len(files)+2)
+	total := tagStats{}
+	w := tabwriter.NewWriter(d.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TAG\tPOINTS\tEXPIRED\tOVERWRITTEN\tFIRST\tLAST\tBYTES")
+	for _, f := range files {
+		//the last version of a timestamp in the file is the one the index of the store points to
+		latest := make(map[uint64]uint64)
+		entries := 0
+		report, err := sst.ScanFile(f.path, func(e sst.Entry, o int64) {
+			latest[e.Timestamp] = e.ExpiresAt
+			entries++
+		})
+		if err != nil {
+			w.Flush()
+			return err
+		}
+		reports = append(reports, report)
+		ts := tagStats{overwritten: entries - len(latest), bytes: report.FileBytes}
+		for timestamp, expiresAt := range latest {
+			if (expiresAt != 0) && (expiresAt < now) {
+				ts.expired++
+				continue
+			}
+			ts.points++
+			if (ts.first == 0) || (timestamp < ts.first) {
+				ts.first = timestamp
+			}
+			if timestamp > ts.last {
+				ts.last = timestamp
+			}
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\n", f.tag, ts.points, ts.expired, ts.overwritten, ts.first, ts.last, ts.bytes)
+		total.overwritten += ts.overwritten
+		total.points += ts.points
+		total.expired += ts.expired
+		total.bytes += ts.bytes
+	}
+	fmt.Fprintf(w, "%d tags\t%d\t%d\t%d\t\t\t%d\n", len(files), total.points, total.expired, total.overwritten, total.bytes)
+	w.Flush()
+
+	for _, path := range d.commitlogFiles() {
+		entries := 0
+		report, err := commitlog.ScanFile(path, func(commitlog.Entry, int64) {
+			entries++
+		})
+		if err != nil {
+			return err
+		}
+		reports = append(reports, report)
+		fmt.Fprintf(d.out, "%s: %d entries not flushed yet, %d bytes\n", path, entries, report.FileBytes)
+	}
+	return d.printProblems(reports...)
+}
+
+// formatValue renders values of typed tags as the catalog says and the others as hex.
+func formatValue(vt schema.ValueType, value []byte) string {
+	switch vt {
+	case schema.Float64:
+		if v, err := schema.DecodeFloat64(value); err == nil {
+			return strconv.FormatFloat(v, 'g', -1, 64)
+		}
+	case schema.Int64:
+		if v, err := schema.DecodeInt64(value); err == nil {
+			return strconv.FormatInt(v, 10)
+		}
+	case schema.Bool:
+		if v, err := schema.DecodeBool(value); err == nil {
+			return strconv.FormatBool(v)
+		}
+	case schema.String:
+		if v, err := schema.DecodeString(value); err == nil {
+			return strconv.Quote(v)
+		}
+	}
+	return hex.EncodeToString(value)
+}
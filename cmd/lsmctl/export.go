@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"lsmstore/store"
+	"os"
+	"time"
+)
+
+// openStore starts the store over the directory, which replays its commitlogs the way lsmserver does on start.
+func (d *dataDirectory) openStore() (*store.StorageReader, *store.StorageWriter) {
+	return store.InitStorageWithOptions(store.Options{
+		CommitlogPath:        d.commitlogPath,
+		EntriesPerCommitlog:  store.ImportBatchSize * 100,
+		PeriodBetweenFlushes: time.Hour,
+		SSTPath:              d.sstPath,
+		MemtMaxEntriesPerTag: 1,
+	})
+}
+
+func parseFormatFlags(name string, out io.Writer) (*flag.FlagSet, func() (store.ExportFormat, error)) {
+	flags := flag.NewFlagSet("lsmctl "+name, flag.ContinueOnError)
+	flags.SetOutput(out)
+	encoding := flags.String("format", "csv", "csv, jsonl or columnar")
+	typed := flags.Bool("typed", false, "values of csv and jsonl as typed in the catalog instead of base64")
+	return flags, func() (store.ExportFormat, error) {
+		e, err := store.ParseExportEncoding(*encoding)
+		return store.ExportFormat{Encoding: e, TypedValues: *typed}, err
+	}
+}
+
+func (d *dataDirectory) export(args []string) error {
+	flags, format := parseFormatFlags("export", d.out)
+	from := flags.Uint64("from", 0, "first timestamp exported")
+	to := flags.Uint64("to", ^uint64(0)-1, "last timestamp exported")
+	outFile := flags.String("out", "", "file to write to instead of standard output")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	f, err := format()
+	if err != nil {
+		return err
+	}
+	reader, _ := d.openStore()
+	if *outFile == "" {
+		return reader.Export(d.out, flags.Args(), *from, *to, f)
+	}
+	file, err := os.Create(*outFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := reader.Export(file, flags.Args(), *from, *to, f); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func (d *dataDirectory) importFile(args []string) error {
+	flags, format := parseFormatFlags("import", d.out)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	f, err := format()
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: lsmctl import [-format csv|jsonl|columnar] [-typed] <file|->")
+	}
+	r := io.Reader(os.Stdin)
+	if flags.Arg(0) != "-" {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	_, writer := d.openStore()
+	imported, err := writer.Import(r, f)
+	//whatever was stored is flushed even if the import stopped at an invalid record
+	writer.DiskWriter.Flush()
+	fmt.Fprintf(d.out, "%d measurements imported\n", imported)
+	return err
+}
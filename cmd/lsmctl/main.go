@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+const usage = `usage: lsmctl [-data dir] <command> [args]
+
+Inspects and repairs the data directory of a store which is not running, moves data in and out of it.
+
+commands:
+  tags              tags having an SST
+  dump-sst <tag>    entries of the SST of a tag in file order, overwritten versions included
+  dump-commitlog    entries of both commitlogs in file order
+  verify            checks every SST and commitlog, fails if any is damaged
+  repair            truncates torn tails, drops damaged records and removes leftovers of interrupted rewrites
+  stats             points and bytes per tag, entries waiting in commitlogs
+  export [-format csv|jsonl|columnar] [-typed] [-from ts] [-to ts] [-out file] [tags]
+                    points of the tags, or of all tags, as CSV, JSON Lines or columnar row groups
+  import [-format csv|jsonl|columnar] [-typed] <file|->
+                    points written by export, from a file or standard input
+  restore [-archive dir] [-until-seq n] [-until-time t] [-index-from dir] <checkpoint>
+                    fills a new data directory from a checkpoint and the commitlogs archived after it
+`
+
+// errDamaged makes verify fail once it has printed what is wrong.
+var errDamaged = errors.New("data directory is damaged, see above")
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("lsmctl", flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.Usage = func() {
+		fmt.Fprint(out, usage)
+		flags.PrintDefaults()
+	}
+	dataDir := flags.String("data", "./tmp/lsmserver", "directory holding commitlog and SST files, as given to lsmserver")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("missing command")
+	}
+	d := dataDirectory{commitlogPath: *dataDir + "/commitlog", sstPath: *dataDir + "/sst", out: out}
+	command, commandArgs := flags.Arg(0), flags.Args()[1:]
+	//import and restore may fill a new directory, everything else works on an existing one
+	if _, err := os.Stat(*dataDir); (err != nil) && (command != "import") && (command != "restore") {
+		return err
+	}
+
+	switch command {
+	case "tags":
+		return d.tags()
+	case "dump-sst":
+		if len(commandArgs) != 1 {
+			return errors.New("usage: lsmctl dump-sst <tag>")
+		}
+		return d.dumpSst(commandArgs[0])
+	case "dump-commitlog":
+		return d.dumpCommitlog()
+	case "verify":
+		return d.verify()
+	case "repair":
+		return d.repair()
+	case "stats":
+		return d.stats()
+	case "export":
+		return d.export(commandArgs)
+	case "import":
+		return d.importFile(commandArgs)
+	case "restore":
+		return restore(*dataDir, commandArgs, out)
+	}
+	flags.Usage()
+	return fmt.Errorf("unknown command %q", command)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"lsmstore/commitlog"
+	"lsmstore/dto"
+	"lsmstore/schema"
+	"lsmstore/sst"
+	"lsmstore/store"
+	"lsmstore/utils"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLsmctl_InspectsDataDirectory(t *testing.T) {
+	//given
+	dataDir := newTestDataDir()
+	catalog := schema.Catalog{Path: dataDir + "/sst/" + store.CatalogFileName}
+	assert.Nil(t, catalog.Init())
+	assert.Nil(t, catalog.Register("temperature", schema.Float64))
+
+	//when
+	tags, tagsErr := runCommand(dataDir, "tags")
+	dump, dumpErr := runCommand(dataDir, "dump-sst", "temperature")
+	commitlogDump, commitlogErr := runCommand(dataDir, "dump-commitlog")
+	stats, statsErr := runCommand(dataDir, "stats")
+	verify, verifyErr := runCommand(dataDir, "verify")
+
+	//then
+	assert.Nil(t, tagsErr)
+	assert.Equal(t, "humidity\ntemperature\n", tags)
+	assert.Nil(t, dumpErr)
+	assert.Equal(t, []string{
+		"OFFSET  TIMESTAMP  EXPIRES_AT  VALUE",
+		"8       1000       0           21.5",
+		"38      2000       0           22",
+	}, lines(dump))
+	assert.Nil(t, commitlogErr)
+	assert.Contains(t, commitlogDump, "COMMITLOGA  8       temperature  3000       0           23.5")
+	assert.Nil(t, statsErr)
+	assert.Contains(t, stats, "humidity     3       0        0            1000   3000  77")
+	assert.Contains(t, stats, "1 entries not flushed yet")
+	assert.Nil(t, verifyErr)
+	assert.Contains(t, verify, "4 files checked, 0 damaged, 0 leftovers")
+}
+
+func TestLsmctl_RepairsWhatVerifyReports(t *testing.T) {
+	//given
+	dataDir := newTestDataDir()
+	humidityFile := dataDir + "/sst/" + sst.FileNameForTag("humidity")
+	outOfOrder := sst.Entry{Timestamp: 1500, Value: []byte{9}}
+	appendToFile(t, humidityFile, outOfOrder.ToByteArrayWithLength())
+	appendToFile(t, dataDir+"/commitlog/"+commitlog.FileA, []byte{40, 0, 1})
+	assert.Nil(t, ioutil.WriteFile(humidityFile+".copy", []byte{1, 2, 3}, 0644))
+
+	//when
+	verify, verifyErr := runCommand(dataDir, "verify")
+	repair, repairErr := runCommand(dataDir, "repair")
+	verifyAfterRepair, verifyAfterRepairErr := runCommand(dataDir, "verify")
+
+	//then
+	assert.Equal(t, errDamaged, verifyErr)
+	assert.Contains(t, verify, "timestamp 1500 is before 3000 of the previous entry")
+	assert.Contains(t, verify, "torn tail of 3 bytes at offset 51")
+	assert.Contains(t, verify, "leftover of an interrupted rewrite")
+	assert.Contains(t, verify, "4 files checked, 2 damaged, 1 leftovers")
+	assert.Nil(t, repairErr)
+	assert.Contains(t, repair, "dropped 1 records, truncated 0 bytes")
+	assert.Contains(t, repair, "dropped 0 records, truncated 3 bytes")
+	assert.Nil(t, verifyAfterRepairErr, verifyAfterRepair)
+	assert.False(t, utils.FileExists(humidityFile+".copy"))
+
+	reader, _ := store.InitStorageWithOptions(store.Options{
+		CommitlogPath:        dataDir + "/commitlog",
+		EntriesPerCommitlog:  1000,
+		PeriodBetweenFlushes: time.Hour,
+		SSTPath:              dataDir + "/sst",
+		MemtMaxEntriesPerTag: 10,
+	})
+	assert.Equal(t, map[string][]dto.Measurement{
+		"humidity":    {{Timestamp: 1000, Value: []byte{1}}, {Timestamp: 2000, Value: []byte{2}}, {Timestamp: 3000, Value: []byte{3}}},
+		"temperature": {{Timestamp: 1000, Value: schema.EncodeFloat64(21.5)}, {Timestamp: 2000, Value: schema.EncodeFloat64(22)}, {Timestamp: 3000, Value: schema.EncodeFloat64(23.5)}},
+	}, reader.Retrieve([]string{"humidity", "temperature"}, 0, 5000))
+}
+
+func TestLsmctl_VerifyReportsFlippedBitsAndFilesOfFirstVersion(t *testing.T) {
+	//given
+	dataDir := newTestDataDir()
+	humidityFile := dataDir + "/sst/" + sst.FileNameForTag("humidity")
+	content, err := ioutil.ReadFile(humidityFile)
+	assert.Nil(t, err)
+	content[utils.RecordsHeaderSize+2+16] ^= 0x10
+	assert.Nil(t, ioutil.WriteFile(humidityFile, content, 0644))
+	pressure := sst.Entry{Timestamp: 1000, Value: []byte{7}}
+	firstVersion := pressure.ToByteArrayWithLength()
+	firstVersion = append(firstVersion[:2:2], utils.PayloadOf(firstVersion[2:])...)
+	firstVersion[0] -= utils.ChecksumSize
+	assert.Nil(t, ioutil.WriteFile(dataDir+"/sst/"+sst.FileNameForTag("pressure"), firstVersion, 0644))
+
+	//when
+	verify, verifyErr := runCommand(dataDir, "verify")
+
+	//then
+	assert.Equal(t, errDamaged, verifyErr)
+	assert.Contains(t, verify, "record at offset 8: checksum mismatch")
+	assert.Contains(t, verify, "version 1 without checksums, migrated on opening or by repair")
+	assert.Contains(t, verify, "5 files checked, 1 damaged, 0 leftovers")
+}
+
+func TestLsmctl_ExportedDataIsImportedIntoNewDirectory(t *testing.T) {
+	//given
+	dataDir := newTestDataDir()
+	for _, format := range []string{"jsonl", "columnar"} {
+		exportFile := dataDir + "/export." + format
+		newDataDir := dataDir + "-imported-" + format
+
+		//when
+		_, exportErr := runCommand(dataDir, "export", "-format", format, "-from", "2000", "-out", exportFile, "humidity", "temperature")
+		imported, importErr := runCommand(newDataDir, "import", "-format", format, exportFile)
+		tags, tagsErr := runCommand(newDataDir, "tags")
+		exported, reexportErr := runCommand(newDataDir, "export", "temperature")
+
+		//then
+		assert.Nil(t, exportErr, format)
+		assert.Nil(t, importErr, format)
+		assert.Equal(t, "4 measurements imported\n", imported, format)
+		assert.Nil(t, tagsErr, format)
+		assert.Equal(t, "humidity\ntemperature\n", tags, "imported data was not flushed to SST")
+		assert.Nil(t, reexportErr, format)
+		assert.Equal(t, []string{"tag,timestamp,expires_at,value", "temperature,2000,0,AAAAAAAANkA=", "temperature,3000,0,AAAAAACAN0A="}, lines(exported), format)
+	}
+}
+
+func TestLsmctl_RestoresCheckpointUpToArchivedSequence(t *testing.T) {
+	//given
+	dataDir := fmt.Sprintf("/tmp/golsm_test/lsmctl/data-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	db := store.Open(store.Options{
+		CommitlogPath:        dataDir + "/commitlog",
+		EntriesPerCommitlog:  1000,
+		PeriodBetweenFlushes: time.Hour,
+		SSTPath:              dataDir + "/sst",
+		MemtMaxEntriesPerTag: 1,
+		CommitlogArchivePath: dataDir + "/archive",
+	})
+	_, checkpointErr := db.Checkpoint(dataDir + "/checkpoint")
+	for ts := uint64(1000); ts <= 2000; ts += 1000 {
+		assert.Nil(t, db.Writer.Store(dto.TaggedMeasurement{Tag: "temperature", Timestamp: ts, Value: []byte{1}}, 0))
+		db.Writer.DiskWriter.Flush()
+	}
+	restoredDir := dataDir + "-restored"
+
+	//when
+	restored, restoreErr := runCommand(restoredDir, "restore", "-archive", dataDir+"/archive", "-until-seq", "1", dataDir+"/checkpoint")
+	exported, exportErr := runCommand(restoredDir, "export", "temperature")
+
+	//then
+	assert.Nil(t, checkpointErr)
+	assert.Nil(t, restoreErr)
+	assert.Equal(t, "1 archived commitlogs with 1 entries replayed, restored up to sequence 1\n", restored)
+	assert.Nil(t, exportErr)
+	assert.Equal(t, []string{"tag,timestamp,expires_at,value", "temperature,1000,0,AQ=="}, lines(exported))
+}
+
+func TestLsmctl_RejectsInvalidInvocations(t *testing.T) {
+	//given
+	dataDir := newTestDataDir()
+
+	for _, args := range [][]string{
+		{},
+		{"unknown"},
+		{"dump-sst"},
+		{"dump-sst", "missing"},
+		{"export", "-format", "xml"},
+		{"import"},
+		{"import", "missing-file"},
+		{"restore"},
+		{"restore", "-until-time", "yesterday", "missing-checkpoint"},
+	} {
+		//when
+		_, err := runCommand(dataDir, args...)
+
+		//then
+		assert.NotNil(t, err, args)
+	}
+	err := run([]string{"-data", dataDir + "/missing", "tags"}, ioutil.Discard)
+	assert.NotNil(t, err)
+}
+
+// newTestDataDir lays out a directory as lsmserver leaves it: two flushed tags and one entry still in the commitlog.
+func newTestDataDir() string {
+	dataDir := fmt.Sprintf("/tmp/golsm_test/lsmctl/data-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	sstm := sst.Manager{RootDir: dataDir + "/sst"}
+	sstm.InitStorage()
+	sstm.MergeWithCommitlog([]commitlog.Entry{
+		{Key: []byte("temperature"), Timestamp: 1000, Value: schema.EncodeFloat64(21.5)},
+		{Key: []byte("temperature"), Timestamp: 2000, Value: schema.EncodeFloat64(22)},
+		{Key: []byte("humidity"), Timestamp: 1000, Value: []byte{1}},
+		{Key: []byte("humidity"), Timestamp: 2000, Value: []byte{2}},
+		{Key: []byte("humidity"), Timestamp: 3000, Value: []byte{3}},
+	})
+	clm := commitlog.Manager{Path: dataDir + "/commitlog"}
+	clm.Init()
+	clm.Store(commitlog.Entry{Key: []byte("temperature"), Timestamp: 3000, Value: schema.EncodeFloat64(23.5)})
+	return dataDir
+}
+
+func runCommand(dataDir string, args ...string) (string, error) {
+	var out bytes.Buffer
+	err := run(append([]string{"-data", dataDir}, args...), &out)
+	return out.String(), err
+}
+
+func appendToFile(t *testing.T, fileName string, data []byte) {
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = f.Write(data)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+}
+
+func lines(s string) []string {
+	return strings.Split(strings.TrimRight(s, "\n"), "\n")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"lsmstore/store"
+	"strconv"
+	"time"
+)
+
+// restore fills dataDir, which must not exist yet, from a checkpoint and the commitlogs archived after it.
+func restore(dataDir string, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("lsmctl restore", flag.ContinueOnError)
+	flags.SetOutput(out)
+	archiveDir := flags.String("archive", "", "commitlog archive of the store, as given to lsmserver -commitlog-archive")
+	untilSequence := flags.Uint64("until-seq", 0, "last record replayed, 0 for all")
+	untilTime := flags.String("until-time", "", "replays records written until then, as RFC 3339 or milliseconds")
+	indexFrom := flags.String("index-from", "", "data directory whose catalog and series index are used, as they know tags created after the checkpoint")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: lsmctl restore [-archive dir] [-until-seq n] [-until-time t] [-index-from dir] <checkpoint>")
+	}
+	opts := store.RestoreOptions{CheckpointDir: flags.Arg(0), ArchiveDir: *archiveDir, UntilSequence: *untilSequence}
+	if *untilTime != "" {
+		t, err := parseMillis(*untilTime)
+		if err != nil {
+			return err
+		}
+		opts.UntilTime = t
+	}
+	if *indexFrom != "" {
+		opts.IndexSSTDir = *indexFrom + "/" + store.CheckpointSSTDir
+	}
+	report, err := store.Restore(dataDir, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%d archived commitlogs with %d entries replayed, restored up to sequence %d\n", report.Logs, report.Entries, report.Sequence)
+	return nil
+}
+
+func parseMillis(s string) (uint64, error) {
+	if millis, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return millis, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, neither RFC 3339 nor milliseconds", s)
+	}
+	return uint64(t.UnixNano() / int64(time.Millisecond)), nil
+}
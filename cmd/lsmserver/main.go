@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"lsmstore/promremote"
+	"lsmstore/replication"
+	"lsmstore/rpc"
+	"lsmstore/store"
+	"lsmstore/utils"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/jeanphorn/log4go"
+	"google.golang.org/grpc"
+)
+
+func main() {
+	addr := flag.String("addr", ":8080", "address to listen on")
+	grpcAddr := flag.String("grpc-addr", "", "address to serve gRPC on, none if empty")
+	dataDir := flag.String("data", "./tmp/lsmserver", "directory holding commitlog and SST files")
+	entriesPerCommitlog := flag.Int("entries-per-commitlog", 10000, "entries written before the commitlog is flushed to SST")
+	flushEvery := flag.Duration("flush-every", time.Second, "period between flushes of the commitlog to SST")
+	memtMaxEntries := flag.Int("memt-max-entries", 100, "points cached per tag")
+	memtMaxBytes := flag.Int64("memt-max-bytes", 0, "bound of the memtable cache in bytes, 0 for none")
+	memtPrefetch := flag.Duration("memt-prefetch", time.Minute, "newest window of every tag loaded into the cache on start")
+	blockCacheBytes := flag.Int64("block-cache-bytes", 0, "bound of the SST block cache in bytes, 0 for the default, negative to disable")
+	mmap := flag.Bool("mmap", false, "read SSTs from memory-mapped files")
+	archiveDir := flag.String("commitlog-archive", "", "directory keeping flushed commitlogs for point-in-time restores, none if empty")
+	archiveRetention := flag.Duration("commitlog-archive-retention", 0, "age after which archived commitlogs are removed, 0 to keep them")
+	replicationAddr := flag.String("replication-addr", "", "address to serve replicas on, none if empty")
+	replicaOf := flag.String("replica-of", "", "replication address of the primary to follow; an absent data directory starts from its checkpoint")
+	readSampleLimit := flag.Int("remote-read-sample-limit", promremote.DefaultReadSampleLimit, "samples a remote_read request may return, 0 for no limit")
+	flag.Parse()
+
+	if *replicaOf != "" {
+		if _, err := os.Stat(*dataDir); os.IsNotExist(err) {
+			_, err := replication.FetchCheckpoint(*replicaOf, *dataDir)
+			utils.Check(err)
+		}
+	}
+	reader, writer := store.InitStorageWithOptions(store.Options{
+		CommitlogPath:        *dataDir + "/commitlog",
+		EntriesPerCommitlog:  *entriesPerCommitlog,
+		PeriodBetweenFlushes: *flushEvery,
+		MemtPrefetchSeconds:  *memtPrefetch,
+		SSTPath:              *dataDir + "/sst",
+		MemtMaxEntriesPerTag: *memtMaxEntries,
+		MemtMaxBytes:         *memtMaxBytes,
+		BlockCacheBytes:      *blockCacheBytes,
+		MmapSST:              *mmap,
+
+		CommitlogArchivePath:      *archiveDir,
+		CommitlogArchiveRetention: *archiveRetention,
+	})
+	db := &store.DB{Reader: reader, Writer: writer}
+	//servers other than HTTP are stopped before the store is closed on shutdown
+	stoppers := make([]func(), 0)
+	if *replicationAddr != "" {
+		listener, err := net.Listen("tcp", *replicationAddr)
+		utils.Check(err)
+		primary := replication.Primary{DB: db}
+		primary.Init()
+		stoppers = append(stoppers, primary.Close)
+		log.Info("lsmserver serving replicas on %s", *replicationAddr)
+		go func() {
+			utils.Check(primary.Serve(listener))
+		}()
+	}
+	if *replicaOf != "" {
+		go follow(db, *replicaOf)
+	}
+	if *grpcAddr != "" {
+		listener, err := net.Listen("tcp", *grpcAddr)
+		utils.Check(err)
+		grpcServer := grpc.NewServer()
+		rpc.RegisterStorageServer(grpcServer, &rpc.Server{Reader: reader, Writer: writer})
+		stoppers = append(stoppers, grpcServer.GracefulStop)
+		log.Info("lsmserver serving gRPC on %s", *grpcAddr)
+		go func() {
+			utils.Check(grpcServer.Serve(listener))
+		}()
+	}
+	server := &http.Server{Addr: *addr, Handler: newServer(reader, writer, *readSampleLimit)}
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		log.Info("lsmserver shutting down")
+		server.Shutdown(context.Background())
+	}()
+	log.Info("lsmserver listening on %s", *addr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		utils.Check(err)
+	}
+	for _, stop := range stoppers {
+		stop()
+	}
+	utils.Check(db.Close())
+	log.Close()
+}
+
+// follow keeps applying what the primary serves, reconnecting on failures, but not when it can't catch up anymore.
+func follow(db *store.DB, primaryAddr string) {
+	replica := replication.Replica{Writer: db.Writer}
+	utils.Check(replica.Init())
+	for {
+		err := replica.Follow(primaryAddr, nil)
+		if err == store.ErrTooFarBehind {
+			log.Error("replica stopped following %s: %v; remove the data directory to start over", primaryAddr, err)
+			return
+		}
+		log.Warn("replica lost %s: %v", primaryAddr, err)
+		time.Sleep(time.Second)
+	}
+}
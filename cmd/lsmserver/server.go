@@ -0,0 +1,269 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"lsmstore/dto"
+	"lsmstore/lineprotocol"
+	"lsmstore/memt"
+	"lsmstore/promremote"
+	"lsmstore/sst"
+	"lsmstore/store"
+	"lsmstore/utils"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const MaxWriteBodyBytes = 32 * 1024 * 1024
+
+// WriteRequest is the body of POST /write; values are base64 encoded, as usual for []byte in JSON.
+type WriteRequest struct {
+	ExpiresAt    uint64
+	Measurements []dto.TaggedMeasurement
+}
+
+type AvailabilityResponse struct {
+	From uint64
+	To   uint64
+}
+
+type StatsResponse struct {
+	Tags       int
+	OpenFiles  int
+	Memtable   memt.Stats
+	BlockCache sst.BlockCacheStats
+}
+
+type ErrorResponse struct {
+	Error string
+}
+
+// InfluxErrorResponse is how InfluxDB reports errors, which its clients log.
+type InfluxErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// server exposes a store over HTTP/JSON; all endpoints answer errors with status 4xx and an ErrorResponse.
+type server struct {
+	reader *store.StorageReader
+	writer *store.StorageWriter
+	mux    *http.ServeMux
+}
+
+// newServer answers remote_read requests of up to readSampleLimit samples, see promremote.ReadHandlerWithSampleLimit.
+func newServer(reader *store.StorageReader, writer *store.StorageWriter, readSampleLimit int) *server {
+	s := &server{reader: reader, writer: writer, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/write", s.only(http.MethodPost, s.write))
+	s.mux.HandleFunc("/query", s.only(http.MethodGet, s.query))
+	s.mux.HandleFunc("/tags", s.only(http.MethodGet, s.tags))
+	s.mux.HandleFunc("/availability", s.only(http.MethodGet, s.availability))
+	s.mux.HandleFunc("/stats", s.only(http.MethodGet, s.stats))
+	s.mux.HandleFunc("/api/v2/write", s.influxWrite)
+	s.mux.Handle("/api/v1/write", promremote.WriteHandler(writer))
+	s.mux.Handle("/api/v1/read", promremote.ReadHandlerWithSampleLimit(reader, readSampleLimit))
+	return s
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *server) only(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (s *server) write(w http.ResponseWriter, r *http.Request) {
+	var req WriteRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxWriteBodyBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("malformed body: %v", err))
+		return
+	}
+	if err := store.ValidateBatch(req.Measurements); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.writer.StoreBatch(req.Measurements, req.ExpiresAt); err != nil {
+		writeError(w, writeFailureStatus(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// influxWrite accepts line protocol as InfluxDB /api/v2/write does, optionally gzipped; org and bucket are ignored,
+// as the store has a single namespace. Nothing is written unless every line is valid. Timestamps are truncated
+// to milliseconds, so a request with different timestamps of a series in the same millisecond is rejected; such
+// timestamps sent in separate requests overwrite each other.
+func (s *server) influxWrite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeInfluxError(w, http.StatusMethodNotAllowed, "method not allowed", fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	precision, err := lineprotocol.ParsePrecision(r.URL.Query().Get("precision"))
+	if err != nil {
+		writeInfluxError(w, http.StatusBadRequest, "invalid", err)
+		return
+	}
+	var body io.Reader = http.MaxBytesReader(w, r.Body, MaxWriteBodyBytes)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gzipped, err := gzip.NewReader(body)
+		if err != nil {
+			writeInfluxError(w, http.StatusBadRequest, "invalid", err)
+			return
+		}
+		body = io.LimitReader(gzipped, MaxWriteBodyBytes+1)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		writeInfluxError(w, http.StatusBadRequest, "invalid", err)
+		return
+	}
+	if len(data) > MaxWriteBodyBytes {
+		writeInfluxError(w, http.StatusRequestEntityTooLarge, "request too large", fmt.Errorf("body exceeds %d bytes", MaxWriteBodyBytes))
+		return
+	}
+	measurements, err := lineprotocol.Parse(data, precision, utils.GetNowMillis())
+	if err != nil {
+		writeInfluxError(w, http.StatusBadRequest, "invalid", err)
+		return
+	}
+	if len(measurements) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err := store.ValidateBatch(lineprotocol.ToTagged(measurements)); err != nil {
+		writeInfluxError(w, http.StatusBadRequest, "invalid", err)
+		return
+	}
+	if s.writer.Series != nil {
+		err = s.writer.StoreSeries(measurements, 0)
+	} else {
+		err = s.writer.StoreBatch(lineprotocol.ToTagged(measurements), 0)
+	}
+	if store.IsValidationError(err) {
+		writeInfluxError(w, http.StatusBadRequest, "invalid", err)
+		return
+	}
+	if err != nil {
+		writeInfluxError(w, http.StatusServiceUnavailable, "unavailable", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// query answers GET /query?tags=a,b&from=1&to=2 with measurements per tag; from and to are inclusive.
+// Series keys contain commas, so they are selected with match=<selector> instead of tags.
+func (s *server) query(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	tags := splitTags(params.Get("tags"))
+	selector := params.Get("match")
+	if (len(tags) == 0) == (selector == "") {
+		writeError(w, http.StatusBadRequest, errors.New("either tags or match is required"))
+		return
+	}
+	from, err := parseTimestamp(params.Get("from"), 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid from: %v", err))
+		return
+	}
+	to, err := parseTimestamp(params.Get("to"), ^uint64(0)-1)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid to: %v", err))
+		return
+	}
+	if from > to {
+		writeError(w, http.StatusBadRequest, errors.New("from is after to"))
+		return
+	}
+	if selector != "" {
+		matched, err := s.reader.RetrieveMatching(selector, from, to)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, matched)
+		return
+	}
+	writeJSON(w, s.reader.Retrieve(tags, from, to))
+}
+
+func splitTags(param string) []string {
+	ans := make([]string, 0)
+	for _, tag := range strings.Split(param, ",") {
+		if tag != "" {
+			ans = append(ans, tag)
+		}
+	}
+	return ans
+}
+
+func parseTimestamp(param string, fallback uint64) (uint64, error) {
+	if param == "" {
+		return fallback, nil
+	}
+	return strconv.ParseUint(param, 10, 64)
+}
+
+func (s *server) tags(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.reader.GetTags())
+}
+
+func (s *server) availability(w http.ResponseWriter, r *http.Request) {
+	from, to := s.reader.Availability()
+	writeJSON(w, AvailabilityResponse{From: from, To: to})
+}
+
+// stats answers with StatsResponse, or with dto.TagStats of a single tag if one is given with ?tag=.
+func (s *server) stats(w http.ResponseWriter, r *http.Request) {
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		writeJSON(w, s.reader.TagStats(tag))
+		return
+	}
+	writeJSON(w, StatsResponse{
+		Tags:       len(s.reader.GetTags()),
+		OpenFiles:  s.reader.SSTManager.OpenFilesCount(),
+		Memtable:   s.reader.MemtableStats(),
+		BlockCache: s.reader.BlockCacheStats(),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeFailureStatus answers rejected writes with 400, which clients drop, and writes failing on the disk with 503,
+// which they resend.
+func writeFailureStatus(err error) int {
+	if store.IsValidationError(err) {
+		return http.StatusBadRequest
+	}
+	return http.StatusServiceUnavailable
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+}
+
+func writeInfluxError(w http.ResponseWriter, status int, code string, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(InfluxErrorResponse{Code: code, Message: err.Error()})
+}
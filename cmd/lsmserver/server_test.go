@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"lsmstore/dto"
+	"lsmstore/promremote"
+	"lsmstore/schema"
+	"lsmstore/store"
+	"lsmstore/utils"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_WrittenMeasurementsCanBeQueried(t *testing.T) {
+	//given
+	ts := httptest.NewServer(newTestServer())
+	defer ts.Close()
+	body := WriteRequest{Measurements: []dto.TaggedMeasurement{
+		{Tag: "tagZero", Timestamp: 1337, Value: []byte{1}},
+		{Tag: "tagZero", Timestamp: 1338, Value: []byte{2}},
+		{Tag: "tagOne", Timestamp: 1339, Value: []byte{3}},
+	}}
+
+	//when
+	writeResponse := postJSON(t, ts.URL+"/write", body)
+	var queried map[string][]dto.Measurement
+	queryResponse := getJSON(t, ts.URL+"/query?tags=tagZero,tagOne,unknown&from=1338&to=1400", &queried)
+	var tags []string
+	getJSON(t, ts.URL+"/tags", &tags)
+	var availability AvailabilityResponse
+	getJSON(t, ts.URL+"/availability", &availability)
+
+	//then
+	assert.Equal(t, http.StatusNoContent, writeResponse.StatusCode)
+	assert.Equal(t, http.StatusOK, queryResponse.StatusCode)
+	assert.Equal(t, map[string][]dto.Measurement{
+		"tagZero": {{Timestamp: 1338, Value: []byte{2}}},
+		"tagOne":  {{Timestamp: 1339, Value: []byte{3}}},
+		"unknown": {},
+	}, queried)
+	assert.Equal(t, []string{"tagOne", "tagZero"}, tags)
+	assert.Equal(t, AvailabilityResponse{From: 1337, To: 1339}, availability)
+}
+
+func TestServer_InfluxLineProtocolIsWritten(t *testing.T) {
+	//given
+	ts := httptest.NewServer(newTestServer())
+	defer ts.Close()
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte("cpu,host=web-1,dc=eu usage=0.5,cores=8i 1700000000\ncpu,host=web-2,dc=eu usage=0.25 1700000001\n"))
+	gz.Close()
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/v2/write?org=o&bucket=b&precision=s", &gzipped)
+	assert.Nil(t, err)
+	req.Header.Set("Content-Encoding", "gzip")
+
+	//when
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	var queried map[string][]dto.Measurement
+	getJSON(t, ts.URL+"/query?match="+url.QueryEscape(`cpu_usage{dc="eu"}`), &queried)
+	invalidResp, err := http.Post(ts.URL+"/api/v2/write", "text/plain", bytes.NewBufferString("cpu usage=1 1\ncpu usage="))
+	assert.Nil(t, err)
+	var influxError InfluxErrorResponse
+	json.NewDecoder(invalidResp.Body).Decode(&influxError)
+	invalidResp.Body.Close()
+	collidingResp, err := http.Post(ts.URL+"/api/v2/write", "text/plain", bytes.NewBufferString("mem used=1 1700000000000000001\nmem used=2 1700000000000000002"))
+	assert.Nil(t, err)
+	var collidingError InfluxErrorResponse
+	json.NewDecoder(collidingResp.Body).Decode(&collidingError)
+	collidingResp.Body.Close()
+	var tags []string
+	getJSON(t, ts.URL+"/tags", &tags)
+
+	//then
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, map[string][]dto.Measurement{
+		`cpu_usage{dc="eu",host="web-1"}`: {{Timestamp: 1700000000000, Value: schema.EncodeFloat64(0.5)}},
+		`cpu_usage{dc="eu",host="web-2"}`: {{Timestamp: 1700000001000, Value: schema.EncodeFloat64(0.25)}},
+	}, queried)
+	assert.Equal(t, http.StatusBadRequest, invalidResp.StatusCode)
+	assert.Equal(t, "invalid", influxError.Code)
+	assert.Contains(t, influxError.Message, "line 2")
+	assert.Equal(t, http.StatusBadRequest, collidingResp.StatusCode)
+	assert.Contains(t, collidingError.Message, "both millisecond 1700000000000")
+	assert.Equal(t, 3, len(tags), "valid lines of a rejected request were written")
+}
+
+func TestServer_WritesFailingOnDiskAreToBeRetried(t *testing.T) {
+	//given
+	srv := newTestServer()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	assert.Nil(t, srv.writer.Catalog.Register("temperature", schema.Float64))
+	mistyped := WriteRequest{Measurements: []dto.TaggedMeasurement{{Tag: "temperature", Timestamp: 1337, Value: []byte{1}}}}
+	valid := WriteRequest{Measurements: []dto.TaggedMeasurement{{Tag: "tagZero", Timestamp: 1337, Value: []byte{1}}}}
+
+	//when
+	mistypedResp := postJSON(t, ts.URL+"/write", mistyped)
+	assert.Nil(t, srv.writer.DiskWriter.ClManager.Close())
+	failedResp := postJSON(t, ts.URL+"/write", valid)
+	failedInfluxResp, err := http.Post(ts.URL+"/api/v2/write", "text/plain", bytes.NewBufferString("cpu usage=1 1700000000000000000"))
+	assert.Nil(t, err)
+	var influxError InfluxErrorResponse
+	json.NewDecoder(failedInfluxResp.Body).Decode(&influxError)
+	failedInfluxResp.Body.Close()
+
+	//then
+	assert.Equal(t, http.StatusBadRequest, mistypedResp.StatusCode)
+	assert.Equal(t, http.StatusServiceUnavailable, failedResp.StatusCode)
+	assert.Equal(t, http.StatusServiceUnavailable, failedInfluxResp.StatusCode)
+	assert.Equal(t, "unavailable", influxError.Code)
+}
+
+func TestServer_StatsWork(t *testing.T) {
+	//given
+	ts := httptest.NewServer(newTestServer())
+	defer ts.Close()
+	postJSON(t, ts.URL+"/write", WriteRequest{Measurements: []dto.TaggedMeasurement{{Tag: "tagZero", Timestamp: 1337, Value: []byte{1}}}})
+
+	//when
+	var stats StatsResponse
+	statsResponse := getJSON(t, ts.URL+"/stats", &stats)
+	var tagStats dto.TagStats
+	getJSON(t, ts.URL+"/stats?tag=tagZero", &tagStats)
+
+	//then
+	assert.Equal(t, http.StatusOK, statsResponse.StatusCode)
+	assert.Equal(t, 1, stats.Tags)
+	assert.Equal(t, 1, stats.Memtable.Tags)
+	assert.Equal(t, dto.TagStats{Tag: "tagZero", First: 1337, Last: 1337, Points: 1, MemtablePoints: 1, UnflushedPoints: 1}, tagStats)
+}
+
+func TestServer_InvalidRequestsAreRejected(t *testing.T) {
+	//given
+	ts := httptest.NewServer(newTestServer())
+	defer ts.Close()
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"write with GET", http.MethodGet, "/write", "", http.StatusMethodNotAllowed},
+		{"query with POST", http.MethodPost, "/query?tags=a", "", http.StatusMethodNotAllowed},
+		{"malformed body", http.MethodPost, "/write", "{", http.StatusBadRequest},
+		{"unknown field", http.MethodPost, "/write", `{"Points": []}`, http.StatusBadRequest},
+		{"no measurements", http.MethodPost, "/write", `{"Measurements": []}`, http.StatusBadRequest},
+		{"no tag", http.MethodPost, "/write", `{"Measurements": [{"Timestamp": 1}]}`, http.StatusBadRequest},
+		{"no timestamp", http.MethodPost, "/write", `{"Measurements": [{"Tag": "a"}]}`, http.StatusBadRequest},
+		{"value too large", http.MethodPost, "/write", fmt.Sprintf(`{"Measurements": [{"Tag": "a", "Timestamp": 1, "Value": "%s"}]}`, bytes.Repeat([]byte("AAAA"), 1<<15)), http.StatusBadRequest},
+		{"query without tags", http.MethodGet, "/query?from=1&to=2", "", http.StatusBadRequest},
+		{"query with both tags and match", http.MethodGet, "/query?tags=a&match=a", "", http.StatusBadRequest},
+		{"query with invalid match", http.MethodGet, "/query?match=a{", "", http.StatusBadRequest},
+		{"query with invalid from", http.MethodGet, "/query?tags=a&from=x", "", http.StatusBadRequest},
+		{"query with negative to", http.MethodGet, "/query?tags=a&to=-1", "", http.StatusBadRequest},
+		{"query with from after to", http.MethodGet, "/query?tags=a&from=3&to=2", "", http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		//when
+		req, err := http.NewRequest(c.method, ts.URL+c.path, bytes.NewBufferString(c.body))
+		assert.Nil(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		var errorResponse ErrorResponse
+		json.NewDecoder(resp.Body).Decode(&errorResponse)
+		resp.Body.Close()
+
+		//then
+		assert.Equal(t, c.status, resp.StatusCode, c.name)
+		assert.NotEmpty(t, errorResponse.Error, c.name)
+	}
+}
+
+func newTestServer() *server {
+	reader, writer := store.InitStorageWithOptions(store.Options{
+		CommitlogPath:        fmt.Sprintf("/tmp/golsm_test/lsmserver/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		EntriesPerCommitlog:  1000,
+		PeriodBetweenFlushes: time.Hour,
+		SSTPath:              fmt.Sprintf("/tmp/golsm_test/lsmserver/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		MemtMaxEntriesPerTag: 10,
+	})
+	return newServer(reader, writer, promremote.DefaultReadSampleLimit)
+}
+
+func postJSON(t *testing.T, url string, body interface{}) *http.Response {
+	encoded, err := json.Marshal(body)
+	assert.Nil(t, err)
+	resp, err := http.Post(url, "application/json", bytes.NewReader(encoded))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	return resp
+}
+
+func getJSON(t *testing.T, url string, into interface{}) *http.Response {
+	resp, err := http.Get(url)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(into))
+	return resp
+}
@@ -0,0 +1,158 @@
+package commitlog
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"lsmstore/utils"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/jeanphorn/log4go"
+)
+
+// ArchivedLog is a flushed commitlog kept in the archive directory. Sequences count the flushes of a store from 1
+// without gaps; ArchivedAt is the wall-clock time of the flush in milliseconds. FirstRecord is the sequence of the
+// first record of the log, the others following it one by one.
+type ArchivedLog struct {
+	Path        string
+	Sequence    uint64
+	ArchivedAt  uint64
+	FirstRecord uint64
+}
+
+const archivedLogFormat = "COMMITLOG-%012d-%d-%d"
+
+// TimesFile within Path marks, once per sync, the last record synced and the time of the sync in milliseconds, one
+// mark per line; an archived log keeps the marks of its records next to it, under its name with TimesSuffix.
+const TimesFile = "TIMES"
+const TimesSuffix = ".TIMES"
+
+// ListArchive returns the logs archived in dir by sequence; other files are ignored.
+func ListArchive(dir string) ([]ArchivedLog, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	logs := make([]ArchivedLog, 0, len(infos))
+	for _, info := range infos {
+		var l ArchivedLog
+		n, _ := fmt.Sscanf(info.Name(), archivedLogFormat, &l.Sequence, &l.ArchivedAt, &l.FirstRecord)
+		if (n != 3) || info.IsDir() || (info.Name() != fmt.Sprintf(archivedLogFormat, l.Sequence, l.ArchivedAt, l.FirstRecord)) {
+			continue
+		}
+		l.Path = dir + "/" + info.Name()
+		logs = append(logs, l)
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].Sequence < logs[j].Sequence
+	})
+	return logs, nil
+}
+
+// WrittenUntil is the sequence of the last record of the log written, that is synced and acknowledged, at or before
+// time t in milliseconds, FirstRecord-1 if there is none. Records which lost their marks in a crash, as a log archived
+// by an earlier version, are taken as written when the log was archived.
+func (l ArchivedLog) WrittenUntil(t uint64) (uint64, error) {
+	if l.ArchivedAt <= t {
+		return ^uint64(0), nil
+	}
+	until := l.FirstRecord - 1
+	content, err := ioutil.ReadFile(l.Path + TimesSuffix)
+	if os.IsNotExist(err) {
+		return until, nil
+	}
+	if err != nil {
+		return until, err
+	}
+	//a line without its newline is torn by a crash while marking, and may hold a number cut short
+	marks := string(content[:bytes.LastIndexByte(content, '\n')+1])
+	for i, line := range strings.Split(strings.TrimSuffix(marks, "\n"), "\n") {
+		var sequence, syncedAt uint64
+		if line == "" {
+			continue
+		}
+		if n, _ := fmt.Sscanf(line, "%d %d", &sequence, &syncedAt); n != 2 {
+			return until, fmt.Errorf("%s: line %d is not a mark", l.Path+TimesSuffix, i+1)
+		}
+		if (syncedAt <= t) && (sequence > until) {
+			until = sequence
+		}
+	}
+	return until, nil
+}
+
+func (m *Manager) initArchive() {
+	utils.Check(os.MkdirAll(m.ArchiveDir, os.ModePerm))
+	logs, err := ListArchive(m.ArchiveDir)
+	utils.Check(err)
+	if len(logs) > 0 {
+		m.archivedSequence = logs[len(logs)-1].Sequence
+	}
+	m.markedSequence = m.flushedSequence
+	//a mark torn by a crash would run into the next one
+	if content, err := ioutil.ReadFile(m.Path + "/" + TimesFile); err == nil {
+		utils.Check(os.Truncate(m.Path+"/"+TimesFile, int64(bytes.LastIndexByte(content, '\n')+1)))
+	}
+	m.openTimes()
+}
+
+func (m *Manager) openTimes() {
+	times, err := os.OpenFile(m.Path+"/"+TimesFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	utils.Check(err)
+	m.times = times
+}
+
+// mark notes the time records up to the current sequence were synced at; it is not synced itself, as records whose
+// mark is lost are only taken as written later than they were.
+func (m *Manager) mark() {
+	sequence := m.Sequence()
+	if (m.times == nil) || (sequence <= m.markedSequence) {
+		return
+	}
+	if _, err := fmt.Fprintf(m.times, "%d %d\n", sequence, utils.GetNowMillis()); err != nil {
+		log.Warn("Marking the time of records up to %d failed: %v", sequence, err)
+		return
+	}
+	m.markedSequence = sequence
+}
+
+func (m *Manager) archive(o *OverFile, firstRecord uint64) {
+	if o.isEmpty() {
+		o.Clear()
+		return
+	}
+	now := utils.GetNowMillis()
+	path := fmt.Sprintf("%s/"+archivedLogFormat, m.ArchiveDir, m.archivedSequence+1, now, firstRecord)
+	utils.Check(o.MoveTo(path))
+	//every record stored so far is in the log archived, so are all the marks
+	utils.Check(m.times.Close())
+	utils.Check(utils.LinkOrCopy(m.Path+"/"+TimesFile, path+TimesSuffix))
+	utils.Check(os.Remove(m.Path + "/" + TimesFile))
+	m.openTimes()
+	m.archivedSequence++
+	if m.ArchiveRetention > 0 {
+		m.pruneArchive(now - uint64(m.ArchiveRetention.Milliseconds()))
+	}
+}
+
+// pruneArchive removes logs archived before the given time, always keeping the newest one so that sequences
+// continue after a restart.
+func (m *Manager) pruneArchive(before uint64) {
+	logs, err := ListArchive(m.ArchiveDir)
+	utils.Check(err)
+	for i := 0; i < len(logs)-1; i++ {
+		if logs[i].ArchivedAt < before {
+			utils.Check(os.Remove(logs[i].Path))
+			if err := os.Remove(logs[i].Path + TimesSuffix); !os.IsNotExist(err) {
+				utils.Check(err)
+			}
+		}
+	}
+}
+
+// ArchivedSequence is the sequence of the last log archived, 0 if there is none or no archive.
+func (m *Manager) ArchivedSequence() uint64 {
+	return m.archivedSequence
+}
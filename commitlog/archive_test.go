@@ -0,0 +1,140 @@
+package commitlog_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"lsmstore/commitlog"
+	"lsmstore/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManager_ArchivesFlushedCommitlogsAndContinuesSequenceAfterRestart(t *testing.T) {
+	//given
+	dir := fmt.Sprintf("/tmp/golsm_test/archive-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	m := commitlog.Manager{Path: dir + "/commitlog", ArchiveDir: dir + "/archive"}
+	m.Init()
+	first := commitlog.Entry{Key: []byte("a"), Timestamp: 1000, Value: []byte{1}}
+	second := commitlog.Entry{Key: []byte("a"), Timestamp: 2000, Value: []byte{2}}
+
+	//when
+	m.Store(first)
+	flush(&m)
+	m.Store(second)
+	flush(&m)
+	flush(&m)
+	restarted := commitlog.Manager{Path: dir + "/commitlog", ArchiveDir: dir + "/archive"}
+	restarted.Init()
+	restarted.Store(first)
+	flush(&restarted)
+
+	//then
+	logs, err := commitlog.ListArchive(dir + "/archive")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(logs), "empty commitlog was archived")
+	for i, l := range logs {
+		assert.Equal(t, uint64(i+1), l.Sequence)
+		assert.Equal(t, uint64(i+1), l.FirstRecord)
+	}
+	assert.Equal(t, uint64(3), restarted.ArchivedSequence())
+	assert.Equal(t, uint64(3), restarted.Sequence())
+	assert.Equal(t, uint64(3), restarted.FlushedSequence())
+	archived := make([]commitlog.Entry, 0)
+	report, err := commitlog.ScanFile(logs[1].Path, func(e commitlog.Entry, _ int64) {
+		archived = append(archived, e)
+	})
+	assert.Nil(t, err)
+	assert.True(t, report.Clean())
+	assert.Equal(t, []commitlog.Entry{second}, archived)
+	assert.Equal(t, 0, len(restarted.RetrieveAll()))
+}
+
+func TestManager_PrunesArchiveKeepingNewestLog(t *testing.T) {
+	//given
+	dir := fmt.Sprintf("/tmp/golsm_test/archive-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	m := commitlog.Manager{Path: dir + "/commitlog", ArchiveDir: dir + "/archive", ArchiveRetention: time.Millisecond}
+	m.Init()
+	assert.Nil(t, ioutil.WriteFile(dir+"/archive/notes.txt", []byte("kept"), 0644))
+
+	//when
+	for i := 1; i <= 3; i++ {
+		m.Store(commitlog.Entry{Key: []byte("a"), Timestamp: uint64(i), Value: []byte{1}})
+		flush(&m)
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	//then
+	logs, err := commitlog.ListArchive(dir + "/archive")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(logs))
+	assert.Equal(t, uint64(3), logs[0].Sequence)
+	assert.True(t, utils.FileExists(dir+"/archive/notes.txt"))
+	files, _ := ioutil.ReadDir(dir + "/archive")
+	assert.Equal(t, 3, len(files), "marks of pruned logs were kept")
+	assert.True(t, utils.FileExists(logs[0].Path+commitlog.TimesSuffix))
+}
+
+func TestManager_MarksWhenRecordsWereSynced(t *testing.T) {
+	//given
+	dir := fmt.Sprintf("/tmp/golsm_test/archive-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	m := commitlog.Manager{Path: dir + "/commitlog", ArchiveDir: dir + "/archive"}
+	m.Init()
+	store := func(m *commitlog.Manager, count int) uint64 {
+		for i := 0; i < count; i++ {
+			assert.Nil(t, m.Store(commitlog.Entry{Key: []byte("a"), Timestamp: uint64(i + 1), Value: []byte{1}}))
+		}
+		assert.Nil(t, m.Sync())
+		syncedAt := utils.GetNowMillis()
+		time.Sleep(5 * time.Millisecond)
+		return syncedAt
+	}
+
+	//when
+	firstSynced := store(&m, 1)
+	secondSynced := store(&m, 2)
+	store(&m, 1)
+	flush(&m)
+	logs, _ := commitlog.ListArchive(dir + "/archive")
+	marks := logs[0].Path + commitlog.TimesSuffix
+	content, _ := ioutil.ReadFile(marks)
+	//a torn mark claiming every record was written at once
+	assert.Nil(t, ioutil.WriteFile(marks, append(content, []byte("4 1")...), 0644))
+
+	//then
+	untilNothing, errNothing := logs[0].WrittenUntil(firstSynced - 10)
+	untilFirst, errFirst := logs[0].WrittenUntil(firstSynced)
+	untilSecond, errSecond := logs[0].WrittenUntil(secondSynced)
+	untilArchived, errArchived := logs[0].WrittenUntil(logs[0].ArchivedAt)
+	assert.Nil(t, errNothing)
+	assert.Nil(t, errFirst)
+	assert.Nil(t, errSecond)
+	assert.Nil(t, errArchived)
+	assert.Equal(t, uint64(0), untilNothing)
+	assert.Equal(t, uint64(1), untilFirst)
+	assert.Equal(t, uint64(3), untilSecond)
+	assert.Equal(t, ^uint64(0), untilArchived)
+
+	//when
+	store(&m, 1)
+	assert.Nil(t, m.Close())
+	content, _ = ioutil.ReadFile(dir + "/commitlog/" + commitlog.TimesFile)
+	assert.Nil(t, ioutil.WriteFile(dir+"/commitlog/"+commitlog.TimesFile, append(content, []byte("5 1")...), 0644))
+	restarted := commitlog.Manager{Path: dir + "/commitlog", ArchiveDir: dir + "/archive"}
+	restarted.Init()
+	restartedSynced := store(&restarted, 1)
+	flush(&restarted)
+	logs, _ = commitlog.ListArchive(dir + "/archive")
+	untilRestarted, errRestarted := logs[1].WrittenUntil(restartedSynced)
+
+	//then
+	assert.Nil(t, errRestarted, "mark torn before restart ran into the next one")
+	assert.Equal(t, uint64(6), untilRestarted)
+}
+
+// flush switches commitlogs the way writer.DiskWriter does.
+func flush(m *commitlog.Manager) {
+	m.SwapCommitlogs()
+	m.ClearPrevious()
+}
@@ -3,6 +3,7 @@ package commitlog
 import (
 	"encoding/binary"
 	"encoding/json"
+	"lsmstore/utils"
 )
 
 type Entry struct {
@@ -46,9 +47,7 @@ func (e *Entry) ToByteArray() []uint8 {
 	return arr
 }
 
+// ToByteArrayWithLength encodes the entry as a record of a commitlog, checksum included.
 func (e *Entry) ToByteArrayWithLength() []uint8 {
-	dest := make([]byte, 2)
-	arr := e.ToByteArray()
-	binary.LittleEndian.PutUint16(dest, uint16(len(arr)))
-	return append(dest[:], arr[:]...)
+	return utils.EncodeRecord(e.ToByteArray())
 }
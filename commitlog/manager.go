@@ -1,12 +1,27 @@
 package commitlog
 
 import (
+	"lsmstore/utils"
 	"os"
 	"sync/atomic"
+	"time"
 )
 
+// FileA and FileB are the two commitlogs within Path; writes go to one of them while the other is flushed.
+const FileA = "COMMITLOGA"
+const FileB = "COMMITLOGB"
+
 type Manager struct {
-	Path              string
+	Path string
+	// ArchiveDir keeps flushed commitlogs instead of deleting them, for restoring a checkpoint up to a later point
+	ArchiveDir string
+	// ArchiveRetention removes archived logs once older; 0 keeps them all
+	ArchiveRetention  time.Duration
+	archivedSequence  uint64
+	markedSequence    uint64
+	times             *os.File
+	sequence          uint64
+	flushedSequence   uint64
 	commitlogA        *OverFile
 	commitlogB        *OverFile
 	usingA            bool
@@ -17,14 +32,24 @@ type Manager struct {
 func (m *Manager) Init() {
 	os.MkdirAll(m.Path, os.ModePerm)
 
-	m.commitlogA = &OverFile{commitlogFileName: m.Path + "/COMMITLOGA"}
-	m.commitlogB = &OverFile{commitlogFileName: m.Path + "/COMMITLOGB"}
+	m.commitlogA = &OverFile{commitlogFileName: m.Path + "/" + FileA}
+	m.commitlogB = &OverFile{commitlogFileName: m.Path + "/" + FileB}
 
 	m.commitlogA.Init()
 	m.commitlogB.Init()
+	//whatever the previous run left in B would otherwise wait for two switches to be flushed
+	for _, entry := range m.commitlogB.RetrieveAll() {
+		utils.Check(m.commitlogA.Store(entry))
+	}
+	utils.Check(m.commitlogA.Sync())
+	m.commitlogB.Clear()
+	m.initSequence()
 
 	m.activeCommitlog.Store(m.commitlogA)
 	m.usingA = true
+	if m.ArchiveDir != "" {
+		m.initArchive()
+	}
 }
 
 func (m *Manager) getActiveCommitlog() *OverFile {
@@ -37,16 +62,46 @@ func (m *Manager) getInactiveCommitlog() *OverFile {
 	return inactive
 }
 
-func (m *Manager) Store(entry Entry) {
+func (m *Manager) Store(entry Entry) error {
 	active := m.getActiveCommitlog()
-	active.Store(entry)
+	if err := active.Store(entry); err != nil {
+		return err
+	}
+	atomic.AddUint64(&m.sequence, 1)
+	return nil
 }
 
-func (m *Manager) StoreMultiple(entries []Entry) {
+// StoreMultiple stops at the first entry failing to be written; the sequence counts the entries stored before it.
+func (m *Manager) StoreMultiple(entries []Entry) error {
 	active := m.getActiveCommitlog()
 	for _, entry := range entries {
-		active.Store(entry)
+		if err := active.Store(entry); err != nil {
+			return err
+		}
+		atomic.AddUint64(&m.sequence, 1)
+	}
+	return nil
+}
+
+// Close closes both commitlogs; nothing may be stored afterwards.
+func (m *Manager) Close() error {
+	if m.times != nil {
+		m.times.Close()
+	}
+	errA, errB := m.commitlogA.Close(), m.commitlogB.Close()
+	if errA != nil {
+		return errA
 	}
+	return errB
+}
+
+// Sync makes everything stored in the active commitlog durable, marking when it became so if logs are archived.
+func (m *Manager) Sync() error {
+	if err := m.getActiveCommitlog().Sync(); err != nil {
+		return err
+	}
+	m.mark()
+	return nil
 }
 
 func (m *Manager) RetrieveAll() []Entry {
@@ -72,5 +127,24 @@ func (m *Manager) RetrieveAllFromPrevious() []Entry {
 
 func (m *Manager) ClearPrevious() {
 	inactive := m.getInactiveCommitlog()
+	first := m.FlushedSequence() + 1
+	m.setFlushed()
+	if m.ArchiveDir != "" {
+		m.archive(inactive, first)
+		return
+	}
 	inactive.Clear()
 }
+
+// CopyTo copies both commitlogs, with the sequence of their records, into dir; nothing may be stored meanwhile.
+func (m *Manager) CopyTo(dir string) error {
+	for _, name := range []string{FileA, FileB, SequenceFile} {
+		if (name == SequenceFile) && !utils.FileExists(m.Path+"/"+name) {
+			continue
+		}
+		if err := utils.CopyFile(m.Path+"/"+name, dir+"/"+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,7 +1,12 @@
 package commitlog_test
 
 import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
 	"lsmstore/commitlog"
+	"lsmstore/utils"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -55,3 +60,83 @@ func TestCommitlog(t *testing.T) {
 	assert.Equal(t, dummy3, all2[1], "commitlogB failed on second item")
 	assert.Equal(t, dummy4, all1[1], "commitlogA failed on second item")
 }
+
+func TestCommitlog_EntriesLeftInSecondFileAreActiveAfterRestart(t *testing.T) {
+	//given
+	path := fmt.Sprintf("/tmp/golsm_test/commitlog/restart-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	m := commitlog.Manager{Path: path}
+	m.Init()
+	dummy1 := commitlog.Entry{Key: []byte("tagZero"), Timestamp: 1337, Value: make([]byte, 2)}
+	dummy2 := commitlog.Entry{Key: []byte("tagZero"), Timestamp: 1338, Value: make([]byte, 2)}
+	m.SwapCommitlogs()
+	m.Store(dummy1)
+	m.Store(dummy2)
+
+	//when
+	restarted := commitlog.Manager{Path: path}
+	restarted.Init()
+
+	//then
+	assert.Equal(t, []commitlog.Entry{dummy1, dummy2}, restarted.RetrieveAll(), "entries left in COMMITLOGB were not replayed")
+}
+
+func TestCommitlog_FileOfFirstVersionIsMigratedAndReplayed(t *testing.T) {
+	//given
+	path := fmt.Sprintf("/tmp/golsm_test/commitlog/migration-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	os.MkdirAll(path, os.ModePerm)
+	dummy1 := commitlog.Entry{Key: []byte("tagZero"), Timestamp: 1337, Value: make([]byte, 2)}
+	dummy2 := commitlog.Entry{Key: []byte("tagZero"), Timestamp: 1338, Value: []byte{1}}
+	firstVersion := make([]byte, 0)
+	for _, e := range []commitlog.Entry{dummy1, dummy2} {
+		record := e.ToByteArray()
+		firstVersion = append(firstVersion, byte(len(record)), byte(len(record)>>8))
+		firstVersion = append(firstVersion, record...)
+	}
+	assert.Nil(t, ioutil.WriteFile(path+"/"+commitlog.FileA, firstVersion, 0644))
+
+	//when
+	m := commitlog.Manager{Path: path}
+	m.Init()
+	replayed := m.RetrieveAll()
+	report, scanErr := commitlog.ScanFile(path+"/"+commitlog.FileA, func(commitlog.Entry, int64) {})
+
+	//then
+	assert.Equal(t, []commitlog.Entry{dummy1, dummy2}, replayed)
+	assert.Nil(t, scanErr)
+	assert.Equal(t, utils.RecordsVersion, report.Version)
+	assert.Equal(t, 2, report.Records)
+}
+
+func TestCommitlog_ScanDropsRecordsFailingChecksum(t *testing.T) {
+	//given
+	path := fmt.Sprintf("/tmp/golsm_test/commitlog/checksum-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	m := commitlog.Manager{Path: path}
+	m.Init()
+	m.Store(commitlog.Entry{Key: []byte("tagZero"), Timestamp: 1337, Value: []byte{1, 2, 3}})
+	m.Store(commitlog.Entry{Key: []byte("tagZero"), Timestamp: 1338, Value: []byte{4, 5, 6}})
+	fileName := path + "/" + commitlog.FileA
+	data, err := ioutil.ReadFile(fileName)
+	assert.Nil(t, err)
+	firstLength := int(binary.LittleEndian.Uint16(data[utils.RecordsHeaderSize:]))
+	//a bit flipped in the value of the first record, which keeps the record well formed
+	data[utils.RecordsHeaderSize+2+firstLength-utils.ChecksumSize-1] ^= 1
+	assert.Nil(t, ioutil.WriteFile(fileName, data, 0644))
+
+	//when
+	timestamps := make([]uint64, 0)
+	before, scanErr := commitlog.ScanFile(fileName, func(e commitlog.Entry, _ int64) {
+		timestamps = append(timestamps, e.Timestamp)
+	})
+	_, repairErr := commitlog.RepairFile(fileName)
+	after, afterErr := commitlog.ScanFile(fileName, func(commitlog.Entry, int64) {})
+
+	//then
+	assert.Nil(t, scanErr)
+	assert.Nil(t, repairErr)
+	assert.Nil(t, afterErr)
+	assert.Equal(t, 1, before.Dropped)
+	assert.Contains(t, before.Problems[0], "checksum mismatch")
+	assert.Equal(t, []uint64{1338}, timestamps)
+	assert.True(t, after.Clean(), after.Problems)
+	assert.Equal(t, 1, after.Records)
+}
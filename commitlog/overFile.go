@@ -2,13 +2,17 @@ package commitlog
 
 import (
 	"encoding/binary"
+	"fmt"
+	"io"
 	"lsmstore/utils"
 	"os"
+
+	log "github.com/jeanphorn/log4go"
 )
 
 type Commitlog interface {
 	Init()
-	Store(entry Entry)
+	Store(entry Entry) error
 	RetrieveAll() []Entry
 	Count() int
 	Clear()
@@ -18,18 +22,50 @@ type OverFile struct {
 	commitlogFileName string
 	commitlogFile     *os.File
 	entriesCount      int
+	bytes             int64
 }
 
+// Init migrates a commitlog of an earlier version before appending to it, and starts a new one with the header.
 func (o *OverFile) Init() {
+	report, migrated, err := utils.MigrateRecords(o.commitlogFileName, checkEntry)
+	utils.Check(err)
+	if migrated && !report.Clean() {
+		log.Warn("Migrating %s dropped %d records and %d bytes of torn tail", o.commitlogFileName, report.Dropped, report.TornTail)
+	}
 	file, err := os.OpenFile(o.commitlogFileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	utils.Check(err)
 	o.commitlogFile = file
+	o.bytes = o.fileSize()
+	if o.bytes == 0 {
+		_, err = file.Write(utils.RecordsHeader())
+		utils.Check(err)
+		o.bytes = utils.RecordsHeaderSize
+	}
 }
 
-func (o *OverFile) Store(entry Entry) {
+// Store appends the entry; what a failed write left of it is cut off again, so the next record does not follow
+// a torn one.
+func (o *OverFile) Store(entry Entry) error {
 	//log.Debug("STORE on " + o.commitlogFileName + " ts " + strconv.FormatUint(entry.Timestamp, 10))
-	o.commitlogFile.Write(entry.ToByteArrayWithLength())
+	record := entry.ToByteArrayWithLength()
+	if _, err := o.commitlogFile.Write(record); err != nil {
+		if truncateErr := o.commitlogFile.Truncate(o.bytes); truncateErr != nil {
+			return fmt.Errorf("%v, cutting off the torn record failed too: %v", err, truncateErr)
+		}
+		return err
+	}
+	o.bytes += int64(len(record))
 	o.entriesCount += 1
+	return nil
+}
+
+func (o *OverFile) Close() error {
+	return o.commitlogFile.Close()
+}
+
+// Sync makes the stored entries durable.
+func (o *OverFile) Sync() error {
+	return o.commitlogFile.Sync()
 }
 
 func (o *OverFile) RetrieveAll() []Entry {
@@ -45,6 +81,8 @@ func (o *OverFile) readAllEntries() []Entry {
 	o.commitlogFile.Close()
 	f, err := os.OpenFile(o.commitlogFileName, os.O_RDONLY, 0644)
 	utils.Check(err)
+	_, err = f.Seek(utils.RecordsHeaderSize, io.SeekStart)
+	utils.Check(err)
 	buf := make([]byte, 2)
 	ans := make([]Entry, 0)
 	n := 2
@@ -56,7 +94,7 @@ func (o *OverFile) readAllEntries() []Entry {
 		if n2 != lenToRead {
 			panic("fail")
 		}
-		ans = append(ans, FromByteArray(bigbuf))
+		ans = append(ans, FromByteArray(utils.PayloadOf(bigbuf)))
 		n, _ = f.Read(buf)
 	}
 	f.Close()
@@ -70,3 +108,26 @@ func (o *OverFile) Clear() {
 	utils.Check(os.Remove(o.commitlogFileName))
 	o.Init()
 }
+
+func (o *OverFile) isEmpty() bool {
+	return o.fileSize() <= utils.RecordsHeaderSize
+}
+
+func (o *OverFile) fileSize() int64 {
+	info, err := o.commitlogFile.Stat()
+	utils.Check(err)
+	return info.Size()
+}
+
+// MoveTo renames the commitlog to path, copying it where renaming is not possible, and starts a new one.
+func (o *OverFile) MoveTo(path string) error {
+	o.commitlogFile.Close()
+	err := os.Rename(o.commitlogFileName, path)
+	if err != nil {
+		if err = utils.CopyFile(o.commitlogFileName, path); err == nil {
+			err = os.Remove(o.commitlogFileName)
+		}
+	}
+	o.Init()
+	return err
+}
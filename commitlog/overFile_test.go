@@ -0,0 +1,30 @@
+package commitlog
+
+import (
+	"fmt"
+	"lsmstore/utils"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOverFile_FailedWriteIsReportedAndNotCounted(t *testing.T) {
+	//given
+	dir := fmt.Sprintf("/tmp/golsm_test/commitlog/failedwrite-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	assert.Nil(t, os.MkdirAll(dir, os.ModePerm))
+	o := &OverFile{commitlogFileName: dir + "/" + FileA}
+	o.Init()
+	stored := Entry{Key: []byte("tagZero"), Timestamp: 1337, Value: make([]byte, 2)}
+	assert.Nil(t, o.Store(stored))
+	assert.Nil(t, o.Sync())
+	assert.Nil(t, o.commitlogFile.Close())
+
+	//when
+	err := o.Store(Entry{Key: []byte("tagZero"), Timestamp: 1338, Value: make([]byte, 2)})
+
+	//then
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, o.Count())
+	assert.Equal(t, []Entry{stored}, o.RetrieveAll())
+}
@@ -0,0 +1,35 @@
+package commitlog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"lsmstore/utils"
+)
+
+// ScanFile reads a commitlog without the store being open; records whose key does not fit are reported and skipped,
+// as are records with an empty key, which the store never writes.
+func ScanFile(fileName string, receiver func(Entry, int64)) (utils.RecordsReport, error) {
+	return utils.ScanRecords(fileName, checkEntry, func(record []byte, o int64) {
+		receiver(FromByteArray(record), o)
+	})
+}
+
+// RepairFile truncates a torn tail of a commitlog, as left by a crash during a write, and drops the entries ScanFile reports.
+func RepairFile(fileName string) (utils.RecordsReport, error) {
+	return utils.RepairRecords(fileName, checkEntry)
+}
+
+func checkEntry(record []byte) error {
+	if len(record) < 2 {
+		return errors.New("record is too short for a key length")
+	}
+	keyLen := int(binary.LittleEndian.Uint16(record))
+	if keyLen == 0 {
+		return errors.New("empty key")
+	}
+	if keyLen+18 > len(record) {
+		return fmt.Errorf("key of %d bytes does not fit into %d bytes", keyLen, len(record))
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package commitlog
+
+import (
+	"io/ioutil"
+	"lsmstore/utils"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// SequenceFile within Path holds the sequence of the last record flushed. Records are numbered from 1 in the order they
+// are stored, across restarts; a crash while flushing may skip numbers, but never reuses them.
+const SequenceFile = "SEQUENCE"
+
+// Record is an entry with the sequence it was stored under.
+type Record struct {
+	Sequence uint64
+	Entry    Entry
+}
+
+func (m *Manager) initSequence() {
+	content, err := ioutil.ReadFile(m.Path + "/" + SequenceFile)
+	if err == nil {
+		m.flushedSequence, err = strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+	}
+	if !os.IsNotExist(err) {
+		utils.Check(err)
+	}
+	m.sequence = m.flushedSequence + uint64(len(m.commitlogA.RetrieveAll()))
+}
+
+// Sequence is the sequence of the last record stored.
+func (m *Manager) Sequence() uint64 {
+	return atomic.LoadUint64(&m.sequence)
+}
+
+// FlushedSequence is the sequence of the last record flushed; later ones are in the active commitlog.
+func (m *Manager) FlushedSequence() uint64 {
+	return atomic.LoadUint64(&m.flushedSequence)
+}
+
+// setFlushed marks everything stored so far as flushed, as the active commitlog is empty once the previous one is
+// cleared. It is persisted before the previous commitlog is gone, so a crash in between skips its records' numbers.
+func (m *Manager) setFlushed() {
+	sequence := m.Sequence()
+	utils.Check(WriteSequence(m.Path, sequence))
+	atomic.StoreUint64(&m.flushedSequence, sequence)
+}
+
+// WriteSequence makes the commitlogs in dir continue numbering their records after sequence.
+func WriteSequence(dir string, sequence uint64) error {
+	tmpPath := dir + "/" + SequenceFile + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, []byte(strconv.FormatUint(sequence, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, dir+"/"+SequenceFile)
+}
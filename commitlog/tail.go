@@ -0,0 +1,69 @@
+package commitlog
+
+import "sync"
+
+// Tail keeps the newest Capacity records stored, for readers following the writes of a store.
+type Tail struct {
+	Capacity int
+	records  []Record
+	next     uint64
+	changed  chan struct{}
+	mutex    *sync.Mutex
+}
+
+// Init starts the tail after the record of the given sequence, the last one stored so far.
+func (t *Tail) Init(sequence uint64) {
+	t.records = make([]Record, 0, t.Capacity)
+	t.next = sequence + 1
+	t.changed = make(chan struct{})
+	t.mutex = &sync.Mutex{}
+}
+
+// Append takes entries stored under consecutive sequences from first on.
+func (t *Tail) Append(first uint64, entries []Entry) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for i, e := range entries {
+		t.records = append(t.records, Record{Sequence: first + uint64(i), Entry: e})
+	}
+	if len(t.records) > t.Capacity {
+		//copied instead of resliced, so the array does not grow forever
+		kept := make([]Record, t.Capacity, t.Capacity)
+		copy(kept, t.records[len(t.records)-t.Capacity:])
+		t.records = kept
+	}
+	t.next = first + uint64(len(entries))
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// Since returns at most max records from sequence from on, and false if the tail no longer holds the one at from.
+func (t *Tail) Since(from uint64, max int) ([]Record, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	oldest := t.next
+	if len(t.records) > 0 {
+		oldest = t.records[0].Sequence
+	}
+	if from < oldest {
+		return nil, false
+	}
+	if from >= t.next {
+		return nil, true
+	}
+	start := int(from - oldest)
+	end := start + max
+	if end > len(t.records) {
+		end = len(t.records)
+	}
+	ans := make([]Record, end-start)
+	copy(ans, t.records[start:end])
+	return ans, true
+}
+
+// Changed is closed once records are appended; taken before calling Since, nothing appended in between is missed.
+func (t *Tail) Changed() <-chan struct{} {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.changed
+}
@@ -0,0 +1,14 @@
+package dto
+
+type Bucket struct {
+	From  uint64
+	To    uint64
+	Count uint64
+	Min   float64
+	Max   float64
+	Sum   float64
+	Avg   float64
+	First float64
+	Last  float64
+	Value float64
+}
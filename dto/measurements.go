@@ -10,3 +10,54 @@ type TaggedMeasurement struct {
 	Timestamp uint64
 	Value     []byte
 }
+
+type FloatMeasurement struct {
+	Timestamp uint64
+	Value     float64
+}
+
+type IntMeasurement struct {
+	Timestamp uint64
+	Value     int64
+}
+
+type BoolMeasurement struct {
+	Timestamp uint64
+	Value     bool
+}
+
+type StringMeasurement struct {
+	Timestamp uint64
+	Value     string
+}
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+type SeriesMeasurement struct {
+	Metric    string
+	Labels    []Label
+	Timestamp uint64
+	Value     []byte
+}
+
+type TagInfo struct {
+	Tag          string
+	First        uint64
+	Last         uint64
+	ApproxPoints int
+	DiskBytes    int64
+}
+
+type TagStats struct {
+	Tag                 string
+	First               uint64
+	Last                uint64
+	Points              int
+	DiskBytes           int64
+	MemtablePoints      int
+	UnflushedPoints     int
+	ExpiredNotCompacted int
+}
@@ -4,8 +4,11 @@ go 1.15
 
 require (
 	github.com/btcsuite/btcutil v1.0.2
+	github.com/golang/snappy v0.0.4
 	github.com/google/btree v1.0.0
 	github.com/jeanphorn/log4go v0.0.0-20190526082429-7dbb8deb9468
-	github.com/stretchr/testify v1.6.1
+	github.com/stretchr/testify v1.7.0
 	github.com/toolkits/file v0.0.0-20160325033739-a5b3c5147e07 // indirect
+	google.golang.org/grpc v1.41.0
+	google.golang.org/protobuf v1.27.1
 )
@@ -0,0 +1,293 @@
+package lineprotocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"lsmstore/dto"
+	"lsmstore/schema"
+	"lsmstore/series"
+	"math"
+	"strconv"
+)
+
+// Precision is the unit of timestamps in the parsed data; the store keeps milliseconds.
+type Precision int
+
+const (
+	Nanoseconds Precision = iota
+	Microseconds
+	Milliseconds
+	Seconds
+)
+
+// ParsePrecision accepts the values of the precision parameter of InfluxDB /api/v2/write; empty means nanoseconds.
+func ParsePrecision(s string) (Precision, error) {
+	switch s {
+	case "", "ns":
+		return Nanoseconds, nil
+	case "us":
+		return Microseconds, nil
+	case "ms":
+		return Milliseconds, nil
+	case "s":
+		return Seconds, nil
+	}
+	return Nanoseconds, fmt.Errorf("unknown precision %q", s)
+}
+
+func (p Precision) toMillis(ts int64) (uint64, error) {
+	if ts < 0 {
+		return 0, fmt.Errorf("negative timestamp %d", ts)
+	}
+	switch p {
+	case Nanoseconds:
+		return uint64(ts / 1000000), nil
+	case Microseconds:
+		return uint64(ts / 1000), nil
+	case Seconds:
+		if ts > math.MaxInt64/1000 {
+			return 0, fmt.Errorf("timestamp %d out of range", ts)
+		}
+		return uint64(ts * 1000), nil
+	}
+	return uint64(ts), nil
+}
+
+// Parse converts InfluxDB line protocol into series measurements: every field of a line becomes its own series,
+// named measurement_field and labeled with the tag set. Lines without a timestamp get nowMillis.
+// Field values are encoded as the schema package does: floats, integers and unsigned integers as 8 bytes,
+// booleans as 1 byte and strings as they are. Any invalid line fails the whole input.
+//
+// Timestamps finer than milliseconds are truncated, as the store keeps milliseconds. Points of a series whose
+// timestamps differ but fall in the same millisecond would overwrite each other, so they fail the input as well;
+// equal timestamps overwrite as they do in InfluxDB, the last line winning. Points of other inputs, stored before
+// or after, are not checked and do overwrite points within the same millisecond.
+func Parse(data []byte, precision Precision, nowMillis uint64) ([]dto.SeriesMeasurement, error) {
+	ans := make([]dto.SeriesMeasurement, 0)
+	var seen map[pointKey]parsedTimestamp
+	if (precision == Nanoseconds) || (precision == Microseconds) {
+		seen = make(map[pointKey]parsedTimestamp)
+	}
+	for i, line := range bytes.Split(data, []byte{'\n'}) {
+		line = bytes.TrimRight(line, "\r")
+		trimmed := bytes.TrimLeft(line, " \t")
+		if (len(trimmed) == 0) || (trimmed[0] == '#') {
+			continue
+		}
+		measurements, given, err := parseLine(trimmed, precision, nowMillis)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		if seen != nil {
+			if err := checkCollisions(seen, measurements, parsedTimestamp{given: given, line: i + 1}); err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+		}
+		ans = append(ans, measurements...)
+	}
+	return ans, nil
+}
+
+func checkCollisions(seen map[pointKey]parsedTimestamp, measurements []dto.SeriesMeasurement, ts parsedTimestamp) error {
+	for _, m := range measurements {
+		key := pointKey{tag: series.BuildTag(m.Metric, m.Labels), millis: m.Timestamp}
+		if previous, exists := seen[key]; exists && (previous.given != ts.given) {
+			return fmt.Errorf("timestamp %d and timestamp %d of line %d are both millisecond %d of %s, which the store cannot tell apart",
+				ts.given, previous.given, previous.line, m.Timestamp, key.tag)
+		}
+		seen[key] = ts
+	}
+	return nil
+}
+
+type pointKey struct {
+	tag    string
+	millis uint64
+}
+
+// parsedTimestamp is a timestamp as given in the input, or -1 for a line without one, and the line it is on.
+type parsedTimestamp struct {
+	given int64
+	line  int
+}
+
+// ToTagged renders series measurements with their canonical series key as tag.
+func ToTagged(data []dto.SeriesMeasurement) []dto.TaggedMeasurement {
+	ans := make([]dto.TaggedMeasurement, len(data))
+	for i, m := range data {
+		ans[i] = dto.TaggedMeasurement{Tag: series.BuildTag(m.Metric, m.Labels), Timestamp: m.Timestamp, Value: m.Value}
+	}
+	return ans
+}
+
+const measurementEscapes = ", "
+const keyEscapes = ",= "
+
+type lineParser struct {
+	line []byte
+	pos  int
+}
+
+type field struct {
+	key   string
+	value []byte
+}
+
+// parseLine also returns the timestamp as given, -1 if there is none.
+func parseLine(line []byte, precision Precision, nowMillis uint64) ([]dto.SeriesMeasurement, int64, error) {
+	p := &lineParser{line: line}
+	measurement, stop := p.token(", ", measurementEscapes)
+	if measurement == "" {
+		return nil, 0, errors.New("missing measurement")
+	}
+
+	labels := make([]dto.Label, 0)
+	for stop == ',' {
+		key, keyStop := p.token("=", keyEscapes)
+		if (key == "") || (keyStop != '=') {
+			return nil, 0, errors.New("invalid tag key")
+		}
+		value, valueStop := p.token(", ", keyEscapes)
+		if value == "" {
+			return nil, 0, fmt.Errorf("missing value of tag %q", key)
+		}
+		labels = append(labels, dto.Label{Name: key, Value: value})
+		stop = valueStop
+	}
+	if stop != ' ' {
+		return nil, 0, errors.New("missing fields")
+	}
+
+	fields := make([]field, 0)
+	for {
+		key, keyStop := p.token("=", keyEscapes)
+		if (key == "") || (keyStop != '=') {
+			return nil, 0, errors.New("invalid field key")
+		}
+		value, err := p.fieldValue()
+		if err != nil {
+			return nil, 0, fmt.Errorf("field %q: %v", key, err)
+		}
+		fields = append(fields, field{key: key, value: value})
+		if stop = p.next(); stop != ',' {
+			break
+		}
+	}
+
+	timestamp := nowMillis
+	given := int64(-1)
+	if stop == ' ' {
+		raw := bytes.TrimSpace(p.line[p.pos:])
+		if len(raw) > 0 {
+			ts, err := strconv.ParseInt(string(raw), 10, 64)
+			if err != nil {
+				return nil, 0, fmt.Errorf("invalid timestamp %q", raw)
+			}
+			if timestamp, err = precision.toMillis(ts); err != nil {
+				return nil, 0, err
+			}
+			given = ts
+		}
+	} else if stop != 0 {
+		return nil, 0, fmt.Errorf("unexpected %q after fields", stop)
+	}
+
+	ans := make([]dto.SeriesMeasurement, len(fields))
+	for i, f := range fields {
+		metric := measurement + "_" + f.key
+		if err := series.Validate(metric, labels); err != nil {
+			return nil, 0, err
+		}
+		ans[i] = dto.SeriesMeasurement{Metric: metric, Labels: labels, Timestamp: timestamp, Value: f.value}
+	}
+	return ans, given, nil
+}
+
+// next consumes and returns the next byte, or 0 at the end of the line.
+func (p *lineParser) next() byte {
+	if p.pos >= len(p.line) {
+		return 0
+	}
+	c := p.line[p.pos]
+	p.pos++
+	return c
+}
+
+// token reads up to the first unescaped byte of stops, consuming it and returning it, or 0 at the end of the line;
+// a backslash escapes the bytes of escapable and is kept as it is before any other byte.
+func (p *lineParser) token(stops string, escapable string) (string, byte) {
+	var sb bytes.Buffer
+	for p.pos < len(p.line) {
+		c := p.line[p.pos]
+		p.pos++
+		if (c == '\\') && (p.pos < len(p.line)) && (bytes.IndexByte([]byte(escapable), p.line[p.pos]) >= 0) {
+			sb.WriteByte(p.line[p.pos])
+			p.pos++
+			continue
+		}
+		if bytes.IndexByte([]byte(stops), c) >= 0 {
+			return sb.String(), c
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String(), 0
+}
+
+func (p *lineParser) fieldValue() ([]byte, error) {
+	if (p.pos < len(p.line)) && (p.line[p.pos] == '"') {
+		return p.stringValue()
+	}
+	start := p.pos
+	for (p.pos < len(p.line)) && (p.line[p.pos] != ',') && (p.line[p.pos] != ' ') {
+		p.pos++
+	}
+	raw := string(p.line[start:p.pos])
+	switch raw {
+	case "":
+		return nil, errors.New("missing value")
+	case "t", "T", "true", "True", "TRUE":
+		return schema.EncodeBool(true), nil
+	case "f", "F", "false", "False", "FALSE":
+		return schema.EncodeBool(false), nil
+	}
+	switch raw[len(raw)-1] {
+	case 'i':
+		v, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer %q", raw)
+		}
+		return schema.EncodeInt64(v), nil
+	case 'u':
+		v, err := strconv.ParseUint(raw[:len(raw)-1], 10, 64)
+		if (err != nil) || (v > math.MaxInt64) {
+			return nil, fmt.Errorf("invalid or too large unsigned integer %q", raw)
+		}
+		return schema.EncodeInt64(int64(v)), nil
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if (err != nil) || math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil, fmt.Errorf("invalid float %q", raw)
+	}
+	return schema.EncodeFloat64(v), nil
+}
+
+// stringValue reads a double quoted string in which only \" and \\ are escapes.
+func (p *lineParser) stringValue() ([]byte, error) {
+	p.pos++
+	var sb bytes.Buffer
+	for p.pos < len(p.line) {
+		c := p.line[p.pos]
+		p.pos++
+		if (c == '\\') && (p.pos < len(p.line)) && ((p.line[p.pos] == '"') || (p.line[p.pos] == '\\')) {
+			sb.WriteByte(p.line[p.pos])
+			p.pos++
+			continue
+		}
+		if c == '"' {
+			return schema.EncodeString(sb.String()), nil
+		}
+		sb.WriteByte(c)
+	}
+	return nil, errors.New("unterminated string")
+}
@@ -0,0 +1,119 @@
+package lineprotocol
+
+import (
+	"lsmstore/dto"
+	"lsmstore/schema"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse_ConvertsEveryFieldToSeries(t *testing.T) {
+	//given
+	data := []byte("# comment\n" +
+		"cpu,host=web-1,region=eu usage=0.5,cores=8i,up=t 1700000000123456789\n" +
+		"\n" +
+		"weather,city=New\\ York,note=a\\,b\\=c temp=-3.5,desc=\"cloudy, \\\"cold\\\"\" 1700000000000000000\r\n" +
+		"disk free=10u\n" +
+		"my\\ metric value=1")
+
+	//when
+	measurements, err := Parse(data, Nanoseconds, 42)
+
+	//then
+	assert.Nil(t, err)
+	cpuLabels := []dto.Label{{Name: "host", Value: "web-1"}, {Name: "region", Value: "eu"}}
+	weatherLabels := []dto.Label{{Name: "city", Value: "New York"}, {Name: "note", Value: "a,b=c"}}
+	assert.Equal(t, []dto.SeriesMeasurement{
+		{Metric: "cpu_usage", Labels: cpuLabels, Timestamp: 1700000000123, Value: schema.EncodeFloat64(0.5)},
+		{Metric: "cpu_cores", Labels: cpuLabels, Timestamp: 1700000000123, Value: schema.EncodeInt64(8)},
+		{Metric: "cpu_up", Labels: cpuLabels, Timestamp: 1700000000123, Value: schema.EncodeBool(true)},
+		{Metric: "weather_temp", Labels: weatherLabels, Timestamp: 1700000000000, Value: schema.EncodeFloat64(-3.5)},
+		{Metric: "weather_desc", Labels: weatherLabels, Timestamp: 1700000000000, Value: schema.EncodeString(`cloudy, "cold"`)},
+		{Metric: "disk_free", Labels: []dto.Label{}, Timestamp: 42, Value: schema.EncodeInt64(10)},
+		{Metric: "my metric_value", Labels: []dto.Label{}, Timestamp: 42, Value: schema.EncodeFloat64(1)},
+	}, measurements)
+	assert.Equal(t, `cpu_usage{host="web-1",region="eu"}`, ToTagged(measurements)[0].Tag)
+}
+
+func TestParse_ConvertsPrecisionToMillis(t *testing.T) {
+	for _, c := range []struct {
+		precision string
+		line      string
+		expected  uint64
+	}{
+		{"", "m v=1 1700000000123456789", 1700000000123},
+		{"ns", "m v=1 1700000000123456789", 1700000000123},
+		{"us", "m v=1 1700000000123456", 1700000000123},
+		{"ms", "m v=1 1700000000123", 1700000000123},
+		{"s", "m v=1 1700000000", 1700000000000},
+	} {
+		//given
+		precision, err := ParsePrecision(c.precision)
+		assert.Nil(t, err)
+
+		//when
+		measurements, err := Parse([]byte(c.line), precision, 0)
+
+		//then
+		assert.Nil(t, err)
+		assert.Equal(t, c.expected, measurements[0].Timestamp, c.precision)
+	}
+	_, err := ParsePrecision("h")
+	assert.NotNil(t, err)
+}
+
+func TestParse_RejectsInvalidLines(t *testing.T) {
+	for _, line := range []string{
+		"cpu",
+		"cpu ",
+		",host=a v=1",
+		"cpu,host v=1",
+		"cpu,host= v=1",
+		"cpu v=",
+		"cpu v=abc",
+		"cpu v=NaN",
+		"cpu v=1.5i",
+		"cpu v=18446744073709551615u",
+		"cpu v=\"unterminated",
+		"cpu v=1 notatimestamp",
+		"cpu v=1 -5",
+		"cpu,metric=a v=1",
+		"cpu,host=a,host=b v=1",
+		"cpu v=1x=2",
+	} {
+		//when
+		_, err := Parse([]byte("ok v=1\n"+line), Nanoseconds, 1)
+
+		//then
+		assert.NotNil(t, err, line)
+		if err != nil {
+			assert.Contains(t, err.Error(), "line 2", line)
+		}
+	}
+}
+
+func TestParse_RejectsPointsOfSeriesCollidingWithinMillisecond(t *testing.T) {
+	//given
+	colliding := "cpu,host=a usage=1 1700000000123000001\n" +
+		"cpu,host=b usage=2 1700000000123000002\n" +
+		"cpu,host=a usage=3 1700000000123999999"
+	overwriting := "cpu,host=a usage=1 1700000000123000001\n" +
+		"cpu,host=a usage=2 1700000000123000001\n" +
+		"cpu,host=a usage=3 1700000000124000000\n" +
+		"cpu,host=a usage=4\n" +
+		"cpu,host=a usage=5"
+
+	//when
+	_, collidingErr := Parse([]byte(colliding), Nanoseconds, 42)
+	_, collidingMicrosErr := Parse([]byte("m v=1 1700000000123001\nm v=2 1700000000123002"), Microseconds, 42)
+	measurements, overwritingErr := Parse([]byte(overwriting), Nanoseconds, 42)
+
+	//then
+	if assert.NotNil(t, collidingErr) {
+		assert.Contains(t, collidingErr.Error(), "line 3: timestamp 1700000000123999999 and timestamp 1700000000123000001 of line 1 are both millisecond 1700000000123")
+	}
+	assert.NotNil(t, collidingMicrosErr)
+	assert.Nil(t, overwritingErr)
+	assert.Equal(t, 5, len(measurements))
+}
@@ -20,6 +20,11 @@ func (e *Entry) ToString() string {
 }
 
 
+// Size accounts the value and both timestamps.
+func (e *Entry) Size() int64 {
+	return int64(len(e.Value) + 8 + 8)
+}
+
 func (e *Entry) Less(than btree.Item) bool {
 	oe := than.(*Entry)
 	return e.Timestamp < oe.Timestamp
@@ -2,62 +2,242 @@ package memt
 
 import (
 	"lsmstore/commitlog"
-	"lsmstore/dto"
 	"lsmstore/utils"
 	"sync"
-
-	"github.com/google/btree"
+	"sync/atomic"
+	"time"
 )
 
+// MemTforTag serializes writers with mutex while readers go straight to the current skiplist;
+// when the writer outgrows the arena, it swaps in a compacted copy and readers move over on their next call.
+//
+// It tracks the range it fully holds as a suffix starting at CoveredFrom: every point of the tag with a greater
+// or equal timestamp is in memory, as all writes pass through it, while points below persistedBelow may exist
+// only on disk and points below evictedBelow were evicted. Expiration does not affect coverage, as an expired
+// entry is expired on disk as well.
+//
+// The Manager drops a tag once it holds no entries; a dropped one covers nothing and takes no more writes.
 type MemTforTag struct {
+	bytes           int64
+	evictedBelow    uint64
+	persistedBelow  uint64
 	Tag             string
 	MaxEntriesCount int
+	MaxAge          time.Duration
 	mutex           *sync.Mutex
-	data            *btree.BTree
+	dropped         bool
+	list            atomic.Value
+	onResize        func(int64)
 }
 
 const DefaultSlicePreassignedMem = 0
 
 func (mt *MemTforTag) InitStorage() {
-	mt.data = btree.New(4)
+	mt.list.Store(newSkiplist(MinArenaSize))
 	mt.mutex = &sync.Mutex{}
+	mt.resize(int64(len(mt.Tag) + MinArenaSize))
+}
+
+func (mt *MemTforTag) skiplist() *skiplist {
+	return mt.list.Load().(*skiplist)
 }
 
 func (mt *MemTforTag) StoreCommitlogEntry(entry commitlog.Entry) {
-	mt.mutex.Lock()
-	if string(entry.Key) == mt.Tag {
-		mt.save(entry.Timestamp, entry.ExpiresAt, entry.Value)
-	}
-	mt.mutex.Unlock()
+	mt.MergeWithCommitlog([]commitlog.Entry{entry})
 }
 
+// MergeWithCommitlog skips entries below CoveredFrom: they wouldn't make any read skip the disk.
 func (mt *MemTforTag) MergeWithCommitlog(entries []commitlog.Entry) {
+	mt.mergeWithCommitlog(entries)
+}
+
+// mergeWithCommitlog returns false, merging nothing, once the tag is dropped.
+func (mt *MemTforTag) mergeWithCommitlog(entries []commitlog.Entry) bool {
 	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+	if mt.dropped {
+		return false
+	}
 	for _, entry := range entries {
-		if string(entry.Key) == mt.Tag {
+		if (string(entry.Key) == mt.Tag) && (entry.Timestamp >= mt.CoveredFrom()) {
 			mt.save(entry.Timestamp, entry.ExpiresAt, entry.Value)
 		}
 	}
-	mt.mutex.Unlock()
+	return true
 }
 
-func (mt *MemTforTag) MergeWithPrefetched(entries []dto.Measurement, expiresAt uint64) {
+// MergeWithPrefetched adds entries read back from disk; the caller guarantees they are all persisted points
+// with timestamp not less than loadedFrom, so that coverage can be extended down to it.
+func (mt *MemTforTag) MergeWithPrefetched(entries []commitlog.Entry, loadedFrom uint64) {
+	mt.mergeWithPrefetched(entries, loadedFrom)
+}
+
+// mergeWithPrefetched returns false, merging nothing, once the tag is dropped.
+func (mt *MemTforTag) mergeWithPrefetched(entries []commitlog.Entry, loadedFrom uint64) bool {
 	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+	if mt.dropped {
+		return false
+	}
 	for _, entry := range entries {
-		mt.save(entry.Timestamp, expiresAt, entry.Value)
+		mt.save(entry.Timestamp, entry.ExpiresAt, entry.Value)
 	}
-	mt.mutex.Unlock()
+	if loadedFrom < atomic.LoadUint64(&mt.persistedBelow) {
+		atomic.StoreUint64(&mt.persistedBelow, loadedFrom)
+	}
+	return true
 }
 
+// CoveredFrom is the timestamp starting from which the memtable holds every point of the tag.
+func (mt *MemTforTag) CoveredFrom() uint64 {
+	evictedBelow := atomic.LoadUint64(&mt.evictedBelow)
+	persistedBelow := atomic.LoadUint64(&mt.persistedBelow)
+	if evictedBelow > persistedBelow {
+		return evictedBelow
+	}
+	return persistedBelow
+}
+
+// evicted must be called with mutex held before a live entry is dropped for any reason but expiration,
+// so that a reader that misses the entry is bound to see the raised coverage afterwards.
+func (mt *MemTforTag) evicted(timestamp uint64) {
+	below := timestamp + 1
+	if timestamp == ^uint64(0) {
+		below = timestamp
+	}
+	if below > atomic.LoadUint64(&mt.evictedBelow) {
+		atomic.StoreUint64(&mt.evictedBelow, below)
+	}
+}
+
+// save must be called with mutex held.
 func (mt *MemTforTag) save(timestamp uint64, expiresAt uint64, value []byte) {
-	entry := Entry{Timestamp: timestamp, ExpiresAt: expiresAt, Value: value}
-	if (mt.MaxEntriesCount != 0) && (mt.data.Len() >= mt.MaxEntriesCount) {
-		min := mt.data.Min()
-		if min.Less(&entry) {
-			mt.data.DeleteMin()
+	list := mt.skiplist()
+	if (mt.MaxEntriesCount != 0) && (list.len() >= mt.MaxEntriesCount) {
+		if min, exists := list.min(); exists && (min.Timestamp < timestamp) {
+			mt.evicted(min.Timestamp)
+			list.removeMin()
+		} else if exists && (min.Timestamp > timestamp) {
+			mt.evicted(timestamp)
+			return
 		}
 	}
-	mt.data.ReplaceOrInsert(&entry)
+	if _, _, ok := list.put(timestamp, expiresAt, value); !ok {
+		list = list.compacted(nodeSize(skiplistMaxHeight) + valueSize(len(value)))
+		list.put(timestamp, expiresAt, value)
+		mt.swap(list)
+	}
+	if mt.MaxAge > 0 {
+		mt.dropOlderThanMaxAge(list)
+	}
+}
+
+// dropOlderThanMaxAge keeps entries within MaxAge of the newest one; must be called with mutex held.
+func (mt *MemTforTag) dropOlderThanMaxAge(list *skiplist) {
+	max, exists := list.max()
+	maxAge := uint64(mt.MaxAge.Milliseconds())
+	if !exists || (max.Timestamp <= maxAge) {
+		return
+	}
+	cutoff := max.Timestamp - maxAge
+	for min, exists := list.min(); exists && (min.Timestamp < cutoff); min, exists = list.min() {
+		mt.evicted(min.Timestamp)
+		list.removeMin()
+	}
+	mt.shrink(list)
+}
+
+// swap must be called with mutex held; the arena capacity is what is accounted, garbage included.
+func (mt *MemTforTag) swap(list *skiplist) {
+	old := mt.skiplist()
+	mt.list.Store(list)
+	mt.resize(int64(len(list.arena)) - int64(len(old.arena)))
+}
+
+// shrink compacts the skiplist once entries were removed from most of it; must be called with mutex held.
+func (mt *MemTforTag) shrink(list *skiplist) {
+	if list.sparse() {
+		mt.swap(list.compacted(0))
+	}
+}
+
+func (mt *MemTforTag) resize(delta int64) {
+	atomic.AddInt64(&mt.bytes, delta)
+	if mt.onResize != nil {
+		mt.onResize(delta)
+	}
+}
+
+// Bytes is the accounted size of the tag and its arena.
+func (mt *MemTforTag) Bytes() int64 {
+	return atomic.LoadInt64(&mt.bytes)
+}
+
+func (mt *MemTforTag) oldestTimestamp() (uint64, bool) {
+	min, exists := mt.skiplist().min()
+	return min.Timestamp, exists
+}
+
+// EvictOldest drops the oldest entry, returning its size, or 0 if there was none;
+// Bytes only drops once the arena is sparse enough to be shrunk.
+func (mt *MemTforTag) EvictOldest() int64 {
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+	list := mt.skiplist()
+	min, exists := list.min()
+	if !exists {
+		return 0
+	}
+	mt.evicted(min.Timestamp)
+	removed, _ := list.removeMin()
+	mt.shrink(list)
+	return removed.Size()
+}
+
+// evictOldestUncompacted drops the oldest entry like EvictOldest, but leaves it as garbage for compact to reclaim;
+// besides the size of the entry, it returns what the tag will be charged once compacted, 0 if it is to be dropped.
+func (mt *MemTforTag) evictOldestUncompacted() (int64, int64) {
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+	list := mt.skiplist()
+	removed := int64(0)
+	if min, exists := list.min(); exists {
+		mt.evicted(min.Timestamp)
+		entry, _ := list.removeMin()
+		removed = entry.Size()
+	}
+	if list.len() == 0 {
+		return removed, 0
+	}
+	arena := evictedArenaSize(list.liveBytes())
+	if uint32(len(list.arena)) < arena {
+		arena = uint32(len(list.arena))
+	}
+	return removed, int64(len(mt.Tag)) + int64(arena)
+}
+
+// compact reclaims the garbage of evicted entries, leaving the arena no larger than its live entries.
+func (mt *MemTforTag) compact() {
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+	list := mt.skiplist()
+	if size := evictedArenaSize(list.liveBytes()); size < uint32(len(list.arena)) {
+		mt.swap(list.compactedInto(size))
+	}
+}
+
+// drop releases the charge of a tag holding no entries, returning false if it holds any; as a reader that got the
+// tag before may still be reading it, the tag stops covering anything.
+func (mt *MemTforTag) drop() bool {
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+	if mt.dropped || (mt.skiplist().len() > 0) {
+		return false
+	}
+	mt.dropped = true
+	atomic.StoreUint64(&mt.evictedBelow, ^uint64(0))
+	mt.resize(-mt.Bytes())
+	return true
 }
 
 func (mt *MemTforTag) RetrieveAll() []Entry {
@@ -65,48 +245,79 @@ func (mt *MemTforTag) RetrieveAll() []Entry {
 }
 
 func (mt *MemTforTag) Availability() (uint64, uint64) {
-	min := mt.data.Min()
-	max := mt.data.Max()
+	list := mt.skiplist()
+	min, minExists := list.min()
+	max, maxExists := list.max()
 
-	if (min == nil) || (max == nil) {
+	if !minExists || !maxExists {
 		return 0, 0
 	}
 
-	mine := min.(*Entry)
-	maxe := max.(*Entry)
+	return min.Timestamp, max.Timestamp
+}
 
-	return mine.Timestamp, maxe.Timestamp
+func (mt *MemTforTag) Len() int {
+	return mt.skiplist().len()
 }
 
+func (mt *MemTforTag) CountInRange(fromTs uint64, toTs uint64) int {
+	count := 0
+	mt.skiplist().ascend(fromTs, toTs, func(e Entry) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+// Retrieve returns entries whose values alias the arena; they are never modified, so callers must not modify them either.
 func (mt *MemTforTag) Retrieve(fromTs uint64, toTs uint64) []Entry {
-	mt.mutex.Lock()
 	ans := make([]Entry, 0, DefaultSlicePreassignedMem)
-	mt.data.AscendRange(buildIndexKey(fromTs), buildIndexKey(toTs+1), func(i btree.Item) bool {
-		oe := i.(*Entry)
-		ans = append(ans, *oe)
+	mt.skiplist().ascend(fromTs, toTs, func(e Entry) bool {
+		ans = append(ans, e)
+		return true
+	})
+	return ans
+}
+
+// LastN returns up to n newest entries in ascending order.
+func (mt *MemTforTag) LastN(n int) []Entry {
+	ans := make([]Entry, 0, n)
+	mt.skiplist().descend(0, ^uint64(0), func(e Entry) bool {
+		if len(ans) >= n {
+			return false
+		}
+		ans = append(ans, e)
+		return true
+	})
+	for i, j := 0, len(ans)-1; i < j; i, j = i+1, j-1 {
+		ans[i], ans[j] = ans[j], ans[i]
+	}
+	return ans
+}
+
+func (mt *MemTforTag) RetrieveDescending(fromTs uint64, toTs uint64) []Entry {
+	ans := make([]Entry, 0, DefaultSlicePreassignedMem)
+	mt.skiplist().descend(fromTs, toTs, func(e Entry) bool {
+		ans = append(ans, e)
 		return true
 	})
-	mt.mutex.Unlock()
 	return ans
 }
 
 func (mt *MemTforTag) PerformExpiration() {
 	mt.mutex.Lock()
-	toBeDeleted := make([]*Entry, 0, DefaultSlicePreassignedMem)
+	list := mt.skiplist()
+	toBeDeleted := make([]uint64, 0, DefaultSlicePreassignedMem)
 	now := utils.GetNowMillis()
-	mt.data.Ascend(func(i btree.Item) bool {
-		oe := i.(*Entry)
-		if (oe.ExpiresAt != 0) && (oe.ExpiresAt < now) {
-			toBeDeleted = append(toBeDeleted, oe)
+	list.ascend(0, ^uint64(0), func(e Entry) bool {
+		if (e.ExpiresAt != 0) && (e.ExpiresAt < now) {
+			toBeDeleted = append(toBeDeleted, e.Timestamp)
 		}
 		return true
 	})
-	for _, i := range toBeDeleted {
-		mt.data.Delete(i)
+	for _, ts := range toBeDeleted {
+		list.remove(ts)
 	}
+	mt.shrink(list)
 	mt.mutex.Unlock()
 }
-
-func buildIndexKey(ts uint64) btree.Item {
-	return &Entry{Timestamp: ts}
-}
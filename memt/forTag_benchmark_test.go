@@ -0,0 +1,88 @@
+package memt
+
+import (
+	"fmt"
+	"lsmstore/commitlog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/btree"
+)
+
+// btreeMemTforTag is the former google/btree based memtable, kept to benchmark the skiplist against.
+type btreeMemTforTag struct {
+	maxEntriesCount int
+	mutex           *sync.Mutex
+	data            *btree.BTree
+}
+
+func (mt *btreeMemTforTag) MergeWithCommitlog(entries []commitlog.Entry) {
+	mt.mutex.Lock()
+	for _, e := range entries {
+		entry := Entry{Timestamp: e.Timestamp, ExpiresAt: e.ExpiresAt, Value: e.Value}
+		if (mt.maxEntriesCount != 0) && (mt.data.Len() >= mt.maxEntriesCount) {
+			if mt.data.Min().Less(&entry) {
+				mt.data.DeleteMin()
+			}
+		}
+		mt.data.ReplaceOrInsert(&entry)
+	}
+	mt.mutex.Unlock()
+}
+
+func (mt *btreeMemTforTag) Retrieve(fromTs uint64, toTs uint64) []Entry {
+	mt.mutex.Lock()
+	ans := make([]Entry, 0, DefaultSlicePreassignedMem)
+	mt.data.AscendRange(&Entry{Timestamp: fromTs}, &Entry{Timestamp: toTs + 1}, func(i btree.Item) bool {
+		ans = append(ans, *i.(*Entry))
+		return true
+	})
+	mt.mutex.Unlock()
+	return ans
+}
+
+type memtUnderBenchmark interface {
+	MergeWithCommitlog(entries []commitlog.Entry)
+	Retrieve(fromTs uint64, toTs uint64) []Entry
+}
+
+// BenchmarkMemtLoadWorkload mirrors TestLoad: every user writes 5 byte points with current timestamps
+// to its own tag, keeping 100 entries per tag, while reading its latest points back.
+func BenchmarkMemtLoadWorkload(b *testing.B) {
+	const numUsers = 4
+	implementations := []struct {
+		name   string
+		create func(tag string) memtUnderBenchmark
+	}{
+		{"btree", func(tag string) memtUnderBenchmark {
+			return &btreeMemTforTag{maxEntriesCount: 100, mutex: &sync.Mutex{}, data: btree.New(4)}
+		}},
+		{"skiplist", func(tag string) memtUnderBenchmark {
+			mt := MemTforTag{Tag: tag, MaxEntriesCount: 100}
+			mt.InitStorage()
+			return &mt
+		}},
+	}
+	for _, implementation := range implementations {
+		b.Run(implementation.name, func(b *testing.B) {
+			b.ReportAllocs()
+			wg := &sync.WaitGroup{}
+			wg.Add(numUsers)
+			for i := 0; i < numUsers; i++ {
+				go func(id int) {
+					defer wg.Done()
+					tag := fmt.Sprintf("tag%d", id)
+					mt := implementation.create(tag)
+					expiresAt := uint64(time.Now().Add(time.Hour * 48).UnixMilli())
+					for n := 0; n < b.N; n++ {
+						ts := uint64(1000000 + n)
+						mt.MergeWithCommitlog([]commitlog.Entry{{Key: []byte(tag), Timestamp: ts, ExpiresAt: expiresAt, Value: make([]byte, 5)}})
+						mt.Retrieve(ts-50, ts)
+					}
+				}(i)
+			}
+			wg.Wait()
+		})
+	}
+}
@@ -1,53 +1,99 @@
 package memt
 
 import (
+	"container/heap"
 	"lsmstore/commitlog"
-	"lsmstore/dto"
-	"lsmstore/utils"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const DefaultBudgetLowWatermark = 0.9
+
+// Manager is the cache of hot data: per tag it keeps the newest MaxEntriesPerTag points and, if MaxAgePerTag is set,
+// only points within MaxAgePerTag of the newest one; MaxEntriesPerTag defaults to 10 unless MaxAgePerTag is set.
+// If MaxBytes is set, it is also bounded by the accounted size of all tags.
+// Once over MaxBytes, BeforeEviction is called and then the globally oldest entries are evicted until
+// the memtable is back under BudgetLowWatermark of MaxBytes. Tags left without entries are dropped.
 type Manager struct {
+	bytes                  int64
+	evictions              int64
+	evictedBytes           int64
 	memtForTag             map[string]*MemTforTag
 	mutex                  *sync.Mutex
-	shouldBeRunning        bool
+	evictionMutex          *sync.Mutex
+	stop                   chan struct{}
 	MaxEntriesPerTag       int
+	MaxAgePerTag           time.Duration
 	PerformExpirationEvery time.Duration
+	MaxBytes               int64
+	BudgetLowWatermark     float64
+	BeforeEviction         func()
+	// PersistedMax reports the newest timestamp of a tag already on disk, so that a new cache starts covering right above it
+	PersistedMax func(tag string) (uint64, bool)
+}
+
+type Stats struct {
+	Bytes        int64
+	MaxBytes     int64
+	Tags         int
+	Evictions    int64
+	EvictedBytes int64
 }
 
 func (sm *Manager) InitStorage() {
 	sm.memtForTag = make(map[string]*MemTforTag)
-	if sm.MaxEntriesPerTag == 0 {
+	sm.mutex = &sync.Mutex{}
+	sm.evictionMutex = &sync.Mutex{}
+	if sm.BudgetLowWatermark == 0 {
+		sm.BudgetLowWatermark = DefaultBudgetLowWatermark
+	}
+	if (sm.MaxEntriesPerTag == 0) && (sm.MaxAgePerTag == 0) {
 		sm.MaxEntriesPerTag = 10
 	}
 	if sm.PerformExpirationEvery == 0 {
 		sm.PerformExpirationEvery = 10 * time.Second
 	}
-	sm.shouldBeRunning = true
+	sm.stop = make(chan struct{})
 	go func() {
-		for sm.shouldBeRunning {
-			time.Sleep(sm.PerformExpirationEvery)
-			for _, memtft := range sm.memtForTag {
-				memtft.PerformExpiration()
+		ticker := time.NewTicker(sm.PerformExpirationEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for _, memtft := range sm.allMemtForTag() {
+					memtft.PerformExpiration()
+					sm.dropIfEmpty(memtft)
+				}
+			case <-sm.stop:
+				return
 			}
 		}
 	}()
 }
 
+// CloseStorage stops the periodic expiration; it must be called once.
 func (sm *Manager) CloseStorage() {
-	sm.shouldBeRunning = false
+	close(sm.stop)
 }
 
-func (sm *Manager) MergeWithPrefetched(data map[string][]dto.Measurement) {
-	expiresAt := utils.GetNowMillis() + uint64(sm.PerformExpirationEvery.Milliseconds()*10)
-	for tag, values := range data {
-		memtForTag := sm.MemTableForTag(tag)
-		memtForTag.MergeWithPrefetched(values, expiresAt)
+func (sm *Manager) MergeWithCommitlog(commitlogEntries []commitlog.Entry) {
+	for tag, values := range groupByTag(commitlogEntries) {
+		for !sm.MemTableForTag(tag).mergeWithCommitlog(values) {
+		}
 	}
+	sm.enforceBudget()
 }
 
-func (sm *Manager) MergeWithCommitlog(commitlogEntries []commitlog.Entry) {
+// MergeWithPrefetched fills the cache of a tag with entries read back from SST, keeping their own expiration;
+// entries must be all persisted points of the tag from loadedFrom on.
+func (sm *Manager) MergeWithPrefetched(tag string, entries []commitlog.Entry, loadedFrom uint64) {
+	for !sm.MemTableForTag(tag).mergeWithPrefetched(entries, loadedFrom) {
+	}
+	sm.enforceBudget()
+}
+
+func groupByTag(commitlogEntries []commitlog.Entry) map[string][]commitlog.Entry {
 	groupedByTag := make(map[string][]commitlog.Entry)
 	for _, entry := range commitlogEntries {
 		tag := string(entry.Key)
@@ -60,27 +106,25 @@ func (sm *Manager) MergeWithCommitlog(commitlogEntries []commitlog.Entry) {
 			groupedByTag[tag] = newGroup
 		}
 	}
-	for tag, values := range groupedByTag {
-		memtForTag := sm.MemTableForTag(tag)
-		memtForTag.MergeWithCommitlog(values)
-	}
+	return groupedByTag
 }
 
 func (sm *Manager) StoreCommitlogEntry(tag string, entry commitlog.Entry) {
-	st := sm.MemTableForTag(tag)
-	st.StoreCommitlogEntry(entry)
+	sm.MergeWithCommitlogForTag(tag, []commitlog.Entry{entry})
 }
 
+// MergeWithCommitlogForTag merges into the current memtable of the tag, retrying if the one it got was dropped meanwhile.
 func (sm *Manager) MergeWithCommitlogForTag(tag string, entries []commitlog.Entry) {
-	st := sm.MemTableForTag(tag)
-	st.MergeWithCommitlog(entries)
+	for !sm.MemTableForTag(tag).mergeWithCommitlog(entries) {
+	}
+	sm.enforceBudget()
 }
 
 func (sm *Manager) Availability() (uint64, uint64) {
 	fromts := ^uint64(0)
 	tots := uint64(0)
 
-	for _, memtft := range sm.memtForTag {
+	for _, memtft := range sm.allMemtForTag() {
 		f, t := memtft.Availability()
 		if fromts > f {
 			fromts = f
@@ -97,6 +141,8 @@ func (sm *Manager) Availability() (uint64, uint64) {
 }
 
 func (sm *Manager) GetTags() []string {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
 	keys := make([]string, len(sm.memtForTag))
 	i := 0
 	for k := range sm.memtForTag {
@@ -107,16 +153,144 @@ func (sm *Manager) GetTags() []string {
 }
 
 func (sm *Manager) createMemtForTag(tag string) *MemTforTag {
-	memtft := MemTforTag{Tag: tag, MaxEntriesCount: sm.MaxEntriesPerTag}
+	memtft := MemTforTag{Tag: tag, MaxEntriesCount: sm.MaxEntriesPerTag, MaxAge: sm.MaxAgePerTag, onResize: sm.resize}
 	memtft.InitStorage()
+	if sm.PersistedMax != nil {
+		if max, exists := sm.PersistedMax(tag); exists {
+			memtft.persistedBelow = max + 1
+			if max == ^uint64(0) {
+				memtft.persistedBelow = max
+			}
+		}
+	}
 	sm.memtForTag[tag] = &memtft
 	return &memtft
 }
 
+func (sm *Manager) ExistingMemTableForTag(tag string) (*MemTforTag, bool) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	memtForTag, memtForTagExists := sm.memtForTag[tag]
+	return memtForTag, memtForTagExists
+}
+
 func (sm *Manager) MemTableForTag(tag string) *MemTforTag {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
 	memtForTag, memtForTagExists := sm.memtForTag[tag]
 	if !memtForTagExists {
 		memtForTag = sm.createMemtForTag(tag)
 	}
 	return memtForTag
 }
+
+// dropIfEmpty forgets a tag holding no entries, releasing its charge.
+func (sm *Manager) dropIfEmpty(memtft *MemTforTag) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	if (sm.memtForTag[memtft.Tag] == memtft) && memtft.drop() {
+		delete(sm.memtForTag, memtft.Tag)
+	}
+}
+
+func (sm *Manager) allMemtForTag() []*MemTforTag {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	ans := make([]*MemTforTag, 0, len(sm.memtForTag))
+	for _, memtft := range sm.memtForTag {
+		ans = append(ans, memtft)
+	}
+	return ans
+}
+
+func (sm *Manager) resize(delta int64) {
+	atomic.AddInt64(&sm.bytes, delta)
+}
+
+func (sm *Manager) Bytes() int64 {
+	return atomic.LoadInt64(&sm.bytes)
+}
+
+func (sm *Manager) Stats() Stats {
+	sm.mutex.Lock()
+	tags := len(sm.memtForTag)
+	sm.mutex.Unlock()
+	return Stats{
+		Bytes:        sm.Bytes(),
+		MaxBytes:     sm.MaxBytes,
+		Tags:         tags,
+		Evictions:    atomic.LoadInt64(&sm.evictions),
+		EvictedBytes: atomic.LoadInt64(&sm.evictedBytes),
+	}
+}
+
+// enforceBudget evicts oldest entries first, whichever tag they belong to, as newest data is the most read.
+// Evicted entries stay in the arena until it is compacted, so what each eviction frees is judged from the charge
+// of the tag once compacted, or from none once it is emptied and dropped; every tag evicted from is compacted at
+// the end. Evicting stops at the watermark or once there is nothing left to evict, as by writes racing with it.
+func (sm *Manager) enforceBudget() {
+	if (sm.MaxBytes == 0) || (sm.Bytes() <= sm.MaxBytes) {
+		return
+	}
+	sm.evictionMutex.Lock()
+	defer sm.evictionMutex.Unlock()
+	if sm.Bytes() <= sm.MaxBytes {
+		//evicted by concurrent writer already
+		return
+	}
+	if sm.BeforeEviction != nil {
+		sm.BeforeEviction()
+	}
+
+	target := int64(float64(sm.MaxBytes) * sm.BudgetLowWatermark)
+	oldest := &oldestFirst{}
+	for _, memtft := range sm.allMemtForTag() {
+		if ts, exists := memtft.oldestTimestamp(); exists {
+			oldest.items = append(oldest.items, oldestOfTag{memtft, ts, memtft.Bytes()})
+		} else {
+			sm.dropIfEmpty(memtft)
+		}
+	}
+	heap.Init(oldest)
+	excess := sm.Bytes() - target
+	evictedFrom := make(map[*MemTforTag]bool)
+	for (excess > 0) && (oldest.Len() > 0) {
+		item := heap.Pop(oldest).(oldestOfTag)
+		freed, charge := item.memtft.evictOldestUncompacted()
+		evictedFrom[item.memtft] = true
+		excess -= item.charge - charge
+		if freed == 0 {
+			continue
+		}
+		atomic.AddInt64(&sm.evictions, 1)
+		atomic.AddInt64(&sm.evictedBytes, freed)
+		if ts, exists := item.memtft.oldestTimestamp(); exists {
+			heap.Push(oldest, oldestOfTag{item.memtft, ts, charge})
+		}
+	}
+	for memtft := range evictedFrom {
+		memtft.compact()
+		sm.dropIfEmpty(memtft)
+	}
+}
+
+// oldestOfTag is a tag by its oldest entry, with what it is to be charged once compacted.
+type oldestOfTag struct {
+	memtft *MemTforTag
+	ts     uint64
+	charge int64
+}
+
+type oldestFirst struct {
+	items []oldestOfTag
+}
+
+func (h *oldestFirst) Len() int           { return len(h.items) }
+func (h *oldestFirst) Less(i, j int) bool { return h.items[i].ts < h.items[j].ts }
+func (h *oldestFirst) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *oldestFirst) Push(x interface{}) { h.items = append(h.items, x.(oldestOfTag)) }
+func (h *oldestFirst) Pop() interface{} {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return last
+}
@@ -1,6 +1,7 @@
 package memt
 
 import (
+	"fmt"
 	"lsmstore/commitlog"
 	"lsmstore/utils"
 	"testing"
@@ -128,6 +129,207 @@ func TestMemTManager_ExpirationWorks(t *testing.T) {
 	log.Close()
 }
 
+func TestMemTManager_MaxBytesEvictsOldestEntriesAcrossTags(t *testing.T) {
+	//given
+	flushes := 0
+	m := Manager{MaxEntriesPerTag: 1000, MaxBytes: 4000, BudgetLowWatermark: 0.5, BeforeEviction: func() {
+		flushes++
+	}}
+	m.InitStorage()
+
+	//when
+	m.MergeWithCommitlog(getSizedCommitlogEntries("tagZero", 1000, 10, 24))
+	m.MergeWithCommitlog(getSizedCommitlogEntries("tagZero", 1000, 10, 24))
+
+	//then
+	arena := m.memtForTag["tagZero"].skiplist().arena
+	assert.Equal(t, int64(7+len(arena)), m.Bytes(), "arena capacity is not accounted")
+	assert.Less(t, len(arena), 2048, "arena did not grow geometrically")
+	assert.Equal(t, 0, flushes)
+
+	//when
+	m.MergeWithCommitlog(getSizedCommitlogEntries("tagOne", 2000, 10, 24))
+	m.MergeWithCommitlog(getSizedCommitlogEntries("tagZero", 1010, 50, 24))
+	stats := m.Stats()
+
+	//then
+	assert.Equal(t, 1, flushes, "eviction was not preceded by flush")
+	assert.LessOrEqual(t, stats.Bytes, int64(2000), "memtable was not evicted down to low watermark")
+	assert.Equal(t, stats.Bytes, m.memtForTag["tagZero"].Bytes()+m.memtForTag["tagOne"].Bytes(), "global and per tag accounting differ")
+	assert.Equal(t, int64(stats.Evictions*40), stats.EvictedBytes)
+	assert.Equal(t, 10, m.memtForTag["tagOne"].Len(), "newest entries were evicted")
+	from, to := m.memtForTag["tagZero"].Availability()
+	assert.Less(t, uint64(1000), from, "oldest entries were not evicted first")
+	assert.Equal(t, uint64(1059), to)
+	assert.Equal(t, int(1060-from), m.memtForTag["tagZero"].Len(), "oldest entries were not evicted first")
+}
+
+func TestMemTManager_MaxBytesDropsEvictedTagsInsteadOfEmptyingAll(t *testing.T) {
+	//given
+	m := Manager{MaxEntriesPerTag: 1000, MaxBytes: 10000}
+	m.InitStorage()
+
+	//when
+	for i := 0; i < 200; i++ {
+		m.MergeWithCommitlog(getSizedCommitlogEntries(fmt.Sprintf("tag%03d", i), 1000+uint64(i), 1, 24))
+	}
+	stats := m.Stats()
+
+	//then
+	assert.LessOrEqual(t, stats.Bytes, m.MaxBytes)
+	assert.Equal(t, 200-stats.Tags, int(stats.Evictions), "tags left without entries were not dropped")
+	live, bytes := 0, int64(0)
+	for _, memtft := range m.allMemtForTag() {
+		live += memtft.Len()
+		bytes += memtft.Bytes()
+	}
+	assert.Equal(t, stats.Tags, live, "newest entries were evicted")
+	assert.Less(t, 10, live)
+	assert.Equal(t, stats.Bytes, bytes, "charge of dropped tags was not released")
+	_, exists := m.ExistingMemTableForTag("tag199")
+	assert.True(t, exists, "newest tag was dropped")
+	_, exists = m.ExistingMemTableForTag("tag000")
+	assert.False(t, exists, "oldest tag was kept")
+}
+
+func TestMemTManager_EvictionsAreJudgedFromCompactedSize(t *testing.T) {
+	//given
+	m := Manager{MaxEntriesPerTag: 10000}
+	m.InitStorage()
+	m.MergeWithCommitlog(getSizedCommitlogEntries("tagZero", 1000, 1000, 24))
+	m.MaxBytes = m.Bytes() * 3 / 4
+
+	//when
+	m.MergeWithCommitlog(getSizedCommitlogEntries("tagZero", 2000, 100, 24))
+	stats := m.Stats()
+
+	//then
+	assert.LessOrEqual(t, stats.Bytes, int64(float64(m.MaxBytes)*m.BudgetLowWatermark))
+	assert.Less(t, 700, m.memtForTag["tagZero"].Len(), "most entries were evicted before any byte was freed")
+	assert.Equal(t, stats.Bytes, m.memtForTag["tagZero"].Bytes())
+	assert.Equal(t, int64(7+len(m.memtForTag["tagZero"].skiplist().arena)), stats.Bytes, "evicted entries were not compacted")
+}
+
+func TestMemTManager_DroppedTagCoversNothingAndTakesNoWrites(t *testing.T) {
+	//given
+	m := Manager{MaxEntriesPerTag: 10}
+	m.InitStorage()
+	m.MergeWithCommitlog(getSizedCommitlogEntries("tagZero", 1000, 5, 4))
+	dropped := m.memtForTag["tagZero"]
+	for dropped.EvictOldest() != 0 {
+	}
+
+	//when
+	m.dropIfEmpty(dropped)
+	merged := dropped.mergeWithCommitlog(getSizedCommitlogEntries("tagZero", 2000, 1, 4))
+	m.MergeWithCommitlogForTag("tagZero", getSizedCommitlogEntries("tagZero", 2000, 1, 4))
+
+	//then
+	assert.False(t, merged)
+	assert.Equal(t, ^uint64(0), dropped.CoveredFrom(), "readers of the dropped tag would skip the disk")
+	assert.Equal(t, 0, dropped.Len())
+	assert.Equal(t, 1, m.memtForTag["tagZero"].Len(), "write to a dropped tag was lost")
+	assert.Equal(t, m.memtForTag["tagZero"].Bytes(), m.Bytes())
+}
+
+func TestMemTManager_MaxAgePerTagKeepsRecentWindow(t *testing.T) {
+	//given
+	m := Manager{MaxAgePerTag: 10 * time.Millisecond}
+	m.InitStorage()
+
+	//when
+	m.MergeWithCommitlog(getSizedCommitlogEntries("tagZero", 1000, 50, 4))
+	m.MergeWithCommitlog(getSizedCommitlogEntries("tagZero", 900, 5, 4))
+	from, to := m.memtForTag["tagZero"].Availability()
+
+	//then
+	assert.Equal(t, 11, m.memtForTag["tagZero"].Len(), "points count is not limited when only max age is set")
+	assert.Equal(t, uint64(1039), from, "points older than max age were kept")
+	assert.Equal(t, uint64(1049), to)
+}
+
+func TestMemTManager_CoverageFollowsEvictionsAndPersistedData(t *testing.T) {
+	//given
+	m := Manager{MaxEntriesPerTag: 3, PersistedMax: func(tag string) (uint64, bool) {
+		return 100, tag == "tagOne"
+	}}
+	m.InitStorage()
+
+	//when
+	m.MergeWithCommitlog(getSizedCommitlogEntries("tagZero", 10, 5, 4))
+	m.MergeWithCommitlog(getSizedCommitlogEntries("tagZero", 5, 1, 4))
+	m.MergeWithCommitlog(getSizedCommitlogEntries("tagOne", 50, 1, 4))
+	m.MergeWithCommitlog(getSizedCommitlogEntries("tagOne", 150, 1, 4))
+
+	//then
+	assert.Equal(t, uint64(12), m.memtForTag["tagZero"].CoveredFrom(), "coverage was not raised past evicted points")
+	assert.Equal(t, 3, m.memtForTag["tagZero"].Len(), "point below coverage was cached")
+	assert.Equal(t, uint64(101), m.memtForTag["tagOne"].CoveredFrom(), "coverage does not start above persisted points")
+	assert.Equal(t, 1, m.memtForTag["tagOne"].Len(), "point below coverage was cached")
+
+	//when
+	m.MergeWithPrefetched("tagOne", getSizedCommitlogEntries("tagOne", 95, 2, 4), 90)
+
+	//then
+	assert.Equal(t, uint64(90), m.memtForTag["tagOne"].CoveredFrom(), "prefetch did not extend coverage")
+	assert.Equal(t, 3, m.memtForTag["tagOne"].Len())
+
+	//when
+	m.MergeWithCommitlog(getSizedCommitlogEntries("tagOne", 151, 1, 4))
+
+	//then
+	assert.Equal(t, uint64(96), m.memtForTag["tagOne"].CoveredFrom(), "eviction of prefetched point did not shrink coverage")
+}
+
+func TestWriteBuffer_RemovesOnlyUnchangedFlushedEntries(t *testing.T) {
+	//given
+	wb := WriteBuffer{}
+	wb.Init()
+	flushed := getSizedCommitlogEntries("tagZero", 1000, 10, 4)
+	wb.Add(flushed)
+	overwrite := getSizedCommitlogEntries("tagZero", 1005, 1, 8)
+	wb.Add(overwrite)
+
+	//when
+	wb.RemoveFlushed(flushed)
+
+	//then
+	buffer, exists := wb.ExistingBufferForTag("tagZero")
+	assert.True(t, exists)
+	assert.Equal(t, 1, wb.Len(), "flushed entries were kept")
+	assert.Equal(t, overwrite[0].Value, buffer.RetrieveAll()[0].Value, "entry overwritten after flush started was removed")
+}
+
+func TestWriteBuffer_TagIsDroppedOnceAllItsEntriesAreFlushed(t *testing.T) {
+	//given
+	wb := WriteBuffer{}
+	wb.Init()
+	flushed := append(getSizedCommitlogEntries("tagZero", 1000, 100, 4), getSizedCommitlogEntries("tagOne", 1000, 10, 4)...)
+	wb.Add(flushed)
+	outOfOrder := getSizedCommitlogEntries("tagOne", 500, 1, 4)
+	wb.Add(outOfOrder)
+
+	//when
+	wb.RemoveFlushed(flushed)
+
+	//then
+	_, exists := wb.ExistingBufferForTag("tagZero")
+	assert.False(t, exists, "buffer of a flushed tag was kept")
+	assert.Equal(t, []string{"tagOne"}, wb.GetTags())
+	buffer, _ := wb.ExistingBufferForTag("tagOne")
+	assert.Equal(t, []Entry{{Timestamp: 500, Value: outOfOrder[0].Value}}, buffer.RetrieveAll())
+	assert.Equal(t, uint64(500), buffer.RetrieveDescending(0, 600)[0].Timestamp)
+	assert.LessOrEqual(t, cap(buffer.entries), 2, "array was kept at the size before the flush")
+}
+
+func getSizedCommitlogEntries(tag string, firstTs uint64, count int, valueSize int) []commitlog.Entry {
+	ans := make([]commitlog.Entry, count)
+	for i := range ans {
+		ans[i] = commitlog.Entry{Key: []byte(tag), Timestamp: firstTs + uint64(i), Value: make([]byte, valueSize)}
+	}
+	return ans
+}
+
 func getDummyCommitlogEntriesForMultipleTags() []commitlog.Entry {
 	expiresAt := utils.GetNowMillis() + 100000
 	ans := make([]commitlog.Entry, 5)
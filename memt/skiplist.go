@@ -0,0 +1,358 @@
+package memt
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sync/atomic"
+	"unsafe"
+)
+
+// MinArenaSize is the arena a tag starts with; it grows geometrically as entries come in.
+const MinArenaSize = 128
+
+const (
+	skiplistMaxHeight = 16
+	nodeHeaderSize    = 16 // ts uint64, value offset uint32, height uint32
+	valueHeaderSize   = 12 // expiresAt uint64, length uint32
+	nilOffset         = 0
+)
+
+// skiplist keeps entries of a tag in a single arena, so a point costs no allocation of its own.
+// It is written by one writer at a time and read without locks: nodes and values never change once
+// linked, except next pointers and the value offset of a node, which are swapped atomically.
+// Removed nodes are unlinked but stay in the arena, so that readers standing on them can still move on;
+// the space is reclaimed when the writer runs out of arena and copies live entries into a new skiplist.
+type skiplist struct {
+	length  int64
+	height  int32
+	arena   []byte
+	used    uint32
+	garbage uint32
+	head    uint32
+	random  *rand.Rand
+}
+
+func newSkiplist(arenaSize uint32) *skiplist {
+	s := &skiplist{arena: make([]byte, arenaSize), used: 8, height: 1, random: rand.New(rand.NewSource(rand.Int63()))}
+	s.head = s.allocNode(0, skiplistMaxHeight)
+	return s
+}
+
+func nodeSize(height int) uint32 {
+	return uint32(nodeHeaderSize + 4*height)
+}
+
+func valueSize(length int) uint32 {
+	return align4(uint32(valueHeaderSize + length))
+}
+
+func align4(size uint32) uint32 {
+	return (size + 3) &^ 3
+}
+
+func (s *skiplist) fits(height int, length int) bool {
+	return uint64(s.used)+uint64(nodeSize(height))+uint64(valueSize(length)) <= uint64(len(s.arena))
+}
+
+func (s *skiplist) liveBytes() uint32 {
+	return s.used - s.garbage
+}
+
+// sparse tells if the arena is worth shrinking, being mostly unused or garbage.
+func (s *skiplist) sparse() bool {
+	return (len(s.arena) > MinArenaSize) && (4*uint64(s.liveBytes()) <= uint64(len(s.arena)))
+}
+
+func (s *skiplist) alloc(size uint32) uint32 {
+	offset := s.used
+	s.used += size
+	return offset
+}
+
+func (s *skiplist) allocNode(ts uint64, height int) uint32 {
+	offset := s.alloc(nodeSize(height))
+	binary.LittleEndian.PutUint64(s.arena[offset:], ts)
+	binary.LittleEndian.PutUint32(s.arena[offset+12:], uint32(height))
+	return offset
+}
+
+func (s *skiplist) allocValue(expiresAt uint64, value []byte) uint32 {
+	offset := s.alloc(valueSize(len(value)))
+	binary.LittleEndian.PutUint64(s.arena[offset:], expiresAt)
+	binary.LittleEndian.PutUint32(s.arena[offset+8:], uint32(len(value)))
+	copy(s.arena[offset+valueHeaderSize:], value)
+	return offset
+}
+
+func (s *skiplist) atomicAt(offset uint32) *uint32 {
+	return (*uint32)(unsafe.Pointer(&s.arena[offset]))
+}
+
+func (s *skiplist) ts(node uint32) uint64 {
+	return binary.LittleEndian.Uint64(s.arena[node:])
+}
+
+func (s *skiplist) nodeHeight(node uint32) int {
+	return int(binary.LittleEndian.Uint32(s.arena[node+12:]))
+}
+
+// valueOf returns nilOffset once the node was removed.
+func (s *skiplist) valueOf(node uint32) uint32 {
+	return atomic.LoadUint32(s.atomicAt(node + 8))
+}
+
+func (s *skiplist) setValueOf(node uint32, value uint32) {
+	atomic.StoreUint32(s.atomicAt(node+8), value)
+}
+
+func (s *skiplist) next(node uint32, level int) uint32 {
+	return atomic.LoadUint32(s.atomicAt(node + nodeHeaderSize + 4*uint32(level)))
+}
+
+func (s *skiplist) setNext(node uint32, level int, next uint32) {
+	atomic.StoreUint32(s.atomicAt(node+nodeHeaderSize+4*uint32(level)), next)
+}
+
+// entry aliases the arena; values are never overwritten in place, so the slice stays valid.
+func (s *skiplist) entry(node uint32, value uint32) Entry {
+	length := binary.LittleEndian.Uint32(s.arena[value+8:])
+	start := value + valueHeaderSize
+	return Entry{
+		Timestamp: s.ts(node),
+		ExpiresAt: binary.LittleEndian.Uint64(s.arena[value:]),
+		Value:     s.arena[start : start+length : start+length],
+	}
+}
+
+func (s *skiplist) len() int {
+	return int(atomic.LoadInt64(&s.length))
+}
+
+func (s *skiplist) randomHeight() int {
+	height := 1
+	for (height < skiplistMaxHeight) && (s.random.Intn(4) == 0) {
+		height++
+	}
+	return height
+}
+
+// findGreaterOrEqual returns the first node with ts not less than the given one, filling preds if not nil.
+func (s *skiplist) findGreaterOrEqual(ts uint64, preds *[skiplistMaxHeight]uint32) uint32 {
+	node := s.head
+	for level := int(atomic.LoadInt32(&s.height)) - 1; level >= 0; level-- {
+		next := s.next(node, level)
+		for (next != nilOffset) && (s.ts(next) < ts) {
+			node = next
+			next = s.next(node, level)
+		}
+		if preds != nil {
+			preds[level] = node
+		}
+	}
+	return s.next(node, 0)
+}
+
+// findLess returns the last node with ts less than the given one, or nilOffset.
+func (s *skiplist) findLess(ts uint64) uint32 {
+	return s.findLast(func(nodeTs uint64) bool {
+		return nodeTs < ts
+	})
+}
+
+func (s *skiplist) findLessOrEqual(ts uint64) uint32 {
+	return s.findLast(func(nodeTs uint64) bool {
+		return nodeTs <= ts
+	})
+}
+
+func (s *skiplist) findLast(before func(uint64) bool) uint32 {
+	node := s.head
+	for level := int(atomic.LoadInt32(&s.height)) - 1; level >= 0; level-- {
+		next := s.next(node, level)
+		for (next != nilOffset) && before(s.ts(next)) {
+			node = next
+			next = s.next(node, level)
+		}
+	}
+	if node == s.head {
+		return nilOffset
+	}
+	return node
+}
+
+// put inserts or replaces the entry, returning the replaced entry if there was one;
+// ok is false if the arena has no room left, in which case nothing was changed.
+func (s *skiplist) put(ts uint64, expiresAt uint64, value []byte) (replaced Entry, existed bool, ok bool) {
+	var preds [skiplistMaxHeight]uint32
+	node := s.findGreaterOrEqual(ts, &preds)
+	if (node != nilOffset) && (s.ts(node) == ts) {
+		if !s.fits(0, len(value)) {
+			return Entry{}, false, false
+		}
+		oldValue := s.valueOf(node)
+		replaced = s.entry(node, oldValue)
+		s.setValueOf(node, s.allocValue(expiresAt, value))
+		s.garbage += valueSize(len(replaced.Value))
+		return replaced, true, true
+	}
+
+	height := s.randomHeight()
+	if !s.fits(height, len(value)) {
+		return Entry{}, false, false
+	}
+	node = s.allocNode(ts, height)
+	s.setValueOf(node, s.allocValue(expiresAt, value))
+	listHeight := int(atomic.LoadInt32(&s.height))
+	for level := listHeight; level < height; level++ {
+		preds[level] = s.head
+	}
+	if height > listHeight {
+		atomic.StoreInt32(&s.height, int32(height))
+	}
+	for level := 0; level < height; level++ {
+		s.setNext(node, level, s.next(preds[level], level))
+		s.setNext(preds[level], level, node)
+	}
+	atomic.AddInt64(&s.length, 1)
+	return Entry{}, false, true
+}
+
+func (s *skiplist) remove(ts uint64) (Entry, bool) {
+	var preds [skiplistMaxHeight]uint32
+	node := s.findGreaterOrEqual(ts, &preds)
+	if (node == nilOffset) || (s.ts(node) != ts) {
+		return Entry{}, false
+	}
+	return s.unlink(node, &preds), true
+}
+
+func (s *skiplist) removeMin() (Entry, bool) {
+	node := s.next(s.head, 0)
+	if node == nilOffset {
+		return Entry{}, false
+	}
+	var preds [skiplistMaxHeight]uint32
+	for level := range preds {
+		preds[level] = s.head
+	}
+	return s.unlink(node, &preds), true
+}
+
+func (s *skiplist) unlink(node uint32, preds *[skiplistMaxHeight]uint32) Entry {
+	value := s.valueOf(node)
+	removed := s.entry(node, value)
+	s.setValueOf(node, nilOffset)
+	height := s.nodeHeight(node)
+	for level := height - 1; level >= 0; level-- {
+		if s.next(preds[level], level) == node {
+			s.setNext(preds[level], level, s.next(node, level))
+		}
+	}
+	s.garbage += nodeSize(height) + valueSize(len(removed.Value))
+	atomic.AddInt64(&s.length, -1)
+	return removed
+}
+
+// ascend calls receiver for live entries in [fromTs, toTs] in ascending order until it returns false.
+func (s *skiplist) ascend(fromTs uint64, toTs uint64, receiver func(Entry) bool) {
+	for node := s.findGreaterOrEqual(fromTs, nil); (node != nilOffset) && (s.ts(node) <= toTs); node = s.next(node, 0) {
+		value := s.valueOf(node)
+		if value == nilOffset {
+			continue
+		}
+		if !receiver(s.entry(node, value)) {
+			return
+		}
+	}
+}
+
+// descend calls receiver for live entries in [fromTs, toTs] newest first until it returns false;
+// as nodes only link forward, every step is a search from the head.
+func (s *skiplist) descend(fromTs uint64, toTs uint64, receiver func(Entry) bool) {
+	for node := s.findLessOrEqual(toTs); (node != nilOffset) && (s.ts(node) >= fromTs); node = s.findLess(s.ts(node)) {
+		value := s.valueOf(node)
+		if value == nilOffset {
+			continue
+		}
+		if !receiver(s.entry(node, value)) {
+			return
+		}
+	}
+}
+
+func (s *skiplist) get(ts uint64) (Entry, bool) {
+	node := s.findGreaterOrEqual(ts, nil)
+	if (node == nilOffset) || (s.ts(node) != ts) {
+		return Entry{}, false
+	}
+	value := s.valueOf(node)
+	if value == nilOffset {
+		return Entry{}, false
+	}
+	return s.entry(node, value), true
+}
+
+func (s *skiplist) min() (Entry, bool) {
+	ans, found := Entry{}, false
+	s.ascend(0, ^uint64(0), func(e Entry) bool {
+		ans, found = e, true
+		return false
+	})
+	return ans, found
+}
+
+func (s *skiplist) max() (Entry, bool) {
+	ans, found := Entry{}, false
+	s.descend(0, ^uint64(0), func(e Entry) bool {
+		ans, found = e, true
+		return false
+	})
+	return ans, found
+}
+
+// compacted copies live entries into a new skiplist with room for at least extra more bytes.
+func (s *skiplist) compacted(extra uint32) *skiplist {
+	return s.compactedInto(compactedArenaSize(s.liveBytes() + extra))
+}
+
+// compactedInto copies live entries into a new skiplist with an arena of size bytes, which must hold liveBytes;
+// nodes keep their height, so that the copy takes exactly liveBytes.
+func (s *skiplist) compactedInto(size uint32) *skiplist {
+	ans := newSkiplist(size)
+	var last [skiplistMaxHeight]uint32
+	for level := range last {
+		last[level] = ans.head
+	}
+	height := 1
+	for node := s.next(s.head, 0); node != nilOffset; node = s.next(node, 0) {
+		e := s.entry(node, s.valueOf(node))
+		nodeHeight := s.nodeHeight(node)
+		copied := ans.allocNode(e.Timestamp, nodeHeight)
+		ans.setValueOf(copied, ans.allocValue(e.ExpiresAt, e.Value))
+		for level := 0; level < nodeHeight; level++ {
+			ans.setNext(last[level], level, copied)
+			last[level] = copied
+		}
+		if nodeHeight > height {
+			height = nodeHeight
+		}
+	}
+	ans.height = int32(height)
+	ans.length = int64(s.len())
+	return ans
+}
+
+func compactedArenaSize(liveBytes uint32) uint32 {
+	if 2*liveBytes < MinArenaSize {
+		return MinArenaSize
+	}
+	return 2 * liveBytes
+}
+
+// evictedArenaSize leaves no room to grow, as a tag evicted from is the least likely to be written to.
+func evictedArenaSize(liveBytes uint32) uint32 {
+	if liveBytes < MinArenaSize {
+		return MinArenaSize
+	}
+	return liveBytes
+}
@@ -0,0 +1,129 @@
+package memt
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkiplist_MatchesSortedModel(t *testing.T) {
+	//given
+	s := newSkiplist(1024)
+	model := make(map[uint64]byte)
+	random := rand.New(rand.NewSource(42))
+
+	//when
+	for i := 0; i < 20000; i++ {
+		ts := uint64(random.Intn(500))
+		switch random.Intn(4) {
+		case 0:
+			_, existed := s.remove(ts)
+			_, inModel := model[ts]
+			assert.Equal(t, inModel, existed, "remove disagrees with model")
+			delete(model, ts)
+		case 1:
+			removed, existed := s.removeMin()
+			if existed {
+				assert.Equal(t, model[removed.Timestamp], removed.Value[0])
+				delete(model, removed.Timestamp)
+			} else {
+				assert.Equal(t, 0, len(model))
+			}
+		default:
+			value := []byte{byte(random.Intn(256))}
+			_, _, ok := s.put(ts, 0, value)
+			if !ok {
+				s = s.compacted(nodeSize(skiplistMaxHeight) + valueSize(1))
+				s.put(ts, 0, value)
+			}
+			model[ts] = value[0]
+		}
+	}
+
+	//then
+	expected := make([]uint64, 0, len(model))
+	for ts := range model {
+		expected = append(expected, ts)
+	}
+	sort.Slice(expected, func(i, j int) bool {
+		return expected[i] < expected[j]
+	})
+	actual := make([]uint64, 0, len(model))
+	s.ascend(0, ^uint64(0), func(e Entry) bool {
+		assert.Equal(t, model[e.Timestamp], e.Value[0], "value disagrees with model")
+		actual = append(actual, e.Timestamp)
+		return true
+	})
+	assert.Equal(t, expected, actual)
+	assert.Equal(t, len(model), s.len())
+
+	descending := make([]uint64, 0, len(model))
+	s.descend(100, 300, func(e Entry) bool {
+		descending = append(descending, e.Timestamp)
+		return true
+	})
+	for i := 1; i < len(descending); i++ {
+		assert.Less(t, descending[i], descending[i-1], "descending walk is not sorted")
+	}
+	for _, ts := range descending {
+		assert.GreaterOrEqual(t, ts, uint64(100))
+		assert.LessOrEqual(t, ts, uint64(300))
+	}
+}
+
+func TestMemTforTag_ReadersDoNotBlockOnWriter(t *testing.T) {
+	//given
+	mt := MemTforTag{Tag: "tagZero", MaxEntriesCount: 100}
+	mt.InitStorage()
+
+	//when
+	var wg sync.WaitGroup
+	wg.Add(5)
+	go func() {
+		defer wg.Done()
+		for ts := uint64(1); ts <= 20000; ts++ {
+			mt.MergeWithCommitlog(getSizedCommitlogEntries("tagZero", ts, 1, 32))
+		}
+	}()
+	for r := 0; r < 4; r++ {
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				entries := mt.RetrieveAll()
+				for j := 1; j < len(entries); j++ {
+					assert.Less(t, entries[j-1].Timestamp, entries[j].Timestamp, "reader saw unsorted entries")
+				}
+				mt.Availability()
+			}
+		}()
+	}
+	wg.Wait()
+
+	//then
+	from, to := mt.Availability()
+	assert.Equal(t, 100, mt.Len())
+	assert.Equal(t, uint64(19901), from)
+	assert.Equal(t, uint64(20000), to)
+	assert.Equal(t, int64(len("tagZero")+len(mt.skiplist().arena)), mt.Bytes(), "arena capacity is not accounted")
+}
+
+func TestMemTForTag_ArenaShrinksOnceEntriesAreRemoved(t *testing.T) {
+	//given
+	mt := MemTforTag{Tag: "tagZero"}
+	mt.InitStorage()
+	mt.MergeWithCommitlog(getSizedCommitlogEntries("tagZero", 1000, 100, 24))
+	grown := mt.Bytes()
+
+	//when
+	for mt.EvictOldest() != 0 {
+	}
+
+	//then
+	assert.Less(t, int64(7+MinArenaSize), grown)
+	assert.Equal(t, 0, mt.Len())
+	assert.Less(t, mt.Bytes(), int64(7+4*MinArenaSize), "arena of evicted entries is still accounted")
+	assert.Equal(t, int64(7+len(mt.skiplist().arena)), mt.Bytes())
+}
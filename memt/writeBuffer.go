@@ -0,0 +1,188 @@
+package memt
+
+import (
+	"bytes"
+	"lsmstore/commitlog"
+	"sort"
+	"sync"
+)
+
+// WriteBuffer holds what was written but not yet flushed to SST, so it stays readable whatever the
+// cache policy of the Manager evicts. Entries are dropped once flushed, unless overwritten meanwhile,
+// and a tag left without entries is dropped along with them.
+//
+// Adding and removing hold mutex throughout, so that a tag is never dropped while entries are added to it.
+type WriteBuffer struct {
+	bufferForTag map[string]*TagBuffer
+	mutex        *sync.Mutex
+}
+
+// TagBuffer keeps the unflushed entries of a tag sorted by timestamp. Writes mostly come in timestamp order,
+// so they are appended, and a flush removes its entries in a single pass.
+type TagBuffer struct {
+	entries []Entry
+	mutex   *sync.RWMutex
+}
+
+func (wb *WriteBuffer) Init() {
+	wb.bufferForTag = make(map[string]*TagBuffer)
+	wb.mutex = &sync.Mutex{}
+}
+
+func (wb *WriteBuffer) Add(entries []commitlog.Entry) {
+	wb.mutex.Lock()
+	defer wb.mutex.Unlock()
+	for tag, entriesForTag := range groupByTag(entries) {
+		buffer, exists := wb.bufferForTag[tag]
+		if !exists {
+			buffer = &TagBuffer{mutex: &sync.RWMutex{}}
+			wb.bufferForTag[tag] = buffer
+		}
+		buffer.add(entriesForTag)
+	}
+}
+
+func (wb *WriteBuffer) RemoveFlushed(entries []commitlog.Entry) {
+	wb.mutex.Lock()
+	defer wb.mutex.Unlock()
+	for tag, entriesForTag := range groupByTag(entries) {
+		if buffer, exists := wb.bufferForTag[tag]; exists && (buffer.removeUnchanged(entriesForTag) == 0) {
+			delete(wb.bufferForTag, tag)
+		}
+	}
+}
+
+func (wb *WriteBuffer) ExistingBufferForTag(tag string) (*TagBuffer, bool) {
+	wb.mutex.Lock()
+	defer wb.mutex.Unlock()
+	buffer, exists := wb.bufferForTag[tag]
+	return buffer, exists
+}
+
+func (wb *WriteBuffer) GetTags() []string {
+	wb.mutex.Lock()
+	defer wb.mutex.Unlock()
+	ans := make([]string, 0, len(wb.bufferForTag))
+	for tag := range wb.bufferForTag {
+		ans = append(ans, tag)
+	}
+	return ans
+}
+
+func (wb *WriteBuffer) Len() int {
+	wb.mutex.Lock()
+	defer wb.mutex.Unlock()
+	ans := 0
+	for _, buffer := range wb.bufferForTag {
+		ans += buffer.Len()
+	}
+	return ans
+}
+
+func (tb *TagBuffer) add(entries []commitlog.Entry) {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	for _, e := range entries {
+		entry := Entry{Timestamp: e.Timestamp, ExpiresAt: e.ExpiresAt, Value: e.Value}
+		n := len(tb.entries)
+		if (n == 0) || (tb.entries[n-1].Timestamp < e.Timestamp) {
+			tb.entries = append(tb.entries, entry)
+			continue
+		}
+		i := tb.search(e.Timestamp)
+		if tb.entries[i].Timestamp == e.Timestamp {
+			tb.entries[i] = entry
+			continue
+		}
+		tb.entries = append(tb.entries, Entry{})
+		copy(tb.entries[i+1:], tb.entries[i:])
+		tb.entries[i] = entry
+	}
+}
+
+// removeUnchanged drops the entries still holding what was flushed, returning how many are left. Readers get
+// copies, so the remaining entries are moved within the same array, which is reallocated once mostly empty.
+func (tb *TagBuffer) removeUnchanged(flushed []commitlog.Entry) int {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	//a timestamp flushed twice is left with the later value
+	flushedByTs := make(map[uint64]commitlog.Entry, len(flushed))
+	for _, e := range flushed {
+		flushedByTs[e.Timestamp] = e
+	}
+	kept := tb.entries[:0]
+	for _, e := range tb.entries {
+		f, wasFlushed := flushedByTs[e.Timestamp]
+		if wasFlushed && (f.ExpiresAt == e.ExpiresAt) && bytes.Equal(f.Value, e.Value) {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	for i := len(kept); i < len(tb.entries); i++ {
+		tb.entries[i] = Entry{}
+	}
+	if 4*len(kept) <= cap(tb.entries) {
+		kept = append(make([]Entry, 0, 2*len(kept)), kept...)
+	}
+	tb.entries = kept
+	return len(kept)
+}
+
+// search returns the index of the first entry not older than timestamp; mutex must be held.
+func (tb *TagBuffer) search(timestamp uint64) int {
+	return sort.Search(len(tb.entries), func(i int) bool {
+		return tb.entries[i].Timestamp >= timestamp
+	})
+}
+
+func (tb *TagBuffer) RetrieveAll() []Entry {
+	return tb.Retrieve(0, ^uint64(0))
+}
+
+func (tb *TagBuffer) Availability() (uint64, uint64) {
+	tb.mutex.RLock()
+	defer tb.mutex.RUnlock()
+	if len(tb.entries) == 0 {
+		return 0, 0
+	}
+	return tb.entries[0].Timestamp, tb.entries[len(tb.entries)-1].Timestamp
+}
+
+func (tb *TagBuffer) Len() int {
+	tb.mutex.RLock()
+	defer tb.mutex.RUnlock()
+	return len(tb.entries)
+}
+
+// Retrieve returns entries in [fromTs, toTs] in ascending order.
+func (tb *TagBuffer) Retrieve(fromTs uint64, toTs uint64) []Entry {
+	tb.mutex.RLock()
+	defer tb.mutex.RUnlock()
+	return append([]Entry{}, tb.entries[tb.search(fromTs):tb.end(toTs)]...)
+}
+
+func (tb *TagBuffer) RetrieveDescending(fromTs uint64, toTs uint64) []Entry {
+	ans := tb.Retrieve(fromTs, toTs)
+	for i, j := 0, len(ans)-1; i < j; i, j = i+1, j-1 {
+		ans[i], ans[j] = ans[j], ans[i]
+	}
+	return ans
+}
+
+// LastN returns up to n newest entries in ascending order.
+func (tb *TagBuffer) LastN(n int) []Entry {
+	tb.mutex.RLock()
+	defer tb.mutex.RUnlock()
+	start := len(tb.entries) - n
+	if start < 0 {
+		start = 0
+	}
+	return append([]Entry{}, tb.entries[start:]...)
+}
+
+// end returns the index past the last entry not newer than timestamp; mutex must be held.
+func (tb *TagBuffer) end(timestamp uint64) int {
+	return sort.Search(len(tb.entries), func(i int) bool {
+		return tb.entries[i].Timestamp > timestamp
+	})
+}
@@ -0,0 +1,280 @@
+package promremote
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative remote.proto
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"lsmstore/dto"
+	"lsmstore/schema"
+	"lsmstore/series"
+	"lsmstore/store"
+	"net/http"
+	"sort"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/proto"
+)
+
+const MaxRequestBytes = 32 * 1024 * 1024
+
+// DefaultReadSampleLimit bounds the samples of a remote_read request as Prometheus does by default.
+const DefaultReadSampleLimit = 50000000
+
+// MetricNameLabel carries the metric name among Prometheus labels; the series index keeps it apart as Metric.
+const MetricNameLabel = "__name__"
+
+// WriteHandler receives Prometheus remote_write requests and stores every sample under the key of its series,
+// as a float64 encoded by schema.EncodeFloat64. Valid series of a request are stored even if some are rejected,
+// in which case it answers 400, so that Prometheus does not resend the batch. A write failing on the disk is
+// answered with 503, which Prometheus retries.
+func WriteHandler(writer *store.StorageWriter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req WriteRequest
+		if err := readSnappyProto(w, r, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		measurements, rejected := ToSeriesMeasurements(&req)
+		if len(measurements) > 0 {
+			if err := writer.StoreSeries(measurements, 0); store.IsValidationError(err) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		if rejected != nil {
+			http.Error(w, rejected.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// ToSeriesMeasurements converts samples of all valid series; rejected reports the first invalid one, if any.
+func ToSeriesMeasurements(req *WriteRequest) (measurements []dto.SeriesMeasurement, rejected error) {
+	measurements = make([]dto.SeriesMeasurement, 0)
+	for _, ts := range req.Timeseries {
+		metric, labels := splitLabels(ts.Labels)
+		tag := series.BuildTag(metric, labels)
+		err := series.Validate(metric, labels)
+		converted := make([]dto.SeriesMeasurement, 0, len(ts.Samples))
+		for _, s := range ts.Samples {
+			if (err == nil) && (s.Timestamp <= 0) {
+				err = fmt.Errorf("sample at %d is not after the epoch", s.Timestamp)
+			}
+			m := dto.SeriesMeasurement{Metric: metric, Labels: labels, Timestamp: uint64(s.Timestamp), Value: schema.EncodeFloat64(s.Value)}
+			if err == nil {
+				err = store.ValidateBatch([]dto.TaggedMeasurement{{Tag: tag, Timestamp: m.Timestamp, Value: m.Value}})
+			}
+			converted = append(converted, m)
+		}
+		if err != nil {
+			if rejected == nil {
+				rejected = fmt.Errorf("series %s: %v", tag, err)
+			}
+			continue
+		}
+		measurements = append(measurements, converted...)
+	}
+	return measurements, rejected
+}
+
+func splitLabels(promLabels []*Label) (string, []dto.Label) {
+	metric := ""
+	labels := make([]dto.Label, 0, len(promLabels))
+	for _, l := range promLabels {
+		if l.Name == MetricNameLabel {
+			metric = l.Value
+		} else {
+			labels = append(labels, dto.Label{Name: l.Name, Value: l.Value})
+		}
+	}
+	return metric, labels
+}
+
+// ReadHandler answers Prometheus remote_read requests with raw samples of every series matching each query.
+// Values are decoded as numbers according to the catalog, values that are not numbers are skipped.
+func ReadHandler(reader *store.StorageReader) http.Handler {
+	return ReadHandlerWithSampleLimit(reader, DefaultReadSampleLimit)
+}
+
+// ReadHandlerWithSampleLimit is ReadHandler failing a request with 400 once its queries read more than sampleLimit
+// samples, as they are held in memory until answered; 0 sets no limit.
+func ReadHandlerWithSampleLimit(reader *store.StorageReader, sampleLimit int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req ReadRequest
+		if err := readSnappyProto(w, r, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !acceptsSamples(&req) {
+			http.Error(w, "only the SAMPLES response type is supported", http.StatusBadRequest)
+			return
+		}
+		if reader.Series == nil {
+			http.Error(w, "series index is not configured", http.StatusInternalServerError)
+			return
+		}
+		resp := &ReadResponse{Results: make([]*QueryResult, len(req.Queries))}
+		samplesLeft := sampleLimit
+		if sampleLimit == 0 {
+			samplesLeft = int(^uint(0) >> 1)
+		}
+		for i, q := range req.Queries {
+			result, err := runQuery(reader, q, &samplesLeft)
+			if err == errSampleLimitExceeded {
+				err = fmt.Errorf("exceeded sample limit (%d)", sampleLimit)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			resp.Results[i] = result
+		}
+		encoded, err := proto.Marshal(resp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Header().Set("Content-Encoding", "snappy")
+		w.Write(snappy.Encode(nil, encoded))
+	})
+}
+
+func acceptsSamples(req *ReadRequest) bool {
+	if len(req.AcceptedResponseTypes) == 0 {
+		return true
+	}
+	for _, t := range req.AcceptedResponseTypes {
+		if t == ReadRequest_SAMPLES {
+			return true
+		}
+	}
+	return false
+}
+
+var errSampleLimitExceeded = errors.New("sample limit exceeded")
+
+// runQuery reads at most samplesLeft samples, which it decreases, failing with errSampleLimitExceeded on the next one.
+func runQuery(reader *store.StorageReader, q *Query, samplesLeft *int) (*QueryResult, error) {
+	matchers, err := ToMatchers(q.Matchers)
+	if err != nil {
+		return nil, err
+	}
+	result := &QueryResult{Timeseries: make([]*TimeSeries, 0)}
+	if (q.EndTimestampMs < q.StartTimestampMs) || (q.EndTimestampMs <= 0) {
+		return result, nil
+	}
+	from := uint64(0)
+	if q.StartTimestampMs > 0 {
+		from = uint64(q.StartTimestampMs)
+	}
+	for _, s := range reader.Series.Select(matchers) {
+		valueType := schema.Untyped
+		if reader.Catalog != nil {
+			valueType = reader.Catalog.TypeOf(s.Tag)
+		}
+		samples := make([]*Sample, 0)
+		exceeded := false
+		reader.Iterate(s.Tag, from, uint64(q.EndTimestampMs), func(m dto.Measurement) bool {
+			v, err := schema.DecodeNumeric(valueType, m.Value)
+			if err != nil {
+				return true
+			}
+			if *samplesLeft == 0 {
+				exceeded = true
+				return false
+			}
+			*samplesLeft--
+			samples = append(samples, &Sample{Value: v, Timestamp: int64(m.Timestamp)})
+			return true
+		})
+		if exceeded {
+			return nil, errSampleLimitExceeded
+		}
+		if len(samples) > 0 {
+			result.Timeseries = append(result.Timeseries, &TimeSeries{Labels: promLabels(s), Samples: samples})
+		}
+	}
+	return result, nil
+}
+
+// ToMatchers translates Prometheus label matchers, naming the metric as the series index does.
+func ToMatchers(promMatchers []*LabelMatcher) ([]series.Matcher, error) {
+	ans := make([]series.Matcher, len(promMatchers))
+	for i, pm := range promMatchers {
+		name := pm.Name
+		if name == MetricNameLabel {
+			name = series.MetricLabel
+		}
+		var t series.MatchType
+		switch pm.Type {
+		case LabelMatcher_EQ:
+			t = series.MatchEqual
+		case LabelMatcher_NEQ:
+			t = series.MatchNotEqual
+		case LabelMatcher_RE:
+			t = series.MatchRegexp
+		case LabelMatcher_NRE:
+			t = series.MatchNotRegexp
+		default:
+			return nil, fmt.Errorf("unknown matcher type %d", pm.Type)
+		}
+		m, err := series.NewMatcher(name, t, pm.Value)
+		if err != nil {
+			return nil, err
+		}
+		ans[i] = m
+	}
+	return ans, nil
+}
+
+// promLabels returns labels of the series sorted by name, as Prometheus expects them.
+func promLabels(s *series.Series) []*Label {
+	ans := make([]*Label, 0, len(s.Labels)+1)
+	ans = append(ans, &Label{Name: MetricNameLabel, Value: s.Metric})
+	for _, l := range s.Labels {
+		ans = append(ans, &Label{Name: l.Name, Value: l.Value})
+	}
+	sort.Slice(ans, func(i, j int) bool {
+		return ans[i].Name < ans[j].Name
+	})
+	return ans
+}
+
+func readSnappyProto(w http.ResponseWriter, r *http.Request, into proto.Message) error {
+	compressed, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxRequestBytes))
+	if err != nil {
+		return err
+	}
+	decodedLen, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		return err
+	}
+	if decodedLen > MaxRequestBytes {
+		return errors.New("request too large")
+	}
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return err
+	}
+	if err := proto.Unmarshal(data, into); err != nil {
+		return err
+	}
+	return nil
+}
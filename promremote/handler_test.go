@@ -0,0 +1,200 @@
+package promremote
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"lsmstore/dto"
+	"lsmstore/schema"
+	"lsmstore/store"
+	"lsmstore/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestWriteHandler_StoresRecordedRequest(t *testing.T) {
+	//given
+	reader, writer := newTestStorage()
+	body := readFixture(t, "write_request.snappy")
+
+	//when
+	rec := post(WriteHandler(writer), body)
+
+	//then
+	assert.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+	stored, err := reader.RetrieveMatching(`metric="http_requests_total", job="api"`, 0, 1800000000000)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]dto.Measurement{
+		`http_requests_total{instance="a:9090",job="api"}`: {
+			{Timestamp: 1700000000000, Value: schema.EncodeFloat64(1.5)},
+			{Timestamp: 1700000015000, Value: schema.EncodeFloat64(2.5)},
+		},
+	}, stored)
+	up, err := reader.RetrieveMatching(`metric="up"`, 0, 1800000000000)
+	assert.Nil(t, err)
+	assert.Equal(t, []dto.Measurement{{Timestamp: 1700000000000, Value: schema.EncodeFloat64(1)}}, up[`up{instance="a:9090",job="api"}`])
+}
+
+func TestReadHandler_AnswersRecordedRequest(t *testing.T) {
+	//given
+	reader, writer := newTestStorage()
+	post(WriteHandler(writer), readFixture(t, "write_request.snappy"))
+
+	//when
+	rec := post(ReadHandler(reader), readFixture(t, "read_request.snappy"))
+
+	//then
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "snappy", rec.Header().Get("Content-Encoding"))
+	data, err := snappy.Decode(nil, rec.Body.Bytes())
+	assert.Nil(t, err)
+	var resp ReadResponse
+	assert.Nil(t, proto.Unmarshal(data, &resp))
+	assert.Equal(t, 1, len(resp.Results))
+	assert.Equal(t, 1, len(resp.Results[0].Timeseries), "up does not match the name and 2.5 is after the end")
+	ts := resp.Results[0].Timeseries[0]
+	assert.Equal(t, []string{"__name__=http_requests_total", "instance=a:9090", "job=api"}, labelStrings(ts.Labels))
+	assert.Equal(t, 1, len(ts.Samples))
+	assert.Equal(t, 1.5, ts.Samples[0].Value)
+	assert.Equal(t, int64(1700000000000), ts.Samples[0].Timestamp)
+}
+
+func TestReadHandler_FailsRequestsOverSampleLimit(t *testing.T) {
+	//given
+	reader, writer := newTestStorage()
+	write := &WriteRequest{}
+	for _, job := range []string{"api", "db"} {
+		samples := []*Sample{{Value: 1, Timestamp: 1000}, {Value: 2, Timestamp: 2000}, {Value: 3, Timestamp: 3000}}
+		write.Timeseries = append(write.Timeseries, &TimeSeries{Labels: []*Label{{Name: MetricNameLabel, Value: "up"}, {Name: "job", Value: job}}, Samples: samples})
+	}
+	assert.Equal(t, http.StatusNoContent, post(WriteHandler(writer), encode(t, write)).Code)
+	query := func(job string) *Query {
+		matchers := []*LabelMatcher{{Type: LabelMatcher_EQ, Name: MetricNameLabel, Value: "up"}, {Type: LabelMatcher_RE, Name: "job", Value: job}}
+		return &Query{StartTimestampMs: 1, EndTimestampMs: 5000, Matchers: matchers}
+	}
+	bothSeries := encode(t, &ReadRequest{Queries: []*Query{query("api|db")}})
+	bothQueries := encode(t, &ReadRequest{Queries: []*Query{query("api"), query("db")}})
+
+	//when
+	withinLimit := post(ReadHandlerWithSampleLimit(reader, 6), bothSeries)
+	unlimited := post(ReadHandlerWithSampleLimit(reader, 0), bothSeries)
+	overLimit := post(ReadHandlerWithSampleLimit(reader, 5), bothSeries)
+	overLimitTogether := post(ReadHandlerWithSampleLimit(reader, 5), bothQueries)
+
+	//then
+	assert.Equal(t, http.StatusOK, withinLimit.Code, withinLimit.Body.String())
+	assert.Equal(t, http.StatusOK, unlimited.Code, unlimited.Body.String())
+	assert.Equal(t, http.StatusBadRequest, overLimit.Code)
+	assert.Equal(t, "exceeded sample limit (5)\n", overLimit.Body.String())
+	assert.Equal(t, http.StatusBadRequest, overLimitTogether.Code, "limit applies to each query instead of the request")
+	data, err := snappy.Decode(nil, withinLimit.Body.Bytes())
+	assert.Nil(t, err)
+	var resp ReadResponse
+	assert.Nil(t, proto.Unmarshal(data, &resp))
+	assert.Equal(t, 2, len(resp.Results[0].Timeseries))
+}
+
+func TestWriteHandler_StoresValidSeriesOfPartlyInvalidRequest(t *testing.T) {
+	//given
+	reader, writer := newTestStorage()
+	req := &WriteRequest{Timeseries: []*TimeSeries{
+		{Labels: []*Label{{Name: "job", Value: "api"}}, Samples: []*Sample{{Value: 1, Timestamp: 1000}}},
+		{Labels: []*Label{{Name: MetricNameLabel, Value: "up"}, {Name: "metric", Value: "x"}}, Samples: []*Sample{{Value: 1, Timestamp: 1000}}},
+		{Labels: []*Label{{Name: MetricNameLabel, Value: "up"}}, Samples: []*Sample{{Value: 1, Timestamp: -5}}},
+		{Labels: []*Label{{Name: MetricNameLabel, Value: "up"}, {Name: "huge", Value: strings.Repeat("x", store.MaxMeasurementBytes)}}, Samples: []*Sample{{Value: 1, Timestamp: 1000}}},
+		{Labels: []*Label{{Name: MetricNameLabel, Value: "up"}, {Name: "job", Value: "api"}}, Samples: []*Sample{{Value: 7, Timestamp: 1000}}},
+	}}
+
+	//when
+	rec := post(WriteHandler(writer), encode(t, req))
+
+	//then
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	stored, err := reader.RetrieveMatching(`metric="up"`, 0, 2000)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]dto.Measurement{`up{job="api"}`: {{Timestamp: 1000, Value: schema.EncodeFloat64(7)}}}, stored)
+}
+
+func TestWriteHandler_WriteFailingOnDiskIsToBeRetried(t *testing.T) {
+	//given
+	_, writer := newTestStorage()
+	assert.Nil(t, writer.DiskWriter.ClManager.Close())
+	req := &WriteRequest{Timeseries: []*TimeSeries{
+		{Labels: []*Label{{Name: MetricNameLabel, Value: "up"}, {Name: "job", Value: "api"}}, Samples: []*Sample{{Value: 7, Timestamp: 1000}}},
+	}}
+
+	//when
+	rec := post(WriteHandler(writer), encode(t, req))
+
+	//then
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestHandlers_RejectInvalidPayloads(t *testing.T) {
+	//given
+	reader, writer := newTestStorage()
+	handlers := []http.Handler{WriteHandler(writer), ReadHandler(reader)}
+	notSnappy := []byte("definitely not snappy")
+	notProto := snappy.Encode(nil, []byte{0xff, 0xff, 0xff})
+	chunked := encode(t, &ReadRequest{AcceptedResponseTypes: []ReadRequest_ResponseType{ReadRequest_STREAMED_XOR_CHUNKS}})
+	badRegexp := encode(t, &ReadRequest{Queries: []*Query{{EndTimestampMs: 10, Matchers: []*LabelMatcher{{Type: LabelMatcher_RE, Name: "job", Value: "("}}}}})
+
+	for _, h := range handlers {
+		//when
+		get := httptest.NewRecorder()
+		h.ServeHTTP(get, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		//then
+		assert.Equal(t, http.StatusMethodNotAllowed, get.Code)
+		assert.Equal(t, http.StatusBadRequest, post(h, notSnappy).Code)
+		assert.Equal(t, http.StatusBadRequest, post(h, notProto).Code)
+	}
+	assert.Equal(t, http.StatusBadRequest, post(handlers[1], chunked).Code)
+	assert.Equal(t, http.StatusBadRequest, post(handlers[1], badRegexp).Code)
+}
+
+func newTestStorage() (*store.StorageReader, *store.StorageWriter) {
+	return store.InitStorageWithOptions(store.Options{
+		CommitlogPath:        fmt.Sprintf("/tmp/golsm_test/promremote/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		EntriesPerCommitlog:  1000,
+		PeriodBetweenFlushes: time.Hour,
+		SSTPath:              fmt.Sprintf("/tmp/golsm_test/promremote/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		MemtMaxEntriesPerTag: 10,
+	})
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile("testdata/" + name)
+	assert.Nil(t, err)
+	return data
+}
+
+func encode(t *testing.T, m proto.Message) []byte {
+	data, err := proto.Marshal(m)
+	assert.Nil(t, err)
+	return snappy.Encode(nil, data)
+}
+
+func post(h http.Handler, body []byte) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func labelStrings(labels []*Label) []string {
+	ans := make([]string, len(labels))
+	for i, l := range labels {
+		ans[i] = l.Name + "=" + l.Value
+	}
+	return ans
+}
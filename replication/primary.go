@@ -0,0 +1,212 @@
+package replication
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"lsmstore/commitlog"
+	"lsmstore/store"
+	"lsmstore/utils"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/jeanphorn/log4go"
+)
+
+// Primary serves the records written to DB to replicas, and checkpoints of DB for replicas to start from.
+type Primary struct {
+	DB          *store.DB
+	stop        chan struct{}
+	listener    net.Listener
+	checkpoints uint64
+	mutex       *sync.Mutex
+}
+
+func (p *Primary) Init() {
+	p.stop = make(chan struct{})
+	p.mutex = &sync.Mutex{}
+}
+
+// Serve accepts replicas on l until Close is called.
+func (p *Primary) Serve(l net.Listener) error {
+	p.mutex.Lock()
+	p.listener = l
+	p.mutex.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-p.stop:
+				return nil
+			default:
+				return err
+			}
+		}
+		go p.serve(conn)
+	}
+}
+
+// Close stops accepting replicas and disconnects those following.
+func (p *Primary) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	select {
+	case <-p.stop:
+		return
+	default:
+	}
+	close(p.stop)
+	if p.listener != nil {
+		p.listener.Close()
+	}
+}
+
+func (p *Primary) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	request, err := r.ReadByte()
+	if err != nil {
+		return
+	}
+	switch request {
+	case requestFollow:
+		from := make([]byte, 8)
+		if _, err := io.ReadFull(r, from); err != nil {
+			return
+		}
+		err = p.follow(r, w, binary.LittleEndian.Uint64(from))
+	case requestCheckpoint:
+		err = p.sendCheckpoint(w)
+	default:
+		err = fmt.Errorf("unknown request %q", request)
+	}
+	if err != nil {
+		log.Warn("replica %s: %v", conn.RemoteAddr(), err)
+		writeFrame(w, frameError, []byte(err.Error()))
+		w.Flush()
+	}
+}
+
+func (p *Primary) follow(r *bufio.Reader, w *bufio.Writer, from uint64) error {
+	stop := make(chan struct{})
+	disconnected := make(chan struct{})
+	go func() {
+		//a replica sends nothing after its request, so this returns once it is gone
+		r.ReadByte()
+		close(disconnected)
+	}()
+	go func() {
+		select {
+		case <-p.stop:
+		case <-disconnected:
+		}
+		close(stop)
+	}()
+
+	var seriesSent uint64
+	typesSent := 0
+	return p.DB.Follow(from, stop, func(records []commitlog.Record) error {
+		//series and types are registered before their points are written, so sent now they precede the records
+		if p.DB.Writer.Series != nil {
+			if created := p.DB.Writer.Series.Since(seriesSent); len(created) > 0 {
+				payload := make([]seriesRecord, len(created))
+				for i, s := range created {
+					payload[i] = seriesRecord{Metric: s.Metric, Labels: s.Labels}
+				}
+				if err := writeJSONFrame(w, frameSeries, payload); err != nil {
+					return err
+				}
+				seriesSent = created[len(created)-1].ID
+			}
+		}
+		if p.DB.Writer.Catalog != nil {
+			if types := p.DB.Writer.Catalog.Types(); len(types) != typesSent {
+				payload := make(map[string]string, len(types))
+				for tag, vt := range types {
+					payload[tag] = vt.String()
+				}
+				if err := writeJSONFrame(w, frameTypes, payload); err != nil {
+					return err
+				}
+				typesSent = len(types)
+			}
+		}
+		if err := writeFrame(w, frameRecords, encodeRecords(records)); err != nil {
+			return err
+		}
+		return w.Flush()
+	})
+}
+
+// sendCheckpoint removes the temporary checkpoint once its files are opened, before streaming them: until then,
+// the SSTs it links count as linked and are rewritten by every merge. As SSTs are only appended to until replaced,
+// each file is read up to its size in the manifest, which is what was checkpointed.
+func (p *Primary) sendCheckpoint(w *bufio.Writer) error {
+	dir := fmt.Sprintf("%s/.replica-%d-%d", p.DB.Reader.SSTManager.RootDir, utils.GetNowMillis(), atomic.AddUint64(&p.checkpoints, 1))
+	manifest, err := p.DB.Checkpoint(dir)
+	if err != nil {
+		return err
+	}
+	files := make([]*os.File, 0, len(manifest.Files))
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, f := range manifest.Files {
+		var file *os.File
+		if file, err = os.Open(dir + "/" + f.Path); err != nil {
+			break
+		}
+		files = append(files, file)
+	}
+	if removeErr := os.RemoveAll(dir); err == nil {
+		err = removeErr
+	}
+	if err != nil {
+		return err
+	}
+	for i, f := range manifest.Files {
+		if err := sendFile(w, io.NewSectionReader(files[i], 0, f.Bytes), f.Path); err != nil {
+			return err
+		}
+	}
+	if err := writeJSONFrame(w, frameManifest, manifest); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func sendFile(w *bufio.Writer, file io.Reader, path string) error {
+	chunk := make([]byte, checkpointChunkBytes)
+	var offset uint64
+	for {
+		n, err := io.ReadFull(file, chunk)
+		//an empty file is sent as one empty chunk, so the replica creates it
+		if (n > 0) || (offset == 0) {
+			if err := writeFrame(w, frameFile, encodeFileChunk(path, offset, chunk[:n])); err != nil {
+				return err
+			}
+			offset += uint64(n)
+		}
+		if (err == io.EOF) || (err == io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func writeJSONFrame(w *bufio.Writer, kind byte, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFrame(w, kind, payload)
+}
@@ -0,0 +1,123 @@
+package replication
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"lsmstore/commitlog"
+	"lsmstore/dto"
+	"lsmstore/utils"
+)
+
+// A replica opens a connection with a request: requestFollow and the sequence of the first record wanted as uint64, or
+// requestCheckpoint. The primary answers with frames of a kind, a uint32 length and a payload, all little endian.
+const (
+	requestFollow     = 'F'
+	requestCheckpoint = 'C'
+
+	// records, each as its sequence followed by the record as in the commitlog
+	frameRecords = 'R'
+	// JSON of the series created since the previous frame, sent before the records of the series
+	frameSeries = 'S'
+	// JSON of all value types by tag, sent whenever types were registered
+	frameTypes = 'T'
+	// chunk of a checkpoint file: path length as uint16, path, offset as uint64 and content
+	frameFile = 'D'
+	// JSON manifest, closing a checkpoint
+	frameManifest = 'M'
+	frameError    = 'E'
+)
+
+// maxFrameBytes allows a batch of store.FollowBatchSize records of the largest size.
+const maxFrameBytes = 128 << 20
+
+const checkpointChunkBytes = 1 << 20
+
+type seriesRecord struct {
+	Metric string      `json:"metric"`
+	Labels []dto.Label `json:"labels"`
+}
+
+func writeFrame(w *bufio.Writer, kind byte, payload []byte) error {
+	header := make([]byte, 5)
+	header[0] = kind
+	binary.LittleEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := binary.LittleEndian.Uint32(header[1:])
+	if length > maxFrameBytes {
+		return 0, nil, fmt.Errorf("frame of %d bytes exceeds %d", length, maxFrameBytes)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+func encodeRecords(records []commitlog.Record) []byte {
+	ans := make([]byte, 0)
+	sequence := make([]byte, 8)
+	for _, r := range records {
+		binary.LittleEndian.PutUint64(sequence, r.Sequence)
+		ans = append(ans, sequence...)
+		ans = append(ans, r.Entry.ToByteArrayWithLength()...)
+	}
+	return ans
+}
+
+func decodeRecords(payload []byte) ([]commitlog.Record, error) {
+	ans := make([]commitlog.Record, 0)
+	for len(payload) > 0 {
+		if len(payload) < 10 {
+			return nil, errors.New("truncated record")
+		}
+		sequence := binary.LittleEndian.Uint64(payload)
+		length := int(binary.LittleEndian.Uint16(payload[8:]))
+		if len(payload) < 10+length {
+			return nil, errors.New("truncated record")
+		}
+		record, err := utils.VerifiedPayloadOf(payload[10 : 10+length])
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %v", sequence, err)
+		}
+		if (len(record) < 18) || (int(binary.LittleEndian.Uint16(record))+18 > len(record)) {
+			return nil, fmt.Errorf("malformed record %d", sequence)
+		}
+		ans = append(ans, commitlog.Record{Sequence: sequence, Entry: commitlog.FromByteArray(record)})
+		payload = payload[10+length:]
+	}
+	return ans, nil
+}
+
+func encodeFileChunk(path string, offset uint64, chunk []byte) []byte {
+	ans := make([]byte, 2+len(path)+8, 2+len(path)+8+len(chunk))
+	binary.LittleEndian.PutUint16(ans, uint16(len(path)))
+	copy(ans[2:], path)
+	binary.LittleEndian.PutUint64(ans[2+len(path):], offset)
+	return append(ans, chunk...)
+}
+
+func decodeFileChunk(payload []byte) (string, uint64, []byte, error) {
+	if len(payload) < 2 {
+		return "", 0, nil, errors.New("truncated file chunk")
+	}
+	pathLen := int(binary.LittleEndian.Uint16(payload))
+	if len(payload) < 2+pathLen+8 {
+		return "", 0, nil, errors.New("truncated file chunk")
+	}
+	path := string(payload[2 : 2+pathLen])
+	return path, binary.LittleEndian.Uint64(payload[2+pathLen:]), payload[2+pathLen+8:], nil
+}
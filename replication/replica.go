@@ -0,0 +1,230 @@
+package replication
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"lsmstore/commitlog"
+	"lsmstore/schema"
+	"lsmstore/store"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// AppliedFile within the commitlog directory of a replica holds the sequence of the last record of the primary applied.
+const AppliedFile = "REPLICATED"
+
+// Replica applies the records a Primary serves to Writer through the same memtable and commitlog paths as any write.
+// Records are applied at least once: after a crash, the last batch may be applied again, which stores the same points.
+type Replica struct {
+	Writer    *store.StorageWriter
+	applied   uint64
+	statePath string
+}
+
+func (r *Replica) Init() error {
+	r.statePath = r.Writer.DiskWriter.ClManager.Path + "/" + AppliedFile
+	content, err := ioutil.ReadFile(r.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r.applied, err = strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+	return err
+}
+
+// Applied is the sequence of the last record of the primary applied.
+func (r *Replica) Applied() uint64 {
+	return atomic.LoadUint64(&r.applied)
+}
+
+// Follow applies what the primary at addr serves until stop is closed, returning nil then, or the connection fails.
+// It returns store.ErrTooFarBehind if the primary no longer has the records following the applied ones; the replica
+// then has to start over from FetchCheckpoint.
+func (r *Replica) Follow(addr string, stop <-chan struct{}) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	stopped := int32(0)
+	go func() {
+		select {
+		case <-stop:
+			atomic.StoreInt32(&stopped, 1)
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	request := make([]byte, 9)
+	request[0] = requestFollow
+	binary.LittleEndian.PutUint64(request[1:], r.Applied()+1)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	for {
+		kind, payload, err := readFrame(reader)
+		if err != nil {
+			if atomic.LoadInt32(&stopped) == 1 {
+				return nil
+			}
+			return err
+		}
+		if err := r.apply(kind, payload); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *Replica) apply(kind byte, payload []byte) error {
+	switch kind {
+	case frameRecords:
+		records, err := decodeRecords(payload)
+		if err != nil {
+			return err
+		}
+		entries := make([]commitlog.Entry, 0, len(records))
+		for _, record := range records {
+			if record.Sequence > r.Applied() {
+				entries = append(entries, record.Entry)
+			}
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		if err := r.Writer.Apply(entries); err != nil {
+			return err
+		}
+		return r.setApplied(records[len(records)-1].Sequence)
+	case frameSeries:
+		var created []seriesRecord
+		if err := json.Unmarshal(payload, &created); err != nil {
+			return err
+		}
+		for _, s := range created {
+			if _, err := r.Writer.Series.GetOrCreate(s.Metric, s.Labels); err != nil {
+				return err
+			}
+		}
+		return nil
+	case frameTypes:
+		var types map[string]string
+		if err := json.Unmarshal(payload, &types); err != nil {
+			return err
+		}
+		for tag, name := range types {
+			vt, err := schema.ParseValueType(name)
+			if err == nil {
+				err = r.Writer.Catalog.Register(tag, vt)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case frameError:
+		if string(payload) == store.ErrTooFarBehind.Error() {
+			return store.ErrTooFarBehind
+		}
+		return fmt.Errorf("primary failed: %s", payload)
+	}
+	return fmt.Errorf("unexpected frame %q", kind)
+}
+
+func (r *Replica) setApplied(sequence uint64) error {
+	tmpPath := r.statePath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, []byte(strconv.FormatUint(sequence, 10)), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, r.statePath); err != nil {
+		return err
+	}
+	atomic.StoreUint64(&r.applied, sequence)
+	return nil
+}
+
+// FetchCheckpoint fills dataDir, which must not exist yet, with a checkpoint of the primary at addr, laid out as
+// lsmserver lays out its data directory. A Replica over it follows the primary from the checkpoint on.
+func FetchCheckpoint(addr string, dataDir string) (store.Manifest, error) {
+	if _, err := os.Stat(dataDir); err == nil {
+		return store.Manifest{}, fmt.Errorf("%s already exists", dataDir)
+	}
+	manifest, err := fetchCheckpoint(addr, dataDir)
+	if err != nil {
+		os.RemoveAll(dataDir)
+	}
+	return manifest, err
+}
+
+func fetchCheckpoint(addr string, dataDir string) (store.Manifest, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return store.Manifest{}, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{requestCheckpoint}); err != nil {
+		return store.Manifest{}, err
+	}
+	reader := bufio.NewReader(conn)
+	for {
+		kind, payload, err := readFrame(reader)
+		if err != nil {
+			return store.Manifest{}, err
+		}
+		switch kind {
+		case frameFile:
+			if err := writeFileChunk(dataDir, payload); err != nil {
+				return store.Manifest{}, err
+			}
+		case frameManifest:
+			if err := ioutil.WriteFile(dataDir+"/"+store.ManifestFileName, payload, 0644); err != nil {
+				return store.Manifest{}, err
+			}
+			manifest, err := store.VerifyCheckpoint(dataDir)
+			if err != nil {
+				return manifest, err
+			}
+			applied := strconv.FormatUint(manifest.Sequence, 10)
+			return manifest, ioutil.WriteFile(dataDir+"/"+store.CheckpointCommitlogDir+"/"+AppliedFile, []byte(applied), 0644)
+		case frameError:
+			return store.Manifest{}, fmt.Errorf("primary failed: %s", payload)
+		default:
+			return store.Manifest{}, fmt.Errorf("unexpected frame %q", kind)
+		}
+	}
+}
+
+func writeFileChunk(dataDir string, payload []byte) error {
+	path, offset, chunk, err := decodeFileChunk(payload)
+	if err != nil {
+		return err
+	}
+	//paths come from the manifest of the primary, which only names files within the checkpoint
+	if clean := filepath.Clean(path); filepath.IsAbs(clean) || strings.HasPrefix(clean, "..") {
+		return errors.New("file outside of the checkpoint: " + path)
+	}
+	if err := os.MkdirAll(filepath.Dir(dataDir+"/"+path), os.ModePerm); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(dataDir+"/"+path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteAt(chunk, int64(offset)); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,193 @@
+package replication
+
+import (
+	"fmt"
+	"io/ioutil"
+	"lsmstore/dto"
+	"lsmstore/schema"
+	"lsmstore/sst"
+	"lsmstore/store"
+	"lsmstore/utils"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplica_FollowsPrimaryOverLoopback(t *testing.T) {
+	//given
+	primary := openTestDB(newTestDataDir("primary"), "", 0)
+	addr, closePrimary := servePrimary(t, primary)
+	defer closePrimary()
+	assert.Nil(t, primary.Writer.Catalog.Register("temperature", schema.Float64))
+	assert.Nil(t, primary.Writer.StoreFloat("temperature", 1000, 21.5, 0))
+	replicaDir := newTestDataDir("replica")
+	replicaDB := openTestDB(replicaDir, "", 0)
+	replica := Replica{Writer: replicaDB.Writer}
+	assert.Nil(t, replica.Init())
+
+	//when
+	stop := make(chan struct{})
+	followed := make(chan error, 1)
+	go func() {
+		followed <- replica.Follow(addr, stop)
+	}()
+	assert.Nil(t, primary.Writer.StoreSeries([]dto.SeriesMeasurement{{Metric: "up", Labels: []dto.Label{{Name: "job", Value: "api"}}, Timestamp: 1000, Value: []byte{1}}}, 0))
+	primary.Writer.DiskWriter.Flush()
+	assert.Nil(t, primary.Writer.StoreFloat("temperature", 2000, 22, 0))
+	waitForApplied(t, &replica, primary.Writer.DiskWriter.ClManager.Sequence())
+	close(stop)
+
+	//then
+	assert.Nil(t, <-followed)
+	floats, err := replicaDB.Reader.RetrieveFloat("temperature", 0, 5000)
+	assert.Nil(t, err)
+	assert.Equal(t, []dto.FloatMeasurement{{Timestamp: 1000, Value: 21.5}, {Timestamp: 2000, Value: 22}}, floats)
+	up, err := replicaDB.Reader.RetrieveMatching(`job="api"`, 0, 5000)
+	assert.Nil(t, err)
+	assert.Equal(t, []dto.Measurement{{Timestamp: 1000, Value: []byte{1}}}, up[`up{job="api"}`])
+	restarted := Replica{Writer: replicaDB.Writer}
+	assert.Nil(t, restarted.Init())
+	assert.Equal(t, uint64(3), restarted.Applied())
+}
+
+func TestReplica_CatchesUpFromArchiveAndCommitlog(t *testing.T) {
+	//given
+	primaryDir := newTestDataDir("primary")
+	primary := openTestDB(primaryDir, primaryDir+"/archive", 2)
+	addr, closePrimary := servePrimary(t, primary)
+	defer closePrimary()
+	storeCounter(t, primary, 1, 5)
+	primary.Writer.DiskWriter.Flush()
+	storeCounter(t, primary, 6, 8)
+	replicaDB := openTestDB(newTestDataDir("replica"), "", 0)
+	replica := Replica{Writer: replicaDB.Writer}
+	assert.Nil(t, replica.Init())
+
+	//when
+	stop := make(chan struct{})
+	followed := make(chan error, 1)
+	go func() {
+		followed <- replica.Follow(addr, stop)
+	}()
+	waitForApplied(t, &replica, 8)
+	close(stop)
+
+	//then
+	assert.Nil(t, <-followed)
+	assert.Equal(t, 8, len(replicaDB.Reader.Retrieve([]string{"counter"}, 0, 100)["counter"]))
+}
+
+func TestReplica_StartsOverFromCheckpointWhenTooFarBehind(t *testing.T) {
+	//given
+	primary := openTestDB(newTestDataDir("primary"), "", 2)
+	addr, closePrimary := servePrimary(t, primary)
+	defer closePrimary()
+	storeCounter(t, primary, 1, 5)
+	primary.Writer.DiskWriter.Flush()
+	storeCounter(t, primary, 6, 6)
+	empty := Replica{Writer: openTestDB(newTestDataDir("replica"), "", 0).Writer}
+	assert.Nil(t, empty.Init())
+	replicaDir := newTestDataDir("replica")
+
+	//when
+	tooFarBehindErr := empty.Follow(addr, nil)
+	manifest, fetchErr := FetchCheckpoint(addr, replicaDir)
+	replicaDB := openTestDB(replicaDir, "", 0)
+	replica := Replica{Writer: replicaDB.Writer}
+	initErr := replica.Init()
+	appliedFromCheckpoint := replica.Applied()
+	stop := make(chan struct{})
+	followed := make(chan error, 1)
+	go func() {
+		followed <- replica.Follow(addr, stop)
+	}()
+	storeCounter(t, primary, 7, 8)
+	waitForApplied(t, &replica, 8)
+	close(stop)
+
+	//then
+	assert.Equal(t, store.ErrTooFarBehind, tooFarBehindErr)
+	assert.Nil(t, fetchErr)
+	assert.Equal(t, uint64(6), manifest.Sequence)
+	assert.Nil(t, initErr)
+	assert.Equal(t, uint64(6), appliedFromCheckpoint)
+	assert.Nil(t, <-followed)
+	assert.Equal(t, 8, len(replicaDB.Reader.Retrieve([]string{"counter"}, 0, 100)["counter"]))
+	_, existingErr := FetchCheckpoint(addr, replicaDir)
+	assert.NotNil(t, existingErr)
+}
+
+func TestPrimary_CheckpointForReplicaLeavesNoLinkedSSTsBehind(t *testing.T) {
+	//given
+	primaryDir := newTestDataDir("primary")
+	primary := openTestDB(primaryDir, "", 0)
+	addr, closePrimary := servePrimary(t, primary)
+	defer closePrimary()
+	//the second merge into an SST resorts it, which only later merges skip
+	for _, ts := range []uint64{1, 5} {
+		storeCounter(t, primary, ts, ts+3)
+		primary.Writer.DiskWriter.Flush()
+	}
+	sstFile := primaryDir + "/" + store.CheckpointSSTDir + "/" + sst.FileNameForTag("counter")
+	before, statErr := os.Stat(sstFile)
+	assert.Nil(t, statErr)
+
+	//when
+	_, fetchErr := FetchCheckpoint(addr, newTestDataDir("replica"))
+	storeCounter(t, primary, 9, 10)
+	primary.Writer.DiskWriter.Flush()
+
+	//then
+	assert.Nil(t, fetchErr)
+	infos, err := ioutil.ReadDir(primaryDir + "/" + store.CheckpointSSTDir)
+	assert.Nil(t, err)
+	for _, info := range infos {
+		assert.False(t, strings.HasPrefix(info.Name(), ".replica-"), "temporary checkpoint %s was left behind", info.Name())
+	}
+	after, statErr := os.Stat(sstFile)
+	assert.Nil(t, statErr)
+	assert.True(t, os.SameFile(before, after), "SST was rewritten instead of appended to after the checkpoint was sent")
+}
+
+func newTestDataDir(name string) string {
+	return fmt.Sprintf("/tmp/golsm_test/replication/%s-%d-%d", name, utils.GetNowMillis(), utils.GetTestIdx())
+}
+
+func openTestDB(dataDir string, archiveDir string, tailRecords int) *store.DB {
+	return store.Open(store.Options{
+		CommitlogPath:        dataDir + "/" + store.CheckpointCommitlogDir,
+		EntriesPerCommitlog:  1000,
+		PeriodBetweenFlushes: time.Hour,
+		SSTPath:              dataDir + "/" + store.CheckpointSSTDir,
+		MemtMaxEntriesPerTag: 10,
+		CommitlogArchivePath: archiveDir,
+		TailRecords:          tailRecords,
+	})
+}
+
+func servePrimary(t *testing.T, db *store.DB) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	primary := Primary{DB: db}
+	primary.Init()
+	go primary.Serve(listener)
+	return listener.Addr().String(), primary.Close
+}
+
+func storeCounter(t *testing.T, db *store.DB, from uint64, to uint64) {
+	for ts := from; ts <= to; ts++ {
+		assert.Nil(t, db.Writer.Store(dto.TaggedMeasurement{Tag: "counter", Timestamp: ts, Value: []byte{byte(ts)}}, 0))
+	}
+}
+
+func waitForApplied(t *testing.T, replica *Replica, sequence uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for (replica.Applied() < sequence) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, sequence, replica.Applied())
+}
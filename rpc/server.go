@@ -0,0 +1,106 @@
+package rpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative lsm.proto
+
+import (
+	"context"
+	"io"
+	"lsmstore/dto"
+	"lsmstore/store"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const DefaultChunkSize = 1000
+const MaxChunkSize = 10000
+
+// Server implements the Storage service over a store; register it with RegisterStorageServer.
+type Server struct {
+	UnimplementedStorageServer
+	Reader *store.StorageReader
+	Writer *store.StorageWriter
+}
+
+// Write stores every request of the stream as a batch as soon as it arrives; on an invalid request,
+// the stream fails and requests received before it stay written. A request failing on the disk fails the stream
+// with Unavailable, so that the client resends from that request on.
+func (s *Server) Write(stream Storage_WriteServer) error {
+	written := uint64(0)
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&WriteResponse{Written: written})
+		}
+		if err != nil {
+			return err
+		}
+		batch := make([]dto.TaggedMeasurement, len(req.Measurements))
+		for i, m := range req.Measurements {
+			batch[i] = dto.TaggedMeasurement{Tag: m.Tag, Timestamp: m.Timestamp, Value: m.Value}
+		}
+		if err := store.ValidateBatch(batch); err != nil {
+			return status.Errorf(codes.InvalidArgument, "request after %d measurements: %v", written, err)
+		}
+		if err := s.Writer.StoreBatch(batch, req.ExpiresAt); store.IsValidationError(err) {
+			return status.Errorf(codes.InvalidArgument, "request after %d measurements: %v", written, err)
+		} else if err != nil {
+			//a failure of the disk, so the client may resend from this request on
+			return status.Errorf(codes.Unavailable, "request after %d measurements: %v", written, err)
+		}
+		written += uint64(len(batch))
+	}
+}
+
+// Query streams each tag in chunks, sent as they fill up during a single pass over the tag; no file lock is held
+// while a slow client blocks a send.
+func (s *Server) Query(req *QueryRequest, stream Storage_QueryServer) error {
+	if len(req.Tags) == 0 {
+		return status.Error(codes.InvalidArgument, "tags are required")
+	}
+	to := req.To
+	if to == 0 {
+		to = ^uint64(0) - 1
+	}
+	if req.From > to {
+		return status.Error(codes.InvalidArgument, "from is after to")
+	}
+	chunkSize := int(req.ChunkSize)
+	if chunkSize == 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if chunkSize > MaxChunkSize {
+		chunkSize = MaxChunkSize
+	}
+
+	for _, tag := range req.Tags {
+		chunk := make([]*Measurement, 0, chunkSize)
+		var sendErr error
+		s.Reader.Iterate(tag, req.From, to, func(m dto.Measurement) bool {
+			chunk = append(chunk, &Measurement{Timestamp: m.Timestamp, Value: m.Value})
+			if len(chunk) < chunkSize {
+				return true
+			}
+			sendErr = stream.Send(&QueryResponse{Tag: tag, Measurements: chunk})
+			chunk = make([]*Measurement, 0, chunkSize)
+			return sendErr == nil
+		})
+		if sendErr != nil {
+			return sendErr
+		}
+		if len(chunk) > 0 {
+			if err := stream.Send(&QueryResponse{Tag: tag, Measurements: chunk}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) ListTags(ctx context.Context, req *ListTagsRequest) (*ListTagsResponse, error) {
+	tags, err := s.Reader.FindTags(store.TagQuery{Prefix: req.Prefix, After: req.After, Limit: int(req.Limit)})
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &ListTagsResponse{Tags: tags}, nil
+}
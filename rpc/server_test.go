@@ -0,0 +1,200 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"lsmstore/dto"
+	"lsmstore/store"
+	"lsmstore/utils"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestServer_StreamedWritesCanBeQueriedInChunks(t *testing.T) {
+	//given
+	client, closeClient := newTestClient(t)
+	defer closeClient()
+	ctx := context.Background()
+	writeStream, err := client.Write(ctx)
+	assert.Nil(t, err)
+	for batch := 0; batch < 5; batch++ {
+		req := &WriteRequest{}
+		for i := 0; i < 10; i++ {
+			ts := uint64(1000 + batch*10 + i)
+			req.Measurements = append(req.Measurements,
+				&TaggedMeasurement{Tag: "tagZero", Timestamp: ts, Value: []byte{byte(ts)}},
+				&TaggedMeasurement{Tag: "tagOne", Timestamp: ts, Value: []byte{byte(ts)}})
+		}
+		assert.Nil(t, writeStream.Send(req))
+	}
+
+	//when
+	written, err := writeStream.CloseAndRecv()
+	assert.Nil(t, err)
+	chunks := queryAll(t, client, &QueryRequest{Tags: []string{"tagZero", "tagOne"}, From: 1005, To: 1044, ChunkSize: 15})
+	tags, err := client.ListTags(ctx, &ListTagsRequest{Prefix: "tag"})
+	assert.Nil(t, err)
+
+	//then
+	assert.Equal(t, uint64(100), written.Written)
+	assert.Equal(t, 6, len(chunks), "40 points per tag should come in chunks of 15, 15 and 10")
+	for i, chunk := range chunks {
+		expectedTag := "tagZero"
+		if i >= 3 {
+			expectedTag = "tagOne"
+		}
+		assert.Equal(t, expectedTag, chunk.Tag)
+		for j, m := range chunk.Measurements {
+			expectedTs := uint64(1005 + (i%3)*15 + j)
+			assert.Equal(t, expectedTs, m.Timestamp)
+			assert.Equal(t, []byte{byte(expectedTs)}, m.Value)
+		}
+	}
+	assert.Equal(t, []string{"tagOne", "tagZero"}, tags.Tags)
+}
+
+func TestServer_InvalidRequestsAreRejected(t *testing.T) {
+	//given
+	client, closeClient := newTestClient(t)
+	defer closeClient()
+	ctx := context.Background()
+	writeStream, err := client.Write(ctx)
+	assert.Nil(t, err)
+	assert.Nil(t, writeStream.Send(&WriteRequest{Measurements: []*TaggedMeasurement{{Tag: "tagZero", Timestamp: 1337}}}))
+	writeStream.Send(&WriteRequest{Measurements: []*TaggedMeasurement{{Tag: "", Timestamp: 1338}}})
+
+	//when
+	_, writeErr := writeStream.CloseAndRecv()
+	queryStream, err := client.Query(ctx, &QueryRequest{Tags: []string{"tagZero"}, From: 3, To: 2})
+	assert.Nil(t, err)
+	_, queryErr := queryStream.Recv()
+
+	//then
+	assert.Equal(t, codes.InvalidArgument, status.Code(writeErr))
+	assert.Equal(t, codes.InvalidArgument, status.Code(queryErr))
+	chunks := queryAll(t, client, &QueryRequest{Tags: []string{"tagZero"}})
+	assert.Equal(t, 1, len(chunks), "batch received before the invalid one was not kept")
+}
+
+func TestServer_WriteFailingOnDiskIsUnavailable(t *testing.T) {
+	//given
+	reader, writer := newTestStorage()
+	client, closeClient := newTestClientOf(t, reader, writer)
+	defer closeClient()
+	assert.Nil(t, writer.DiskWriter.ClManager.Close())
+	writeStream, err := client.Write(context.Background())
+	assert.Nil(t, err)
+	writeStream.Send(&WriteRequest{Measurements: []*TaggedMeasurement{{Tag: "tagZero", Timestamp: 1337}}})
+
+	//when
+	_, writeErr := writeStream.CloseAndRecv()
+
+	//then
+	assert.Equal(t, codes.Unavailable, status.Code(writeErr))
+}
+
+func TestServer_SlowQueryClientDoesNotHoldUpFlushes(t *testing.T) {
+	//given
+	reader, writer := newTestStorage()
+	for ts := uint64(1000); ts < 1030; ts++ {
+		assert.Nil(t, writer.Store(dto.TaggedMeasurement{Tag: "tagZero", Timestamp: ts, Value: []byte{byte(ts)}}, 0))
+	}
+	writer.DiskWriter.Flush()
+	server := &Server{Reader: reader, Writer: writer}
+	chunks := make([]*QueryResponse, 0)
+	stream := &sendingQueryServer{send: func(chunk *QueryResponse) error {
+		if len(chunks) == 0 {
+			flushed := make(chan struct{})
+			go func() {
+				writer.Store(dto.TaggedMeasurement{Tag: "tagZero", Timestamp: 2000, Value: []byte{1}}, 0)
+				writer.DiskWriter.Flush()
+				close(flushed)
+			}()
+			select {
+			case <-flushed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("flush waited for a query client")
+			}
+		}
+		chunks = append(chunks, chunk)
+		return nil
+	}}
+
+	//when
+	err := server.Query(&QueryRequest{Tags: []string{"tagZero"}, From: 1000, To: 1999, ChunkSize: 10}, stream)
+
+	//then
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(chunks))
+	for i, chunk := range chunks {
+		assert.Equal(t, 10, len(chunk.Measurements))
+		assert.Equal(t, uint64(1000+10*i), chunk.Measurements[0].Timestamp)
+	}
+}
+
+type sendingQueryServer struct {
+	grpc.ServerStream
+	send func(*QueryResponse) error
+}
+
+func (s *sendingQueryServer) Send(chunk *QueryResponse) error {
+	return s.send(chunk)
+}
+
+func newTestStorage() (*store.StorageReader, *store.StorageWriter) {
+	return store.InitStorageWithOptions(store.Options{
+		CommitlogPath:        fmt.Sprintf("/tmp/golsm_test/rpc/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		EntriesPerCommitlog:  1000,
+		PeriodBetweenFlushes: time.Hour,
+		SSTPath:              fmt.Sprintf("/tmp/golsm_test/rpc/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		MemtMaxEntriesPerTag: 10,
+	})
+}
+
+func newTestClient(t *testing.T) (StorageClient, func()) {
+	reader, writer := newTestStorage()
+	return newTestClientOf(t, reader, writer)
+}
+
+func newTestClientOf(t *testing.T, reader *store.StorageReader, writer *store.StorageWriter) (StorageClient, func()) {
+	listener := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer()
+	RegisterStorageServer(grpcServer, &Server{Reader: reader, Writer: writer})
+	go grpcServer.Serve(listener)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+			return listener.Dial()
+		}),
+		grpc.WithInsecure())
+	assert.Nil(t, err)
+	return NewStorageClient(conn), func() {
+		conn.Close()
+		grpcServer.Stop()
+	}
+}
+
+func queryAll(t *testing.T, client StorageClient, req *QueryRequest) []*QueryResponse {
+	stream, err := client.Query(context.Background(), req)
+	assert.Nil(t, err)
+	ans := make([]*QueryResponse, 0)
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			return ans
+		}
+		assert.Nil(t, err)
+		if err != nil {
+			return ans
+		}
+		ans = append(ans, chunk)
+	}
+}
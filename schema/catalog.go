@@ -0,0 +1,112 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"lsmstore/utils"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type Catalog struct {
+	Path  string
+	types map[string]ValueType
+	mutex *sync.RWMutex
+}
+
+type catalogFile struct {
+	Types map[string]string `json:"types"`
+}
+
+// Init loads the catalog persisted at Path, if any; a catalog which cannot be read or parsed is reported
+// rather than taken for an empty one.
+func (c *Catalog) Init() error {
+	c.types = make(map[string]ValueType)
+	c.mutex = &sync.RWMutex{}
+	dir, _ := filepath.Split(c.Path)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	if !utils.FileExists(c.Path) {
+		return nil
+	}
+	content, err := ioutil.ReadFile(c.Path)
+	if err != nil {
+		return err
+	}
+	var cf catalogFile
+	if err := json.Unmarshal(content, &cf); err != nil {
+		return fmt.Errorf("cannot parse catalog %s: %v", c.Path, err)
+	}
+	for tag, name := range cf.Types {
+		vt, err := ParseValueType(name)
+		if err != nil {
+			return fmt.Errorf("catalog %s: tag %s: %v", c.Path, tag, err)
+		}
+		c.types[tag] = vt
+	}
+	return nil
+}
+
+func (c *Catalog) Register(tag string, vt ValueType) error {
+	if (vt <= Untyped) || (vt > Bytes) {
+		return fmt.Errorf("cannot register tag %s with value type %s", tag, vt)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	existing, exists := c.types[tag]
+	if exists {
+		if existing != vt {
+			return fmt.Errorf("tag %s is already registered as %s", tag, existing)
+		}
+		return nil
+	}
+	c.types[tag] = vt
+	if err := c.persist(); err != nil {
+		delete(c.types, tag)
+		return err
+	}
+	return nil
+}
+
+func (c *Catalog) TypeOf(tag string) ValueType {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.types[tag]
+}
+
+// Types returns a copy of the registered types by tag.
+func (c *Catalog) Types() map[string]ValueType {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	ans := make(map[string]ValueType, len(c.types))
+	for tag, vt := range c.types {
+		ans[tag] = vt
+	}
+	return ans
+}
+
+func (c *Catalog) Validate(tag string, value []byte) error {
+	if err := c.TypeOf(tag).Validate(value); err != nil {
+		return fmt.Errorf("invalid value for tag %s: %v", tag, err)
+	}
+	return nil
+}
+
+func (c *Catalog) persist() error {
+	cf := catalogFile{Types: make(map[string]string)}
+	for tag, vt := range c.types {
+		cf.Types[tag] = vt.String()
+	}
+	content, err := json.Marshal(cf)
+	if err != nil {
+		return err
+	}
+	tmpPath := c.Path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, c.Path)
+}
@@ -0,0 +1,70 @@
+package schema
+
+import (
+	"fmt"
+	"io/ioutil"
+	"lsmstore/utils"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCatalog_PersistsRegisteredTypes(t *testing.T) {
+	//given
+	c := Catalog{Path: fmt.Sprintf("/tmp/golsm_test/catalog-%d-%d/catalog.json", utils.GetNowMillis(), utils.GetTestIdx())}
+	assert.Nil(t, c.Init())
+
+	//when
+	err1 := c.Register("temperature", Float64)
+	err2 := c.Register("enabled", Bool)
+	err3 := c.Register("temperature", Int64)
+
+	//then
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+	assert.NotNil(t, err3, "type of registered tag was changed")
+
+	//given
+	c = Catalog{Path: c.Path}
+	assert.Nil(t, c.Init())
+
+	//then
+	assert.Equal(t, Float64, c.TypeOf("temperature"), "type lost after reopening")
+	assert.Equal(t, Bool, c.TypeOf("enabled"), "type lost after reopening")
+	assert.Equal(t, Untyped, c.TypeOf("whatever"), "unregistered tag is typed")
+}
+
+func TestCatalog_ValidatesValues(t *testing.T) {
+	//given
+	c := Catalog{Path: fmt.Sprintf("/tmp/golsm_test/catalog-%d-%d/catalog.json", utils.GetNowMillis(), utils.GetTestIdx())}
+	assert.Nil(t, c.Init())
+	c.Register("temperature", Float64)
+	c.Register("enabled", Bool)
+	c.Register("name", String)
+
+	//then
+	assert.Nil(t, c.Validate("temperature", EncodeFloat64(36.6)))
+	assert.NotNil(t, c.Validate("temperature", make([]byte, 4)))
+	assert.Nil(t, c.Validate("enabled", EncodeBool(true)))
+	assert.NotNil(t, c.Validate("enabled", []byte{2}))
+	assert.Nil(t, c.Validate("name", EncodeString("kitchen")))
+	assert.NotNil(t, c.Validate("name", []byte{0xff, 0xfe}))
+	assert.Nil(t, c.Validate("whatever", []byte{0xff, 0xfe}))
+}
+
+func TestCatalog_DamagedFileIsReported(t *testing.T) {
+	//given
+	c := Catalog{Path: fmt.Sprintf("/tmp/golsm_test/catalog-%d-%d/catalog.json", utils.GetNowMillis(), utils.GetTestIdx())}
+	assert.Nil(t, c.Init())
+	assert.Nil(t, c.Register("temperature", Float64))
+
+	for _, content := range []string{`{"types":`, `{"types":{"temperature":"decimal"}}`} {
+		assert.Nil(t, ioutil.WriteFile(c.Path, []byte(content), 0644))
+
+		//when
+		err := (&Catalog{Path: c.Path}).Init()
+
+		//then
+		assert.NotNil(t, err, content)
+	}
+}
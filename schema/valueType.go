@@ -0,0 +1,133 @@
+package schema
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"unicode/utf8"
+)
+
+type ValueType int
+
+const (
+	Untyped ValueType = iota
+	Float64
+	Int64
+	Bool
+	String
+	Bytes
+)
+
+var valueTypeNames = map[ValueType]string{
+	Untyped: "untyped",
+	Float64: "float64",
+	Int64:   "int64",
+	Bool:    "bool",
+	String:  "string",
+	Bytes:   "bytes",
+}
+
+func (vt ValueType) String() string {
+	name, exists := valueTypeNames[vt]
+	if !exists {
+		return fmt.Sprintf("ValueType(%d)", int(vt))
+	}
+	return name
+}
+
+func ParseValueType(name string) (ValueType, error) {
+	for vt, n := range valueTypeNames {
+		if n == name {
+			return vt, nil
+		}
+	}
+	return Untyped, fmt.Errorf("unknown value type %q", name)
+}
+
+func (vt ValueType) IsNumeric() bool {
+	return (vt == Float64) || (vt == Int64)
+}
+
+func (vt ValueType) Validate(value []byte) error {
+	switch vt {
+	case Float64, Int64:
+		if len(value) != 8 {
+			return fmt.Errorf("%s value must be 8 bytes long, got %d", vt, len(value))
+		}
+	case Bool:
+		if (len(value) != 1) || (value[0] > 1) {
+			return fmt.Errorf("bool value must be a single 0 or 1 byte")
+		}
+	case String:
+		if !utf8.Valid(value) {
+			return fmt.Errorf("string value is not valid UTF-8")
+		}
+	case Untyped, Bytes:
+	default:
+		return fmt.Errorf("unknown value type %d", int(vt))
+	}
+	return nil
+}
+
+func EncodeFloat64(v float64) []byte {
+	arr := make([]byte, 8)
+	binary.LittleEndian.PutUint64(arr, math.Float64bits(v))
+	return arr
+}
+
+func DecodeFloat64(value []byte) (float64, error) {
+	if err := Float64.Validate(value); err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(value)), nil
+}
+
+func EncodeInt64(v int64) []byte {
+	arr := make([]byte, 8)
+	binary.LittleEndian.PutUint64(arr, uint64(v))
+	return arr
+}
+
+func DecodeInt64(value []byte) (int64, error) {
+	if err := Int64.Validate(value); err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(value)), nil
+}
+
+func EncodeBool(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+func DecodeBool(value []byte) (bool, error) {
+	if err := Bool.Validate(value); err != nil {
+		return false, err
+	}
+	return value[0] == 1, nil
+}
+
+func EncodeString(v string) []byte {
+	return []byte(v)
+}
+
+func DecodeString(value []byte) (string, error) {
+	if err := String.Validate(value); err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// DecodeNumeric reads a numeric value as float64; untyped values are treated as float64 when they are 8 bytes long.
+func DecodeNumeric(vt ValueType, value []byte) (float64, error) {
+	switch vt {
+	case Float64, Untyped:
+		return DecodeFloat64(value)
+	case Int64:
+		v, err := DecodeInt64(value)
+		return float64(v), err
+	}
+	return 0, fmt.Errorf("%s value is not numeric", vt)
+}
@@ -0,0 +1,253 @@
+package series
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"lsmstore/dto"
+	"lsmstore/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Index assigns ids to series and keeps an inverted index of label pairs to series ids.
+// New series are appended to the file at Path, one JSON record per line.
+type Index struct {
+	Path     string
+	byTag    map[string]*Series
+	byID     map[uint64]*Series
+	postings map[string]map[string][]uint64
+	nextID   uint64
+	file     *os.File
+	mutex    *sync.RWMutex
+}
+
+type indexRecord struct {
+	ID     uint64      `json:"id"`
+	Metric string      `json:"metric"`
+	Labels []dto.Label `json:"labels"`
+}
+
+// Init loads the series persisted at Path, if any; a file damaged anywhere but in its last line is reported
+// rather than cut short, as that would lose every series after the damage.
+func (idx *Index) Init() error {
+	idx.byTag = make(map[string]*Series)
+	idx.byID = make(map[uint64]*Series)
+	idx.postings = make(map[string]map[string][]uint64)
+	idx.nextID = 1
+	idx.mutex = &sync.RWMutex{}
+
+	dir, _ := filepath.Split(idx.Path)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	if utils.FileExists(idx.Path) {
+		if err := idx.load(); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(idx.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	idx.file = file
+	return nil
+}
+
+// load drops a torn tail of the last append from the file, so that the next append starts on a line of its own.
+func (idx *Index) load() error {
+	file, err := os.Open(idx.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	good := int64(0)
+	for lineNo := 1; ; lineNo++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			//a line without its newline is torn even if it parses
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var r indexRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			return fmt.Errorf("series index %s: line %d: %v", idx.Path, lineNo, err)
+		}
+		idx.add(&Series{ID: r.ID, Metric: r.Metric, Labels: r.Labels, Tag: BuildTag(r.Metric, r.Labels)})
+		good += int64(len(line))
+	}
+	return os.Truncate(idx.Path, good)
+}
+
+func (idx *Index) add(s *Series) {
+	idx.byTag[s.Tag] = s
+	idx.byID[s.ID] = s
+	idx.addPosting(MetricLabel, s.Metric, s.ID)
+	for _, l := range s.Labels {
+		idx.addPosting(l.Name, l.Value, s.ID)
+	}
+	if s.ID >= idx.nextID {
+		idx.nextID = s.ID + 1
+	}
+}
+
+func (idx *Index) addPosting(name string, value string, id uint64) {
+	values, exists := idx.postings[name]
+	if !exists {
+		values = make(map[string][]uint64)
+		idx.postings[name] = values
+	}
+	values[value] = append(values[value], id)
+}
+
+func (idx *Index) GetOrCreate(metric string, labels []dto.Label) (*Series, error) {
+	if err := Validate(metric, labels); err != nil {
+		return nil, err
+	}
+	tag := BuildTag(metric, labels)
+
+	idx.mutex.RLock()
+	s, exists := idx.byTag[tag]
+	idx.mutex.RUnlock()
+	if exists {
+		return s, nil
+	}
+
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	if s, exists := idx.byTag[tag]; exists {
+		return s, nil
+	}
+	s = &Series{ID: idx.nextID, Metric: metric, Labels: SortedLabels(labels), Tag: tag}
+	line, err := json.Marshal(indexRecord{ID: s.ID, Metric: s.Metric, Labels: s.Labels})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := idx.file.Write(append(line, '\n')); err != nil {
+		return nil, fmt.Errorf("cannot persist series %s: %v", tag, err)
+	}
+	if err := idx.file.Sync(); err != nil {
+		return nil, err
+	}
+	idx.add(s)
+	return s, nil
+}
+
+func (idx *Index) ByTag(tag string) (*Series, bool) {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+	s, exists := idx.byTag[tag]
+	return s, exists
+}
+
+// Select returns all series satisfying every matcher, ordered by id.
+// As in Prometheus, a series lacking a label is treated as having it set to an empty value.
+func (idx *Index) Select(matchers []Matcher) []*Series {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	var candidates []uint64
+	for i := range matchers {
+		ids := idx.idsMatching(&matchers[i])
+		if i == 0 {
+			candidates = ids
+		} else {
+			candidates = intersect(candidates, ids)
+		}
+		if len(candidates) == 0 {
+			break
+		}
+	}
+
+	ans := make([]*Series, len(candidates))
+	for i, id := range candidates {
+		ans[i] = idx.byID[id]
+	}
+	return ans
+}
+
+func (idx *Index) idsMatching(m *Matcher) []uint64 {
+	values := idx.postings[m.Name]
+	if !m.Matches("") {
+		ans := make([]uint64, 0)
+		for value, ids := range values {
+			if m.Matches(value) {
+				ans = append(ans, ids...)
+			}
+		}
+		sortIds(ans)
+		return ans
+	}
+
+	excluded := make(map[uint64]struct{})
+	for value, ids := range values {
+		if !m.Matches(value) {
+			for _, id := range ids {
+				excluded[id] = struct{}{}
+			}
+		}
+	}
+	ans := make([]uint64, 0, len(idx.byID))
+	for id := range idx.byID {
+		if _, exists := excluded[id]; !exists {
+			ans = append(ans, id)
+		}
+	}
+	sortIds(ans)
+	return ans
+}
+
+// Since returns the series created after the one of the given id, ordered by id.
+func (idx *Index) Since(id uint64) []*Series {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+	ans := make([]*Series, 0)
+	for i := id + 1; i < idx.nextID; i++ {
+		if s, exists := idx.byID[i]; exists {
+			ans = append(ans, s)
+		}
+	}
+	return ans
+}
+
+// CopyTo copies the file of the index as it is with every series created so far.
+func (idx *Index) CopyTo(path string) error {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+	return utils.CopyFile(idx.Path, path)
+}
+
+func (idx *Index) Close() error {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	return idx.file.Close()
+}
+
+func sortIds(ids []uint64) {
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+}
+
+func intersect(a []uint64, b []uint64) []uint64 {
+	ans := make([]uint64, 0)
+	i, j := 0, 0
+	for (i < len(a)) && (j < len(b)) {
+		if a[i] == b[j] {
+			ans = append(ans, a[i])
+			i++
+			j++
+		} else if a[i] < b[j] {
+			i++
+		} else {
+			j++
+		}
+	}
+	return ans
+}
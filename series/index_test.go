@@ -0,0 +1,133 @@
+package series
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"lsmstore/dto"
+	"lsmstore/utils"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndex_SelectWorks(t *testing.T) {
+	//given
+	idx := Index{Path: fmt.Sprintf("/tmp/golsm_test/series-%d-%d/series.idx", utils.GetNowMillis(), utils.GetTestIdx())}
+	assert.Nil(t, idx.Init())
+	web1, _ := idx.GetOrCreate("cpu", []dto.Label{{Name: "host", Value: "web-1"}, {Name: "dc", Value: "eu"}})
+	web2, _ := idx.GetOrCreate("cpu", []dto.Label{{Name: "host", Value: "web-2"}})
+	db1, _ := idx.GetOrCreate("cpu", []dto.Label{{Name: "host", Value: "db-1"}, {Name: "dc", Value: "us"}})
+	mem, _ := idx.GetOrCreate("mem", []dto.Label{{Name: "host", Value: "web-1"}})
+	again, _ := idx.GetOrCreate("cpu", []dto.Label{{Name: "dc", Value: "eu"}, {Name: "host", Value: "web-1"}})
+
+	//then
+	assert.Equal(t, web1, again, "same label set got a new series")
+	assert.Equal(t, `cpu{dc="eu",host="web-1"}`, web1.Tag, "tag is not canonical")
+	assert.Equal(t, []*Series{web1, web2}, selectOrFail(t, &idx, `metric="cpu", host=~"web-.*"`))
+	assert.Equal(t, []*Series{web1, web2, db1}, selectOrFail(t, &idx, `cpu{}`))
+	assert.Equal(t, []*Series{web2, db1}, selectOrFail(t, &idx, `cpu{dc!="eu"}`))
+	assert.Equal(t, []*Series{web1, mem}, selectOrFail(t, &idx, `host="web-1"`))
+	assert.Equal(t, []*Series{db1}, selectOrFail(t, &idx, `metric=~"cpu|mem", host!~"web-.*"`))
+	assert.Equal(t, 0, len(selectOrFail(t, &idx, `disk{}`)))
+
+	//given
+	idx.Close()
+	idx = Index{Path: idx.Path}
+	assert.Nil(t, idx.Init())
+	reopened, _ := idx.GetOrCreate("mem", []dto.Label{{Name: "host", Value: "web-1"}})
+	fresh, _ := idx.GetOrCreate("mem", []dto.Label{{Name: "host", Value: "web-2"}})
+
+	//then
+	assert.Equal(t, mem.ID, reopened.ID, "series id changed after reopening")
+	assert.Equal(t, mem.ID+1, fresh.ID, "series id reused after reopening")
+	assert.Equal(t, 2, len(selectOrFail(t, &idx, `cpu{host=~"web-.*"}`)), "postings lost after reopening")
+}
+
+func TestIndex_TornTailIsTruncatedOnReopening(t *testing.T) {
+	//given
+	idx := Index{Path: fmt.Sprintf("/tmp/golsm_test/series-%d-%d/series.idx", utils.GetNowMillis(), utils.GetTestIdx())}
+	assert.Nil(t, idx.Init())
+	web1, _ := idx.GetOrCreate("cpu", []dto.Label{{Name: "host", Value: "web-1"}})
+	assert.Nil(t, idx.Close())
+	file, err := os.OpenFile(idx.Path, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.WriteString(`{"id":2,"metric":"cpu","lab`)
+	assert.Nil(t, err)
+	file.Close()
+
+	//when
+	idx = Index{Path: idx.Path}
+	assert.Nil(t, idx.Init())
+	web2, _ := idx.GetOrCreate("cpu", []dto.Label{{Name: "host", Value: "web-2"}})
+	assert.Nil(t, idx.Close())
+	idx = Index{Path: idx.Path}
+	assert.Nil(t, idx.Init())
+
+	//then
+	assert.Equal(t, web1.ID+1, web2.ID)
+	assert.Equal(t, []*Series{web1, web2}, selectOrFail(t, &idx, `cpu{}`), "series appended after a torn tail were lost")
+}
+
+func TestIndex_DamagedLineBeforeTheLastIsReported(t *testing.T) {
+	//given
+	idx := Index{Path: fmt.Sprintf("/tmp/golsm_test/series-%d-%d/series.idx", utils.GetNowMillis(), utils.GetTestIdx())}
+	assert.Nil(t, idx.Init())
+	idx.GetOrCreate("cpu", []dto.Label{{Name: "host", Value: "web-1"}})
+	idx.GetOrCreate("cpu", []dto.Label{{Name: "host", Value: "web-2"}})
+	idx.GetOrCreate("cpu", []dto.Label{{Name: "host", Value: "web-3"}})
+	assert.Nil(t, idx.Close())
+	content, err := ioutil.ReadFile(idx.Path)
+	assert.Nil(t, err)
+	damaged := bytes.Replace(content, []byte(`"web-2"`), []byte(`"web-2`), 1)
+	assert.Nil(t, ioutil.WriteFile(idx.Path, damaged, 0644))
+
+	//when
+	idx = Index{Path: idx.Path}
+	err = idx.Init()
+	after, _ := ioutil.ReadFile(idx.Path)
+
+	//then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "line 2")
+	assert.Equal(t, damaged, after, "series after the damaged line were truncated")
+}
+
+func TestIndex_RejectsInvalidSeries(t *testing.T) {
+	//given
+	idx := Index{Path: fmt.Sprintf("/tmp/golsm_test/series-%d-%d/series.idx", utils.GetNowMillis(), utils.GetTestIdx())}
+	assert.Nil(t, idx.Init())
+
+	//when
+	_, errNoMetric := idx.GetOrCreate("", nil)
+	_, errReserved := idx.GetOrCreate("cpu", []dto.Label{{Name: MetricLabel, Value: "x"}})
+	_, errDuplicate := idx.GetOrCreate("cpu", []dto.Label{{Name: "host", Value: "a"}, {Name: "host", Value: "b"}})
+
+	//then
+	assert.NotNil(t, errNoMetric)
+	assert.NotNil(t, errReserved)
+	assert.NotNil(t, errDuplicate)
+}
+
+func TestParseSelector(t *testing.T) {
+	matchers, err := ParseSelector(`metric="cpu", host=~"web-.*" ,dc!="e\"u", zone !~ "a|b"`)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(matchers))
+	assert.Equal(t, `metric="cpu"`, matchers[0].String())
+	assert.Equal(t, `host=~"web-.*"`, matchers[1].String())
+	assert.Equal(t, `dc!="e\"u"`, matchers[2].String())
+	assert.Equal(t, `zone!~"a|b"`, matchers[3].String())
+	assert.False(t, matchers[1].Matches("xweb-1"), "regexp is not anchored")
+
+	for _, bad := range []string{``, `host`, `host="a" dc="b"`, `host=~"("`, `cpu{host="a"`, `host=a`} {
+		_, err := ParseSelector(bad)
+		assert.NotNil(t, err, "accepted "+bad)
+	}
+}
+
+func selectOrFail(t *testing.T, idx *Index, selector string) []*Series {
+	matchers, err := ParseSelector(selector)
+	assert.Nil(t, err)
+	return idx.Select(matchers)
+}
@@ -0,0 +1,74 @@
+package series
+
+import (
+	"fmt"
+	"lsmstore/dto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MetricLabel is the label name under which the metric name is indexed and matched.
+const MetricLabel = "metric"
+
+type Series struct {
+	ID     uint64
+	Metric string
+	Labels []dto.Label
+	Tag    string
+}
+
+func (s *Series) LabelValue(name string) string {
+	if name == MetricLabel {
+		return s.Metric
+	}
+	for _, l := range s.Labels {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+func SortedLabels(labels []dto.Label) []dto.Label {
+	sorted := make([]dto.Label, len(labels))
+	copy(sorted, labels)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+func Validate(metric string, labels []dto.Label) error {
+	if metric == "" {
+		return fmt.Errorf("metric name is empty")
+	}
+	seen := make(map[string]struct{})
+	for _, l := range labels {
+		if (l.Name == "") || (l.Name == MetricLabel) {
+			return fmt.Errorf("invalid label name %q", l.Name)
+		}
+		if _, exists := seen[l.Name]; exists {
+			return fmt.Errorf("duplicate label %q", l.Name)
+		}
+		seen[l.Name] = struct{}{}
+	}
+	return nil
+}
+
+// BuildTag renders the canonical series key used as a storage tag, e.g. cpu{host="a",region="eu"}.
+func BuildTag(metric string, labels []dto.Label) string {
+	var sb strings.Builder
+	sb.WriteString(metric)
+	sb.WriteByte('{')
+	for i, l := range SortedLabels(labels) {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(l.Name)
+		sb.WriteByte('=')
+		sb.WriteString(strconv.Quote(l.Value))
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
@@ -0,0 +1,166 @@
+package series
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type MatchType int
+
+const (
+	MatchEqual MatchType = iota
+	MatchNotEqual
+	MatchRegexp
+	MatchNotRegexp
+)
+
+var matchTypeOperators = map[MatchType]string{
+	MatchEqual:     "=",
+	MatchNotEqual:  "!=",
+	MatchRegexp:    "=~",
+	MatchNotRegexp: "!~",
+}
+
+type Matcher struct {
+	Name  string
+	Type  MatchType
+	Value string
+	re    *regexp.Regexp
+}
+
+func NewMatcher(name string, t MatchType, value string) (Matcher, error) {
+	m := Matcher{Name: name, Type: t, Value: value}
+	if (t == MatchRegexp) || (t == MatchNotRegexp) {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return m, err
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+func (m *Matcher) Matches(value string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return value == m.Value
+	case MatchNotEqual:
+		return value != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(value)
+	case MatchNotRegexp:
+		return !m.re.MatchString(value)
+	}
+	return false
+}
+
+func (m Matcher) String() string {
+	return m.Name + matchTypeOperators[m.Type] + strconv.Quote(m.Value)
+}
+
+// ParseSelector parses either `metric="cpu", host=~"web-.*"` or the shorthand `cpu{host=~"web-.*"}`.
+func ParseSelector(selector string) ([]Matcher, error) {
+	s := strings.TrimSpace(selector)
+	ans := make([]Matcher, 0)
+
+	if open := strings.IndexByte(s, '{'); open >= 0 {
+		if !strings.HasSuffix(s, "}") {
+			return nil, fmt.Errorf("selector %q is missing closing brace", selector)
+		}
+		metric := strings.TrimSpace(s[:open])
+		if metric != "" {
+			ans = append(ans, Matcher{Name: MetricLabel, Type: MatchEqual, Value: metric})
+		}
+		s = s[open+1 : len(s)-1]
+	}
+
+	p := selectorParser{input: s}
+	for {
+		p.skipSpaces()
+		if p.done() {
+			break
+		}
+		m, err := p.parseMatcher()
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse selector %q: %v", selector, err)
+		}
+		ans = append(ans, m)
+		p.skipSpaces()
+		if p.done() {
+			break
+		}
+		if p.input[p.pos] != ',' {
+			return nil, fmt.Errorf("cannot parse selector %q: expected ',' at %d", selector, p.pos)
+		}
+		p.pos++
+	}
+
+	if len(ans) == 0 {
+		return nil, fmt.Errorf("selector %q has no matchers", selector)
+	}
+	return ans, nil
+}
+
+type selectorParser struct {
+	input string
+	pos   int
+}
+
+func (p *selectorParser) done() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *selectorParser) skipSpaces() {
+	for !p.done() && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *selectorParser) parseMatcher() (Matcher, error) {
+	start := p.pos
+	for !p.done() && isLabelNameChar(p.input[p.pos]) {
+		p.pos++
+	}
+	name := p.input[start:p.pos]
+	if name == "" {
+		return Matcher{}, fmt.Errorf("expected label name at %d", start)
+	}
+
+	p.skipSpaces()
+	var t MatchType
+	switch {
+	case strings.HasPrefix(p.input[p.pos:], "=~"):
+		t = MatchRegexp
+	case strings.HasPrefix(p.input[p.pos:], "!~"):
+		t = MatchNotRegexp
+	case strings.HasPrefix(p.input[p.pos:], "!="):
+		t = MatchNotEqual
+	case strings.HasPrefix(p.input[p.pos:], "="):
+		t = MatchEqual
+	default:
+		return Matcher{}, fmt.Errorf("expected operator after %s", name)
+	}
+	p.pos += len(matchTypeOperators[t])
+
+	p.skipSpaces()
+	if p.done() || (p.input[p.pos] != '"') {
+		return Matcher{}, fmt.Errorf("expected quoted value for %s", name)
+	}
+	quoted, err := strconv.QuotedPrefix(p.input[p.pos:])
+	if err != nil {
+		return Matcher{}, fmt.Errorf("bad quoted value for %s: %v", name, err)
+	}
+	p.pos += len(quoted)
+	value, err := strconv.Unquote(quoted)
+	if err != nil {
+		return Matcher{}, err
+	}
+	return NewMatcher(name, t, value)
+}
+
+func isLabelNameChar(c byte) bool {
+	return (c == '_') || ((c >= 'a') && (c <= 'z')) || ((c >= 'A') && (c <= 'Z')) || ((c >= '0') && (c <= '9'))
+}
@@ -0,0 +1,186 @@
+package sst
+
+import (
+	"container/list"
+	"sync"
+)
+
+const DefaultBlockSize = 32 * 1024
+const DefaultBlockCacheBytes = 64 * 1024 * 1024
+
+// BlockCache keeps fixed-size blocks of SST files in memory, shared by all SSTforTag instances of a manager.
+// Unpinned blocks are evicted least recently used first once they take more than MaxBytes; blocks of
+// pinned files are never evicted and are not counted against MaxBytes.
+// Only full blocks are cached: SSTs are append-only until resorted, so a full block never changes
+// until the file is replaced, at which point it must be invalidated.
+type BlockCache struct {
+	MaxBytes    int64
+	BlockSize   int
+	mutex       *sync.Mutex
+	lru         *list.List
+	blocks      map[string]map[int64]*cachedBlock
+	pinned      map[string]bool
+	generations map[string]uint64
+	bytes       int64
+	pinnedBytes int64
+	hits        uint64
+	misses      uint64
+	evictions   uint64
+}
+
+type BlockCacheStats struct {
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64
+	Blocks      int
+	Bytes       int64
+	PinnedBytes int64
+}
+
+type cachedBlock struct {
+	name string
+	idx  int64
+	data []byte
+	elem *list.Element
+}
+
+func (bc *BlockCache) Init() {
+	if bc.MaxBytes == 0 {
+		bc.MaxBytes = DefaultBlockCacheBytes
+	}
+	if bc.BlockSize == 0 {
+		bc.BlockSize = DefaultBlockSize
+	}
+	bc.mutex = &sync.Mutex{}
+	bc.lru = list.New()
+	bc.blocks = make(map[string]map[int64]*cachedBlock)
+	bc.pinned = make(map[string]bool)
+	bc.generations = make(map[string]uint64)
+}
+
+// Generation is bumped by every Invalidate of the file, telling its contents before and after apart.
+func (bc *BlockCache) Generation(name string) uint64 {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	return bc.generations[name]
+}
+
+// GetOrLoad returns block idx of the file, calling load outside of the lock on a miss.
+// load must return exactly BlockSize bytes.
+func (bc *BlockCache) GetOrLoad(name string, idx int64, load func() []byte) []byte {
+	return bc.getOrLoadOf(name, bc.Generation(name), idx, load)
+}
+
+// getOrLoadOf bypasses the cache for a reader still on a replaced generation of the file.
+func (bc *BlockCache) getOrLoadOf(name string, generation uint64, idx int64, load func() []byte) []byte {
+	bc.mutex.Lock()
+	if generation != bc.generations[name] {
+		bc.mutex.Unlock()
+		return load()
+	}
+	if cb, exists := bc.blocks[name][idx]; exists {
+		bc.hits++
+		if cb.elem != nil {
+			bc.lru.MoveToFront(cb.elem)
+		}
+		bc.mutex.Unlock()
+		return cb.data
+	}
+	bc.misses++
+	bc.mutex.Unlock()
+
+	data := load()
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	if generation != bc.generations[name] {
+		//replaced meanwhile
+		return data
+	}
+	if cb, exists := bc.blocks[name][idx]; exists {
+		//loaded concurrently by another reader
+		return cb.data
+	}
+	cb := &cachedBlock{name: name, idx: idx, data: data}
+	blocksOfFile, exists := bc.blocks[name]
+	if !exists {
+		blocksOfFile = make(map[int64]*cachedBlock)
+		bc.blocks[name] = blocksOfFile
+	}
+	blocksOfFile[idx] = cb
+	if bc.pinned[name] {
+		bc.pinnedBytes += int64(len(data))
+	} else {
+		cb.elem = bc.lru.PushFront(cb)
+		bc.bytes += int64(len(data))
+		bc.evict()
+	}
+	return data
+}
+
+// Invalidate drops all blocks of the file; must be called once the file was replaced on disk.
+func (bc *BlockCache) Invalidate(name string) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	bc.generations[name]++
+	for _, cb := range bc.blocks[name] {
+		if cb.elem != nil {
+			bc.lru.Remove(cb.elem)
+			bc.bytes -= int64(len(cb.data))
+		} else {
+			bc.pinnedBytes -= int64(len(cb.data))
+		}
+	}
+	delete(bc.blocks, name)
+}
+
+func (bc *BlockCache) Pin(name string) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	bc.pinned[name] = true
+	for _, cb := range bc.blocks[name] {
+		if cb.elem != nil {
+			bc.lru.Remove(cb.elem)
+			cb.elem = nil
+			bc.bytes -= int64(len(cb.data))
+			bc.pinnedBytes += int64(len(cb.data))
+		}
+	}
+}
+
+func (bc *BlockCache) Unpin(name string) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	delete(bc.pinned, name)
+	for _, cb := range bc.blocks[name] {
+		if cb.elem == nil {
+			cb.elem = bc.lru.PushFront(cb)
+			bc.pinnedBytes -= int64(len(cb.data))
+			bc.bytes += int64(len(cb.data))
+		}
+	}
+	bc.evict()
+}
+
+func (bc *BlockCache) Stats() BlockCacheStats {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	blocks := 0
+	for _, blocksOfFile := range bc.blocks {
+		blocks += len(blocksOfFile)
+	}
+	return BlockCacheStats{Hits: bc.hits, Misses: bc.misses, Evictions: bc.evictions, Blocks: blocks, Bytes: bc.bytes, PinnedBytes: bc.pinnedBytes}
+}
+
+func (bc *BlockCache) evict() {
+	for (bc.bytes > bc.MaxBytes) && (bc.lru.Len() > 0) {
+		cb := bc.lru.Remove(bc.lru.Back()).(*cachedBlock)
+		bc.bytes -= int64(len(cb.data))
+		bc.evictions++
+		blocksOfFile := bc.blocks[cb.name]
+		delete(blocksOfFile, cb.idx)
+		if len(blocksOfFile) == 0 {
+			delete(bc.blocks, cb.name)
+		}
+	}
+}
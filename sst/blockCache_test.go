@@ -0,0 +1,148 @@
+package sst
+
+import (
+	"encoding/binary"
+	"fmt"
+	"lsmstore/commitlog"
+	"lsmstore/utils"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockCache_EvictsOnlyUnpinnedBlocks(t *testing.T) {
+	//given
+	bc := BlockCache{MaxBytes: 40, BlockSize: 10}
+	bc.Init()
+	loads := 0
+	load := func() []byte {
+		loads++
+		return make([]byte, 10)
+	}
+
+	//when
+	bc.Pin("hot")
+	for i := int64(0); i < 3; i++ {
+		bc.GetOrLoad("hot", i, load)
+	}
+	for i := int64(0); i < 6; i++ {
+		bc.GetOrLoad("cold", i, load)
+	}
+	stats := bc.Stats()
+
+	//then
+	assert.Equal(t, 9, loads)
+	assert.Equal(t, int64(40), stats.Bytes, "unpinned blocks exceed the budget")
+	assert.Equal(t, int64(30), stats.PinnedBytes)
+	assert.Equal(t, uint64(2), stats.Evictions)
+	assert.Equal(t, 7, stats.Blocks)
+
+	//when
+	bc.GetOrLoad("hot", 0, load)
+	bc.GetOrLoad("cold", 5, load)
+	bc.GetOrLoad("cold", 0, load)
+	stats = bc.Stats()
+
+	//then
+	assert.Equal(t, 10, loads, "evicted block was not reloaded")
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Equal(t, uint64(10), stats.Misses)
+
+	//when
+	bc.Unpin("hot")
+	stats = bc.Stats()
+
+	//then
+	assert.Equal(t, int64(40), stats.Bytes, "unpinned blocks exceed the budget after unpinning")
+	assert.Equal(t, int64(0), stats.PinnedBytes)
+
+	//when
+	bc.Invalidate("cold")
+	stats = bc.Stats()
+
+	//then
+	assert.Equal(t, 3, stats.Blocks, "blocks of invalidated file were kept")
+}
+
+func TestBlockCache_ReadersOfReplacedFileBypassCache(t *testing.T) {
+	//given
+	bc := BlockCache{MaxBytes: 40, BlockSize: 1}
+	bc.Init()
+	before := bc.Generation("file")
+	bc.Invalidate("file")
+
+	//when
+	stale := bc.getOrLoadOf("file", before, 0, func() []byte {
+		return []byte{1}
+	})
+	current := bc.GetOrLoad("file", 0, func() []byte {
+		return []byte{2}
+	})
+	staleAgain := bc.getOrLoadOf("file", before, 0, func() []byte {
+		return []byte{1}
+	})
+
+	//then
+	assert.Equal(t, []byte{1}, stale)
+	assert.Equal(t, []byte{2}, current, "block of replaced file was cached")
+	assert.Equal(t, []byte{1}, staleAgain, "reader of replaced file got block of new one")
+}
+func TestSSTforTag_ReadsThroughBlockCache(t *testing.T) {
+	//given
+	bc := BlockCache{MaxBytes: 4096, BlockSize: 64}
+	bc.Init()
+	st := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx()), Blocks: &bc}
+	st.InitStorage()
+	st.MergeWithCommitlog(getEntriesWithValues(100, 1000, 1))
+
+	//when
+	first := st.GetEntriesWithIndex(1000, 2000)
+	second := st.GetEntriesWithIndex(1000, 2000)
+
+	//then
+	assert.Equal(t, 100, len(first))
+	assert.Equal(t, first, second, "cached read differs from the first one")
+	assertEntriesHaveValues(t, first, 1)
+	assert.Less(t, uint64(0), bc.Stats().Hits, "nothing was read from the cache")
+
+	//when
+	st.MergeWithCommitlog(getEntriesWithValues(10, 1100, 1))
+	appended := st.GetEntriesWithIndex(1000, 2000)
+
+	//then
+	assert.Equal(t, 110, len(appended), "appended entries lost")
+	assertEntriesHaveValues(t, appended, 1)
+
+	//when
+	st.MergeWithCommitlog(getEntriesWithValues(50, 1000, 2))
+	resorted := st.GetEntriesWithIndex(1000, 2000)
+	descending := make([]Entry, 0)
+	st.IterateEntriesDescending(1000, 2000, func(e Entry) bool {
+		descending = append(descending, e)
+		return true
+	})
+
+	//then
+	assert.Equal(t, 110, len(resorted))
+	assertEntriesHaveValues(t, resorted[:50], 2)
+	assertEntriesHaveValues(t, resorted[50:], 1)
+	assert.Equal(t, 110, len(descending))
+	assert.Equal(t, resorted[0], descending[109], "stale block read after resorting")
+}
+
+func getEntriesWithValues(count int, firstTs uint64, multiplier uint64) []commitlog.Entry {
+	ans := make([]commitlog.Entry, count)
+	for i := range ans {
+		ts := firstTs + uint64(i)
+		value := make([]byte, 8)
+		binary.LittleEndian.PutUint64(value, ts*multiplier)
+		ans[i] = commitlog.Entry{Key: []byte("tagZero"), Timestamp: ts, Value: value}
+	}
+	return ans
+}
+
+func assertEntriesHaveValues(t *testing.T, entries []Entry, multiplier uint64) {
+	for _, e := range entries {
+		assert.Equal(t, e.Timestamp*multiplier, binary.LittleEndian.Uint64(e.Value), fmt.Sprintf("wrong value at ts %d", e.Timestamp))
+	}
+}
@@ -3,6 +3,7 @@ package sst
 import (
 	"encoding/binary"
 	"encoding/json"
+	"lsmstore/utils"
 )
 
 type Entry struct {
@@ -23,9 +24,7 @@ func FromByteArray(arr []uint8) Entry {
 	timestamp := binary.LittleEndian.Uint64(arr)
 	expiresAt := binary.LittleEndian.Uint64(arr[8:])
 	value := make([]byte, len(arr) - 16)
-	for i := 16; i < len(arr); i++ {
-		value[i - 16] = arr[i]
-	}
+	copy(value, arr[16:])
 	return Entry{
 		Timestamp: timestamp,
 		ExpiresAt: expiresAt,
@@ -33,14 +32,31 @@ func FromByteArray(arr []uint8) Entry {
 	}
 }
 
-func (e *Entry) ToByteArrayWithLength() []uint8 {
-	entryLen := len(e.Value) + 8 + 8
-	arr := make([]byte, entryLen + 2)
-	binary.LittleEndian.PutUint64(arr[2:], e.Timestamp)
-	binary.LittleEndian.PutUint64(arr[10:], e.ExpiresAt)
-	for i := 18; i < len(arr); i++ {
-		arr[i] = e.Value[i - 18]
+// entryOf decodes an entry whose value aliases arr.
+func entryOf(arr []uint8) Entry {
+	return Entry{
+		Timestamp: binary.LittleEndian.Uint64(arr),
+		ExpiresAt: binary.LittleEndian.Uint64(arr[8:]),
+		Value:     arr[16:],
 	}
-	binary.LittleEndian.PutUint16(arr, uint16(entryLen))
-	return arr
-}
\ No newline at end of file
+}
+
+// Detached returns the entry with a copy of its value, to be kept after the receiver it was passed to returned.
+func (e *Entry) Detached() Entry {
+	value := make([]byte, len(e.Value))
+	copy(value, e.Value)
+	return Entry{Timestamp: e.Timestamp, ExpiresAt: e.ExpiresAt, Value: value}
+}
+
+// ToByteArrayWithLength encodes the entry as a record of an SST, checksum included.
+func (e *Entry) ToByteArrayWithLength() []uint8 {
+	arr := make([]byte, len(e.Value) + 8 + 8)
+	binary.LittleEndian.PutUint64(arr, e.Timestamp)
+	binary.LittleEndian.PutUint64(arr[8:], e.ExpiresAt)
+	copy(arr[16:], e.Value)
+	return utils.EncodeRecord(arr)
+}
+
+func (e *Entry) SizeWithLength() int64 {
+	return int64(len(e.Value) + 8 + 8 + 2 + utils.ChecksumSize)
+}
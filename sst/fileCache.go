@@ -0,0 +1,112 @@
+package sst
+
+import (
+	"container/list"
+	"os"
+	"sync"
+)
+
+const DefaultMaxOpenFiles = 256
+
+// FileCache keeps up to MaxOpenFiles read-only SST handles open, evicting the least recently used idle one.
+// Handles are only read with ReadAt, so a single one is shared by any number of concurrent readers.
+type FileCache struct {
+	MaxOpenFiles int
+	mutex        *sync.Mutex
+	lru          *list.List
+	files        map[string]*list.Element
+}
+
+type cachedFile struct {
+	name  string
+	file  *os.File
+	users int
+	stale bool
+}
+
+func (fc *FileCache) Init() {
+	if fc.MaxOpenFiles == 0 {
+		fc.MaxOpenFiles = DefaultMaxOpenFiles
+	}
+	fc.mutex = &sync.Mutex{}
+	fc.lru = list.New()
+	fc.files = make(map[string]*list.Element)
+}
+
+// Acquire returns an open handle for the file; release must be called once the caller is done with it.
+func (fc *FileCache) Acquire(name string) (*os.File, func(), error) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	elem, exists := fc.files[name]
+	if exists {
+		fc.lru.MoveToFront(elem)
+	} else {
+		file, err := os.OpenFile(name, os.O_RDONLY, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		elem = fc.lru.PushFront(&cachedFile{name: name, file: file})
+		fc.files[name] = elem
+	}
+	cf := elem.Value.(*cachedFile)
+	cf.users++
+	fc.evictIdle()
+	return cf.file, func() {
+		fc.release(cf)
+	}, nil
+}
+
+func (fc *FileCache) release(cf *cachedFile) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	cf.users--
+	if cf.stale && (cf.users == 0) {
+		cf.file.Close()
+	}
+}
+
+// Invalidate must be called after a file was replaced on disk so that no reader keeps using the old inode.
+func (fc *FileCache) Invalidate(name string) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	elem, exists := fc.files[name]
+	if !exists {
+		return
+	}
+	fc.remove(elem)
+}
+
+func (fc *FileCache) Len() int {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	return fc.lru.Len()
+}
+
+func (fc *FileCache) Close() {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	for fc.lru.Len() > 0 {
+		fc.remove(fc.lru.Back())
+	}
+}
+
+func (fc *FileCache) evictIdle() {
+	elem := fc.lru.Back()
+	for (fc.lru.Len() > fc.MaxOpenFiles) && (elem != nil) {
+		prev := elem.Prev()
+		if elem.Value.(*cachedFile).users == 0 {
+			fc.remove(elem)
+		}
+		elem = prev
+	}
+}
+
+func (fc *FileCache) remove(elem *list.Element) {
+	cf := elem.Value.(*cachedFile)
+	fc.lru.Remove(elem)
+	delete(fc.files, cf.name)
+	cf.stale = true
+	if cf.users == 0 {
+		cf.file.Close()
+	}
+}
@@ -0,0 +1,64 @@
+package sst
+
+import (
+	"fmt"
+	"io/ioutil"
+	"lsmstore/utils"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileCache_EvictsLeastRecentlyUsedIdleFiles(t *testing.T) {
+	//given
+	dir := fmt.Sprintf("/tmp/golsm_test/filecache-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	os.MkdirAll(dir, os.ModePerm)
+	names := make([]string, 4)
+	for i := range names {
+		names[i] = fmt.Sprintf("%s/file%d", dir, i)
+		ioutil.WriteFile(names[i], []byte{byte(i)}, 0644)
+	}
+	fc := FileCache{MaxOpenFiles: 2}
+	fc.Init()
+
+	//when
+	_, release0, _ := fc.Acquire(names[0])
+	_, release1, _ := fc.Acquire(names[1])
+	release1()
+	file2, release2, _ := fc.Acquire(names[2])
+
+	//then
+	assert.Equal(t, 2, fc.Len(), "idle file was not evicted")
+	buf := make([]byte, 1)
+	_, err := file2.ReadAt(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(2), buf[0], "wrong file returned")
+
+	//when
+	_, release3, _ := fc.Acquire(names[3])
+
+	//then
+	assert.Equal(t, 3, fc.Len(), "files in use must not be evicted")
+
+	//when
+	release0()
+	release2()
+	release3()
+	_, release1, _ = fc.Acquire(names[1])
+	release1()
+
+	//then
+	assert.Equal(t, 2, fc.Len(), "idle files were not evicted")
+
+	//when
+	file3, release3, _ := fc.Acquire(names[3])
+	fc.Invalidate(names[3])
+	_, err = file3.ReadAt(buf, 0)
+
+	//then
+	assert.Nil(t, err, "invalidated file was closed while in use")
+	release3()
+	_, err = file3.ReadAt(buf, 0)
+	assert.NotNil(t, err, "invalidated file was not closed after release")
+}
@@ -3,10 +3,12 @@ package sst
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"lsmstore/commitlog"
 	"lsmstore/utils"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
@@ -18,24 +20,53 @@ import (
 )
 
 const DefaultSlicePreassignedMem = 0
+const DescendingBlockEntries = 256
+
+// MmapRetryPeriod is how long an SST is read without mmap after mapping it failed.
+const MmapRetryPeriod = time.Minute
 
 type SSTforTag struct {
 	Tag                     string
 	FileName                string
 	PerformCompactionEvery  time.Duration
+	Files                   *FileCache
+	Blocks                  *BlockCache
+	Mmap                    bool
 	file                    *os.File
-	mutex                   *sync.Mutex
+	mutex                   *sync.RWMutex
 	index                   *btree.BTree
 	nextCompactionTimestamp uint64
+	nextExpirationTimestamp uint64
+	entriesInFile           int
+	bytesInFile             int64
+	mapped                  *mapping
+	mapMutex                *sync.Mutex
+	// mmapRetryAt is when mapping is tried again after it failed, in milliseconds
+	mmapRetryAt uint64
+	// linked is whether the file was linked elsewhere, as marked by the file named with LinkedSuffix
+	linked bool
+}
+
+// LinkedSuffix names the marker of an SST linked elsewhere, e.g. into a checkpoint, next to the SST.
+const LinkedSuffix = ".linked"
+
+type Stats struct {
+	First               uint64
+	Last                uint64
+	Points              int
+	Bytes               int64
+	ExpiredNotCompacted int
 }
 
 func (st *SSTforTag) InitStorage() {
 	dir, _ := filepath.Split(st.FileName)
 	os.MkdirAll(dir, os.ModePerm)
 	st.index = btree.New(4)
+	st.mapMutex = &sync.Mutex{}
 	if st.PerformCompactionEvery == 0 {
 		st.PerformCompactionEvery = time.Minute * 10
 	}
+	st.linked = utils.FileExists(st.FileName + LinkedSuffix)
 	if utils.FileExists(st.FileName) {
 		st.initOverExistingFile()
 	} else {
@@ -46,15 +77,24 @@ func (st *SSTforTag) InitStorage() {
 func (st *SSTforTag) initOverNewFile() {
 	file, err := os.OpenFile(st.FileName, os.O_CREATE|os.O_WRONLY, 0644)
 	utils.Check(err)
+	_, err = file.Write(utils.RecordsHeader())
+	utils.Check(err)
 	st.file = file
-	st.mutex = &sync.Mutex{}
+	st.mutex = &sync.RWMutex{}
+	st.bytesInFile = utils.RecordsHeaderSize
 }
 
+// initOverExistingFile migrates a file of an earlier version first.
 func (st *SSTforTag) initOverExistingFile() {
+	report, migrated, err := utils.MigrateRecords(st.FileName, sortedEntries())
+	utils.Check(err)
+	if migrated && !report.Clean() {
+		log.Warn("Migrating %s dropped %d records and %d bytes of torn tail", st.FileName, report.Dropped, report.TornTail)
+	}
 	file, err := os.OpenFile(st.FileName, os.O_APPEND|os.O_WRONLY, 0644)
 	utils.Check(err)
 	st.file = file
-	st.mutex = &sync.Mutex{}
+	st.mutex = &sync.RWMutex{}
 	st.rebuildIndex()
 }
 
@@ -65,15 +105,29 @@ func (st *SSTforTag) reopenFile() {
 }
 
 func (st *SSTforTag) rebuildIndex() {
+	index := btree.New(4)
+	nextExpirationTimestamp := uint64(0)
+	entriesInFile := 0
+	bytesInFile := int64(utils.RecordsHeaderSize)
 	st.iterateOverFileAndApplyForAllEntries(func(e Entry, o int64) {
-		st.index.ReplaceOrInsert(buildIndexEntry(e.Timestamp, o, e.ExpiresAt))
+		index.ReplaceOrInsert(buildIndexEntry(e.Timestamp, o, e.ExpiresAt))
+		nextExpirationTimestamp = earliestExpiration(nextExpirationTimestamp, e.ExpiresAt)
+		entriesInFile++
+		bytesInFile = o + e.SizeWithLength()
 	})
+	st.mutex.Lock()
+	st.index = index
+	st.nextExpirationTimestamp = nextExpirationTimestamp
+	st.entriesInFile = entriesInFile
+	st.bytesInFile = bytesInFile
+	st.mutex.Unlock()
 }
 
 func (st *SSTforTag) GetAllEntries() []Entry {
 	ans := make([]Entry, 0, DefaultSlicePreassignedMem)
-	st.iterateOverFileAndApplyForAllEntries(func(e Entry, o int64) {
+	st.iterateOverFileWhile(utils.RecordsHeaderSize, int((^uint(0))>>1), true, func(e Entry, o int64) bool {
 		ans = append(ans, e)
+		return true
 	})
 	sort.Slice(ans, func(i, j int) bool {
 		return ans[i].Timestamp < ans[j].Timestamp
@@ -82,19 +136,77 @@ func (st *SSTforTag) GetAllEntries() []Entry {
 }
 
 func (st *SSTforTag) iterateOverFileAndApplyForAllEntries(receiver func(Entry, int64)) {
-	st.iterateOverFileAndApplyForEntries(0, int((^uint(0))>>1), receiver)
+	st.iterateOverFileAndApplyForEntries(utils.RecordsHeaderSize, int((^uint(0))>>1), receiver)
 }
 
 func (st *SSTforTag) iterateOverFileAndApplyForEntries(fileOffsetBytes int64, entriesCount int, receiver func(Entry, int64)) {
-	st.mutex.Lock()
-	file, err := os.OpenFile(st.FileName, os.O_RDONLY, 0644)
-	utils.Check(err)
+	st.iterateOverFileWhile(fileOffsetBytes, entriesCount, false, func(e Entry, o int64) bool {
+		receiver(e, o)
+		return true
+	})
+}
+
+// iterateOverFileWhile keeps mutex held while receiver runs, so that it may look at the index; with keep set,
+// receiver gets entries it may keep.
+func (st *SSTforTag) iterateOverFileWhile(fileOffsetBytes int64, entriesCount int, keep bool, receiver func(Entry, int64) bool) {
+	st.mutex.RLock()
+	snap := st.snapshot()
+	if snap.mapped == nil {
+		//nothing is appended meanwhile, so the file is read to its end, which the index might not know yet
+		snap.bytes = math.MaxInt64
+	}
+	st.readFileWhile(snap, fileOffsetBytes, entriesCount, func(e Entry, o int64) bool {
+		if keep {
+			e = snap.kept(e)
+		}
+		return receiver(e, o)
+	})
+	snap.release()
+	st.mutex.RUnlock()
+}
 
-	if fileOffsetBytes > 0 {
-		_, ok := file.Seek(fileOffsetBytes, 0)
-		utils.Check(ok)
+// fileSnapshot is the file as it was when taken: a handle or mapping of the same inode, of which the first bytes
+// never change, as the file is only appended to until it is replaced. It stays readable without mutex held.
+type fileSnapshot struct {
+	mapped  *mapping
+	reader  io.ReaderAt
+	bytes   int64
+	release func()
+}
+
+// snapshot must be called with mutex held; release must be called once done reading.
+func (st *SSTforTag) snapshot() fileSnapshot {
+	if m, mapped := st.mappedData(); mapped {
+		return fileSnapshot{mapped: m, bytes: st.bytesInFile, release: func() {
+			st.releaseMapping(m)
+		}}
 	}
-	reader := bufio.NewReader(file)
+	file, release := st.openForReading()
+	return fileSnapshot{reader: st.readerAt(file), bytes: st.bytesInFile, release: release}
+}
+
+// kept returns an entry that outlives the snapshot: only values read from a mapping alias it, those read with pread
+// have a buffer of their own already.
+func (snap fileSnapshot) kept(e Entry) Entry {
+	if snap.mapped != nil {
+		return e.Detached()
+	}
+	return e
+}
+
+// readFileWhile reads with pread so concurrent readers never share a file position.
+func (st *SSTforTag) readFileWhile(snap fileSnapshot, fileOffsetBytes int64, entriesCount int, receiver func(Entry, int64) bool) {
+	if snap.mapped != nil {
+		st.readMappedWhile(snap.mapped.data[:snap.bytes], fileOffsetBytes, entriesCount, receiver)
+		return
+	}
+	if fileOffsetBytes < utils.RecordsHeaderSize {
+		fileOffsetBytes = utils.RecordsHeaderSize
+	}
+	if fileOffsetBytes >= snap.bytes {
+		return
+	}
+	reader := bufio.NewReader(io.NewSectionReader(snap.reader, fileOffsetBytes, snap.bytes-fileOffsetBytes))
 
 	readerFileOffset := int64(fileOffsetBytes)
 	prevFileOffset := int64(fileOffsetBytes)
@@ -116,75 +228,245 @@ func (st *SSTforTag) iterateOverFileAndApplyForEntries(fileOffsetBytes int64, en
 			panic(fmt.Sprintf("read seems to be failed; expected to read %d, managed to read %d, parsed %d entries", entrySize, n2, entriesParsed))
 		}
 		readerFileOffset += int64(n2)
-		entry := FromByteArray(entryBytes)
+		entry := entryOf(utils.PayloadOf(entryBytes))
 		if entry.Timestamp < prevEntry.Timestamp {
 			panic(fmt.Sprintf("SST was not sorted! prevEntry TS %d, now TS %d", prevEntry.Timestamp, entry.Timestamp))
 		}
 		prevEntry = entry
-		receiver(entry, prevFileOffset)
+		if !receiver(entry, prevFileOffset) {
+			break
+		}
 		prevFileOffset = readerFileOffset
 		entriesParsed += 1
 		if entriesParsed >= entriesCount {
 			break
 		}
 	}
+}
+
+// readMappedWhile decodes entries straight from the mapping, so their values alias it: they are valid only
+// while the snapshot is held, i.e. until the reading method returns.
+func (st *SSTforTag) readMappedWhile(data []byte, fileOffsetBytes int64, entriesCount int, receiver func(Entry, int64) bool) {
+	if fileOffsetBytes < utils.RecordsHeaderSize {
+		fileOffsetBytes = utils.RecordsHeaderSize
+	}
+	pos := fileOffsetBytes
+	entriesParsed := 0
+	prevTimestamp := uint64(0)
+	for pos+2 <= int64(len(data)) {
+		entrySize := int64(binary.LittleEndian.Uint16(data[pos:]))
+		if pos+2+entrySize > int64(len(data)) {
+			panic(fmt.Sprintf("entry at offset %d of %s crosses end of mapping", pos, st.FileName))
+		}
+		entry := entryOf(utils.PayloadOf(data[pos+2 : pos+2+entrySize]))
+		if entry.Timestamp < prevTimestamp {
+			panic(fmt.Sprintf("SST was not sorted! prevEntry TS %d, now TS %d", prevTimestamp, entry.Timestamp))
+		}
+		prevTimestamp = entry.Timestamp
+		if !receiver(entry, pos) {
+			break
+		}
+		pos += 2 + entrySize
+		entriesParsed += 1
+		if entriesParsed >= entriesCount {
+			break
+		}
+	}
+}
+
+// mapping is unmapped once it was replaced and the last reader released it. It reserves room beyond the end
+// of the file, so that appended entries are read through it as well until the file outgrows it.
+type mapping struct {
+	data  []byte
+	users int
+	stale bool
+}
+
+var errMmapUnsupported = errors.New("mmap is only supported on linux")
+
+// mappedData maps the file on first use after it was written, and again once it outgrew the mapping;
+// must be called with mutex held, and releaseMapping once done reading.
+func (st *SSTforTag) mappedData() (*mapping, bool) {
+	if !st.Mmap || (st.bytesInFile <= utils.RecordsHeaderSize) {
+		return nil, false
+	}
+	st.mapMutex.Lock()
+	defer st.mapMutex.Unlock()
+	if (st.mapped != nil) && (int64(len(st.mapped.data)) < st.bytesInFile) {
+		st.retireMapping()
+	}
+	if (st.mapped == nil) && (utils.GetNowMillis() >= st.mmapRetryAt) {
+		file, release := st.openForReading()
+		data, err := mapFile(file, 2*st.bytesInFile)
+		release()
+		switch {
+		case err == errMmapUnsupported:
+			st.mmapRetryAt = math.MaxUint64
+		case err != nil:
+			log.Warn("Falling back to buffered reads of %s for %v: %s", st.FileName, MmapRetryPeriod, err.Error())
+			st.mmapRetryAt = utils.GetNowMillis() + uint64(MmapRetryPeriod.Milliseconds())
+		default:
+			st.mapped = &mapping{data: data}
+		}
+	}
+	if st.mapped == nil {
+		return nil, false
+	}
+	st.mapped.users++
+	return st.mapped, true
+}
+
+func (st *SSTforTag) releaseMapping(m *mapping) {
+	st.mapMutex.Lock()
+	defer st.mapMutex.Unlock()
+	m.users--
+	if m.stale && (m.users == 0) {
+		utils.Check(unmapFile(m.data))
+	}
+}
 
-	err = file.Close()
+// unmap must be called with mutex locked for writing, before the file is replaced or closed.
+func (st *SSTforTag) unmap() {
+	st.mapMutex.Lock()
+	defer st.mapMutex.Unlock()
+	st.retireMapping()
+}
+
+// retireMapping drops the mapping, leaving it to readers still decoding from it to unmap it once released;
+// must be called with mapMutex held.
+func (st *SSTforTag) retireMapping() {
+	if st.mapped != nil {
+		st.mapped.stale = true
+		if st.mapped.users == 0 {
+			utils.Check(unmapFile(st.mapped.data))
+		}
+		st.mapped = nil
+	}
+}
+
+// Close unmaps and closes the file; the SST must not be used afterwards.
+func (st *SSTforTag) Close() error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.unmap()
+	return st.file.Close()
+}
+
+func (st *SSTforTag) openForReading() (*os.File, func()) {
+	if st.Files != nil {
+		file, release, err := st.Files.Acquire(st.FileName)
+		utils.Check(err)
+		return file, release
+	}
+	file, err := os.OpenFile(st.FileName, os.O_RDONLY, 0644)
 	utils.Check(err)
-	st.mutex.Unlock()
+	return file, func() {
+		utils.Check(file.Close())
+	}
+}
+
+// readerAt serves full blocks of the file through the block cache, if there is one. Must be called with mutex held.
+func (st *SSTforTag) readerAt(file *os.File) io.ReaderAt {
+	if st.Blocks == nil {
+		return file
+	}
+	return &blockReaderAt{file: file, name: st.FileName, generation: st.Blocks.Generation(st.FileName), cacheableBytes: st.bytesInFile, blocks: st.Blocks}
+}
+
+type blockReaderAt struct {
+	file           *os.File
+	name           string
+	generation     uint64
+	cacheableBytes int64
+	blocks         *BlockCache
+}
+
+func (r *blockReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	blockSize := int64(r.blocks.BlockSize)
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		idx := pos / blockSize
+		if (idx+1)*blockSize > r.cacheableBytes {
+			//tail of the file is still being appended to
+			m, err := r.file.ReadAt(p[n:], pos)
+			return n + m, err
+		}
+		block := r.blocks.getOrLoadOf(r.name, r.generation, idx, func() []byte {
+			data := make([]byte, blockSize)
+			_, err := r.file.ReadAt(data, idx*blockSize)
+			utils.Check(err)
+			return data
+		})
+		n += copy(p[n:], block[pos-idx*blockSize:])
+	}
+	return n, nil
 }
 
 func (st *SSTforTag) getCurrentMinTimestamp() uint64 {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.performExpirationIfDue()
 	min := st.index.Min()
 	if min == nil {
 		return 0
 	}
-	mine := min.(IndexEntry)
-	if (mine.expiresAt != 0) && (mine.expiresAt < utils.GetNowMillis()) {
-		st.performExpirationWithinIndex()
-		return st.getCurrentMinTimestamp()
-	} else {
-		return mine.ts
-	}
+	return min.(IndexEntry).ts
 }
 
 func (st *SSTforTag) getCurrentMaxTimestamp() uint64 {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.performExpirationIfDue()
 	max := st.index.Max()
 	if max == nil {
 		return 0
 	}
-	maxe := max.(IndexEntry)
-	if (maxe.expiresAt != 0) && (maxe.expiresAt < utils.GetNowMillis()) {
+	return max.(IndexEntry).ts
+}
+
+// performExpirationIfDue drops expired entries from the index once the earliest known expiration has passed;
+// they stay in the file until the next resorting rewrite. Must be called with mutex held.
+func (st *SSTforTag) performExpirationIfDue() {
+	if (st.nextExpirationTimestamp != 0) && (st.nextExpirationTimestamp < utils.GetNowMillis()) {
 		st.performExpirationWithinIndex()
-		return st.getCurrentMaxTimestamp()
-	} else {
-		return maxe.ts
 	}
 }
 
 func (st *SSTforTag) performExpirationWithinIndex() {
 	toBeDeleted := make([]IndexEntry, 0, DefaultSlicePreassignedMem)
 	now := utils.GetNowMillis()
+	nextExpirationTimestamp := uint64(0)
 	st.index.Ascend(func(i btree.Item) bool {
 		oe := i.(IndexEntry)
 		if (oe.expiresAt != 0) && (oe.expiresAt < now) {
 			toBeDeleted = append(toBeDeleted, oe)
+		} else {
+			nextExpirationTimestamp = earliestExpiration(nextExpirationTimestamp, oe.expiresAt)
 		}
 		return true
 	})
 	for _, i := range toBeDeleted {
 		st.index.Delete(i)
 	}
+	st.nextExpirationTimestamp = nextExpirationTimestamp
 }
 
 func (st *SSTforTag) MergeWithCommitlog(commitlogEntries []commitlog.Entry) {
 	sorted := commitlogEntries
-	sort.Slice(sorted, func(i, j int) bool {
+	//stable, so that the latest of several writes of a timestamp is also the last one written and indexed
+	sort.SliceStable(sorted, func(i, j int) bool {
 		return sorted[i].Timestamp < sorted[j].Timestamp
 	})
+	sorted = latestVersions(sorted)
 	minimalTimestamp := sorted[0].Timestamp
-	if st.getCurrentMinTimestamp() != 0 {
-		if (minimalTimestamp >= st.getCurrentMaxTimestamp()) && (st.nextCompactionTimestamp > utils.GetNowMillis()) {
+	//an expired version is not written, so it can only replace the version on disk by resorting
+	overwritesWithExpired := (minimalTimestamp == st.getCurrentMaxTimestamp()) && (sorted[0].ExpiresAt != 0) && (sorted[0].ExpiresAt < utils.GetNowMillis())
+	if st.isLinked() {
+		//the file is also part of a checkpoint, so it is replaced instead of being appended to
+		st.addDataResortingTable(sorted)
+	} else if st.getCurrentMinTimestamp() != 0 {
+		if (minimalTimestamp >= st.getCurrentMaxTimestamp()) && !overwritesWithExpired && (st.nextCompactionTimestamp > utils.GetNowMillis()) {
 			st.appendDataToEndOfTable(sorted)
 		} else {
 			st.addDataResortingTable(sorted)
@@ -194,6 +476,19 @@ func (st *SSTforTag) MergeWithCommitlog(commitlogEntries []commitlog.Entry) {
 	}
 }
 
+// latestVersions keeps the last of the entries of each timestamp, sorted by it, so that an expired version, which is
+// not written, drops the earlier ones instead of leaving them current.
+func latestVersions(sorted []commitlog.Entry) []commitlog.Entry {
+	ans := sorted[:0]
+	for i, e := range sorted {
+		if (i+1 < len(sorted)) && (sorted[i+1].Timestamp == e.Timestamp) {
+			continue
+		}
+		ans = append(ans, e)
+	}
+	return ans
+}
+
 func (st *SSTforTag) appendDataToEndOfTable(commitlogEntries []commitlog.Entry) {
 	log.Debug("Appending to end of table")
 	st.mutex.Lock()
@@ -202,9 +497,16 @@ func (st *SSTforTag) appendDataToEndOfTable(commitlogEntries []commitlog.Entry)
 	writer := bufio.NewWriter(st.file)
 	for _, entry := range commitlogEntries {
 		sstEntry := Entry{Timestamp: entry.Timestamp, ExpiresAt: entry.ExpiresAt, Value: entry.Value}
+		written := writeEntryToFile(sstEntry, writer)
+		if written == 0 {
+			continue
+		}
 		st.index.ReplaceOrInsert(buildIndexEntry(sstEntry.Timestamp, offset, sstEntry.ExpiresAt))
-		offset += writeEntryToFile(sstEntry, writer)
+		st.nextExpirationTimestamp = earliestExpiration(st.nextExpirationTimestamp, sstEntry.ExpiresAt)
+		st.entriesInFile++
+		offset += written
 	}
+	st.bytesInFile = offset
 	err = writer.Flush()
 	st.file.Sync()
 	utils.Check(err)
@@ -215,19 +517,41 @@ func (st *SSTforTag) addDataResortingTable(commitlogEntries []commitlog.Entry) {
 	log.Debug("Adding and resorting the table")
 	//TODO: what should I do if there is equal TS in both commitlog and already existing file?
 	copyFileName := st.FileName + ".copy"
-	copyFile, err := os.OpenFile(copyFileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	copyFile, err := os.OpenFile(copyFileName, os.O_APPEND|os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 	utils.Check(err)
 	writer := bufio.NewWriter(copyFile)
+	_, err = writer.Write(utils.RecordsHeader())
+	utils.Check(err)
 	idx := 0
 
+	//the index of the copy is built while writing it, so it can be swapped in together with the file
+	index := btree.New(4)
+	nextExpirationTimestamp := uint64(0)
+	entriesInFile := 0
+	offset := int64(utils.RecordsHeaderSize)
+	write := func(e Entry) {
+		written := writeEntryToFile(e, writer)
+		if written == 0 {
+			return
+		}
+		index.ReplaceOrInsert(buildIndexEntry(e.Timestamp, offset, e.ExpiresAt))
+		nextExpirationTimestamp = earliestExpiration(nextExpirationTimestamp, e.ExpiresAt)
+		entriesInFile++
+		offset += written
+	}
+
 	//over sstable
 	st.iterateOverFileAndApplyForAllEntries(func(sstEntry Entry, o int64) {
+		//overwritten versions stay in the file until resorted; only the indexed one is current
+		if current := st.index.Get(IndexEntry{ts: sstEntry.Timestamp}); (current == nil) || (current.(IndexEntry).fileOffset != o) {
+			return
+		}
 		banExistingEntry := false
 		for idx < len(commitlogEntries) {
 			commitlogEntry := commitlogEntries[idx]
 			if commitlogEntry.Timestamp <= sstEntry.Timestamp {
 				newSstEntry := Entry{Timestamp: commitlogEntry.Timestamp, ExpiresAt: commitlogEntry.ExpiresAt, Value: commitlogEntry.Value}
-				writeEntryToFile(newSstEntry, writer)
+				write(newSstEntry)
 				//log.Debug("write new %d", newSstEntry.Timestamp)
 				if commitlogEntry.Timestamp == sstEntry.Timestamp {
 					banExistingEntry = true
@@ -238,20 +562,18 @@ func (st *SSTforTag) addDataResortingTable(commitlogEntries []commitlog.Entry) {
 			}
 		}
 		if !banExistingEntry {
-			writeEntryToFile(sstEntry, writer)
+			write(sstEntry)
 			//log.Debug("write exis %d", sstEntry.Timestamp)
 		} else {
 			log.Warn("Not writing old entry for tag %s ts %d as there is newer entry", st.Tag, sstEntry.Timestamp)
 		}
 	})
 
-	st.mutex.Lock()
-
 	//over still unprocessed new commitlog entries, if there are any
 	for idx < len(commitlogEntries) {
 		newEntry := commitlogEntries[idx]
 		sstEntry := Entry{Timestamp: newEntry.Timestamp, ExpiresAt: newEntry.ExpiresAt, Value: newEntry.Value}
-		writeEntryToFile(sstEntry, writer)
+		write(sstEntry)
 		idx += 1
 	}
 
@@ -259,68 +581,284 @@ func (st *SSTforTag) addDataResortingTable(commitlogEntries []commitlog.Entry) {
 	copyFile.Sync()
 	copyFile.Close()
 
+	st.mutex.Lock()
+	st.unmap()
 	st.file.Close()
 	err = os.Rename(copyFileName, st.FileName)
 	utils.Check(err)
-	st.mutex.Unlock()
+	if st.linked {
+		//the new file is linked nowhere
+		if err := os.Remove(st.FileName + LinkedSuffix); !os.IsNotExist(err) {
+			utils.Check(err)
+		}
+		st.linked = false
+	}
+	if st.Files != nil {
+		st.Files.Invalidate(st.FileName)
+	}
+	if st.Blocks != nil {
+		st.Blocks.Invalidate(st.FileName)
+	}
 	st.reopenFile()
-	st.rebuildIndex()
+	st.index = index
+	st.nextExpirationTimestamp = nextExpirationTimestamp
+	st.entriesInFile = entriesInFile
+	st.bytesInFile = offset
+	st.mutex.Unlock()
 	st.nextCompactionTimestamp = utils.GetNowMillis() + uint64(st.PerformCompactionEvery.Milliseconds())
 }
 
+// linkTo hard links the file as fileName, e.g. into a checkpoint, which later merges must leave untouched. Both names
+// are marked as linked before, so that neither is appended to, whether opened by this store or as one of its own.
+func (st *SSTforTag) linkTo(fileName string) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	for _, name := range []string{st.FileName, fileName} {
+		if err := utils.WriteFileSynced(name+LinkedSuffix, nil); err != nil {
+			return err
+		}
+	}
+	st.linked = true
+	return utils.LinkOrCopy(st.FileName, fileName)
+}
+
+// isLinked is marked next to the file, so that it holds across restarts as well; where the link count tells, a file
+// whose other names are all removed is no longer linked.
+func (st *SSTforTag) isLinked() bool {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	if !st.linked {
+		return false
+	}
+	info, err := os.Stat(st.FileName)
+	return (err == nil) && hasOtherLinks(info)
+}
+
 func (st *SSTforTag) GetEntriesWithoutIndex(fromTs uint64, toTs uint64) []Entry {
 	if st.index.Len() == 0 {
 		return []Entry{}
 	}
 	ans := make([]Entry, 0, DefaultSlicePreassignedMem)
 	now := utils.GetNowMillis()
-	st.iterateOverFileAndApplyForAllEntries(func(e Entry, o int64) {
+	st.iterateOverFileWhile(utils.RecordsHeaderSize, int((^uint(0))>>1), true, func(e Entry, o int64) bool {
 		if (e.Timestamp > 0) && (e.Timestamp >= fromTs) && (e.Timestamp <= toTs) && ((e.ExpiresAt == 0) || (e.ExpiresAt >= now)) {
 			ans = append(ans, e)
 		}
+		return true
 	})
 	return ans
 }
 
 func (st *SSTforTag) GetEntriesWithIndex(fromTs uint64, toTs uint64) []Entry {
-	count := 0
-	firstOffset := int64(-1)
+	ans := make([]Entry, 0, DefaultSlicePreassignedMem)
+	st.IterateEntriesWithIndex(fromTs, toTs, func(e Entry) bool {
+		ans = append(ans, e)
+		return true
+	})
+	return ans
+}
+
+// IterateEntriesWithIndex walks live entries in [fromTs, toTs] in ascending order; receiver returns false to stop early.
+// Overwritten versions of a point stay in the file until resorted, so only entries at indexed offsets are returned.
+// Receiver runs without mutex held, reading a snapshot of the file, so that writers are not held up by slow receivers.
+// Receiver may keep entries: values are copied out of a mapping of the file, and only out of it.
+func (st *SSTforTag) IterateEntriesWithIndex(fromTs uint64, toTs uint64, receiver func(Entry) bool) {
 	now := utils.GetNowMillis()
+	st.mutex.RLock()
 	if st.index.Len() == 0 {
-		return []Entry{}
+		st.mutex.RUnlock()
+		return
 	}
-	st.mutex.Lock()
+	offsets := make([]int64, 0, DefaultSlicePreassignedMem)
 	st.index.AscendRange(buildIndexEntry(fromTs, 0, 0), buildIndexEntry(toTs+1, 0, 0), func(i btree.Item) bool {
 		oe := i.(IndexEntry)
 		if (oe.expiresAt != 0) && (oe.expiresAt < now) {
 			return true
 		}
 		//log.Debug(fmt.Sprintf("ascendRange on tag %s entry ts %d offset %d", st.Tag, oe.ts, oe.fileOffset))
-		if firstOffset == -1 {
+		offsets = append(offsets, oe.fileOffset)
+		return true
+	})
+	if len(offsets) == 0 {
+		st.mutex.RUnlock()
+		return
+	}
+	snap := st.snapshot()
+	st.mutex.RUnlock()
+	defer snap.release()
+	received := 0
+	stopped := false
+	st.readFileWhile(snap, offsets[0], int((^uint(0))>>1), func(e Entry, o int64) bool {
+		if o < offsets[received] {
+			return true
+		}
+		if o > offsets[received] {
+			panic(fmt.Sprintf("index of tag %s points to offset %d which is not an entry", st.Tag, offsets[received]))
+		}
+		received++
+		if !receiver(snap.kept(e)) {
+			stopped = true
+			return false
+		}
+		return received < len(offsets)
+	})
+	if !stopped && (received != len(offsets)) {
+		panic(fmt.Sprintf("MISMATCH IN LENGTH ON TAG %s: INDEX SAID %d, IN REALITY WAS %d", st.Tag, len(offsets), received))
+	}
+}
+
+// LastEntries returns up to n newest live entries in ascending order, reading only the tail of the file
+// starting at the oldest of them.
+func (st *SSTforTag) LastEntries(n int) []Entry {
+	wantedOffsets := make(map[int64]struct{})
+	firstOffset := int64(-1)
+	now := utils.GetNowMillis()
+	st.mutex.RLock()
+	st.index.Descend(func(i btree.Item) bool {
+		if len(wantedOffsets) >= n {
+			return false
+		}
+		oe := i.(IndexEntry)
+		if (oe.expiresAt != 0) && (oe.expiresAt < now) {
+			return true
+		}
+		wantedOffsets[oe.fileOffset] = struct{}{}
+		if (firstOffset == -1) || (oe.fileOffset < firstOffset) {
 			firstOffset = oe.fileOffset
 		}
-		count += 1
 		return true
 	})
-	st.mutex.Unlock()
-	ans := make([]Entry, 0, DefaultSlicePreassignedMem)
-	countInFile := 0
-	st.iterateOverFileAndApplyForEntries(firstOffset, count, func(e Entry, i int64) {
-		if (e.Timestamp > 0) && (e.Timestamp >= fromTs) && (e.Timestamp <= toTs) && ((e.ExpiresAt == 0) || (e.ExpiresAt >= now)) {
-			ans = append(ans, e)
+	ans := make([]Entry, 0, len(wantedOffsets))
+	if len(wantedOffsets) == 0 {
+		st.mutex.RUnlock()
+		return ans
+	}
+	snap := st.snapshot()
+	st.mutex.RUnlock()
+	defer snap.release()
+	st.readFileWhile(snap, firstOffset, int((^uint(0))>>1), func(e Entry, o int64) bool {
+		if _, wanted := wantedOffsets[o]; wanted {
+			ans = append(ans, snap.kept(e))
 		}
-		countInFile++
+		return true
 	})
-	if len(ans) != count {
-		panic(fmt.Sprintf("MISMATCH IN LENGTH ON TAG %s: INDEX SAID %d, IN REALITY WAS %d", st.Tag, count, len(ans)))
-	}
 	return ans
 }
 
+// IterateEntriesDescending walks live entries in [fromTs, toTs] newest first, reading the file backwards
+// in blocks of DescendingBlockEntries index entries; receiver returns false to stop early. As with
+// IterateEntriesWithIndex, receiver runs without mutex held and may keep entries.
+func (st *SSTforTag) IterateEntriesDescending(fromTs uint64, toTs uint64, receiver func(Entry) bool) {
+	now := utils.GetNowMillis()
+	st.mutex.RLock()
+	if st.index.Len() == 0 {
+		st.mutex.RUnlock()
+		return
+	}
+	offsets := make([]int64, 0, DefaultSlicePreassignedMem)
+	st.index.DescendLessOrEqual(buildIndexEntry(toTs, 0, 0), func(i btree.Item) bool {
+		oe := i.(IndexEntry)
+		if oe.ts < fromTs {
+			return false
+		}
+		if (oe.expiresAt == 0) || (oe.expiresAt >= now) {
+			offsets = append(offsets, oe.fileOffset)
+		}
+		return true
+	})
+	if len(offsets) == 0 {
+		st.mutex.RUnlock()
+		return
+	}
+	snap := st.snapshot()
+	st.mutex.RUnlock()
+	defer snap.release()
+
+	//the first block ends with the newest wanted entry rather than the file
+	blockEnd := offsets[0] + 2 + int64(st.entryLengthAt(snap, offsets[0]))
+	for blockStartIdx := 0; blockStartIdx < len(offsets); blockStartIdx += DescendingBlockEntries {
+		blockEndIdx := blockStartIdx + DescendingBlockEntries
+		if blockEndIdx > len(offsets) {
+			blockEndIdx = len(offsets)
+		}
+		wanted := offsets[blockStartIdx:blockEndIdx]
+		blockStart := wanted[len(wanted)-1]
+		var block []byte
+		if snap.mapped != nil {
+			block = snap.mapped.data[blockStart:blockEnd]
+		} else {
+			block = make([]byte, blockEnd-blockStart)
+			_, err := snap.reader.ReadAt(block, blockStart)
+			utils.Check(err)
+		}
+
+		entries := make(map[int64]Entry, len(wanted))
+		decodeBlock(block, blockStart, func(e Entry, o int64) {
+			entries[o] = e
+		})
+		for _, o := range wanted {
+			e, found := entries[o]
+			if !found {
+				panic(fmt.Sprintf("index of tag %s points to offset %d which is not an entry", st.Tag, o))
+			}
+			if !receiver(snap.kept(e)) {
+				return
+			}
+		}
+		blockEnd = blockStart
+	}
+}
+
+// entryLengthAt reads the length prefix of the entry at offset.
+func (st *SSTforTag) entryLengthAt(snap fileSnapshot, offset int64) uint16 {
+	if snap.mapped != nil {
+		return binary.LittleEndian.Uint16(snap.mapped.data[offset:])
+	}
+	sizeBuf := make([]byte, 2)
+	_, err := snap.reader.ReadAt(sizeBuf, offset)
+	utils.Check(err)
+	return binary.LittleEndian.Uint16(sizeBuf)
+}
+
+func decodeBlock(block []byte, blockOffset int64, receiver func(Entry, int64)) {
+	pos := 0
+	for pos+2 <= len(block) {
+		entrySize := int(binary.LittleEndian.Uint16(block[pos:]))
+		if pos+2+entrySize > len(block) {
+			panic(fmt.Sprintf("entry at offset %d crosses block end", blockOffset+int64(pos)))
+		}
+		receiver(entryOf(utils.PayloadOf(block[pos+2:pos+2+entrySize])), blockOffset+int64(pos))
+		pos += 2 + entrySize
+	}
+}
+
 func (st *SSTforTag) Availability() (uint64, uint64) {
 	return st.getCurrentMinTimestamp(), st.getCurrentMaxTimestamp()
 }
 
+// Stats is maintained incrementally on writes; entries dropped from the index but still present
+// in the file, whether expired or overwritten, are reported as ExpiredNotCompacted.
+func (st *SSTforTag) Stats() Stats {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.performExpirationIfDue()
+	ans := Stats{Points: st.index.Len(), Bytes: st.bytesInFile, ExpiredNotCompacted: st.entriesInFile - st.index.Len()}
+	if min := st.index.Min(); min != nil {
+		ans.First = min.(IndexEntry).ts
+	}
+	if max := st.index.Max(); max != nil {
+		ans.Last = max.(IndexEntry).ts
+	}
+	return ans
+}
+
+func earliestExpiration(current uint64, expiresAt uint64) uint64 {
+	if (expiresAt != 0) && ((current == 0) || (expiresAt < current)) {
+		return expiresAt
+	}
+	return current
+}
+
 func writeEntryToFile(e Entry, w *bufio.Writer) int64 {
 	if (e.ExpiresAt != 0) && (e.ExpiresAt < utils.GetNowMillis()) {
 		log.Debug("Attempt to WriteEntryToFile that was expired")
@@ -0,0 +1,33 @@
+package sst
+
+import (
+	"fmt"
+	"lsmstore/utils"
+	"testing"
+)
+
+func BenchmarkRangeScanMmapVsBuffered(b *testing.B) {
+	path := fmt.Sprintf("/tmp/golsm_test/benchMmap-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx())
+	writer := SSTforTag{FileName: path}
+	writer.InitStorage()
+	writer.MergeWithCommitlog(getBigBatchOfEntriesOfSize(50000, 1000, 0, 256))
+	min, max := writer.Availability()
+
+	readers := []struct {
+		name string
+		st   *SSTforTag
+	}{
+		{"buffered", &SSTforTag{FileName: path}},
+		{"mmap", &SSTforTag{FileName: path, Mmap: true}},
+	}
+	for _, reader := range readers {
+		reader.st.InitStorage()
+		b.Run(reader.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				from := randomTs(min, min+(max-min)/2)
+				to := randomTs(from, max)
+				reader.st.GetEntriesWithIndex(from, to)
+			}
+		})
+	}
+}
@@ -149,20 +149,30 @@ func TestSSTforTag_WritesSortedFile(t *testing.T) {
 	st.MergeWithCommitlog(actualEntries3)
 
 	entries := st.GetAllEntries()
+	lastEntries := st.LastEntries(3)
 
 	//then
 	assert.Equal(t, 1500, len(entries), "size incorrect") //not 3000 because of repeating TSs
+	assert.Equal(t, entries[1497:], lastEntries, "last entries incorrect")
 }
 
-func TestSSTforTag_ReadsExistingFile(t *testing.T) {
+func TestSSTforTag_ReadsExistingFileOfFirstVersion(t *testing.T) {
 	//given
-	st := SSTforTag{FileName: "test_3yYHfn"}
+	path := fmt.Sprintf("/tmp/golsm_test/test_3yYHfn-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	os.MkdirAll("/tmp/golsm_test", os.ModePerm)
+	assert.Nil(t, utils.CopyFile("test_3yYHfn", path))
+	st := SSTforTag{FileName: path}
 	st.InitStorage()
 
 	//when
 	min, max := st.Availability()
+	migrated, scanErr := ScanFile(path, func(Entry, int64) {})
 
 	//then
+	assert.Nil(t, scanErr)
+	assert.Equal(t, utils.RecordsVersion, migrated.Version, "file was not migrated")
+	assert.True(t, migrated.Clean(), migrated.Problems)
+	assert.Equal(t, 3600, migrated.Records)
 	assert.Equal(t, uint64(1599759420524), min, "min ts incorrect") //Thursday, 10 September 2020 г., 17:37:00.524
 	assert.Equal(t, uint64(1599763019524), max, "max ts incorrect") //Thursday, 10 September 2020 г., 18:36:59.524
 
@@ -186,6 +196,226 @@ func TestSSTforTag_ReadsExistingFile(t *testing.T) {
 	}
 }
 
+func TestSSTforTag_DescendingIterationWorks(t *testing.T) {
+	//given
+	st := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx())}
+	st.InitStorage()
+	st.MergeWithCommitlog(getBigBatchOfEntries(1000, 1000, 0))
+	overwrite := getBigBatchOfEntriesOfSize(1, 1999, 0, 7)
+	st.MergeWithCommitlog(overwrite)
+
+	for _, r := range [][2]uint64{{0, 100000}, {10000, 19990}, {12345, 17777}, {15000, 15000}, {15001, 15009}} {
+		//when
+		ascending := st.GetEntriesWithIndex(r[0], r[1])
+		descending := make([]Entry, 0)
+		st.IterateEntriesDescending(r[0], r[1], func(e Entry) bool {
+			descending = append(descending, e)
+			return true
+		})
+
+		//then
+		assert.Equal(t, len(ascending), len(descending), fmt.Sprintf("size incorrect for %d-%d", r[0], r[1]))
+		for i := range ascending {
+			assert.Equal(t, ascending[i], descending[len(descending)-1-i], "entry is not the same when descending")
+		}
+	}
+
+	//when
+	firstThree := make([]Entry, 0)
+	st.IterateEntriesDescending(0, 100000, func(e Entry) bool {
+		firstThree = append(firstThree, e)
+		return len(firstThree) < 3
+	})
+
+	//then
+	assert.Equal(t, 3, len(firstThree), "iteration did not stop")
+	assert.Equal(t, 7, len(firstThree[0].Value), "overwritten entry returned")
+	assert.Equal(t, uint64(19970), firstThree[2].Timestamp, "incorrect order")
+}
+
+func TestSSTforTag_DescendingIterationReadsOnlyBlocksOfRange(t *testing.T) {
+	//given
+	bc := BlockCache{MaxBytes: 1024 * 1024, BlockSize: 1024}
+	bc.Init()
+	st := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx()), Blocks: &bc}
+	st.InitStorage()
+	st.MergeWithCommitlog(getBigBatchOfEntries(10000, 1000, 0))
+
+	//when
+	descending := make([]Entry, 0)
+	st.IterateEntriesDescending(60000, 60090, func(e Entry) bool {
+		descending = append(descending, e)
+		return true
+	})
+
+	//then
+	assert.Equal(t, 10, len(descending))
+	assert.Equal(t, uint64(60090), descending[0].Timestamp)
+	assert.Equal(t, uint64(60000), descending[9].Timestamp)
+	assert.LessOrEqual(t, bc.Stats().Misses, uint64(2), "blocks after the range were read")
+}
+
+func TestSSTforTag_ValuesAreCopiedOnceOnEitherPath(t *testing.T) {
+	for _, mmap := range []bool{false, true} {
+		//given
+		st := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx()), Mmap: mmap}
+		st.InitStorage()
+		st.MergeWithCommitlog(getEntriesWithValues(1000, 1000, 1))
+		st.GetEntriesWithIndex(1000, 2000)
+
+		//when
+		allocs := testing.AllocsPerRun(5, func() {
+			st.GetEntriesWithIndex(1000, 2000)
+		})
+
+		//then
+		assert.Less(t, allocs, float64(1100), "values were copied more than once with mmap %v", mmap)
+		assertEntriesHaveValues(t, st.GetEntriesWithIndex(1000, 2000), 1)
+		assert.Nil(t, st.Close())
+	}
+}
+
+func TestSSTforTag_StatsAreMaintained(t *testing.T) {
+	//given
+	st := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx())}
+	st.InitStorage()
+	expiring := getBigBatchOfEntries(10, 1000, 0)
+	for i := range expiring {
+		expiring[i].ExpiresAt = utils.GetNowMillis() + 500
+	}
+
+	//when
+	st.MergeWithCommitlog(expiring)
+	st.MergeWithCommitlog(getBigBatchOfEntries(5, 1010, 0))
+	stats := st.Stats()
+
+	//then
+	assert.Equal(t, Stats{First: 10000, Last: 10140, Points: 15, Bytes: 8 + 15*26, ExpiredNotCompacted: 0}, stats)
+
+	//when
+	time.Sleep(time.Second)
+	stats = st.Stats()
+
+	//then
+	assert.Equal(t, Stats{First: 10100, Last: 10140, Points: 5, Bytes: 8 + 15*26, ExpiredNotCompacted: 10}, stats)
+
+	//when
+	st.MergeWithCommitlog(getBigBatchOfEntries(1, 1000, 5))
+	stats = st.Stats()
+
+	//then
+	assert.Equal(t, Stats{First: 10005, Last: 10140, Points: 6, Bytes: 8 + 6*26, ExpiredNotCompacted: 0}, stats, "resorting did not compact")
+
+	//given
+	st = SSTforTag{FileName: st.FileName}
+	st.InitStorage()
+
+	//then
+	assert.Equal(t, stats, st.Stats(), "stats changed after reopening")
+}
+
+func TestSSTforTag_LinkedFileIsNotAppendedToAfterReopening(t *testing.T) {
+	//given
+	st := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx())}
+	st.InitStorage()
+	linkName := st.FileName + ".checkpoint"
+	assert.Nil(t, st.linkTo(linkName))
+
+	//when
+	st = SSTforTag{FileName: st.FileName}
+	st.InitStorage()
+	linkedAfterReopening := st.isLinked()
+	st.MergeWithCommitlog(getBigBatchOfEntries(5, 1000, 0))
+
+	//then
+	assert.True(t, linkedAfterReopening, "link was forgotten on reopening")
+	linked, err := os.Stat(linkName)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(utils.RecordsHeaderSize), linked.Size(), "linked file was appended to")
+	assert.Equal(t, 5, len(st.GetAllEntries()))
+	assert.False(t, st.isLinked(), "replaced file is still considered linked")
+}
+
+func TestSSTforTag_LinksAreTrackedOnBothNames(t *testing.T) {
+	//given
+	st := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx())}
+	st.InitStorage()
+	st.MergeWithCommitlog(getBigBatchOfEntries(5, 1000, 0))
+	unmarked := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx())}
+	unmarked.InitStorage()
+	assert.Nil(t, os.Link(unmarked.FileName, unmarked.FileName+"-link"))
+	linkName := st.FileName + ".checkpoint"
+	assert.Nil(t, st.linkTo(linkName))
+
+	//when
+	linked := SSTforTag{FileName: linkName}
+	linked.InitStorage()
+	linkedIsLinked := linked.isLinked()
+	linked.MergeWithCommitlog(getBigBatchOfEntries(5, 2000, 0))
+	st.MergeWithCommitlog(getBigBatchOfEntries(5, 3000, 0))
+
+	//then
+	assert.True(t, linkedIsLinked, "other name of the file is not marked as linked")
+	assert.False(t, unmarked.isLinked(), "file linked outside of linkTo is taken as linked")
+	assert.False(t, utils.FileExists(linkName+LinkedSuffix), "replaced file is still marked as linked")
+	assert.False(t, utils.FileExists(st.FileName+LinkedSuffix), "replaced file is still marked as linked")
+	linkedEntries, entries := linked.GetAllEntries(), st.GetAllEntries()
+	assert.Equal(t, 10, len(linkedEntries))
+	assert.Equal(t, uint64(20040), linkedEntries[9].Timestamp, "file was changed through its other name")
+	assert.Equal(t, 10, len(entries))
+	assert.Equal(t, uint64(30040), entries[9].Timestamp, "file was changed through its other name")
+}
+
+func TestSSTforTag_ExpiredVersionDropsEarlierOnes(t *testing.T) {
+	//given
+	st := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx())}
+	st.InitStorage()
+	expired := utils.GetNowMillis() - 1
+	st.MergeWithCommitlog([]commitlog.Entry{{Timestamp: 10, Value: []byte{1}}, {Timestamp: 20, Value: []byte{1}}})
+
+	//when
+	st.MergeWithCommitlog([]commitlog.Entry{{Timestamp: 20, ExpiresAt: expired, Value: []byte{2}}})
+	st.MergeWithCommitlog([]commitlog.Entry{{Timestamp: 30, Value: []byte{1}}, {Timestamp: 30, ExpiresAt: expired, Value: []byte{2}}})
+	entries := st.GetAllEntries()
+	st = SSTforTag{FileName: st.FileName}
+	st.InitStorage()
+
+	//then
+	assert.Equal(t, []Entry{{Timestamp: 10, Value: []byte{1}}}, entries, "expired version left an earlier one current")
+	assert.Equal(t, []Entry{{Timestamp: 10, Value: []byte{1}}}, st.GetAllEntries(), "earlier version is current after reopening")
+}
+
+func TestSSTforTag_ReceiversDoNotHoldUpWrites(t *testing.T) {
+	for _, mmap := range []bool{false, true} {
+		//given
+		st := SSTforTag{FileName: fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx()), Mmap: mmap}
+		st.InitStorage()
+		st.MergeWithCommitlog(getBigBatchOfEntries(10, 1000, 0))
+		mergeWhileReceiving := func(batch []commitlog.Entry) func(Entry) bool {
+			return func(e Entry) bool {
+				merged := make(chan struct{})
+				go func() {
+					st.MergeWithCommitlog(batch)
+					close(merged)
+				}()
+				select {
+				case <-merged:
+				case <-time.After(5 * time.Second):
+					t.Fatal("write waited for receiver")
+				}
+				return false
+			}
+		}
+
+		//when
+		st.IterateEntriesWithIndex(0, 20000, mergeWhileReceiving(getBigBatchOfEntries(10, 1010, 0)))
+		st.IterateEntriesDescending(0, 20000, mergeWhileReceiving(getBigBatchOfEntries(10, 990, 0)))
+
+		//then
+		assert.Equal(t, 30, len(st.GetEntriesWithIndex(0, 20000)), "mmap %v", mmap)
+	}
+}
+
 func Teardown(t *testing.T) {
 	log.Close()
 }
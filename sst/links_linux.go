@@ -0,0 +1,14 @@
+//go:build linux
+// +build linux
+
+package sst
+
+import (
+	"os"
+	"syscall"
+)
+
+func hasOtherLinks(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && (stat.Nlink > 1)
+}
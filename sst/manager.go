@@ -3,22 +3,41 @@ package sst
 import (
 	"io/ioutil"
 	"lsmstore/commitlog"
+	"lsmstore/utils"
+	"strings"
 	"sync"
-
-	"github.com/btcsuite/btcutil/base58"
 )
 
+// Manager shares one FileCache and one BlockCache between all its SSTs; a negative BlockCacheBytes disables the block cache.
+// With Mmap set, SSTs are read from memory-mapped files instead, leaving caching to the OS page cache.
 type Manager struct {
-	RootDir   string
-	sstForTag map[string]*SSTforTag
-	mutex     *sync.Mutex
+	RootDir         string
+	MaxOpenFiles    int
+	BlockCacheBytes int64
+	BlockSize       int
+	Mmap            bool
+	sstForTag       map[string]*SSTforTag
+	files           *FileCache
+	blocks          *BlockCache
+	mutex           *sync.Mutex
 }
 
 func (sm *Manager) InitStorage() {
 	sm.sstForTag = make(map[string]*SSTforTag)
+	sm.mutex = &sync.Mutex{}
+	sm.files = &FileCache{MaxOpenFiles: sm.MaxOpenFiles}
+	sm.files.Init()
+	if sm.BlockCacheBytes >= 0 {
+		sm.blocks = &BlockCache{MaxBytes: sm.BlockCacheBytes, BlockSize: sm.BlockSize}
+		sm.blocks.Init()
+	}
 	files, _ := ioutil.ReadDir(sm.RootDir)
 	for _, f := range files {
-		tag := string(base58.Decode(f.Name()))
+		if f.IsDir() || strings.Contains(f.Name(), ".") {
+			//not an SST: catalog or leftover of interrupted resorting
+			continue
+		}
+		tag := TagOfFileName(f.Name())
 		sm.SstForTag(tag)
 	}
 }
@@ -46,7 +65,7 @@ func (sm *Manager) Availability() (uint64, uint64) {
 	fromts := ^uint64(0)
 	tots := uint64(0)
 
-	for _, sstft := range sm.sstForTag {
+	for _, sstft := range sm.allSstForTag() {
 		f, t := sstft.Availability()
 		if fromts > f {
 			fromts = f
@@ -63,6 +82,8 @@ func (sm *Manager) Availability() (uint64, uint64) {
 }
 
 func (sm *Manager) SstForTag(tag string) *SSTforTag {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
 	sstForTag, sstForTagExists := sm.sstForTag[tag]
 	if !sstForTagExists {
 		sstForTag = sm.createSstForTag(tag)
@@ -70,9 +91,16 @@ func (sm *Manager) SstForTag(tag string) *SSTforTag {
 	return sstForTag
 }
 
+func (sm *Manager) ExistingSstForTag(tag string) (*SSTforTag, bool) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sstForTag, sstForTagExists := sm.sstForTag[tag]
+	return sstForTag, sstForTagExists
+}
+
 func (sm *Manager) createSstForTag(tag string) *SSTforTag {
 	// fmt.Println(tag)
-	sst := SSTforTag{Tag: tag, FileName: sm.RootDir + "/" + base58.Encode([]byte(tag))}
+	sst := SSTforTag{Tag: tag, FileName: sm.fileNameForTag(tag), Files: sm.files, Blocks: sm.blocks, Mmap: sm.Mmap}
 	// fmt.Println(sst)
 	sst.InitStorage()
 	sm.sstForTag[tag] = &sst
@@ -80,6 +108,8 @@ func (sm *Manager) createSstForTag(tag string) *SSTforTag {
 }
 
 func (sm *Manager) GetTags() []string {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
 	keys := make([]string, len(sm.sstForTag))
 	i := 0
 	for k := range sm.sstForTag {
@@ -88,3 +118,64 @@ func (sm *Manager) GetTags() []string {
 	}
 	return keys
 }
+
+func (sm *Manager) allSstForTag() []*SSTforTag {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	ans := make([]*SSTforTag, 0, len(sm.sstForTag))
+	for _, sstft := range sm.sstForTag {
+		ans = append(ans, sstft)
+	}
+	return ans
+}
+
+// Close closes every SST and the files cached for reading them, returning the first error; nothing may be merged
+// nor read meanwhile or afterwards.
+func (sm *Manager) Close() error {
+	var ans error
+	for _, sstForTag := range sm.allSstForTag() {
+		if err := sstForTag.Close(); (err != nil) && (ans == nil) {
+			ans = err
+		}
+	}
+	sm.files.Close()
+	return ans
+}
+
+func (sm *Manager) OpenFilesCount() int {
+	return sm.files.Len()
+}
+
+func (sm *Manager) fileNameForTag(tag string) string {
+	return sm.RootDir + "/" + FileNameForTag(tag)
+}
+
+// LinkTo hard links every SST into dir; nothing may be merged meanwhile. Syncing dir is left to the caller.
+func (sm *Manager) LinkTo(dir string) error {
+	for _, sstForTag := range sm.allSstForTag() {
+		if err := sstForTag.linkTo(dir + "/" + FileNameForTag(sstForTag.Tag)); err != nil {
+			return err
+		}
+	}
+	return utils.SyncDir(sm.RootDir)
+}
+
+// PinTag keeps cached blocks of the tag's SST in memory regardless of the block cache size.
+func (sm *Manager) PinTag(tag string) {
+	if sm.blocks != nil {
+		sm.blocks.Pin(sm.fileNameForTag(tag))
+	}
+}
+
+func (sm *Manager) UnpinTag(tag string) {
+	if sm.blocks != nil {
+		sm.blocks.Unpin(sm.fileNameForTag(tag))
+	}
+}
+
+func (sm *Manager) BlockCacheStats() BlockCacheStats {
+	if sm.blocks == nil {
+		return BlockCacheStats{}
+	}
+	return sm.blocks.Stats()
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"lsmstore/commitlog"
 	"lsmstore/utils"
+	"sync"
 	"testing"
 
 	log "github.com/jeanphorn/log4go"
@@ -54,6 +55,45 @@ func TestSSTManager_SanityCheck(t *testing.T) {
 	log.Close()
 }
 
+func TestSSTManager_ParallelReadsShareBoundedFileHandles(t *testing.T) {
+	//given
+	m := Manager{RootDir: fmt.Sprintf("/tmp/golsm_test/test-for-SSTManager-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()), MaxOpenFiles: 4}
+	m.InitStorage()
+	entries := make([]commitlog.Entry, 0)
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 100; j++ {
+			entries = append(entries, commitlog.Entry{Key: []byte(fmt.Sprintf("tag%d", i)), Timestamp: 1337 + uint64(j), Value: make([]byte, 4)})
+		}
+	}
+	m.MergeWithCommitlog(entries)
+
+	//when
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				tag := fmt.Sprintf("tag%d", (w+i)%20)
+				assert.Equal(t, 50, len(m.SstForTag(tag).GetEntriesWithIndex(1387, 1436)), "entries count incorrect for "+tag)
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 40; i++ {
+			//resorting swaps files underneath the readers
+			tag := fmt.Sprintf("tag%d", i%20)
+			m.MergeWithCommitlog([]commitlog.Entry{{Key: []byte(tag), Timestamp: 1000 + uint64(i), Value: make([]byte, 4)}})
+		}
+	}()
+	wg.Wait()
+
+	//then
+	assert.LessOrEqual(t, m.OpenFilesCount(), 4, "too many files kept open")
+}
+
 func getDummyCommitlogEntriesForMultipleTags() []commitlog.Entry {
 	ans := make([]commitlog.Entry, 5)
 	ans[0] = commitlog.Entry{Key: []byte("tagZero"), Timestamp: 1337, ExpiresAt: 0, Value: make([]byte, 4)}
@@ -0,0 +1,17 @@
+//go:build linux
+// +build linux
+
+package sst
+
+import (
+	"os"
+	"syscall"
+)
+
+func mapFile(file *os.File, size int64) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func unmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
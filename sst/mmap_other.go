@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package sst
+
+import "os"
+
+func mapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func unmapFile(data []byte) error {
+	return errMmapUnsupported
+}
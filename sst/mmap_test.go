@@ -0,0 +1,111 @@
+package sst
+
+import (
+	"fmt"
+	"lsmstore/utils"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSSTforTag_MmapReadsMatchBufferedReads(t *testing.T) {
+	//given
+	path := fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx())
+	st := SSTforTag{FileName: path, Mmap: true}
+	st.InitStorage()
+	st.MergeWithCommitlog(getEntriesWithValues(100, 1000, 1))
+
+	//when
+	mapped := st.GetEntriesWithIndex(1000, 2000)
+
+	//then
+	assert.Equal(t, 100, len(mapped))
+	assertEntriesHaveValues(t, mapped, 1)
+	assert.NotNil(t, st.mapped, "file was not mapped")
+
+	//when
+	st.MergeWithCommitlog(getEntriesWithValues(10, 1100, 1))
+	appended := st.GetEntriesWithIndex(1000, 2000)
+
+	//then
+	assert.Equal(t, 110, len(appended), "appended entries are not visible through the mapping")
+	assertEntriesHaveValues(t, appended, 1)
+
+	//when
+	st.MergeWithCommitlog(getEntriesWithValues(50, 1000, 2))
+	resorted := st.GetEntriesWithIndex(1000, 2000)
+	descending := make([]Entry, 0)
+	st.IterateEntriesDescending(1000, 2000, func(e Entry) bool {
+		descending = append(descending, e)
+		return true
+	})
+	last := st.LastEntries(5)
+
+	//then
+	assert.Equal(t, 110, len(resorted))
+	assertEntriesHaveValues(t, resorted[:50], 2)
+	assertEntriesHaveValues(t, resorted[50:], 1)
+	assert.Equal(t, 110, len(descending))
+	assert.Equal(t, resorted[0], descending[109], "file was not remapped after resorting")
+	assert.Equal(t, resorted[105:], last)
+
+	//given
+	buffered := SSTforTag{FileName: path}
+	buffered.InitStorage()
+	reopened := SSTforTag{FileName: path, Mmap: true}
+	reopened.InitStorage()
+
+	//then
+	assert.Equal(t, buffered.GetEntriesWithIndex(1000, 2000), reopened.GetEntriesWithIndex(1000, 2000), "mapped read of existing file differs")
+}
+
+func TestSSTforTag_MappingIsRemappedOnlyOnceOutgrownAndUnmappedOnClose(t *testing.T) {
+	//given
+	path := fmt.Sprintf("/tmp/golsm_test/testForTag-%d-%d.db", utils.GetNowMillis(), utils.GetTestIdx())
+	st := SSTforTag{FileName: path, Mmap: true}
+	st.InitStorage()
+	st.MergeWithCommitlog(getEntriesWithValues(100, 1000, 1))
+	//later merges append instead of resorting, which replaces the file
+	st.nextCompactionTimestamp = utils.GetNowMillis() + 3600*1000
+	st.GetEntriesWithIndex(1000, 2000)
+	first := st.mapped
+
+	//when
+	st.MergeWithCommitlog(getEntriesWithValues(10, 1100, 1))
+	aliased, appended := 0, 0
+	st.IterateEntriesWithIndex(1100, 1109, func(e Entry) bool {
+		appended++
+		if within(e.Value, st.mapped.data) {
+			aliased++
+		}
+		return true
+	})
+
+	//then
+	assert.True(t, first == st.mapped, "file was remapped although it still fits the mapping")
+	assert.Equal(t, 10, appended, "appended entries were not read from the mapping")
+	assert.Equal(t, 0, aliased, "values handed to receiver alias the mapping")
+
+	//when
+	st.MergeWithCommitlog(getEntriesWithValues(200, 1110, 1))
+	collected := st.GetEntriesWithIndex(1000, 2000)
+
+	//then
+	assert.False(t, first == st.mapped, "file was not remapped once it outgrew the mapping")
+	assert.True(t, first.stale)
+	assert.Equal(t, 310, len(collected))
+
+	//when
+	assert.Nil(t, st.Close())
+
+	//then
+	assert.Nil(t, st.mapped, "mapping was kept after closing")
+	assertEntriesHaveValues(t, collected, 1)
+}
+
+func within(inner []byte, outer []byte) bool {
+	start := uintptr(unsafe.Pointer(&outer[0]))
+	p := uintptr(unsafe.Pointer(&inner[0]))
+	return (p >= start) && (p < start+uintptr(len(outer)))
+}
@@ -0,0 +1,48 @@
+package sst
+
+import (
+	"encoding/binary"
+	"fmt"
+	"lsmstore/utils"
+
+	"github.com/btcsuite/btcutil/base58"
+)
+
+// FileNameForTag is the name of the SST of the tag within the root directory of a Manager.
+func FileNameForTag(tag string) string {
+	return base58.Encode([]byte(tag))
+}
+
+// TagOfFileName reverses FileNameForTag.
+func TagOfFileName(fileName string) string {
+	return string(base58.Decode(fileName))
+}
+
+// ScanFile reads an SST without the store being open, checking what iterateOverFileAndApplyForEntries panics on
+// instead: records too short to be an entry and entries older than the entry before them are reported and skipped.
+// Overwritten versions of a point are passed to receiver as well, in file order.
+func ScanFile(fileName string, receiver func(Entry, int64)) (utils.RecordsReport, error) {
+	return utils.ScanRecords(fileName, sortedEntries(), func(record []byte, o int64) {
+		receiver(FromByteArray(record), o)
+	})
+}
+
+// RepairFile truncates a torn tail of an SST and drops the entries ScanFile reports.
+func RepairFile(fileName string) (utils.RecordsReport, error) {
+	return utils.RepairRecords(fileName, sortedEntries())
+}
+
+func sortedEntries() func([]byte) error {
+	prevTimestamp := uint64(0)
+	return func(record []byte) error {
+		if len(record) < 16 {
+			return fmt.Errorf("%d bytes are too short for an entry", len(record))
+		}
+		timestamp := binary.LittleEndian.Uint64(record)
+		if timestamp < prevTimestamp {
+			return fmt.Errorf("timestamp %d is before %d of the previous entry", timestamp, prevTimestamp)
+		}
+		prevTimestamp = timestamp
+		return nil
+	}
+}
@@ -0,0 +1,55 @@
+package sst
+
+import (
+	"fmt"
+	"io/ioutil"
+	"lsmstore/commitlog"
+	"lsmstore/utils"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanFile_RepairedFileIsReadByStore(t *testing.T) {
+	//given
+	m := Manager{RootDir: fmt.Sprintf("/tmp/golsm_test/test-for-SSTScan-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())}
+	m.InitStorage()
+	m.MergeWithCommitlog([]commitlog.Entry{
+		{Key: []byte("tagZero"), Timestamp: 10, Value: []byte{1}},
+		{Key: []byte("tagZero"), Timestamp: 20, Value: []byte{2}},
+	})
+	fileName := m.RootDir + "/" + FileNameForTag("tagZero")
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	f.Write([]byte{3, 0, 1, 2, 3})
+	newer := Entry{Timestamp: 30, Value: []byte{3}}
+	f.Write(newer.ToByteArrayWithLength())
+	f.Write([]byte{100, 0, 1})
+	f.Close()
+
+	//when
+	before, scanErr := ScanFile(fileName, func(Entry, int64) {})
+	repaired, repairErr := RepairFile(fileName)
+	after, afterErr := ScanFile(fileName, func(Entry, int64) {})
+	untouched, untouchedErr := RepairFile(fileName)
+
+	//then
+	assert.Nil(t, scanErr)
+	assert.Nil(t, repairErr)
+	assert.Nil(t, afterErr)
+	assert.Nil(t, untouchedErr)
+	assert.Equal(t, 3, before.Records)
+	assert.Equal(t, 1, before.Dropped, "record of 3 bytes cannot be an entry")
+	assert.Equal(t, int64(3), before.TornTail)
+	assert.Equal(t, before.Records, repaired.Records)
+	assert.True(t, after.Clean(), after.Problems)
+	assert.Equal(t, 3, after.Records)
+	assert.True(t, untouched.Clean())
+	leftovers, _ := ioutil.ReadDir(m.RootDir)
+	assert.Equal(t, 1, len(leftovers), "repair of a clean file leaves nothing behind")
+
+	m = Manager{RootDir: m.RootDir}
+	m.InitStorage()
+	assert.Equal(t, []Entry{{Timestamp: 10, Value: []byte{1}}, {Timestamp: 20, Value: []byte{2}}, {Timestamp: 30, Value: []byte{3}}}, m.SstForTag("tagZero").GetEntriesWithIndex(0, 100))
+}
@@ -0,0 +1,118 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"lsmstore/dto"
+	"lsmstore/schema"
+)
+
+const MaxAggregationBuckets = 100000
+
+type AggregationFunction int
+
+const (
+	AggregateMin AggregationFunction = iota
+	AggregateMax
+	AggregateSum
+	AggregateCount
+	AggregateAvg
+	AggregateFirst
+	AggregateLast
+)
+
+// Aggregate splits [from, to] into windows of step milliseconds and returns one bucket per window for every tag.
+// Tags must be numeric; untyped values are read as little-endian float64 and entries of other sizes are skipped.
+func (sr *StorageReader) Aggregate(tags []string, from uint64, to uint64, step uint64, fn AggregationFunction) (map[string][]dto.Bucket, error) {
+	if step == 0 {
+		return nil, errors.New("aggregation step must be positive")
+	}
+	if from > to {
+		return nil, errors.New("aggregation range is empty")
+	}
+	if (to-from)/step >= MaxAggregationBuckets {
+		return nil, errors.New("aggregation step is too small for the requested range")
+	}
+	if (fn < AggregateMin) || (fn > AggregateLast) {
+		return nil, errors.New("unknown aggregation function")
+	}
+
+	for _, tag := range tags {
+		vt := sr.valueTypeOf(tag)
+		if (vt != schema.Untyped) && !vt.IsNumeric() {
+			return nil, fmt.Errorf("cannot aggregate tag %s of type %s", tag, vt)
+		}
+	}
+
+	ans := make(map[string][]dto.Bucket)
+	for _, tag := range tags {
+		ans[tag] = sr.aggregateForTag(tag, from, to, step, fn)
+	}
+	return ans, nil
+}
+
+func (sr *StorageReader) aggregateForTag(tag string, from uint64, to uint64, step uint64, fn AggregationFunction) []dto.Bucket {
+	bucketsCount := (to-from)/step + 1
+	buckets := make([]dto.Bucket, bucketsCount)
+	for i := range buckets {
+		buckets[i].From = from + uint64(i)*step
+		buckets[i].To = buckets[i].From + step - 1
+		if buckets[i].To > to {
+			buckets[i].To = to
+		}
+	}
+
+	vt := sr.valueTypeOf(tag)
+	sr.iterateOverDataForTag(tag, from, to, func(m dto.Measurement) bool {
+		v, err := schema.DecodeNumeric(vt, m.Value)
+		if err == nil {
+			addToBucket(&buckets[(m.Timestamp-from)/step], v)
+		}
+		return true
+	})
+
+	for i := range buckets {
+		finishBucket(&buckets[i], fn)
+	}
+	return buckets
+}
+
+func addToBucket(b *dto.Bucket, v float64) {
+	if b.Count == 0 {
+		b.Min = v
+		b.Max = v
+		b.First = v
+	}
+	if v < b.Min {
+		b.Min = v
+	}
+	if v > b.Max {
+		b.Max = v
+	}
+	b.Sum += v
+	b.Last = v
+	b.Count++
+}
+
+func finishBucket(b *dto.Bucket, fn AggregationFunction) {
+	if b.Count == 0 {
+		return
+	}
+	b.Avg = b.Sum / float64(b.Count)
+	switch fn {
+	case AggregateMin:
+		b.Value = b.Min
+	case AggregateMax:
+		b.Value = b.Max
+	case AggregateSum:
+		b.Value = b.Sum
+	case AggregateCount:
+		b.Value = float64(b.Count)
+	case AggregateAvg:
+		b.Value = b.Avg
+	case AggregateFirst:
+		b.Value = b.First
+	case AggregateLast:
+		b.Value = b.Last
+	}
+}
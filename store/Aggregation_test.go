@@ -0,0 +1,60 @@
+package store
+
+import (
+	"fmt"
+	"lsmstore/dto"
+	"lsmstore/schema"
+	"lsmstore/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLSM_AggregateWorks(t *testing.T) {
+	//given
+	storageReader, storageWriter := InitStorage(
+		fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		10,
+		1*time.Second,
+		10*time.Second,
+		10*time.Second,
+		fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		5)
+	const tagName = "whatever"
+
+	data := make([]dto.Measurement, 30)
+	for i := range data {
+		data[i] = dto.Measurement{Timestamp: 1000 + uint64(i), Value: schema.EncodeFloat64(float64(i))}
+	}
+	data = append(data, dto.Measurement{Timestamp: 1030, Value: make([]byte, 3)})
+
+	//when
+	storageWriter.StoreMultiple(map[string][]dto.Measurement{tagName: data}, 0)
+	time.Sleep(2 * time.Second)
+	buckets, err := storageReader.Aggregate(toList(tagName), 1000, 1039, 10, AggregateAvg)
+
+	//then
+	assert.Nil(t, err)
+	tagBuckets := buckets[tagName]
+	assert.Equal(t, 4, len(tagBuckets), "buckets count incorrect")
+	for i := 0; i < 3; i++ {
+		b := tagBuckets[i]
+		assert.Equal(t, uint64(1000+i*10), b.From, "bucket start incorrect")
+		assert.Equal(t, uint64(1009+i*10), b.To, "bucket end incorrect")
+		assert.Equal(t, uint64(10), b.Count, "bucket count incorrect")
+		assert.Equal(t, float64(i*10), b.Min, "bucket min incorrect")
+		assert.Equal(t, float64(i*10+9), b.Max, "bucket max incorrect")
+		assert.Equal(t, float64(i*10), b.First, "bucket first incorrect")
+		assert.Equal(t, float64(i*10+9), b.Last, "bucket last incorrect")
+		assert.Equal(t, float64(i*100+45), b.Sum, "bucket sum incorrect")
+		assert.Equal(t, float64(i*10)+4.5, b.Value, "bucket avg incorrect")
+	}
+	assert.Equal(t, uint64(0), tagBuckets[3].Count, "non-numeric value was aggregated")
+
+	//when
+	_, err = storageReader.Aggregate(toList(tagName), 1000, 1039, 0, AggregateAvg)
+
+	//then
+	assert.NotNil(t, err, "zero step accepted")
+}
@@ -0,0 +1,16 @@
+package store
+
+import "lsmstore/sst"
+
+// PinTag keeps blocks of the tag's SST in the block cache once they are read, so hot tags survive scans of cold ones.
+func (sr *StorageReader) PinTag(tag string) {
+	sr.SSTManager.PinTag(tag)
+}
+
+func (sr *StorageReader) UnpinTag(tag string) {
+	sr.SSTManager.UnpinTag(tag)
+}
+
+func (sr *StorageReader) BlockCacheStats() sst.BlockCacheStats {
+	return sr.SSTManager.BlockCacheStats()
+}
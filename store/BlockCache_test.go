@@ -0,0 +1,42 @@
+package store
+
+import (
+	"fmt"
+	"lsmstore/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLSM_BlockCacheIsConfiguredFromOptions(t *testing.T) {
+	//given
+	storageReader, storageWriter := InitStorageWithOptions(Options{
+		CommitlogPath:              fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		EntriesPerCommitlog:        1000,
+		PeriodBetweenFlushes:       1 * time.Second,
+		MemtPerformExpirationEvery: 10 * time.Second,
+		MemtPrefetchSeconds:        10 * time.Second,
+		SSTPath:                    fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		MemtMaxEntriesPerTag:       5,
+		BlockCacheBytes:            256,
+		BlockSize:                  64,
+		PinnedTags:                 []string{"hot"},
+	})
+	storageWriter.StoreBatch(sliceAndToBatch(buildDummyData(50), "hot", 0, 50), 0)
+	storageWriter.StoreBatch(sliceAndToBatch(buildDummyData(50), "cold", 0, 50), 0)
+	time.Sleep(2 * time.Second)
+
+	//when
+	storageReader.Retrieve([]string{"hot", "cold"}, 0, 2000)
+	afterFirstRead := storageReader.BlockCacheStats()
+	data := storageReader.Retrieve([]string{"hot"}, 0, 2000)
+	afterSecondRead := storageReader.BlockCacheStats()
+
+	//then
+	assert.Equal(t, 50, len(data["hot"]), "measurements lost")
+	assert.Less(t, int64(0), afterFirstRead.PinnedBytes, "blocks of pinned tag were not pinned")
+	assert.LessOrEqual(t, afterFirstRead.Bytes, int64(256), "block cache exceeds configured size")
+	assert.Equal(t, afterFirstRead.Misses, afterSecondRead.Misses, "pinned blocks were evicted")
+	assert.Less(t, afterFirstRead.Hits, afterSecondRead.Hits)
+}
@@ -0,0 +1,231 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"lsmstore/utils"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const ManifestFileName = "MANIFEST.json"
+
+// Checkpoints lay out their files as lsmserver does within its data directory.
+const CheckpointCommitlogDir = "commitlog"
+const CheckpointSSTDir = "sst"
+
+type Manifest struct {
+	CreatedAt uint64 `json:"created_at"`
+	// Sequence is of the last commitlog record the checkpoint holds
+	Sequence uint64 `json:"sequence"`
+	// CommitlogArchive tells whether the store archived its commitlogs, in which case the checkpoint holds everything
+	// of the archived logs up to CommitlogSequence
+	CommitlogArchive  bool           `json:"commitlog_archive,omitempty"`
+	CommitlogSequence uint64         `json:"commitlog_sequence,omitempty"`
+	Files             []ManifestFile `json:"files"`
+}
+
+// ManifestFile is a file of a checkpoint; Path is relative to the checkpoint directory.
+type ManifestFile struct {
+	Path   string `json:"path"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+}
+
+// Checkpoint makes dir a copy of the store as of one moment, which opens as a store of its own. SSTs are hard linked
+// when dir is on the same file system, after which the store replaces them on their next flush instead of appending
+// to them; commitlogs are copied, so that the checkpoint holds writes not flushed yet, too.
+func (db *DB) Checkpoint(dir string) (Manifest, error) {
+	if _, err := os.Stat(dir); err == nil {
+		return Manifest{}, fmt.Errorf("%s already exists", dir)
+	}
+	if err := db.checkpoint(dir); err != nil {
+		os.RemoveAll(dir)
+		return Manifest{}, err
+	}
+	manifest, err := readManifest(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+	}
+	return manifest, err
+}
+
+func (db *DB) checkpoint(dir string) error {
+	commitlogDir, sstDir := dir+"/"+CheckpointCommitlogDir, dir+"/"+CheckpointSSTDir
+	for _, d := range []string{commitlogDir, sstDir} {
+		if err := os.MkdirAll(d, os.ModePerm); err != nil {
+			return err
+		}
+	}
+	clm := db.Writer.DiskWriter.ClManager
+	var sequence, archivedSequence uint64
+	var err error
+	db.Writer.DiskWriter.Paused(func() {
+		if err = db.Reader.SSTManager.LinkTo(sstDir); err == nil {
+			err = clm.CopyTo(commitlogDir)
+		}
+		sequence, archivedSequence = clm.Sequence(), clm.ArchivedSequence()
+	})
+	if err != nil {
+		return err
+	}
+	//types and series are registered before their points are written, so taken afterwards they cover all of them
+	if (db.Writer.Catalog != nil) && utils.FileExists(db.Writer.Catalog.Path) {
+		if err := utils.LinkOrCopy(db.Writer.Catalog.Path, sstDir+"/"+CatalogFileName); err != nil {
+			return err
+		}
+	}
+	if db.Writer.Series != nil {
+		if err := db.Writer.Series.CopyTo(sstDir + "/" + SeriesIndexFileName); err != nil {
+			return err
+		}
+	}
+	manifest, err := buildManifest(dir)
+	if err != nil {
+		return err
+	}
+	manifest.Sequence = sequence
+	manifest.CommitlogArchive, manifest.CommitlogSequence = clm.ArchiveDir != "", archivedSequence
+	return writeManifest(dir, manifest)
+}
+
+// Backup writes a checkpoint into dir, which may be on another file system than the store. Files which the backup
+// in previousDir holds with the same content are taken from it, hard linked if possible, so only files changed since
+// then are copied from the store; previousDir is empty for a full backup. The checkpoint is first staged next to
+// the SSTs, where linking them is cheap.
+func (db *DB) Backup(dir string, previousDir string) (Manifest, error) {
+	previous := Manifest{}
+	if previousDir != "" {
+		var err error
+		if previous, err = readManifest(previousDir); err != nil {
+			return Manifest{}, err
+		}
+	}
+	previousByPath := make(map[string]ManifestFile, len(previous.Files))
+	for _, f := range previous.Files {
+		previousByPath[f.Path] = f
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return Manifest{}, fmt.Errorf("%s already exists", dir)
+	}
+
+	stagingDir := fmt.Sprintf("%s/.backup-%d", db.Reader.SSTManager.RootDir, utils.GetNowMillis())
+	manifest, err := db.Checkpoint(stagingDir)
+	defer os.RemoveAll(stagingDir)
+	if err != nil {
+		return Manifest{}, err
+	}
+	for _, f := range manifest.Files {
+		if err = os.MkdirAll(filepath.Dir(dir+"/"+f.Path), os.ModePerm); err != nil {
+			break
+		}
+		if p, unchanged := previousByPath[f.Path]; unchanged && (p.SHA256 == f.SHA256) {
+			err = utils.LinkOrCopy(previousDir+"/"+f.Path, dir+"/"+f.Path)
+		} else {
+			err = utils.CopyFile(stagingDir+"/"+f.Path, dir+"/"+f.Path)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writeManifest(dir, manifest)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return Manifest{}, err
+	}
+	return manifest, nil
+}
+
+// VerifyCheckpoint checks that dir holds every file its manifest lists, with the same content.
+func VerifyCheckpoint(dir string) (Manifest, error) {
+	manifest, err := readManifest(dir)
+	if err != nil {
+		return manifest, err
+	}
+	for _, f := range manifest.Files {
+		if sum, err := sha256OfFile(dir + "/" + f.Path); (err != nil) || (sum != f.SHA256) {
+			return manifest, fmt.Errorf("%s/%s does not match the manifest of the checkpoint", dir, f.Path)
+		}
+	}
+	return manifest, nil
+}
+
+func buildManifest(dir string) (Manifest, error) {
+	manifest := Manifest{CreatedAt: utils.GetNowMillis(), Files: make([]ManifestFile, 0)}
+	for _, sub := range []string{CheckpointCommitlogDir, CheckpointSSTDir} {
+		infos, err := ioutil.ReadDir(dir + "/" + sub)
+		if err != nil {
+			return manifest, err
+		}
+		for _, info := range infos {
+			if info.IsDir() {
+				continue
+			}
+			path := sub + "/" + info.Name()
+			sum, err := sha256OfFile(dir + "/" + path)
+			if err != nil {
+				return manifest, err
+			}
+			manifest.Files = append(manifest.Files, ManifestFile{Path: path, Bytes: info.Size(), SHA256: sum})
+		}
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].Path < manifest.Files[j].Path
+	})
+	return manifest, nil
+}
+
+func sha256OfFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func writeManifest(dir string, manifest Manifest) error {
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	//the files are durable before the manifest telling they are complete, which is durable before returning
+	for _, d := range []string{dir + "/" + CheckpointCommitlogDir, dir + "/" + CheckpointSSTDir} {
+		if err := utils.SyncDir(d); (err != nil) && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	tmpPath := dir + "/" + ManifestFileName + ".tmp"
+	if err := utils.WriteFileSynced(tmpPath, content); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, dir+"/"+ManifestFileName); err != nil {
+		return err
+	}
+	if err := utils.SyncDir(dir); err != nil {
+		return err
+	}
+	return utils.SyncDir(filepath.Dir(dir))
+}
+
+// readManifest fails for a directory which is not a complete checkpoint, as the manifest is written last.
+func readManifest(dir string) (Manifest, error) {
+	var manifest Manifest
+	content, err := ioutil.ReadFile(dir + "/" + ManifestFileName)
+	if err != nil {
+		return manifest, err
+	}
+	err = json.Unmarshal(content, &manifest)
+	return manifest, err
+}
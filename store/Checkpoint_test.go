@@ -0,0 +1,202 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"lsmstore/commitlog"
+	"lsmstore/dto"
+	"lsmstore/schema"
+	"lsmstore/sst"
+	"lsmstore/utils"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_CheckpointOpensAsStoreAndIsNotChangedByLaterWrites(t *testing.T) {
+	//given
+	db := openCheckpointTestDB(1000)
+	assert.Nil(t, db.Writer.Catalog.Register("temperature", schema.Float64))
+	assert.Nil(t, db.Writer.StoreFloat("temperature", 1000, 21.5, 0))
+	assert.Nil(t, db.Writer.StoreSeries([]dto.SeriesMeasurement{{Metric: "up", Labels: []dto.Label{{Name: "job", Value: "api"}}, Timestamp: 1000, Value: []byte{1}}}, 0))
+	db.Writer.DiskWriter.Flush()
+	assert.Nil(t, db.Writer.StoreFloat("temperature", 2000, 22, 0))
+	dir := checkpointTestDir("checkpoint")
+
+	//when
+	manifest, err := db.Checkpoint(dir)
+	assert.Nil(t, db.Writer.StoreFloat("temperature", 3000, 22.5, 0))
+	db.Writer.DiskWriter.Flush()
+	assert.Nil(t, db.Writer.StoreFloat("temperature", 4000, 23, 0))
+	db.Writer.DiskWriter.Flush()
+	_, errExisting := db.Checkpoint(dir)
+
+	//then
+	assert.Nil(t, err)
+	assert.NotNil(t, errExisting, "checkpoint overwrote an existing directory")
+	paths := make([]string, len(manifest.Files))
+	for i, f := range manifest.Files {
+		paths[i] = f.Path
+		assert.Equal(t, 64, len(f.SHA256))
+	}
+	expectedPaths := []string{
+		"commitlog/COMMITLOGA",
+		"commitlog/COMMITLOGB",
+		"commitlog/" + commitlog.SequenceFile,
+		"sst/" + sst.FileNameForTag(`up{job="api"}`),
+		"sst/" + sst.FileNameForTag(`up{job="api"}`) + sst.LinkedSuffix,
+		"sst/" + sst.FileNameForTag("temperature"),
+		"sst/" + sst.FileNameForTag("temperature") + sst.LinkedSuffix,
+		"sst/" + CatalogFileName,
+		"sst/" + SeriesIndexFileName,
+	}
+	sort.Strings(expectedPaths)
+	assert.Equal(t, expectedPaths, paths)
+	assert.False(t, utils.FileExists(db.Reader.SSTManager.RootDir+"/"+sst.FileNameForTag("temperature")+sst.LinkedSuffix), "replaced SST is still marked as linked")
+	assert.True(t, utils.FileExists(db.Reader.SSTManager.RootDir+"/"+sst.FileNameForTag(`up{job="api"}`)+sst.LinkedSuffix), "linked SST is not marked")
+	restored := Open(Options{
+		CommitlogPath:        dir + "/" + CheckpointCommitlogDir,
+		EntriesPerCommitlog:  1000,
+		PeriodBetweenFlushes: time.Hour,
+		SSTPath:              dir + "/" + CheckpointSSTDir,
+		MemtMaxEntriesPerTag: 10,
+	})
+	floats, err := restored.Reader.RetrieveFloat("temperature", 0, 5000)
+	assert.Nil(t, err)
+	assert.Equal(t, []dto.FloatMeasurement{{Timestamp: 1000, Value: 21.5}, {Timestamp: 2000, Value: 22}}, floats)
+	up, err := restored.Reader.RetrieveMatching(`metric="up"`, 0, 5000)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(up[`up{job="api"}`]))
+	live, err := db.Reader.RetrieveFloat("temperature", 0, 5000)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(live))
+}
+
+func TestDB_CheckpointIsNotChangedByWritesAfterRestart(t *testing.T) {
+	//given
+	opts := Options{
+		CommitlogPath:        checkpointTestDir("commitlog"),
+		EntriesPerCommitlog:  1000,
+		PeriodBetweenFlushes: time.Hour,
+		SSTPath:              checkpointTestDir("sstm"),
+		MemtMaxEntriesPerTag: 10,
+	}
+	db := Open(opts)
+	assert.Nil(t, db.Writer.Store(dto.TaggedMeasurement{Tag: "counter", Timestamp: 1000, Value: []byte{1}}, 0))
+	db.Writer.DiskWriter.Flush()
+	dir := checkpointTestDir("checkpoint")
+	_, checkpointErr := db.Checkpoint(dir)
+
+	closeErr := db.Close()
+
+	//when
+	restarted := Open(opts)
+	assert.Nil(t, restarted.Writer.Store(dto.TaggedMeasurement{Tag: "counter", Timestamp: 2000, Value: []byte{2}}, 0))
+	restarted.Writer.DiskWriter.Flush()
+	_, verifyErr := VerifyCheckpoint(dir)
+
+	//then
+	assert.Nil(t, checkpointErr)
+	assert.Nil(t, closeErr)
+	assert.Nil(t, verifyErr, "write after restart went into the checkpoint")
+	assert.Equal(t, 2, len(restarted.Reader.Retrieve([]string{"counter"}, 0, 5000)["counter"]))
+}
+
+func TestDB_CheckpointTakenDuringWritesHoldsPrefixOfThem(t *testing.T) {
+	//given
+	db := openCheckpointTestDB(7)
+	const points = 3000
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= points; i++ {
+			db.Writer.Store(dto.TaggedMeasurement{Tag: "counter", Timestamp: uint64(i), Value: []byte{byte(i)}}, 0)
+		}
+	}()
+	time.Sleep(5 * time.Millisecond)
+	dir := checkpointTestDir("concurrent")
+
+	//when
+	_, err := db.Checkpoint(dir)
+	wg.Wait()
+
+	//then
+	assert.Nil(t, err)
+	restored := Open(Options{
+		CommitlogPath:        dir + "/" + CheckpointCommitlogDir,
+		EntriesPerCommitlog:  1000,
+		PeriodBetweenFlushes: time.Hour,
+		SSTPath:              dir + "/" + CheckpointSSTDir,
+		MemtMaxEntriesPerTag: 10,
+	})
+	data := restored.Reader.Retrieve([]string{"counter"}, 0, points)["counter"]
+	for i, m := range data {
+		assert.Equal(t, uint64(i+1), m.Timestamp, "checkpoint misses a point written before a later one")
+	}
+	assert.Equal(t, points, len(db.Reader.Retrieve([]string{"counter"}, 0, points)["counter"]), "live store lost writes")
+}
+
+func TestDB_IncrementalBackupCopiesOnlyChangedFiles(t *testing.T) {
+	//given
+	db := openCheckpointTestDB(1000)
+	assert.Nil(t, db.Writer.Store(dto.TaggedMeasurement{Tag: "unchanged", Timestamp: 1000, Value: []byte{1}}, 0))
+	assert.Nil(t, db.Writer.Store(dto.TaggedMeasurement{Tag: "changed", Timestamp: 1000, Value: []byte{2}}, 0))
+	db.Writer.DiskWriter.Flush()
+	full := checkpointTestDir("backup-full")
+	incremental := checkpointTestDir("backup-incremental")
+
+	//when
+	_, fullErr := db.Backup(full, "")
+	assert.Nil(t, db.Writer.Store(dto.TaggedMeasurement{Tag: "changed", Timestamp: 2000, Value: []byte{3}}, 0))
+	db.Writer.DiskWriter.Flush()
+	manifest, incrementalErr := db.Backup(incremental, full)
+	_, errMissingPrevious := db.Backup(checkpointTestDir("backup-broken"), checkpointTestDir("missing"))
+
+	//then
+	assert.Nil(t, fullErr)
+	assert.Nil(t, incrementalErr)
+	assert.NotNil(t, errMissingPrevious)
+	assert.Equal(t, 8, len(manifest.Files))
+	assert.True(t, sameFile(full, incremental, "sst/"+sst.FileNameForTag("unchanged")), "unchanged SST was copied again")
+	assert.False(t, sameFile(full, incremental, "sst/"+sst.FileNameForTag("changed")))
+	staging, _ := ioutil.ReadDir(db.Reader.SSTManager.RootDir)
+	for _, info := range staging {
+		assert.False(t, info.IsDir(), "staged checkpoint left behind")
+	}
+	restored := Open(Options{
+		CommitlogPath:        incremental + "/" + CheckpointCommitlogDir,
+		EntriesPerCommitlog:  1000,
+		PeriodBetweenFlushes: time.Hour,
+		SSTPath:              incremental + "/" + CheckpointSSTDir,
+		MemtMaxEntriesPerTag: 10,
+	})
+	assert.Equal(t, map[string][]dto.Measurement{
+		"unchanged": {{Timestamp: 1000, Value: []byte{1}}},
+		"changed":   {{Timestamp: 1000, Value: []byte{2}}, {Timestamp: 2000, Value: []byte{3}}},
+	}, restored.Reader.Retrieve([]string{"unchanged", "changed"}, 0, 5000))
+}
+
+func openCheckpointTestDB(entriesPerCommitlog int) *DB {
+	return Open(Options{
+		CommitlogPath:        fmt.Sprintf("/tmp/golsm_test/checkpoint/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		EntriesPerCommitlog:  entriesPerCommitlog,
+		PeriodBetweenFlushes: time.Hour,
+		SSTPath:              fmt.Sprintf("/tmp/golsm_test/checkpoint/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		MemtMaxEntriesPerTag: 10,
+	})
+}
+
+func checkpointTestDir(name string) string {
+	return fmt.Sprintf("/tmp/golsm_test/checkpoint/%s-%d-%d", name, utils.GetNowMillis(), utils.GetTestIdx())
+}
+
+func sameFile(dirA string, dirB string, path string) bool {
+	a, errA := os.Stat(dirA + "/" + path)
+	b, errB := os.Stat(dirB + "/" + path)
+	return (errA == nil) && (errB == nil) && os.SameFile(a, b)
+}
@@ -0,0 +1,265 @@
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+	"lsmstore/dto"
+	"lsmstore/utils"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLSM_RetrieveMatchesModelAcrossEvictionsFlushesAndRestarts(t *testing.T) {
+	policies := []Options{
+		{MemtMaxEntriesPerTag: 4},
+		{MemtMaxAgePerTag: 20 * time.Millisecond},
+		{MemtMaxEntriesPerTag: 16, MemtMaxBytes: 600},
+		{MemtMaxEntriesPerTag: 16, MemtPerformExpirationEvery: 15 * time.Millisecond},
+	}
+	for i, policy := range policies {
+		seed := int64(utils.GetNowMillis()) + int64(i)
+		t.Run(fmt.Sprintf("policy-%d-seed-%d", i, seed), func(t *testing.T) {
+			checkRetrieveAgainstModel(t, policy, rand.New(rand.NewSource(seed)))
+		})
+	}
+}
+
+type modelPoint struct {
+	value     []byte
+	expiresAt uint64
+}
+
+// checkRetrieveAgainstModel runs random writes, some of them expiring, flushes and restarts, comparing every read with
+// a plain map.
+func checkRetrieveAgainstModel(t *testing.T, opts Options, random *rand.Rand) {
+	//given
+	opts.CommitlogPath = fmt.Sprintf("/tmp/golsm_test/coverage/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	opts.SSTPath = fmt.Sprintf("/tmp/golsm_test/coverage/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	opts.EntriesPerCommitlog = 100000
+	opts.PeriodBetweenFlushes = time.Hour
+	storageReader, storageWriter := InitStorageWithOptions(opts)
+	tags := []string{"tagZero", "tagOne", "tagTwo"}
+	model := make(map[string]map[uint64]modelPoint)
+	for _, tag := range tags {
+		model[tag] = make(map[uint64]modelPoint)
+	}
+	written := uint64(0)
+	nextPoint := func() dto.TaggedMeasurement {
+		written++
+		value := make([]byte, 8)
+		binary.LittleEndian.PutUint64(value, written)
+		return dto.TaggedMeasurement{Tag: tags[random.Intn(len(tags))], Timestamp: uint64(1 + random.Intn(200)), Value: value}
+	}
+	//a third of the writes expire within a few reads, some of them on arrival
+	nextExpiresAt := func() uint64 {
+		if random.Intn(3) > 0 {
+			return 0
+		}
+		return utils.GetNowMillis() - 2 + uint64(random.Intn(40))
+	}
+
+	for step := 0; step < 400; step++ {
+		//when
+		switch op := random.Intn(100); {
+		case op < 40:
+			batch := make([]dto.TaggedMeasurement, 1+random.Intn(6))
+			expiresAt := nextExpiresAt()
+			for i := range batch {
+				batch[i] = nextPoint()
+				model[batch[i].Tag][batch[i].Timestamp] = modelPoint{value: batch[i].Value, expiresAt: expiresAt}
+			}
+			if !assert.Nil(t, storageWriter.StoreBatch(batch, expiresAt), "StoreBatch at step %d", step) {
+				return
+			}
+		case op < 50:
+			point := nextPoint()
+			expiresAt := nextExpiresAt()
+			model[point.Tag][point.Timestamp] = modelPoint{value: point.Value, expiresAt: expiresAt}
+			if !assert.Nil(t, storageWriter.Store(point, expiresAt), "Store at step %d", step) {
+				return
+			}
+		case op < 58:
+			storageWriter.DiskWriter.Flush()
+		case op < 62:
+			opts.MemtPrefetchSeconds = time.Duration(random.Intn(3)) * 30 * time.Millisecond
+			if !assert.Nil(t, (&DB{Reader: storageReader, Writer: storageWriter}).Close(), "closing before restart at step %d", step) {
+				return
+			}
+			storageReader, storageWriter = InitStorageWithOptions(opts)
+		default:
+			from := uint64(random.Intn(210))
+			to := from + uint64(random.Intn(210))
+			tag := tags[random.Intn(len(tags))]
+			before := utils.GetNowMillis()
+			var actual []dto.Measurement
+			if random.Intn(2) == 0 {
+				actual = storageReader.Retrieve([]string{tag}, from, to)[tag]
+			} else {
+				actual = storageReader.RetrieveDescending(tag, from, to, len(model[tag])+1)
+				for i, j := 0, len(actual)-1; i < j; i, j = i+1, j-1 {
+					actual[i], actual[j] = actual[j], actual[i]
+				}
+			}
+			expected, expiring := modelRange(model[tag], from, to, before, utils.GetNowMillis())
+
+			//then
+			if !assert.Equal(t, expected, withoutExpiring(t, actual, expiring), "reading %s in [%d, %d] at step %d", tag, from, to, step) {
+				return
+			}
+		}
+	}
+}
+
+// modelRange returns the points in [from, to] of a read which ran between before and after, leaving out those which
+// expired meanwhile, which the read may or may not have returned; they are returned apart by timestamp.
+func modelRange(points map[uint64]modelPoint, from uint64, to uint64, before uint64, after uint64) ([]dto.Measurement, map[uint64][]byte) {
+	ans := make([]dto.Measurement, 0)
+	expiring := make(map[uint64][]byte)
+	for ts, p := range points {
+		switch {
+		case (ts < from) || (ts > to) || ((p.expiresAt != 0) && (p.expiresAt < before)):
+		case (p.expiresAt != 0) && (p.expiresAt < after):
+			expiring[ts] = p.value
+		default:
+			ans = append(ans, dto.Measurement{Timestamp: ts, Value: p.value})
+		}
+	}
+	sort.Slice(ans, func(i, j int) bool {
+		return ans[i].Timestamp < ans[j].Timestamp
+	})
+	return ans, expiring
+}
+
+// withoutExpiring drops the points which expired during the read from what it returned, checking their values.
+func withoutExpiring(t *testing.T, actual []dto.Measurement, expiring map[uint64][]byte) []dto.Measurement {
+	ans := make([]dto.Measurement, 0, len(actual))
+	for _, m := range actual {
+		if value, ok := expiring[m.Timestamp]; ok {
+			assert.Equal(t, value, m.Value, "point %d expiring during the read has another value", m.Timestamp)
+			continue
+		}
+		ans = append(ans, m)
+	}
+	return ans
+}
+
+func TestLSM_RetrieveMatchesModelWhileTagIsWrittenAndEvicted(t *testing.T) {
+	//given
+	const points = 64
+	storageReader, storageWriter := InitStorageWithOptions(Options{
+		CommitlogPath:        fmt.Sprintf("/tmp/golsm_test/coverage/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		EntriesPerCommitlog:  100000,
+		PeriodBetweenFlushes: time.Hour,
+		SSTPath:              fmt.Sprintf("/tmp/golsm_test/coverage/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		MemtMaxEntriesPerTag: points / 4,
+		MemtMaxBytes:         3000,
+	})
+	//versions count the writes of a timestamp, starting at 1, and are its value; 0 stands for no point. A read must
+	//return at least the version acknowledged before it started and at most the one started before it ended.
+	var started, acknowledged [points + 1]uint64
+	write := func(ts uint64, expiresAt uint64) error {
+		version := started[ts] + 1
+		atomic.StoreUint64(&started[ts], version)
+		value := make([]byte, 8)
+		binary.LittleEndian.PutUint64(value, version)
+		if err := storageWriter.Store(dto.TaggedMeasurement{Tag: "contended", Timestamp: ts, Value: value}, expiresAt); err != nil {
+			return err
+		}
+		atomic.StoreUint64(&acknowledged[ts], version)
+		return nil
+	}
+	//every other timestamp is on disk before, the others are inserted meanwhile
+	for ts := uint64(2); ts <= points; ts += 2 {
+		assert.Nil(t, write(ts, 0))
+	}
+	storageWriter.DiskWriter.Flush()
+	stop := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		random := rand.New(rand.NewSource(int64(utils.GetNowMillis())))
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := write(uint64(1+random.Intn(points)), 0); err != nil {
+				assert.Nil(t, err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if memtForTag, exists := storageReader.MemTable.ExistingMemTableForTag("contended"); exists {
+				memtForTag.EvictOldest()
+			}
+			if i%20 == 0 {
+				storageWriter.DiskWriter.Flush()
+			}
+		}
+	}()
+
+	//when
+	random := rand.New(rand.NewSource(int64(utils.GetNowMillis())))
+	for read := 0; read < 2000; read++ {
+		from := uint64(1 + random.Intn(points))
+		to := from + uint64(random.Intn(points))
+		var atLeast, atMost [points + 1]uint64
+		for ts := range acknowledged {
+			atLeast[ts] = atomic.LoadUint64(&acknowledged[ts])
+		}
+		var actual []dto.Measurement
+		if read%2 == 0 {
+			actual = storageReader.Retrieve([]string{"contended"}, from, to)["contended"]
+		} else {
+			actual = storageReader.RetrieveDescending("contended", from, to, points+1)
+			for i, j := 0, len(actual)-1; i < j; i, j = i+1, j-1 {
+				actual[i], actual[j] = actual[j], actual[i]
+			}
+		}
+		for ts := range started {
+			atMost[ts] = atomic.LoadUint64(&started[ts])
+		}
+
+		//then
+		if !checkContendedRead(t, actual, from, to, atLeast[:], atMost[:]) {
+			break
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// checkContendedRead checks that a read of [from, to] returned every timestamp once, in order, at a version allowed.
+func checkContendedRead(t *testing.T, actual []dto.Measurement, from uint64, to uint64, atLeast []uint64, atMost []uint64) bool {
+	versions := make(map[uint64]uint64, len(actual))
+	for i, m := range actual {
+		if (i > 0) && !assert.Less(t, actual[i-1].Timestamp, m.Timestamp, "reading [%d, %d] returned points out of order or twice", from, to) {
+			return false
+		}
+		versions[m.Timestamp] = binary.LittleEndian.Uint64(m.Value)
+	}
+	for ts := from; (ts <= to) && (ts < uint64(len(atLeast))); ts++ {
+		version := versions[ts]
+		if !assert.True(t, (version >= atLeast[ts]) && (version <= atMost[ts]), "reading [%d, %d] returned version %d of %d, not within [%d, %d]", from, to, version, ts, atLeast[ts], atMost[ts]) {
+			return false
+		}
+		delete(versions, ts)
+	}
+	return assert.Empty(t, versions, "reading [%d, %d] returned points never written", from, to)
+}
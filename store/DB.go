@@ -0,0 +1,26 @@
+package store
+
+// DB is a whole store, for operations spanning all of its files; Reader and Writer are the ones
+// InitStorageWithOptions returns.
+type DB struct {
+	Reader *StorageReader
+	Writer *StorageWriter
+}
+
+func Open(opts Options) *DB {
+	reader, writer := InitStorageWithOptions(opts)
+	return &DB{Reader: reader, Writer: writer}
+}
+
+// Close stops the background work of the store and closes its files, returning the first error. Entries not flushed
+// to SST yet are replayed from the commitlog on the next Open; the DB must not be used afterwards.
+func (db *DB) Close() error {
+	db.Reader.MemTable.CloseStorage()
+	ans := db.Writer.DiskWriter.Close()
+	if db.Writer.Series != nil {
+		if err := db.Writer.Series.Close(); (err != nil) && (ans == nil) {
+			ans = err
+		}
+	}
+	return ans
+}
@@ -0,0 +1,42 @@
+package store
+
+import (
+	"fmt"
+	"lsmstore/dto"
+	"lsmstore/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_CloseKeepsUnflushedWritesForNextOpen(t *testing.T) {
+	//given
+	opts := Options{
+		CommitlogPath:        fmt.Sprintf("/tmp/golsm_test/db/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		EntriesPerCommitlog:  1000,
+		PeriodBetweenFlushes: time.Hour,
+		SSTPath:              fmt.Sprintf("/tmp/golsm_test/db/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		MemtMaxEntriesPerTag: 10,
+		MmapSST:              true,
+	}
+	db := Open(opts)
+	assert.Nil(t, db.Writer.Store(dto.TaggedMeasurement{Tag: "counter", Timestamp: 1000, Value: []byte{1}}, 0))
+	db.Writer.DiskWriter.Flush()
+	db.Reader.Retrieve([]string{"counter"}, 0, 5000)
+	assert.Nil(t, db.Writer.Store(dto.TaggedMeasurement{Tag: "counter", Timestamp: 2000, Value: []byte{2}}, 0))
+	_, err := db.Writer.Series.GetOrCreate("cpu", []dto.Label{{Name: "host", Value: "a"}})
+	assert.Nil(t, err)
+
+	//when
+	closeErr := db.Close()
+	storeAfterCloseErr := db.Writer.Store(dto.TaggedMeasurement{Tag: "counter", Timestamp: 3000, Value: []byte{3}}, 0)
+	reopened := Open(opts)
+
+	//then
+	assert.Nil(t, closeErr)
+	assert.NotNil(t, storeAfterCloseErr, "store after close did not fail")
+	assert.Equal(t, []dto.Measurement{{Timestamp: 1000, Value: []byte{1}}, {Timestamp: 2000, Value: []byte{2}}}, reopened.Reader.Retrieve([]string{"counter"}, 0, 5000)["counter"])
+	assert.Equal(t, 1, len(reopened.Writer.Series.Since(0)), "series was lost")
+	assert.Nil(t, reopened.Close())
+}
@@ -0,0 +1,67 @@
+package store
+
+import (
+	"fmt"
+	"lsmstore/dto"
+	"lsmstore/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLSM_RetrieveDescendingPagesNewestFirst(t *testing.T) {
+	//given
+	storageReader, storageWriter := InitStorage(
+		fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		10,
+		1*time.Second,
+		10*time.Second,
+		10*time.Second,
+		fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		5)
+	const tagName = "whatever"
+	//points at even timestamps leave room for inserts between them
+	batch := make([]dto.TaggedMeasurement, 600)
+	expected := make(map[uint64][]byte)
+	for i := range batch {
+		batch[i] = dto.TaggedMeasurement{Tag: tagName, Timestamp: 1000 + 2*uint64(i), Value: []byte{0}}
+		if (batch[i].Timestamp >= 1400) && (batch[i].Timestamp <= 1600) {
+			expected[batch[i].Timestamp] = batch[i].Value
+		}
+	}
+
+	//when
+	storageWriter.StoreBatch(batch, 0)
+	time.Sleep(2 * time.Second)
+	pages := make([][]dto.Measurement, 0)
+	to := uint64(1600)
+	for written := 1; ; written++ {
+		page := storageReader.RetrieveDescending(tagName, 1400, to, 30)
+		if len(page) == 0 {
+			break
+		}
+		pages = append(pages, page)
+		to = page[len(page)-1].Timestamp - 1
+		//inserts and overwrites within the range, both above and below the next page
+		insert := dto.TaggedMeasurement{Tag: tagName, Timestamp: 1401 + 2*uint64((written*37)%100), Value: []byte{byte(written)}}
+		overwrite := dto.TaggedMeasurement{Tag: tagName, Timestamp: 1400 + 2*uint64((written*23)%101), Value: []byte{byte(written)}}
+		for _, m := range []dto.TaggedMeasurement{insert, overwrite} {
+			assert.Nil(t, storageWriter.StoreBatch([]dto.TaggedMeasurement{m}, 0))
+			if m.Timestamp <= to {
+				expected[m.Timestamp] = m.Value
+			}
+		}
+	}
+
+	//then
+	assert.True(t, len(pages) > 3, "pages count incorrect")
+	for _, page := range pages[:len(pages)-1] {
+		assert.Equal(t, 30, len(page), "page size incorrect")
+	}
+	merged := make([]dto.Measurement, 0)
+	for _, page := range pages {
+		merged = append(merged, page...)
+	}
+	assert.Equal(t, sortedModel(expected, true), merged, "measurements lost, duplicated or stale")
+}
@@ -0,0 +1,386 @@
+package store
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"lsmstore/commitlog"
+	"lsmstore/dto"
+	"lsmstore/memt"
+	"lsmstore/schema"
+	"lsmstore/utils"
+	"math"
+	"strconv"
+)
+
+type ExportEncoding int
+
+const (
+	CSV ExportEncoding = iota
+	JSONLines
+	Columnar
+)
+
+// ImportBatchSize is the number of imported records stored at once.
+const ImportBatchSize = 1000
+
+// ExportFormat tells how records are encoded. Values are base64 of the stored bytes unless TypedValues is set,
+// in which case every record also carries the value type from the catalog and values of typed tags are written
+// as numbers, booleans or strings; values of untyped tags stay base64. Columnar files always carry value types
+// and stored bytes, so TypedValues does not apply to them.
+type ExportFormat struct {
+	Encoding    ExportEncoding
+	TypedValues bool
+}
+
+// ParseExportEncoding accepts csv, jsonl and columnar.
+func ParseExportEncoding(name string) (ExportEncoding, error) {
+	switch name {
+	case "csv":
+		return CSV, nil
+	case "jsonl":
+		return JSONLines, nil
+	case "columnar":
+		return Columnar, nil
+	}
+	return CSV, fmt.Errorf("unknown export format %q", name)
+}
+
+type exportRecord struct {
+	Tag       string          `json:"tag"`
+	Timestamp uint64          `json:"timestamp"`
+	ExpiresAt uint64          `json:"expires_at"`
+	Type      string          `json:"type,omitempty"`
+	Value     json.RawMessage `json:"value"`
+}
+
+func (f ExportFormat) csvHeader() []string {
+	if f.TypedValues {
+		return []string{"tag", "timestamp", "expires_at", "type", "value"}
+	}
+	return []string{"tag", "timestamp", "expires_at", "value"}
+}
+
+// Export writes every point of the tags within [from, to], tag after tag in ascending order of timestamps;
+// all tags are exported if none are given. Points carry their expiration, 0 if they never expire; points
+// already expired are not exported.
+func (sr *StorageReader) Export(w io.Writer, tags []string, from uint64, to uint64, format ExportFormat) error {
+	if len(tags) == 0 {
+		tags = sr.GetTags()
+	}
+	buffered := bufio.NewWriter(w)
+	var csvWriter *csv.Writer
+	var columnar *columnarWriter
+	switch format.Encoding {
+	case CSV:
+		csvWriter = csv.NewWriter(buffered)
+		if err := csvWriter.Write(format.csvHeader()); err != nil {
+			return err
+		}
+	case Columnar:
+		columnar = &columnarWriter{w: buffered}
+		if err := columnar.start(); err != nil {
+			return err
+		}
+	}
+	now := utils.GetNowMillis()
+	var err error
+	for _, tag := range tags {
+		vt := schema.Untyped
+		if format.TypedValues || (columnar != nil) {
+			vt = sr.valueTypeOf(tag)
+		}
+		if columnar != nil {
+			if err := columnar.startGroup(tag, vt); err != nil {
+				return err
+			}
+		}
+		sr.iterateOverEntriesForTag(tag, from, to, func(e memt.Entry) bool {
+			//the cache only drops expired entries periodically
+			if (e.ExpiresAt != 0) && (e.ExpiresAt < now) {
+				return true
+			}
+			switch format.Encoding {
+			case CSV:
+				err = writeCSVRecord(csvWriter, format, tag, vt, e)
+			case JSONLines:
+				err = writeJSONRecord(buffered, format, tag, vt, e)
+			case Columnar:
+				err = columnar.add(e)
+			}
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if columnar != nil {
+		if err := columnar.finish(); err != nil {
+			return err
+		}
+	}
+	if csvWriter != nil {
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return err
+		}
+	}
+	return buffered.Flush()
+}
+
+func writeCSVRecord(w *csv.Writer, format ExportFormat, tag string, vt schema.ValueType, e memt.Entry) error {
+	value, err := formatValueText(vt, e.Value)
+	if err != nil {
+		return decodingError(tag, dto.Measurement{Timestamp: e.Timestamp, Value: e.Value}, err)
+	}
+	timestamp := strconv.FormatUint(e.Timestamp, 10)
+	expiresAt := strconv.FormatUint(e.ExpiresAt, 10)
+	if format.TypedValues {
+		return w.Write([]string{tag, timestamp, expiresAt, vt.String(), value})
+	}
+	return w.Write([]string{tag, timestamp, expiresAt, value})
+}
+
+func writeJSONRecord(w io.Writer, format ExportFormat, tag string, vt schema.ValueType, e memt.Entry) error {
+	record := exportRecord{Tag: tag, Timestamp: e.Timestamp, ExpiresAt: e.ExpiresAt}
+	if format.TypedValues {
+		record.Type = vt.String()
+	}
+	value, err := formatValueJSON(vt, e.Value)
+	if err != nil {
+		return decodingError(tag, dto.Measurement{Timestamp: e.Timestamp, Value: e.Value}, err)
+	}
+	record.Value = value
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
+
+// formatValueText renders values of typed tags as strconv does and the others as base64.
+func formatValueText(vt schema.ValueType, value []byte) (string, error) {
+	switch vt {
+	case schema.Float64:
+		v, err := schema.DecodeFloat64(value)
+		return strconv.FormatFloat(v, 'g', -1, 64), err
+	case schema.Int64:
+		v, err := schema.DecodeInt64(value)
+		return strconv.FormatInt(v, 10), err
+	case schema.Bool:
+		v, err := schema.DecodeBool(value)
+		return strconv.FormatBool(v), err
+	case schema.String:
+		return schema.DecodeString(value)
+	}
+	return base64.StdEncoding.EncodeToString(value), nil
+}
+
+// formatValueJSON writes numbers and booleans as JSON literals, except NaN and infinities, which JSON lacks
+// and which are written as strings instead.
+func formatValueJSON(vt schema.ValueType, value []byte) (json.RawMessage, error) {
+	text, err := formatValueText(vt, value)
+	if err != nil {
+		return nil, err
+	}
+	switch vt {
+	case schema.Float64:
+		if v, _ := schema.DecodeFloat64(value); !math.IsNaN(v) && !math.IsInf(v, 0) {
+			return json.RawMessage(text), nil
+		}
+	case schema.Int64, schema.Bool:
+		return json.RawMessage(text), nil
+	}
+	return json.Marshal(text)
+}
+
+func parseValueText(vt schema.ValueType, text string) ([]byte, error) {
+	switch vt {
+	case schema.Float64:
+		v, err := strconv.ParseFloat(text, 64)
+		return schema.EncodeFloat64(v), err
+	case schema.Int64:
+		v, err := strconv.ParseInt(text, 10, 64)
+		return schema.EncodeInt64(v), err
+	case schema.Bool:
+		v, err := strconv.ParseBool(text)
+		return schema.EncodeBool(v), err
+	case schema.String:
+		return schema.EncodeString(text), nil
+	}
+	return base64.StdEncoding.DecodeString(text)
+}
+
+func parseValueJSON(vt schema.ValueType, raw json.RawMessage) ([]byte, error) {
+	if (len(raw) > 0) && (raw[0] == '"') {
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return nil, err
+		}
+		return parseValueText(vt, text)
+	}
+	if (vt != schema.Float64) && (vt != schema.Int64) && (vt != schema.Bool) {
+		return nil, fmt.Errorf("%s value must be a JSON string", vt)
+	}
+	return parseValueText(vt, string(raw))
+}
+
+// Import stores records written by Export in batches of ImportBatchSize, returning how many were stored; records
+// keep their expiration. Records are validated as StoreBatch does; an invalid record stops the import, keeping
+// batches stored before it.
+// With TypedValues, and always for columnar files, types of tags not yet in the catalog are registered.
+func (sw *StorageWriter) Import(r io.Reader, format ExportFormat) (int, error) {
+	imp := importer{writer: sw, format: format, batch: make([]commitlog.Entry, 0, ImportBatchSize)}
+	var err error
+	switch format.Encoding {
+	case CSV:
+		err = imp.readCSV(r)
+	case JSONLines:
+		err = imp.readJSONLines(r)
+	case Columnar:
+		err = imp.readColumnar(r)
+	}
+	if err != nil {
+		return imp.imported, err
+	}
+	return imp.imported, imp.flush()
+}
+
+type importer struct {
+	writer   *StorageWriter
+	format   ExportFormat
+	batch    []commitlog.Entry
+	imported int
+}
+
+func (imp *importer) readCSV(r io.Reader) error {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	expected := imp.format.csvHeader()
+	if fmt.Sprint(header) != fmt.Sprint(expected) {
+		return fmt.Errorf("expected header %v, got %v", expected, header)
+	}
+	reader.FieldsPerRecord = len(expected)
+	for recordIdx := 1; ; recordIdx++ {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := imp.addCSV(fields); err != nil {
+			return fmt.Errorf("record %d: %v", recordIdx, err)
+		}
+	}
+}
+
+func (imp *importer) addCSV(fields []string) error {
+	timestamp, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", fields[1])
+	}
+	expiresAt, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid expires_at %q", fields[2])
+	}
+	vt := schema.Untyped
+	text := fields[3]
+	if imp.format.TypedValues {
+		if vt, err = schema.ParseValueType(fields[3]); err != nil {
+			return err
+		}
+		text = fields[4]
+	}
+	value, err := parseValueText(vt, text)
+	if err != nil {
+		return fmt.Errorf("invalid %s value %q", vt, text)
+	}
+	return imp.add(fields[0], vt, timestamp, expiresAt, value)
+}
+
+func (imp *importer) readJSONLines(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*MaxMeasurementBytes)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if err := imp.addJSON(scanner.Bytes()); err != nil {
+			return fmt.Errorf("line %d: %v", lineNo, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (imp *importer) addJSON(line []byte) error {
+	var record exportRecord
+	if err := json.Unmarshal(line, &record); err != nil {
+		return err
+	}
+	vt := schema.Untyped
+	if imp.format.TypedValues {
+		if record.Type == "" {
+			return errors.New("missing type")
+		}
+		var err error
+		if vt, err = schema.ParseValueType(record.Type); err != nil {
+			return err
+		}
+	}
+	value, err := parseValueJSON(vt, record.Value)
+	if err != nil {
+		return fmt.Errorf("invalid %s value %s", vt, record.Value)
+	}
+	return imp.add(record.Tag, vt, record.Timestamp, record.ExpiresAt, value)
+}
+
+func (imp *importer) add(tag string, vt schema.ValueType, timestamp uint64, expiresAt uint64, value []byte) error {
+	m := dto.TaggedMeasurement{Tag: tag, Timestamp: timestamp, Value: value}
+	if err := validateMeasurement(m); err != nil {
+		return fmt.Errorf("measurement %v", err)
+	}
+	if (vt != schema.Untyped) && (imp.writer.Catalog != nil) {
+		registered := imp.writer.Catalog.TypeOf(tag)
+		if err := checkValueType(tag, registered, vt); err != nil {
+			return err
+		}
+		if registered == schema.Untyped {
+			if err := imp.writer.Catalog.Register(tag, vt); err != nil {
+				return err
+			}
+		}
+	}
+	if err := imp.writer.validate(tag, value); err != nil {
+		return err
+	}
+	imp.batch = append(imp.batch, commitlog.Entry{Key: []byte(tag), Timestamp: timestamp, ExpiresAt: expiresAt, Value: value})
+	if len(imp.batch) >= ImportBatchSize {
+		return imp.flush()
+	}
+	return nil
+}
+
+func (imp *importer) flush() error {
+	if len(imp.batch) == 0 {
+		return nil
+	}
+	//records were validated when added
+	if err := imp.writer.Apply(imp.batch); err != nil {
+		return err
+	}
+	imp.imported += len(imp.batch)
+	imp.batch = imp.batch[:0]
+	return nil
+}
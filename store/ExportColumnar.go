@@ -0,0 +1,331 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"lsmstore/memt"
+	"lsmstore/schema"
+)
+
+// Columnar files lay out points the way Parquet does, in row groups of a single tag holding one column per field,
+// so that analytics jobs read only the columns they need and skip row groups by the footer:
+//
+//	file      magic, row groups, footer, footer offset as uint64 little endian, magic
+//	section   kind byte, body length as uint32 little endian, body, CRC-32C of the body as uint32 little endian
+//	row group tag, value type name, rows, then columns of timestamps (the first, then deltas), expires_at
+//	          (0 for none), value lengths and value bytes, each column prefixed by its length in bytes
+//	footer    row groups, then for each its tag, first and last timestamp, rows and offset in the file
+//
+// Numbers are uvarints and strings are prefixed by their length. Values are bytes as stored, which typed tags
+// encode as the schema package does; the value type is the one registered in the catalog.
+var columnarMagic = []byte{'L', 'S', 'M', 'C', 'O', 'L', 0, 1}
+
+const (
+	columnarRowGroup byte = 1
+	columnarFooter   byte = 2
+)
+
+// A row group is closed once it holds columnarGroupRows points or columnarGroupValueBytes of values, so that
+// importing holds one of at most maxColumnarGroupBytes: values, the last of which may exceed the bound, a tag,
+// and three numbers per row plus a few more.
+const columnarGroupRows = 4096
+const columnarGroupValueBytes = 1 << 20
+const maxColumnarGroupBytes = columnarGroupValueBytes + 2*MaxMeasurementBytes + binary.MaxVarintLen64*(3*columnarGroupRows+16)
+
+var columnarChecksums = crc32.MakeTable(crc32.Castagnoli)
+
+type columnarGroupInfo struct {
+	tag    string
+	first  uint64
+	last   uint64
+	rows   int
+	offset uint64
+}
+
+type columnarWriter struct {
+	w       io.Writer
+	offset  uint64
+	groups  []columnarGroupInfo
+	tag     string
+	vt      schema.ValueType
+	entries []memt.Entry
+	values  int
+}
+
+func (cw *columnarWriter) start() error {
+	return cw.write(columnarMagic)
+}
+
+func (cw *columnarWriter) startGroup(tag string, vt schema.ValueType) error {
+	if err := cw.flushGroup(); err != nil {
+		return err
+	}
+	cw.tag = tag
+	cw.vt = vt
+	return nil
+}
+
+func (cw *columnarWriter) add(e memt.Entry) error {
+	cw.entries = append(cw.entries, e)
+	cw.values += len(e.Value)
+	if (len(cw.entries) >= columnarGroupRows) || (cw.values >= columnarGroupValueBytes) {
+		return cw.flushGroup()
+	}
+	return nil
+}
+
+func (cw *columnarWriter) flushGroup() error {
+	if len(cw.entries) == 0 {
+		return nil
+	}
+	timestamps, expirations, lengths, values := []byte{}, []byte{}, []byte{}, make([]byte, 0, cw.values)
+	previous := uint64(0)
+	for _, e := range cw.entries {
+		timestamps = appendUvarint(timestamps, e.Timestamp-previous)
+		previous = e.Timestamp
+		expirations = appendUvarint(expirations, e.ExpiresAt)
+		lengths = appendUvarint(lengths, uint64(len(e.Value)))
+		values = append(values, e.Value...)
+	}
+	body := appendString(nil, cw.tag)
+	body = appendString(body, cw.vt.String())
+	body = appendUvarint(body, uint64(len(cw.entries)))
+	for _, column := range [][]byte{timestamps, expirations, lengths, values} {
+		body = appendUvarint(body, uint64(len(column)))
+		body = append(body, column...)
+	}
+	cw.groups = append(cw.groups, columnarGroupInfo{
+		tag:    cw.tag,
+		first:  cw.entries[0].Timestamp,
+		last:   previous,
+		rows:   len(cw.entries),
+		offset: cw.offset,
+	})
+	cw.entries = cw.entries[:0]
+	cw.values = 0
+	return cw.writeSection(columnarRowGroup, body)
+}
+
+func (cw *columnarWriter) finish() error {
+	if err := cw.flushGroup(); err != nil {
+		return err
+	}
+	footerOffset := cw.offset
+	body := appendUvarint(nil, uint64(len(cw.groups)))
+	for _, g := range cw.groups {
+		body = appendString(body, g.tag)
+		body = appendUvarint(body, g.first)
+		body = appendUvarint(body, g.last)
+		body = appendUvarint(body, uint64(g.rows))
+		body = appendUvarint(body, g.offset)
+	}
+	if err := cw.writeSection(columnarFooter, body); err != nil {
+		return err
+	}
+	trailer := make([]byte, 8, 8+len(columnarMagic))
+	binary.LittleEndian.PutUint64(trailer, footerOffset)
+	return cw.write(append(trailer, columnarMagic...))
+}
+
+func (cw *columnarWriter) writeSection(kind byte, body []byte) error {
+	header := make([]byte, 5)
+	header[0] = kind
+	binary.LittleEndian.PutUint32(header[1:], uint32(len(body)))
+	checksum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(checksum, crc32.Checksum(body, columnarChecksums))
+	for _, b := range [][]byte{header, body, checksum} {
+		if err := cw.write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cw *columnarWriter) write(b []byte) error {
+	_, err := cw.w.Write(b)
+	cw.offset += uint64(len(b))
+	return err
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(b, buf[:binary.PutUvarint(buf, v)]...)
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendUvarint(b, uint64(len(s))), s...)
+}
+
+// readColumnar imports row groups as they come; the footer and trailer only tell that the file is complete.
+func (imp *importer) readColumnar(r io.Reader) error {
+	reader := bufio.NewReader(r)
+	magic := make([]byte, len(columnarMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil {
+		return fmt.Errorf("missing columnar header: %v", err)
+	}
+	if !bytes.Equal(magic, columnarMagic) {
+		return errors.New("not a columnar file of version 1")
+	}
+	offset := uint64(len(columnarMagic))
+	for groupIdx := 1; ; groupIdx++ {
+		kind, err := reader.ReadByte()
+		if err == io.EOF {
+			return errors.New("columnar file is truncated, footer missing")
+		}
+		if err != nil {
+			return err
+		}
+		switch kind {
+		case columnarRowGroup:
+			body, err := readColumnarSection(reader, maxColumnarGroupBytes)
+			if err != nil {
+				return fmt.Errorf("row group %d: %v", groupIdx, err)
+			}
+			if err := imp.addColumnarGroup(body); err != nil {
+				return fmt.Errorf("row group %d: %v", groupIdx, err)
+			}
+			offset += uint64(1 + 4 + len(body) + 4)
+		case columnarFooter:
+			return readColumnarFooter(reader, offset)
+		default:
+			return fmt.Errorf("unknown section kind %d at offset %d", kind, offset)
+		}
+	}
+}
+
+// readColumnarSection reads what follows the kind byte of a section, returning the verified body.
+func readColumnarSection(r io.Reader, maxBytes int) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(header)
+	if uint64(length) > uint64(maxBytes) {
+		return nil, fmt.Errorf("%d bytes exceed the limit of %d", length, maxBytes)
+	}
+	section := make([]byte, length+4)
+	if _, err := io.ReadFull(r, section); err != nil {
+		return nil, err
+	}
+	body := section[:length]
+	if binary.LittleEndian.Uint32(section[length:]) != crc32.Checksum(body, columnarChecksums) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return body, nil
+}
+
+// readColumnarFooter checks the footer without holding it, as it grows with the file.
+func readColumnarFooter(r io.Reader, footerOffset uint64) error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("footer: %v", err)
+	}
+	checksum := crc32.New(columnarChecksums)
+	if _, err := io.CopyN(checksum, r, int64(binary.LittleEndian.Uint32(header))); err != nil {
+		return fmt.Errorf("footer: %v", err)
+	}
+	trailer := make([]byte, 4+8+len(columnarMagic))
+	if _, err := io.ReadFull(r, trailer); err != nil {
+		return fmt.Errorf("footer: %v", err)
+	}
+	if binary.LittleEndian.Uint32(trailer) != checksum.Sum32() {
+		return errors.New("footer: checksum mismatch")
+	}
+	if (binary.LittleEndian.Uint64(trailer[4:]) != footerOffset) || !bytes.Equal(trailer[12:], columnarMagic) {
+		return errors.New("footer: trailer does not match")
+	}
+	if n, _ := io.Copy(ioutil.Discard, r); n > 0 {
+		return fmt.Errorf("%d bytes after the trailer", n)
+	}
+	return nil
+}
+
+func (imp *importer) addColumnarGroup(body []byte) error {
+	d := columnarDecoder{b: body}
+	tag := string(d.bytes(d.uvarint()))
+	typeName := string(d.bytes(d.uvarint()))
+	rows := d.uvarint()
+	columns := []*columnarDecoder{d.column(), d.column(), d.column(), d.column()}
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.b) > 0 {
+		return fmt.Errorf("%d bytes after the columns", len(d.b))
+	}
+	vt, err := schema.ParseValueType(typeName)
+	if err != nil {
+		return err
+	}
+	if rows > columnarGroupRows {
+		return fmt.Errorf("%d rows exceed the limit of %d", rows, columnarGroupRows)
+	}
+	timestamps, expirations, lengths, values := columns[0], columns[1], columns[2], columns[3]
+	timestamp := uint64(0)
+	for row := uint64(1); row <= rows; row++ {
+		timestamp += timestamps.uvarint()
+		expiresAt := expirations.uvarint()
+		value := values.bytes(lengths.uvarint())
+		if err := firstColumnError(columns); err != nil {
+			return fmt.Errorf("row %d: %v", row, err)
+		}
+		if err := imp.add(tag, vt, timestamp, expiresAt, value); err != nil {
+			return fmt.Errorf("row %d: %v", row, err)
+		}
+	}
+	for _, column := range columns {
+		if len(column.b) > 0 {
+			return fmt.Errorf("%d bytes of a column after %d rows", len(column.b), rows)
+		}
+	}
+	return nil
+}
+
+func firstColumnError(columns []*columnarDecoder) error {
+	for _, column := range columns {
+		if column.err != nil {
+			return column.err
+		}
+	}
+	return nil
+}
+
+type columnarDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *columnarDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = errors.New("malformed number")
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *columnarDecoder) bytes(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.b)) {
+		d.err = fmt.Errorf("%d bytes expected, %d left", n, len(d.b))
+		return nil
+	}
+	ans := d.b[:n]
+	d.b = d.b[n:]
+	return ans
+}
+
+func (d *columnarDecoder) column() *columnarDecoder {
+	return &columnarDecoder{b: d.bytes(d.uvarint())}
+}
@@ -0,0 +1,185 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"lsmstore/dto"
+	"lsmstore/schema"
+	"lsmstore/utils"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExport_ImportRestoresDataOnAnotherStore(t *testing.T) {
+	for _, format := range []ExportFormat{
+		{Encoding: CSV},
+		{Encoding: CSV, TypedValues: true},
+		{Encoding: JSONLines},
+		{Encoding: JSONLines, TypedValues: true},
+		{Encoding: Columnar},
+	} {
+		//given
+		sourceReader, sourceWriter := newExportTestStorage()
+		assert.Nil(t, sourceWriter.Catalog.Register("temperature", schema.Float64))
+		assert.Nil(t, sourceWriter.Catalog.Register("name", schema.String))
+		assert.Nil(t, sourceWriter.StoreFloat("temperature", 1000, 21.5, 0))
+		assert.Nil(t, sourceWriter.StoreFloat("temperature", 2000, math.Inf(1), 0))
+		assert.Nil(t, sourceWriter.StoreString("name", 1000, "kitchen, \"north\"\nside", 0))
+		assert.Nil(t, sourceWriter.Store(dto.TaggedMeasurement{Tag: "raw", Timestamp: 1500, Value: []byte{0, 1, 255}}, 0))
+		expiresAt := utils.GetNowMillis() + 3600*1000
+		assert.Nil(t, sourceWriter.Store(dto.TaggedMeasurement{Tag: "expiring", Timestamp: 1200, Value: []byte{7}}, expiresAt))
+		assert.Nil(t, sourceWriter.Store(dto.TaggedMeasurement{Tag: "expiring", Timestamp: 1300, Value: []byte{8}}, utils.GetNowMillis()-1))
+		targetReader, targetWriter := newExportTestStorage()
+		var exported bytes.Buffer
+
+		//when
+		exportErr := sourceReader.Export(&exported, nil, 0, 5000, format)
+		imported, importErr := targetWriter.Import(bytes.NewReader(exported.Bytes()), format)
+
+		//then
+		assert.Nil(t, exportErr, format)
+		assert.Nil(t, importErr, format)
+		assert.Equal(t, 5, imported, "expired point exported or point lost")
+		tags := []string{"name", "raw", "temperature"}
+		assert.Equal(t, sourceReader.Retrieve(tags, 0, 5000), targetReader.Retrieve(tags, 0, 5000), format)
+		assert.Equal(t, []dto.Measurement{{Timestamp: 1200, Value: []byte{7}}}, targetReader.Retrieve([]string{"expiring"}, 0, 5000)["expiring"], format)
+		unflushed, _ := targetWriter.WriteBuffer.ExistingBufferForTag("expiring")
+		assert.Equal(t, expiresAt, unflushed.RetrieveAll()[0].ExpiresAt, "expiration lost on import")
+		expectedType := schema.Untyped
+		if format.TypedValues || (format.Encoding == Columnar) {
+			expectedType = schema.Float64
+		}
+		assert.Equal(t, expectedType, targetWriter.Catalog.TypeOf("temperature"), format)
+	}
+}
+
+func TestExport_WritesReadableRecords(t *testing.T) {
+	//given
+	reader, writer := newExportTestStorage()
+	assert.Nil(t, writer.Catalog.Register("temperature", schema.Float64))
+	assert.Nil(t, writer.StoreFloat("temperature", 1000, 21.5, 0))
+	assert.Nil(t, writer.StoreFloat("temperature", 2000, 22, 0))
+	rawExpiresAt := utils.GetNowMillis() + 3600*1000
+	assert.Nil(t, writer.Store(dto.TaggedMeasurement{Tag: "raw", Timestamp: 1500, Value: []byte{1, 2}}, rawExpiresAt))
+	expiresAt := strconv.FormatUint(rawExpiresAt, 10)
+	var csv, typedCSV, jsonl, typedJSONL bytes.Buffer
+
+	//when
+	assert.Nil(t, reader.Export(&csv, []string{"temperature"}, 1500, 5000, ExportFormat{Encoding: CSV}))
+	assert.Nil(t, reader.Export(&typedCSV, []string{"temperature", "raw"}, 0, 5000, ExportFormat{Encoding: CSV, TypedValues: true}))
+	assert.Nil(t, reader.Export(&jsonl, []string{"raw"}, 0, 5000, ExportFormat{Encoding: JSONLines}))
+	assert.Nil(t, reader.Export(&typedJSONL, []string{"temperature"}, 0, 1000, ExportFormat{Encoding: JSONLines, TypedValues: true}))
+
+	//then
+	assert.Equal(t, "tag,timestamp,expires_at,value\ntemperature,2000,0,AAAAAAAANkA=\n", csv.String())
+	assert.Equal(t, "tag,timestamp,expires_at,type,value\ntemperature,1000,0,float64,21.5\ntemperature,2000,0,float64,22\nraw,1500,"+expiresAt+",untyped,AQI=\n", typedCSV.String())
+	assert.Equal(t, `{"tag":"raw","timestamp":1500,"expires_at":`+expiresAt+`,"value":"AQI="}`+"\n", jsonl.String())
+	assert.Equal(t, `{"tag":"temperature","timestamp":1000,"expires_at":0,"type":"float64","value":21.5}`+"\n", typedJSONL.String())
+}
+
+func TestImport_RejectsInvalidRecords(t *testing.T) {
+	//given
+	reader, writer := newExportTestStorage()
+	assert.Nil(t, writer.Catalog.Register("temperature", schema.Float64))
+	typedJSONL := ExportFormat{Encoding: JSONLines, TypedValues: true}
+
+	for _, c := range []struct {
+		format   ExportFormat
+		data     string
+		imported int
+		err      string
+	}{
+		{ExportFormat{Encoding: CSV}, "tag,timestamp,expires_at,type,value\n", 0, "expected header"},
+		{ExportFormat{Encoding: CSV}, "tag,timestamp,expires_at,value\nraw,10,0,AQI=\nraw,x,0,AQI=\n", 0, "record 2: invalid timestamp"},
+		{ExportFormat{Encoding: CSV}, "tag,timestamp,expires_at,value\nraw,10,never,AQI=\n", 0, "record 1: invalid expires_at"},
+		{ExportFormat{Encoding: CSV}, "tag,timestamp,expires_at,value\nraw,0,0,AQI=\n", 0, "record 1: measurement has no timestamp"},
+		{ExportFormat{Encoding: CSV}, "tag,timestamp,expires_at,value\nraw,10,0,not base64\n", 0, "record 1: invalid untyped value"},
+		{typedJSONL, `{"tag":"raw","timestamp":10,"value":"AQI="}`, 0, "line 1: missing type"},
+		{typedJSONL, `{"tag":"temperature","timestamp":10,"type":"int64","value":5}`, 0, "holds float64 values, not int64"},
+		{typedJSONL, `{"tag":"flag","timestamp":10,"type":"bool","value":"yes"}`, 0, "invalid bool value"},
+		{typedJSONL, `{"tag":"label","timestamp":10,"type":"string","value":5}`, 0, "invalid string value"},
+		{ExportFormat{Encoding: JSONLines}, "\n" + `{"tag":"","timestamp":10,"value":"AQI="}`, 0, "line 2: measurement has no tag"},
+	} {
+		//when
+		imported, err := writer.Import(strings.NewReader(c.data), c.format)
+
+		//then
+		assert.Equal(t, c.imported, imported, c.data)
+		if assert.NotNil(t, err, c.data) {
+			assert.Contains(t, err.Error(), c.err)
+		}
+	}
+	assert.Equal(t, 0, len(reader.Retrieve([]string{"raw"}, 0, 5000)["raw"]), "records before an invalid one in the same batch were stored")
+}
+
+func TestExport_ColumnarFileIsSplitIntoRowGroupsAndChecked(t *testing.T) {
+	//given
+	reader, writer := newExportTestStorage()
+	batch := make([]dto.TaggedMeasurement, columnarGroupRows+10)
+	for i := range batch {
+		batch[i] = dto.TaggedMeasurement{Tag: "counter", Timestamp: 1000 + 3*uint64(i), Value: []byte{byte(i)}}
+	}
+	assert.Nil(t, writer.StoreBatch(batch, 0))
+	var exported bytes.Buffer
+	assert.Nil(t, reader.Export(&exported, []string{"counter"}, 0, ^uint64(0)-1, ExportFormat{Encoding: Columnar}))
+	file := exported.Bytes()
+
+	//when
+	imported, importErr := importColumnar(file)
+
+	//then
+	assert.Nil(t, importErr)
+	assert.Equal(t, len(batch), imported)
+	footerOffset := binary.LittleEndian.Uint64(file[len(file)-16:])
+	assert.Equal(t, columnarFooter, file[footerOffset], "trailer does not point to the footer")
+	footer := columnarDecoder{b: file[footerOffset+5 : len(file)-20]}
+	assert.Equal(t, uint64(2), footer.uvarint(), "points were not split into row groups")
+
+	for _, c := range []struct {
+		data []byte
+		err  string
+	}{
+		{[]byte("tag,timestamp"), "not a columnar file"},
+		{file[:footerOffset], "footer missing"},
+		{file[:len(file)-3], "footer"},
+		{append(append([]byte{}, file...), 0), "bytes after the trailer"},
+		{flipped(file, len(columnarMagic)+40), "row group 1: checksum mismatch"},
+		{flipped(file, int(footerOffset)+8), "footer: checksum mismatch"},
+		{append(append([]byte{}, columnarMagic...), columnarRowGroup, 0xff, 0xff, 0xff, 0xff), "exceed the limit"},
+	} {
+		//when
+		_, err := importColumnar(c.data)
+
+		//then
+		if assert.NotNil(t, err, c.err) {
+			assert.Contains(t, err.Error(), c.err)
+		}
+	}
+}
+
+func importColumnar(data []byte) (int, error) {
+	_, writer := newExportTestStorage()
+	return writer.Import(bytes.NewReader(data), ExportFormat{Encoding: Columnar})
+}
+
+func flipped(data []byte, at int) []byte {
+	ans := append([]byte{}, data...)
+	ans[at] ^= 0x01
+	return ans
+}
+
+func newExportTestStorage() (*StorageReader, *StorageWriter) {
+	return InitStorageWithOptions(Options{
+		CommitlogPath:        fmt.Sprintf("/tmp/golsm_test/export/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		EntriesPerCommitlog:  1000,
+		PeriodBetweenFlushes: time.Hour,
+		SSTPath:              fmt.Sprintf("/tmp/golsm_test/export/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		MemtMaxEntriesPerTag: 10,
+	})
+}
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"errors"
+	"lsmstore/commitlog"
+)
+
+// FollowBatchSize bounds the records handed to a Follow receiver at once.
+const FollowBatchSize = 1000
+
+// ErrTooFarBehind is returned by Follow for records which are gone from memory and the commitlogs, and not archived.
+var ErrTooFarBehind = errors.New("records are no longer kept, start over from a checkpoint")
+
+// Follow hands the records stored from sequence from on to receiver, in sequence and in batches, and keeps waiting for
+// new ones until stop is closed or receiver fails. Records no longer in memory are read from the commitlog archive or
+// the active commitlog. A crash of the store may leave gaps in sequences, which are skipped.
+func (db *DB) Follow(from uint64, stop <-chan struct{}, receiver func([]commitlog.Record) error) error {
+	tail := db.Writer.Tail
+	if from == 0 {
+		from = 1
+	}
+	for {
+		changed := tail.Changed()
+		records, kept := tail.Since(from, FollowBatchSize)
+		if !kept {
+			next, err := db.catchUp(from, receiver)
+			if err != nil {
+				return err
+			}
+			from = next
+			continue
+		}
+		if len(records) > 0 {
+			if err := receiver(records); err != nil {
+				return err
+			}
+			from = records[len(records)-1].Sequence + 1
+			continue
+		}
+		select {
+		case <-changed:
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// catchUp hands receiver records from sequence from on which the tail does not hold anymore, returning the sequence
+// to continue with.
+func (db *DB) catchUp(from uint64, receiver func([]commitlog.Record) error) (uint64, error) {
+	clm := db.Writer.DiskWriter.ClManager
+	if from <= clm.FlushedSequence() {
+		return db.catchUpFromArchive(from, receiver)
+	}
+	//the active commitlog can only be read while nothing is stored, but receiver is not kept waiting meanwhile
+	var first uint64
+	var entries []commitlog.Entry
+	db.Writer.DiskWriter.Paused(func() {
+		first = clm.FlushedSequence() + 1
+		entries = clm.RetrieveAll()
+	})
+	if from < first {
+		//flushed meanwhile
+		return from, nil
+	}
+	return sendEntries(first, entries, from, receiver)
+}
+
+func (db *DB) catchUpFromArchive(from uint64, receiver func([]commitlog.Record) error) (uint64, error) {
+	archiveDir := db.Writer.DiskWriter.ClManager.ArchiveDir
+	if archiveDir == "" {
+		return from, ErrTooFarBehind
+	}
+	logs, err := commitlog.ListArchive(archiveDir)
+	if err != nil {
+		return from, err
+	}
+	start := -1
+	for i, l := range logs {
+		if l.FirstRecord <= from {
+			start = i
+		}
+	}
+	if start < 0 {
+		return from, ErrTooFarBehind
+	}
+	for _, l := range logs[start:] {
+		entries := make([]commitlog.Entry, 0)
+		if _, err := commitlog.ScanFile(l.Path, func(e commitlog.Entry, _ int64) {
+			entries = append(entries, e)
+		}); err != nil {
+			return from, err
+		}
+		if from, err = sendEntries(l.FirstRecord, entries, from, receiver); err != nil {
+			return from, err
+		}
+	}
+	return from, nil
+}
+
+// sendEntries hands receiver the entries, numbered from first on, whose sequence is at least from.
+func sendEntries(first uint64, entries []commitlog.Entry, from uint64, receiver func([]commitlog.Record) error) (uint64, error) {
+	batch := make([]commitlog.Record, 0, FollowBatchSize)
+	for i, e := range entries {
+		sequence := first + uint64(i)
+		if sequence < from {
+			continue
+		}
+		batch = append(batch, commitlog.Record{Sequence: sequence, Entry: e})
+		if len(batch) == FollowBatchSize {
+			if err := receiver(batch); err != nil {
+				return from, err
+			}
+			from, batch = sequence+1, make([]commitlog.Record, 0, FollowBatchSize)
+		}
+	}
+	if len(batch) > 0 {
+		if err := receiver(batch); err != nil {
+			return from, err
+		}
+		from = batch[len(batch)-1].Sequence + 1
+	}
+	if next := first + uint64(len(entries)); from < next {
+		//a gap left by a crash
+		from = next
+	}
+	return from, nil
+}
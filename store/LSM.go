@@ -3,25 +3,109 @@ package store
 import (
 	"lsmstore/commitlog"
 	"lsmstore/memt"
+	"lsmstore/schema"
+	"lsmstore/series"
 	"lsmstore/sst"
+	"lsmstore/utils"
 	"lsmstore/writer"
 	"time"
 )
 
+const CatalogFileName = "catalog.json"
+const SeriesIndexFileName = "series.idx"
+
+// DefaultTailRecords is how many of the newest commitlog records are kept in memory for DB.Follow by default.
+const DefaultTailRecords = 10000
+
+type Options struct {
+	CommitlogPath              string
+	EntriesPerCommitlog        int
+	PeriodBetweenFlushes       time.Duration
+	MemtPerformExpirationEvery time.Duration
+	MemtPrefetchSeconds        time.Duration
+	SSTPath                    string
+	MemtMaxEntriesPerTag       int
+	// MemtMaxAgePerTag makes the memtable cache keep only points within this age of the newest point of each tag
+	MemtMaxAgePerTag time.Duration
+	ReadParallelism  int
+	MaxOpenFiles     int
+	// BlockCacheBytes bounds the shared SST block cache; 0 means sst.DefaultBlockCacheBytes, negative disables it
+	BlockCacheBytes int64
+	BlockSize       int
+	// PinnedTags are kept in the block cache once read, regardless of BlockCacheBytes
+	PinnedTags []string
+	// MemtMaxBytes bounds the memtable cache; once exceeded, oldest entries are evicted
+	MemtMaxBytes int64
+	// MmapSST reads SSTs from memory-mapped files; only supported on linux, other platforms fall back to buffered reads
+	MmapSST bool
+	// CommitlogArchivePath keeps flushed commitlogs there, see commitlog.Manager.ArchiveDir
+	CommitlogArchivePath      string
+	CommitlogArchiveRetention time.Duration
+	// TailRecords of the newest commitlog records are kept in memory for DB.Follow; 0 means DefaultTailRecords
+	TailRecords int
+}
+
 func InitStorage(commitlogPath string, entriesPerCommitlog int, periodBetweenFlushes time.Duration, memtPerformExpirationEvery time.Duration, memtPrefetchSeconds time.Duration, sstPath string, memtMaxEntriesPerTag int) (*StorageReader, *StorageWriter) {
-	clm := commitlog.Manager{Path: commitlogPath}
-	sstm := sst.Manager{RootDir: sstPath}
-	dw := writer.DiskWriter{SstManager: &sstm, ClManager: &clm, EntriesPerCommitlog: entriesPerCommitlog, PeriodBetweenFlushes: periodBetweenFlushes}
+	return InitStorageWithOptions(Options{
+		CommitlogPath:              commitlogPath,
+		EntriesPerCommitlog:        entriesPerCommitlog,
+		PeriodBetweenFlushes:       periodBetweenFlushes,
+		MemtPerformExpirationEvery: memtPerformExpirationEvery,
+		MemtPrefetchSeconds:        memtPrefetchSeconds,
+		SSTPath:                    sstPath,
+		MemtMaxEntriesPerTag:       memtMaxEntriesPerTag,
+	})
+}
+
+func InitStorageWithOptions(opts Options) (*StorageReader, *StorageWriter) {
+	clm := commitlog.Manager{Path: opts.CommitlogPath, ArchiveDir: opts.CommitlogArchivePath, ArchiveRetention: opts.CommitlogArchiveRetention}
+	sstm := sst.Manager{RootDir: opts.SSTPath, MaxOpenFiles: opts.MaxOpenFiles, BlockCacheBytes: opts.BlockCacheBytes, BlockSize: opts.BlockSize, Mmap: opts.MmapSST}
+	writeBuffer := memt.WriteBuffer{}
+	writeBuffer.Init()
+	dw := writer.DiskWriter{SstManager: &sstm, ClManager: &clm, EntriesPerCommitlog: opts.EntriesPerCommitlog, PeriodBetweenFlushes: opts.PeriodBetweenFlushes, AfterFlush: writeBuffer.RemoveFlushed}
 	dw.Init()
+	tail := commitlog.Tail{Capacity: opts.TailRecords}
+	if tail.Capacity == 0 {
+		tail.Capacity = DefaultTailRecords
+	}
+	tail.Init(clm.Sequence())
+	dw.AfterStore = tail.Append
+	//entries left in the commitlog by the previous run are only flushed on the next switch
+	leftovers := clm.RetrieveAll()
+	writeBuffer.Add(leftovers)
+	for _, tag := range opts.PinnedTags {
+		sstm.PinTag(tag)
+	}
+
+	catalog := schema.Catalog{Path: opts.SSTPath + "/" + CatalogFileName}
+	//a damaged catalog would otherwise leave typed tags unchecked
+	utils.Check(catalog.Init())
+	seriesIndex := series.Index{Path: opts.SSTPath + "/" + SeriesIndexFileName}
+	utils.Check(seriesIndex.Init())
+	tagIndex := TagIndex{}
+	tagIndex.Init()
 
-	memtm := memt.Manager{MaxEntriesPerTag: memtMaxEntriesPerTag, PerformExpirationEvery: memtPerformExpirationEvery}
+	memtm := memt.Manager{MaxEntriesPerTag: opts.MemtMaxEntriesPerTag, MaxAgePerTag: opts.MemtMaxAgePerTag, PerformExpirationEvery: opts.MemtPerformExpirationEvery, MaxBytes: opts.MemtMaxBytes, PersistedMax: persistedMax(&sstm)}
 	memtm.InitStorage()
 
-	storageWriter := StorageWriter{MemTable: &memtm, DiskWriter: &dw}
+	storageWriter := StorageWriter{MemTable: &memtm, WriteBuffer: &writeBuffer, DiskWriter: &dw, Catalog: &catalog, Series: &seriesIndex, Tags: &tagIndex, Tail: &tail}
 	storageWriter.Init()
 
-	storageReader := StorageReader{MemTable: &memtm, SSTManager: &sstm, MemtPrefetch: memtPrefetchSeconds}
+	storageReader := StorageReader{MemTable: &memtm, WriteBuffer: &writeBuffer, SSTManager: &sstm, MemtPrefetch: opts.MemtPrefetchSeconds, Catalog: &catalog, Series: &seriesIndex, Tags: &tagIndex, ReadParallelism: opts.ReadParallelism}
 	storageReader.Init()
+	//replayed after prefetch, as leftovers are newer than anything on disk
+	memtm.MergeWithCommitlog(leftovers)
 
 	return &storageReader, &storageWriter
 }
+
+func persistedMax(sstm *sst.Manager) func(string) (uint64, bool) {
+	return func(tag string) (uint64, bool) {
+		sstForTag, exists := sstm.ExistingSstForTag(tag)
+		if !exists {
+			return 0, false
+		}
+		_, max := sstForTag.Availability()
+		return max, max != 0
+	}
+}
@@ -0,0 +1,75 @@
+package store
+
+import (
+	"lsmstore/dto"
+	"lsmstore/memt"
+	"sort"
+)
+
+// Latest returns the newest measurement for every tag that has any.
+func (sr *StorageReader) Latest(tags []string) map[string]dto.Measurement {
+	ans := make(map[string]dto.Measurement)
+	lastPerTag := make([][]dto.Measurement, len(tags))
+	sr.forEachTagInParallel(tags, func(i int, tag string) {
+		lastPerTag[i] = sr.LastN(tag, 1)
+	})
+	for i, tag := range tags {
+		if len(lastPerTag[i]) > 0 {
+			ans[tag] = lastPerTag[i][0]
+		}
+	}
+	return ans
+}
+
+// LastN returns up to n newest measurements of a tag in ascending order, without reading older data.
+func (sr *StorageReader) LastN(tag string, n int) []dto.Measurement {
+	if n <= 0 {
+		return []dto.Measurement{}
+	}
+	timestampToValue := make(map[uint64][]byte)
+
+	var dataFromMemt []memt.Entry
+	if memtForTag, memtExists := sr.MemTable.ExistingMemTableForTag(tag); memtExists {
+		dataFromMemt = memtForTag.LastN(n)
+	}
+	if sr.WriteBuffer != nil {
+		if buffer, bufferExists := sr.WriteBuffer.ExistingBufferForTag(tag); bufferExists {
+			dataFromMemt = mergeEntries(buffer.LastN(n), dataFromMemt, false)
+		}
+	}
+	if len(dataFromMemt) > n {
+		dataFromMemt = dataFromMemt[len(dataFromMemt)-n:]
+	}
+	fromMemt := len(dataFromMemt)
+	oldestFromMemt := uint64(0)
+	if fromMemt > 0 {
+		oldestFromMemt = dataFromMemt[0].Timestamp
+	}
+	for _, dfm := range dataFromMemt {
+		timestampToValue[dfm.Timestamp] = dfm.Value
+	}
+
+	sstForTag, sstExists := sr.SSTManager.ExistingSstForTag(tag)
+	if sstExists {
+		_, sstTo := sstForTag.Availability()
+		if (fromMemt < n) || (sstTo > oldestFromMemt) {
+			for _, dfs := range sstForTag.LastEntries(n) {
+				if _, inMemt := timestampToValue[dfs.Timestamp]; !inMemt {
+					timestampToValue[dfs.Timestamp] = dfs.Value
+				}
+			}
+		}
+	}
+
+	ans := make([]dto.Measurement, 0, len(timestampToValue))
+	for k, v := range timestampToValue {
+		ans = append(ans, dto.Measurement{Timestamp: k, Value: v})
+	}
+	sort.Slice(ans, func(i, j int) bool {
+		return ans[i].Timestamp < ans[j].Timestamp
+	})
+	if len(ans) > n {
+		ans = ans[len(ans)-n:]
+	}
+	return ans
+}
@@ -0,0 +1,40 @@
+package store
+
+import (
+	"fmt"
+	"lsmstore/dto"
+	"lsmstore/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLSM_LatestAndLastNWork(t *testing.T) {
+	//given
+	storageReader, storageWriter := InitStorage(
+		fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		10,
+		1*time.Second,
+		10*time.Second,
+		10*time.Second,
+		fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		5)
+	dummyData := buildDummyData(20)
+
+	//when
+	storageWriter.StoreBatch(sliceAndToBatch(dummyData, "tag1", 0, 20), 0)
+	storageWriter.StoreBatch(sliceAndToBatch(dummyData, "tag2", 0, 10), 0)
+	storageWriter.Store(dto.TaggedMeasurement{Tag: "tag2", Timestamp: 1400, Value: []byte{42}}, 0)
+	time.Sleep(2 * time.Second)
+	latest := storageReader.Latest([]string{"tag1", "tag2", "tag3"})
+	lastN := storageReader.LastN("tag1", 8)
+	all := storageReader.LastN("tag2", 100)
+
+	//then
+	assert.Equal(t, 2, len(latest), "tag without data returned")
+	assert.Equal(t, dummyData[19], latest["tag1"], "latest incorrect for tag1")
+	assert.Equal(t, dto.Measurement{Timestamp: 1400, Value: []byte{42}}, latest["tag2"], "latest missed flushed-only point")
+	assert.Equal(t, dummyData[12:20], lastN, "lastN incorrect across memtable and SST")
+	assert.Equal(t, 11, len(all), "lastN incorrect when asked for more than stored")
+}
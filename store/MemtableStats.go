@@ -0,0 +1,8 @@
+package store
+
+import "lsmstore/memt"
+
+// MemtableStats reports accounted size of the memtable cache against its budget and how much was evicted to stay within it.
+func (sr *StorageReader) MemtableStats() memt.Stats {
+	return sr.MemTable.Stats()
+}
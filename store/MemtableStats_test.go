@@ -0,0 +1,37 @@
+package store
+
+import (
+	"fmt"
+	"lsmstore/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLSM_MemtableBudgetKeepsEvictedDataReadable(t *testing.T) {
+	//given
+	storageReader, storageWriter := InitStorageWithOptions(Options{
+		CommitlogPath:              fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		EntriesPerCommitlog:        100000,
+		PeriodBetweenFlushes:       time.Hour,
+		MemtPerformExpirationEvery: 10 * time.Second,
+		SSTPath:                    fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		MemtMaxEntriesPerTag:       1000,
+		MemtMaxBytes:               4096,
+	})
+
+	//when
+	for i := 0; i < 10; i++ {
+		storageWriter.StoreBatch(sliceAndToBatch(buildDummyData(50), fmt.Sprintf("tag%d", i), 0, 50), 0)
+	}
+	stats := storageReader.MemtableStats()
+	data := storageReader.Retrieve([]string{"tag0", "tag9"}, 0, 2000)
+
+	//then
+	assert.LessOrEqual(t, stats.Bytes, int64(4096), "memtable exceeds its budget")
+	assert.Less(t, int64(0), stats.Evictions, "nothing was evicted")
+	assert.Equal(t, 10, stats.Tags)
+	assert.Equal(t, 50, len(data["tag0"]), "evicted entries became unreadable")
+	assert.Equal(t, 50, len(data["tag9"]), "evicted entries became unreadable")
+}
@@ -0,0 +1,127 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"lsmstore/dto"
+	"sort"
+)
+
+const DefaultPageLimit = 1000
+
+const cursorVersion = 1
+
+type RetrieveOptions struct {
+	Limit      int
+	Cursor     string
+	Descending bool
+}
+
+// Page holds at most Limit measurements across the requested tags; tags are visited in sorted order.
+// Cursor is empty on the last page, otherwise it is passed back in RetrieveOptions to continue.
+type Page struct {
+	Data   map[string][]dto.Measurement
+	Cursor string
+}
+
+type cursor struct {
+	descending bool
+	tag        string
+	timestamp  uint64
+}
+
+func (sr *StorageReader) RetrievePage(tags []string, from uint64, to uint64, opts RetrieveOptions) (Page, error) {
+	if opts.Limit <= 0 {
+		opts.Limit = DefaultPageLimit
+	}
+	sortedTags := uniqueSorted(tags)
+
+	startIdx := 0
+	cursorFrom, cursorTo := from, to
+	if opts.Cursor != "" {
+		c, err := decodeCursor(opts.Cursor)
+		if err != nil {
+			return Page{}, err
+		}
+		if c.descending != opts.Descending {
+			return Page{}, errors.New("cursor was issued for another scan direction")
+		}
+		startIdx = sort.SearchStrings(sortedTags, c.tag)
+		if (startIdx == len(sortedTags)) || (sortedTags[startIdx] != c.tag) {
+			return Page{}, errors.New("cursor was issued for another set of tags")
+		}
+		if opts.Descending {
+			if c.timestamp == 0 {
+				startIdx++
+			} else if c.timestamp-1 < to {
+				cursorTo = c.timestamp - 1
+			}
+		} else {
+			if c.timestamp == ^uint64(0) {
+				startIdx++
+			} else if c.timestamp+1 > from {
+				cursorFrom = c.timestamp + 1
+			}
+		}
+	}
+
+	ans := Page{Data: make(map[string][]dto.Measurement)}
+	collected := 0
+	var last cursor
+	for i := startIdx; (i < len(sortedTags)) && (collected <= opts.Limit); i++ {
+		tag := sortedTags[i]
+		tagFrom, tagTo := from, to
+		if (i == startIdx) && (opts.Cursor != "") {
+			tagFrom, tagTo = cursorFrom, cursorTo
+		}
+		receiver := func(m dto.Measurement) bool {
+			collected++
+			if collected > opts.Limit {
+				ans.Cursor = encodeCursor(last)
+				return false
+			}
+			ans.Data[tag] = append(ans.Data[tag], m)
+			last = cursor{descending: opts.Descending, tag: tag, timestamp: m.Timestamp}
+			return true
+		}
+		if opts.Descending {
+			sr.iterateOverDataForTagDescending(tag, tagFrom, tagTo, receiver)
+		} else {
+			sr.iterateOverDataForTag(tag, tagFrom, tagTo, receiver)
+		}
+	}
+	return ans, nil
+}
+
+func uniqueSorted(tags []string) []string {
+	set := make(map[string]struct{})
+	ans := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if _, exists := set[tag]; !exists {
+			set[tag] = struct{}{}
+			ans = append(ans, tag)
+		}
+	}
+	sort.Strings(ans)
+	return ans
+}
+
+func encodeCursor(c cursor) string {
+	arr := make([]byte, 10+len(c.tag))
+	arr[0] = cursorVersion
+	if c.descending {
+		arr[1] = 1
+	}
+	binary.LittleEndian.PutUint64(arr[2:], c.timestamp)
+	copy(arr[10:], c.tag)
+	return base64.RawURLEncoding.EncodeToString(arr)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	arr, err := base64.RawURLEncoding.DecodeString(s)
+	if (err != nil) || (len(arr) < 10) || (arr[0] != cursorVersion) || (arr[1] > 1) {
+		return cursor{}, errors.New("malformed cursor")
+	}
+	return cursor{descending: arr[1] == 1, timestamp: binary.LittleEndian.Uint64(arr[2:]), tag: string(arr[10:])}, nil
+}
@@ -0,0 +1,140 @@
+package store
+
+import (
+	"fmt"
+	"lsmstore/dto"
+	"lsmstore/utils"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLSM_RetrievePageWorks(t *testing.T) {
+	//given
+	storageReader, storageWriter := InitStorage(
+		fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		10,
+		1*time.Second,
+		10*time.Second,
+		10*time.Second,
+		fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		5)
+	//points at even timestamps leave room for inserts between them
+	tags := []string{"tag3", "tag1", "tag2"}
+	stored := make(map[string]map[uint64][]byte)
+	for _, tag := range tags {
+		stored[tag] = make(map[uint64][]byte)
+		batch := make([]dto.TaggedMeasurement, 25)
+		for i := range batch {
+			batch[i] = dto.TaggedMeasurement{Tag: tag, Timestamp: 1000 + 2*uint64(i), Value: []byte{0}}
+			stored[tag][batch[i].Timestamp] = batch[i].Value
+		}
+		storageWriter.StoreBatch(batch, 0)
+	}
+	time.Sleep(2 * time.Second)
+	written := 0
+
+	for _, descending := range []bool{false, true} {
+		//given
+		//every point stored when the scan starts is returned once, as are points written ahead of the cursor later
+		expected := make(map[string]map[uint64][]byte)
+		for tag, points := range stored {
+			expected[tag] = make(map[uint64][]byte)
+			for ts, value := range points {
+				expected[tag][ts] = value
+			}
+		}
+
+		//when
+		pages := make([]Page, 0)
+		opts := RetrieveOptions{Limit: 10, Descending: descending}
+		for {
+			page, err := storageReader.RetrievePage(tags, 1000, 1048, opts)
+			assert.Nil(t, err)
+			pages = append(pages, page)
+			if page.Cursor == "" {
+				break
+			}
+			opts.Cursor = page.Cursor
+			lastTag, lastTs := lastOfPage(page)
+			//inserts and overwrites within the range, both behind and ahead of the cursor
+			for _, tag := range []string{"tag1", "tag2", "tag3"} {
+				written++
+				insert := dto.TaggedMeasurement{Tag: tag, Timestamp: 1001 + 2*uint64((written*7)%24), Value: []byte{byte(written)}}
+				overwrite := dto.TaggedMeasurement{Tag: tag, Timestamp: 1000 + 2*uint64((written*5)%25), Value: []byte{byte(written)}}
+				for _, m := range []dto.TaggedMeasurement{insert, overwrite} {
+					assert.Nil(t, storageWriter.StoreBatch([]dto.TaggedMeasurement{m}, 0))
+					stored[m.Tag][m.Timestamp] = m.Value
+					if isAheadOfCursor(lastTag, lastTs, m.Tag, m.Timestamp, descending) {
+						expected[m.Tag][m.Timestamp] = m.Value
+					}
+				}
+			}
+		}
+
+		//then
+		for i, page := range pages {
+			count := 0
+			for _, data := range page.Data {
+				count += len(data)
+			}
+			if i < len(pages)-1 {
+				assert.Equal(t, 10, count, "page size incorrect")
+			}
+		}
+		assert.Equal(t, 10, len(pages[0].Data["tag1"]), "tags are not visited in sorted order")
+		for _, tag := range tags {
+			merged := make([]dto.Measurement, 0)
+			for _, page := range pages {
+				merged = append(merged, page.Data[tag]...)
+			}
+			assert.Equal(t, sortedModel(expected[tag], descending), merged, "measurements of %s lost, duplicated or stale, descending %v", tag, descending)
+		}
+	}
+
+	//when
+	ascendingPage, _ := storageReader.RetrievePage(tags, 1000, 1048, RetrieveOptions{Limit: 10})
+	_, errDirection := storageReader.RetrievePage(tags, 1000, 1048, RetrieveOptions{Limit: 10, Cursor: ascendingPage.Cursor, Descending: true})
+	_, errTags := storageReader.RetrievePage([]string{"tag2"}, 1000, 1048, RetrieveOptions{Limit: 10, Cursor: ascendingPage.Cursor})
+	_, errMalformed := storageReader.RetrievePage(tags, 1000, 1048, RetrieveOptions{Limit: 10, Cursor: "garbage!"})
+
+	//then
+	assert.NotNil(t, errDirection, "cursor accepted for another direction")
+	assert.NotNil(t, errTags, "cursor accepted for another set of tags")
+	assert.NotNil(t, errMalformed, "malformed cursor accepted")
+}
+
+// lastOfPage returns the point the cursor of a page continues after: tags are visited in sorted order.
+func lastOfPage(page Page) (string, uint64) {
+	lastTag := ""
+	for tag := range page.Data {
+		if tag > lastTag {
+			lastTag = tag
+		}
+	}
+	data := page.Data[lastTag]
+	return lastTag, data[len(data)-1].Timestamp
+}
+
+func isAheadOfCursor(cursorTag string, cursorTs uint64, tag string, ts uint64, descending bool) bool {
+	if tag != cursorTag {
+		return tag > cursorTag
+	}
+	if descending {
+		return ts < cursorTs
+	}
+	return ts > cursorTs
+}
+
+func sortedModel(model map[uint64][]byte, descending bool) []dto.Measurement {
+	ans := make([]dto.Measurement, 0, len(model))
+	for ts, value := range model {
+		ans = append(ans, dto.Measurement{Timestamp: ts, Value: value})
+	}
+	sort.Slice(ans, func(i, j int) bool {
+		return (ans[i].Timestamp < ans[j].Timestamp) != descending
+	})
+	return ans
+}
@@ -0,0 +1,40 @@
+package store
+
+import (
+	"fmt"
+	"lsmstore/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLSM_ParallelRetrieveMatchesSequential(t *testing.T) {
+	//given
+	storageReader, storageWriter := InitStorage(
+		fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		1000,
+		1*time.Second,
+		10*time.Second,
+		10*time.Second,
+		fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		5)
+	tags := make([]string, 200)
+	for i := range tags {
+		tags[i] = fmt.Sprintf("tag%d", i)
+		storageWriter.StoreBatch(sliceAndToBatch(buildDummyData(50), tags[i], 0, 50), 0)
+	}
+	time.Sleep(2 * time.Second)
+
+	//when
+	parallel := storageReader.Retrieve(tags, 1340, 1380)
+	storageReader.ReadParallelism = 1
+	sequential := storageReader.Retrieve(tags, 1340, 1380)
+
+	//then
+	assert.Equal(t, 200, len(parallel), "tags lost")
+	assert.Equal(t, sequential, parallel, "parallel read differs from sequential")
+	for _, tag := range tags {
+		assert.Equal(t, 41, len(parallel[tag]), "measurements lost for "+tag)
+	}
+}
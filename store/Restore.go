@@ -0,0 +1,179 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"lsmstore/commitlog"
+	"lsmstore/sst"
+	"lsmstore/utils"
+	"os"
+	"path/filepath"
+)
+
+// RestoreOptions name a checkpoint and the archived commitlogs replayed on top of it. Zero Until fields do not bound
+// the replay; bounds apply record by record, and the restored store holds at least what the checkpoint does.
+type RestoreOptions struct {
+	CheckpointDir string
+	// ArchiveDir is the commitlog archive of the store the checkpoint was taken of; none is replayed if empty
+	ArchiveDir string
+	// UntilSequence is the last record replayed
+	UntilSequence uint64
+	// UntilTime in milliseconds replays the records written until then, that is synced and acknowledged to the writer,
+	// as marked in the archive by commitlog.TimesFile
+	UntilTime uint64
+	// IndexSSTDir is an SST directory whose catalog and series index replace those of the checkpoint, e.g. of the
+	// store being restored, as they know tags created later; both only grow, so newer ones are safe to use
+	IndexSSTDir string
+}
+
+type RestoreReport struct {
+	// Sequence is the last record the restored store holds
+	Sequence uint64
+	Logs     int
+	Entries  int
+}
+
+// Restore fills dataDir, laid out as a checkpoint, with the checkpoint and the archived logs written after it.
+func Restore(dataDir string, opts RestoreOptions) (RestoreReport, error) {
+	if _, err := os.Stat(dataDir); err == nil {
+		return RestoreReport{}, fmt.Errorf("%s already exists", dataDir)
+	}
+	manifest, err := readManifest(opts.CheckpointDir)
+	if err != nil {
+		return RestoreReport{}, err
+	}
+	logs, err := logsToReplay(manifest, opts)
+	if err != nil {
+		return RestoreReport{}, err
+	}
+	report, err := restore(dataDir, manifest, logs, opts)
+	if err != nil {
+		os.RemoveAll(dataDir)
+	}
+	return report, err
+}
+
+// logToReplay is an archived log replayed up to the record Until.
+type logToReplay struct {
+	commitlog.ArchivedLog
+	Until uint64
+}
+
+func logsToReplay(manifest Manifest, opts RestoreOptions) ([]logToReplay, error) {
+	if opts.ArchiveDir == "" {
+		return nil, nil
+	}
+	if !manifest.CommitlogArchive {
+		return nil, fmt.Errorf("checkpoint %s was taken of a store not archiving its commitlogs", opts.CheckpointDir)
+	}
+	if (opts.UntilSequence != 0) && (opts.UntilSequence < manifest.Sequence) {
+		return nil, fmt.Errorf("checkpoint already holds records up to %d", manifest.Sequence)
+	}
+	if (opts.UntilTime != 0) && (opts.UntilTime < manifest.CreatedAt) {
+		return nil, fmt.Errorf("checkpoint was taken at %d, after %d", manifest.CreatedAt, opts.UntilTime)
+	}
+	archived, err := commitlog.ListArchive(opts.ArchiveDir)
+	if err != nil {
+		return nil, err
+	}
+	logs := make([]logToReplay, 0)
+	for _, l := range archived {
+		if l.Sequence <= manifest.CommitlogSequence {
+			continue
+		}
+		until := ^uint64(0)
+		if opts.UntilSequence != 0 {
+			until = opts.UntilSequence
+		}
+		if opts.UntilTime != 0 {
+			written, err := l.WrittenUntil(opts.UntilTime)
+			if err != nil {
+				return nil, err
+			}
+			if written < until {
+				until = written
+			}
+		}
+		//the first log holds the records of the commitlogs of the checkpoint, which are replaced by it
+		if until < manifest.Sequence {
+			until = manifest.Sequence
+		}
+		if until < l.FirstRecord {
+			break
+		}
+		if expected := manifest.CommitlogSequence + uint64(len(logs)) + 1; l.Sequence != expected {
+			return nil, fmt.Errorf("archived commitlog %d is missing", expected)
+		}
+		logs = append(logs, logToReplay{l, until})
+	}
+	return logs, nil
+}
+
+func restore(dataDir string, manifest Manifest, logs []logToReplay, opts RestoreOptions) (RestoreReport, error) {
+	report := RestoreReport{Sequence: manifest.Sequence}
+	for _, f := range manifest.Files {
+		src := opts.CheckpointDir + "/" + f.Path
+		if err := os.MkdirAll(filepath.Dir(dataDir+"/"+f.Path), os.ModePerm); err != nil {
+			return report, err
+		}
+		if err := utils.CopyFile(src, dataDir+"/"+f.Path); err != nil {
+			return report, err
+		}
+		if sum, err := sha256OfFile(dataDir + "/" + f.Path); (err != nil) || (sum != f.SHA256) {
+			return report, fmt.Errorf("%s does not match the manifest of the checkpoint", src)
+		}
+	}
+	sstDir := dataDir + "/" + CheckpointSSTDir
+	if err := replaceIndexes(sstDir, opts.IndexSSTDir); err != nil {
+		return report, err
+	}
+	if len(logs) == 0 {
+		return report, nil
+	}
+
+	//the commitlogs of the checkpoint are a prefix of the first log replayed, so left in place they would be replayed
+	//again on open, over whatever later logs wrote for the same timestamps
+	for _, name := range []string{commitlog.FileA, commitlog.FileB} {
+		if err := ioutil.WriteFile(dataDir+"/"+CheckpointCommitlogDir+"/"+name, nil, 0644); err != nil {
+			return report, err
+		}
+	}
+	sstm := sst.Manager{RootDir: sstDir}
+	sstm.InitStorage()
+	for _, l := range logs {
+		entries := make([]commitlog.Entry, 0)
+		scan, err := commitlog.ScanFile(l.Path, func(e commitlog.Entry, _ int64) {
+			entries = append(entries, e)
+		})
+		if err != nil {
+			return report, err
+		}
+		if !scan.Clean() {
+			return report, fmt.Errorf("archived commitlog %s is damaged, see lsmctl verify", l.Path)
+		}
+		if l.FirstRecord+uint64(len(entries))-1 > l.Until {
+			entries = entries[:l.Until-l.FirstRecord+1]
+		}
+		sstm.MergeWithCommitlog(entries)
+		report.Logs++
+		report.Entries += len(entries)
+		report.Sequence = l.FirstRecord + uint64(len(entries)) - 1
+	}
+	return report, commitlog.WriteSequence(dataDir+"/"+CheckpointCommitlogDir, report.Sequence)
+}
+
+func replaceIndexes(sstDir string, indexSSTDir string) error {
+	if indexSSTDir == "" {
+		return nil
+	}
+	for _, name := range []string{CatalogFileName, SeriesIndexFileName} {
+		if !utils.FileExists(indexSSTDir + "/" + name) {
+			continue
+		}
+		os.Remove(sstDir + "/" + name)
+		if err := utils.CopyFile(indexSSTDir+"/"+name, sstDir+"/"+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
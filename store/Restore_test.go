@@ -0,0 +1,171 @@
+package store
+
+import (
+	"fmt"
+	"lsmstore/commitlog"
+	"lsmstore/dto"
+	"lsmstore/utils"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestore_ReplaysArchivedCommitlogsUpToTarget(t *testing.T) {
+	//given
+	archiveDir := checkpointTestDir("archive")
+	db := Open(Options{
+		CommitlogPath:        checkpointTestDir("commitlog"),
+		EntriesPerCommitlog:  1000,
+		PeriodBetweenFlushes: time.Hour,
+		SSTPath:              checkpointTestDir("sstm"),
+		MemtMaxEntriesPerTag: 10,
+		CommitlogArchivePath: archiveDir,
+	})
+	store := func(ts uint64, value byte) {
+		assert.Nil(t, db.Writer.Store(dto.TaggedMeasurement{Tag: "a", Timestamp: ts, Value: []byte{value}}, 0))
+	}
+	store(1000, 1)
+	db.Writer.DiskWriter.Flush()
+	store(1500, 1)
+	checkpoint := checkpointTestDir("checkpoint")
+	manifest, checkpointErr := db.Checkpoint(checkpoint)
+	store(2000, 2)
+	db.Writer.DiskWriter.Flush()
+	store(1500, 9)
+	overwritten := utils.GetNowMillis()
+	time.Sleep(5 * time.Millisecond)
+	store(3000, 3)
+	db.Writer.DiskWriter.Flush()
+	store(4000, 4)
+
+	//when
+	checkpointOnly, checkpointOnlyPoints, checkpointOnlyErr := restoreAndRetrieve(RestoreOptions{CheckpointDir: checkpoint}, "a")
+	untilLog, untilLogPoints, untilLogErr := restoreAndRetrieve(RestoreOptions{CheckpointDir: checkpoint, ArchiveDir: archiveDir, UntilSequence: 3}, "a")
+	untilSequence, untilSequencePoints, untilSequenceErr := restoreAndRetrieve(RestoreOptions{CheckpointDir: checkpoint, ArchiveDir: archiveDir, UntilSequence: 4}, "a")
+	untilTime, untilTimePoints, untilTimeErr := restoreAndRetrieve(RestoreOptions{CheckpointDir: checkpoint, ArchiveDir: archiveDir, UntilTime: overwritten}, "a")
+	all, allPoints, allErr := restoreAndRetrieve(RestoreOptions{CheckpointDir: checkpoint, ArchiveDir: archiveDir}, "a")
+
+	//then
+	assert.Nil(t, checkpointErr)
+	assert.True(t, manifest.CommitlogArchive)
+	assert.Equal(t, uint64(1), manifest.CommitlogSequence)
+	assert.Equal(t, uint64(2), manifest.Sequence)
+	assert.Nil(t, checkpointOnlyErr)
+	assert.Nil(t, untilLogErr)
+	assert.Nil(t, untilSequenceErr)
+	assert.Nil(t, untilTimeErr)
+	assert.Nil(t, allErr)
+	assert.Equal(t, RestoreReport{Sequence: 2}, checkpointOnly)
+	assert.Equal(t, RestoreReport{Sequence: 3, Logs: 1, Entries: 2}, untilLog)
+	assert.Equal(t, RestoreReport{Sequence: 4, Logs: 2, Entries: 3}, untilSequence, "replay did not stop within the log")
+	assert.Equal(t, RestoreReport{Sequence: 4, Logs: 2, Entries: 3}, untilTime, "replay did not stop at the last record written in time")
+	assert.Equal(t, RestoreReport{Sequence: 5, Logs: 2, Entries: 4}, all)
+	assert.Equal(t, []dto.Measurement{{Timestamp: 1000, Value: []byte{1}}, {Timestamp: 1500, Value: []byte{1}}}, checkpointOnlyPoints)
+	assert.Equal(t, []dto.Measurement{{Timestamp: 1000, Value: []byte{1}}, {Timestamp: 1500, Value: []byte{1}}, {Timestamp: 2000, Value: []byte{2}}}, untilLogPoints)
+	overwrittenPoints := []dto.Measurement{{Timestamp: 1000, Value: []byte{1}}, {Timestamp: 1500, Value: []byte{9}}, {Timestamp: 2000, Value: []byte{2}}}
+	assert.Equal(t, overwrittenPoints, untilSequencePoints)
+	assert.Equal(t, overwrittenPoints, untilTimePoints)
+	assert.Equal(t, []dto.Measurement{{Timestamp: 1000, Value: []byte{1}}, {Timestamp: 1500, Value: []byte{9}}, {Timestamp: 2000, Value: []byte{2}}, {Timestamp: 3000, Value: []byte{3}}}, allPoints)
+}
+
+func TestRestore_ContinuesNumberingAfterTheLastRecordReplayed(t *testing.T) {
+	//given
+	archiveDir := checkpointTestDir("archive")
+	db := Open(Options{
+		CommitlogPath:        checkpointTestDir("commitlog"),
+		EntriesPerCommitlog:  1000,
+		PeriodBetweenFlushes: time.Hour,
+		SSTPath:              checkpointTestDir("sstm"),
+		MemtMaxEntriesPerTag: 10,
+		CommitlogArchivePath: archiveDir,
+	})
+	checkpoint := checkpointTestDir("checkpoint")
+	_, checkpointErr := db.Checkpoint(checkpoint)
+	for ts := uint64(1); ts <= 3; ts++ {
+		assert.Nil(t, db.Writer.Store(dto.TaggedMeasurement{Tag: "a", Timestamp: ts, Value: []byte{1}}, 0))
+	}
+	db.Writer.DiskWriter.Flush()
+	dataDir := checkpointTestDir("restored")
+
+	//when
+	report, err := Restore(dataDir, RestoreOptions{CheckpointDir: checkpoint, ArchiveDir: archiveDir, UntilSequence: 2})
+	restored := Open(Options{
+		CommitlogPath:        dataDir + "/" + CheckpointCommitlogDir,
+		EntriesPerCommitlog:  1000,
+		PeriodBetweenFlushes: time.Hour,
+		SSTPath:              dataDir + "/" + CheckpointSSTDir,
+		MemtMaxEntriesPerTag: 10,
+	})
+
+	//then
+	assert.Nil(t, checkpointErr)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), report.Sequence)
+	assert.Equal(t, uint64(2), restored.Writer.DiskWriter.ClManager.Sequence(), "restored store does not number records after the last replayed")
+	assert.Equal(t, 2, len(restored.Reader.Retrieve([]string{"a"}, 0, 10)["a"]))
+}
+
+func TestRestore_RejectsTargetsTheArchiveCannotReach(t *testing.T) {
+	//given
+	archiveDir := checkpointTestDir("archive")
+	db := Open(Options{
+		CommitlogPath:        checkpointTestDir("commitlog"),
+		EntriesPerCommitlog:  1000,
+		PeriodBetweenFlushes: time.Hour,
+		SSTPath:              checkpointTestDir("sstm"),
+		MemtMaxEntriesPerTag: 10,
+		CommitlogArchivePath: archiveDir,
+	})
+	checkpoint := checkpointTestDir("checkpoint")
+	_, checkpointErr := db.Checkpoint(checkpoint)
+	for ts := uint64(1); ts <= 2; ts++ {
+		assert.Nil(t, db.Writer.Store(dto.TaggedMeasurement{Tag: "a", Timestamp: ts, Value: []byte{1}}, 0))
+		db.Writer.DiskWriter.Flush()
+	}
+	logs, _ := commitlog.ListArchive(archiveDir)
+	assert.Nil(t, os.Remove(logs[0].Path))
+	withoutArchive := Open(Options{
+		CommitlogPath:        checkpointTestDir("commitlog"),
+		EntriesPerCommitlog:  1000,
+		PeriodBetweenFlushes: time.Hour,
+		SSTPath:              checkpointTestDir("sstm"),
+		MemtMaxEntriesPerTag: 10,
+	})
+	checkpointWithoutArchive := checkpointTestDir("checkpoint")
+	_, checkpointWithoutArchiveErr := withoutArchive.Checkpoint(checkpointWithoutArchive)
+	dataDir := checkpointTestDir("restored")
+
+	//when
+	_, gapErr := Restore(dataDir, RestoreOptions{CheckpointDir: checkpoint, ArchiveDir: archiveDir})
+	_, tooEarlyErr := Restore(dataDir, RestoreOptions{CheckpointDir: checkpoint, ArchiveDir: archiveDir, UntilTime: 1})
+	_, noArchiveErr := Restore(dataDir, RestoreOptions{CheckpointDir: checkpointWithoutArchive, ArchiveDir: archiveDir})
+	_, existingErr := Restore(checkpoint, RestoreOptions{CheckpointDir: checkpoint})
+
+	//then
+	assert.Nil(t, checkpointErr)
+	assert.Nil(t, checkpointWithoutArchiveErr)
+	assert.Equal(t, "archived commitlog 1 is missing", fmt.Sprint(gapErr))
+	assert.NotNil(t, tooEarlyErr)
+	assert.NotNil(t, noArchiveErr)
+	assert.NotNil(t, existingErr)
+	assert.False(t, utils.FileExists(dataDir), "failed restore left a directory behind")
+}
+
+// restoreAndRetrieve restores into a new directory and opens it as a store.
+func restoreAndRetrieve(opts RestoreOptions, tag string) (RestoreReport, []dto.Measurement, error) {
+	dataDir := checkpointTestDir("restored")
+	report, err := Restore(dataDir, opts)
+	if err != nil {
+		return report, nil, err
+	}
+	restored := Open(Options{
+		CommitlogPath:        dataDir + "/" + CheckpointCommitlogDir,
+		EntriesPerCommitlog:  1000,
+		PeriodBetweenFlushes: time.Hour,
+		SSTPath:              dataDir + "/" + CheckpointSSTDir,
+		MemtMaxEntriesPerTag: 10,
+	})
+	return report, restored.Reader.Retrieve([]string{tag}, 0, 5000)[tag], nil
+}
@@ -0,0 +1,56 @@
+package store
+
+import (
+	"errors"
+	"lsmstore/dto"
+	"lsmstore/series"
+)
+
+// StoreSeries stores measurements of series, creating the series it does not know yet.
+func (sw *StorageWriter) StoreSeries(data []dto.SeriesMeasurement, expiresAt uint64) error {
+	if sw.Series == nil {
+		return errors.New("series index is not configured")
+	}
+	//validated as a whole first, so that a rejected batch leaves no series behind
+	batch := make([]dto.TaggedMeasurement, len(data))
+	for i, m := range data {
+		if err := series.Validate(m.Metric, m.Labels); err != nil {
+			return invalid(err)
+		}
+		batch[i] = dto.TaggedMeasurement{Tag: series.BuildTag(m.Metric, m.Labels), Timestamp: m.Timestamp, Value: m.Value}
+		if err := sw.validate(batch[i].Tag, m.Value); err != nil {
+			return err
+		}
+	}
+	for _, m := range data {
+		if _, err := sw.Series.GetOrCreate(m.Metric, m.Labels); err != nil {
+			return err
+		}
+	}
+	return sw.StoreBatch(batch, expiresAt)
+}
+
+func (sr *StorageReader) SelectSeries(selector string) ([]*series.Series, error) {
+	if sr.Series == nil {
+		return nil, errors.New("series index is not configured")
+	}
+	matchers, err := series.ParseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	return sr.Series.Select(matchers), nil
+}
+
+// RetrieveMatching works like Retrieve for every series matched by a selector such as `metric="cpu", host=~"web-.*"`.
+// Results are keyed by series tag.
+func (sr *StorageReader) RetrieveMatching(selector string, from uint64, to uint64) (map[string][]dto.Measurement, error) {
+	matched, err := sr.SelectSeries(selector)
+	if err != nil {
+		return nil, err
+	}
+	tags := make([]string, len(matched))
+	for i, s := range matched {
+		tags[i] = s.Tag
+	}
+	return sr.Retrieve(tags, from, to), nil
+}
@@ -0,0 +1,69 @@
+package store
+
+import (
+	"fmt"
+	"lsmstore/dto"
+	"lsmstore/schema"
+	"lsmstore/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLSM_SeriesWithLabelsWork(t *testing.T) {
+	//given
+	storageReader, storageWriter := InitStorage(
+		fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		10,
+		5*time.Second,
+		10*time.Second,
+		10*time.Second,
+		fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		9999)
+	data := []dto.SeriesMeasurement{
+		{Metric: "cpu", Labels: []dto.Label{{Name: "host", Value: "web-1"}}, Timestamp: 1337, Value: []byte{1}},
+		{Metric: "cpu", Labels: []dto.Label{{Name: "host", Value: "web-2"}}, Timestamp: 1338, Value: []byte{2}},
+		{Metric: "cpu", Labels: []dto.Label{{Name: "host", Value: "db-1"}}, Timestamp: 1339, Value: []byte{3}},
+		{Metric: "cpu", Labels: []dto.Label{{Name: "host", Value: "web-1"}}, Timestamp: 1340, Value: []byte{4}},
+	}
+
+	//when
+	err := storageWriter.StoreSeries(data, 0)
+	retrieved, errRetrieve := storageReader.RetrieveMatching(`metric="cpu", host=~"web-.*"`, 0, 2000)
+	_, errBadSelector := storageReader.RetrieveMatching(`host=`, 0, 2000)
+
+	//then
+	assert.Nil(t, err)
+	assert.Nil(t, errRetrieve)
+	assert.NotNil(t, errBadSelector)
+	assert.Equal(t, 2, len(retrieved), "wrong series matched")
+	assert.Equal(t, []dto.Measurement{{Timestamp: 1337, Value: []byte{1}}, {Timestamp: 1340, Value: []byte{4}}}, retrieved[`cpu{host="web-1"}`])
+	assert.Equal(t, []dto.Measurement{{Timestamp: 1338, Value: []byte{2}}}, retrieved[`cpu{host="web-2"}`])
+}
+
+func TestLSM_RejectedSeriesBatchCreatesNoSeries(t *testing.T) {
+	//given
+	storageReader, storageWriter := InitStorage(
+		fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		10,
+		5*time.Second,
+		10*time.Second,
+		10*time.Second,
+		fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		9999)
+	assert.Nil(t, storageWriter.Catalog.Register(`temp{host="db-1"}`, schema.Float64))
+	data := []dto.SeriesMeasurement{
+		{Metric: "temp", Labels: []dto.Label{{Name: "host", Value: "web-1"}}, Timestamp: 1337, Value: schema.EncodeFloat64(1)},
+		{Metric: "temp", Labels: []dto.Label{{Name: "host", Value: "db-1"}}, Timestamp: 1337, Value: []byte{1}},
+	}
+
+	//when
+	err := storageWriter.StoreSeries(data, 0)
+	selected, errSelect := storageReader.SelectSeries(`temp{}`)
+
+	//then
+	assert.True(t, IsValidationError(err))
+	assert.Nil(t, errSelect)
+	assert.Equal(t, 0, len(selected), "series of a rejected batch were created")
+}
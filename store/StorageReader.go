@@ -1,75 +1,212 @@
 package store
 
 import (
+	"lsmstore/commitlog"
 	"lsmstore/dto"
 	"lsmstore/memt"
+	"lsmstore/schema"
+	"lsmstore/series"
 	"lsmstore/sst"
 	"lsmstore/utils"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const DefaultReadParallelism = 8
+
 type StorageReader struct {
-	SSTManager   *sst.Manager
-	MemTable     *memt.Manager
-	MemtPrefetch time.Duration
-	mutex        *sync.Mutex
+	SSTManager      *sst.Manager
+	MemTable        *memt.Manager
+	WriteBuffer     *memt.WriteBuffer
+	MemtPrefetch    time.Duration
+	Catalog         *schema.Catalog
+	Series          *series.Index
+	Tags            *TagIndex
+	ReadParallelism int
+	mutex           *sync.Mutex
 }
 
 func (sr *StorageReader) Init() {
 	sr.mutex = &sync.Mutex{}
+	if sr.ReadParallelism == 0 {
+		sr.ReadParallelism = DefaultReadParallelism
+	}
+	if sr.Tags != nil {
+		for _, tag := range sr.GetTags() {
+			sr.Tags.Add(tag)
+		}
+	}
 	if (len(sr.SSTManager.GetTags()) > 0) && (sr.MemtPrefetch.Milliseconds() > 0) {
 		//i was initialized over existing storage; should prefetch some data to memt
 		sr.prefetch()
 	}
 }
 
+// prefetch fills the cache with the newest MemtPrefetch of every tag, relative to the tag's own newest point;
+// entries keep their expiration and the cache policy decides what stays.
 func (sr *StorageReader) prefetch() {
-	availFrom, availTo := sr.SSTManager.Availability()
-	if (availTo == 0) || (availFrom == 0) {
-		return
-	}
-
-	from := maxNotZero(availFrom, uint64(int64(availTo)-sr.MemtPrefetch.Milliseconds()))
-	to := availTo
 	tags := sr.SSTManager.GetTags()
-	data := sr.retrieveFromSSTOnly(tags, from, to)
-
-	sr.MemTable.MergeWithPrefetched(data)
+	entriesPerTag := make([][]commitlog.Entry, len(tags))
+	loadedFrom := make([]uint64, len(tags))
+	sr.forEachTagInParallel(tags, func(i int, tag string) {
+		sstForTag, exists := sr.SSTManager.ExistingSstForTag(tag)
+		if !exists {
+			return
+		}
+		_, to := sstForTag.Availability()
+		if to == 0 {
+			return
+		}
+		from := maxNotZero(1, uint64(int64(to)-sr.MemtPrefetch.Milliseconds()))
+		loadedFrom[i] = from
+		sstForTag.IterateEntriesWithIndex(from, to, func(e sst.Entry) bool {
+			entriesPerTag[i] = append(entriesPerTag[i], commitlog.Entry{Key: []byte(tag), Timestamp: e.Timestamp, ExpiresAt: e.ExpiresAt, Value: e.Value})
+			return true
+		})
+	})
+	for i, entries := range entriesPerTag {
+		if loadedFrom[i] != 0 {
+			sr.MemTable.MergeWithPrefetched(tags[i], entries, loadedFrom[i])
+		}
+	}
 }
 
 func (sr *StorageReader) Retrieve(tags []string, from uint64, to uint64) map[string][]dto.Measurement {
 	ans := make(map[string][]dto.Measurement)
+	dataPerTag := make([][]dto.Measurement, len(tags))
 
-	for _, tag := range tags {
-		ans[tag] = sr.retrieveDataForTag(tag, from, to)
+	sr.forEachTagInParallel(tags, func(i int, tag string) {
+		dataPerTag[i] = sr.retrieveDataForTag(tag, from, to)
+	})
+
+	for i, tag := range tags {
+		ans[tag] = dataPerTag[i]
 	}
 
 	return ans
 }
 
-func (sr *StorageReader) retrieveFromSSTOnly(tags []string, from uint64, to uint64) map[string][]dto.Measurement {
-	ans := make(map[string][]dto.Measurement)
-
-	for _, tag := range tags {
-		ans[tag] = sr.retrieveDataForTagFromSSTableOnly(tag, from, to)
+// forEachTagInParallel calls f for every tag using at most ReadParallelism goroutines.
+func (sr *StorageReader) forEachTagInParallel(tags []string, f func(int, string)) {
+	workers := sr.ReadParallelism
+	if workers > len(tags) {
+		workers = len(tags)
+	}
+	if workers <= 1 {
+		for i, tag := range tags {
+			f(i, tag)
+		}
+		return
 	}
 
-	return ans
+	next := int64(-1)
+	wg := &sync.WaitGroup{}
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= len(tags) {
+					return
+				}
+				f(i, tags[i])
+			}
+		}()
+	}
+	wg.Wait()
 }
 
 func (sr *StorageReader) Availability() (uint64, uint64) {
 	fromForMem, toForMem := sr.MemTable.Availability()
 	fromForSst, toForSst := sr.SSTManager.Availability()
-
-	return minNotZero(fromForMem, fromForSst), maxNotZero(toForMem, toForSst)
+	from, to := minNotZero(fromForMem, fromForSst), maxNotZero(toForMem, toForSst)
+	if sr.WriteBuffer != nil {
+		for _, tag := range sr.WriteBuffer.GetTags() {
+			if buffer, exists := sr.WriteBuffer.ExistingBufferForTag(tag); exists {
+				fromForBuffer, toForBuffer := buffer.Availability()
+				from, to = minNotZero(from, fromForBuffer), maxNotZero(to, toForBuffer)
+			}
+		}
+	}
+	return from, to
 }
 
 func (sr *StorageReader) GetTags() []string {
 	fromSst := sr.SSTManager.GetTags()
 	fromMemt := sr.MemTable.GetTags()
-	return utils.MergeWithoutDuplicates(fromSst, fromMemt)
+	tags := utils.MergeWithoutDuplicates(fromSst, fromMemt)
+	if sr.WriteBuffer != nil {
+		tags = utils.MergeWithoutDuplicates(tags, sr.WriteBuffer.GetTags())
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// withUnflushed merges entries of the write buffer into those read from the cache; being newer, they win on equal timestamps.
+func (sr *StorageReader) withUnflushed(tag string, fromCache []memt.Entry, from uint64, to uint64, descending bool) []memt.Entry {
+	if sr.WriteBuffer == nil {
+		return fromCache
+	}
+	buffer, exists := sr.WriteBuffer.ExistingBufferForTag(tag)
+	if !exists {
+		return fromCache
+	}
+	var fromBuffer []memt.Entry
+	if descending {
+		fromBuffer = buffer.RetrieveDescending(from, to)
+	} else {
+		fromBuffer = buffer.Retrieve(from, to)
+	}
+	return mergeEntries(fromBuffer, fromCache, descending)
+}
+
+// mergeEntries merges two sorted slices, preferring preferred on equal timestamps.
+func mergeEntries(preferred []memt.Entry, other []memt.Entry, descending bool) []memt.Entry {
+	if len(preferred) == 0 {
+		return other
+	}
+	if len(other) == 0 {
+		return preferred
+	}
+	before := func(a uint64, b uint64) bool {
+		if descending {
+			return a > b
+		}
+		return a < b
+	}
+	ans := make([]memt.Entry, 0, len(preferred)+len(other))
+	i, j := 0, 0
+	for (i < len(preferred)) || (j < len(other)) {
+		switch {
+		case j >= len(other):
+			ans = append(ans, preferred[i])
+			i++
+		case i >= len(preferred):
+			ans = append(ans, other[j])
+			j++
+		case preferred[i].Timestamp == other[j].Timestamp:
+			ans = append(ans, preferred[i])
+			i++
+			j++
+		case before(preferred[i].Timestamp, other[j].Timestamp):
+			ans = append(ans, preferred[i])
+			i++
+		default:
+			ans = append(ans, other[j])
+			j++
+		}
+	}
+	return ans
+}
+
+func (sr *StorageReader) valueTypeOf(tag string) schema.ValueType {
+	if sr.Catalog == nil {
+		return schema.Untyped
+	}
+	return sr.Catalog.TypeOf(tag)
 }
 
 func minNotZero(a uint64, b uint64) uint64 {
@@ -92,73 +229,148 @@ func maxNotZero(a uint64, b uint64) uint64 {
 	return b
 }
 
-func (sr *StorageReader) retrieveDataForTagFromSSTableOnly(tag string, from uint64, to uint64) []dto.Measurement {
-	sstForTag := sr.SSTManager.SstForTag(tag)
-	timestampToValue := make(map[uint64][]byte)
-
-	dataFromSst := sstForTag.GetEntriesWithIndex(from, to)
-
-	for _, dfs := range dataFromSst {
-		timestampToValue[dfs.Timestamp] = dfs.Value
-	}
+func (sr *StorageReader) retrieveDataForTag(tag string, from uint64, to uint64) []dto.Measurement {
+	ans := make([]dto.Measurement, 0, memt.DefaultSlicePreassignedMem)
+	sr.iterateOverDataForTag(tag, from, to, func(m dto.Measurement) bool {
+		ans = append(ans, m)
+		return true
+	})
+	return ans
+}
 
-	ans := make([]dto.Measurement, len(timestampToValue))
-	i := 0
-	for k, v := range timestampToValue {
-		ans[i] = dto.Measurement{Timestamp: k, Value: v}
-		i++
-	}
+// Iterate streams measurements of a tag in [from, to] in ascending order without collecting them; receiver returns false to stop.
+// No file lock is held while receiver runs: the SST is read from a snapshot, so receiver may block.
+func (sr *StorageReader) Iterate(tag string, from uint64, to uint64, receiver func(dto.Measurement) bool) {
+	sr.iterateOverDataForTag(tag, from, to, receiver)
+}
 
-	sort.Slice(ans, func(i, j int) bool {
-		return ans[i].Timestamp < ans[j].Timestamp
+// iterateOverDataForTag streams measurements of a tag in ascending timestamp order, merging memtable
+// and SST on the fly; memtable wins on equal timestamps, as does the latest duplicate within the SST.
+// Receiver returns false to stop.
+func (sr *StorageReader) iterateOverDataForTag(tag string, from uint64, to uint64, receiver func(dto.Measurement) bool) {
+	now := utils.GetNowMillis()
+	sr.iterateOverEntriesForTag(tag, from, to, func(e memt.Entry) bool {
+		//the cache only drops expired entries periodically
+		if (e.ExpiresAt != 0) && (e.ExpiresAt < now) {
+			return true
+		}
+		return receiver(dto.Measurement{Timestamp: e.Timestamp, Value: e.Value})
 	})
-
-	return ans
 }
 
-func (sr *StorageReader) retrieveDataForTag(tag string, from uint64, to uint64) []dto.Measurement {
-	memtForTag := sr.MemTable.MemTableForTag(tag)
-	// fmt.Println("tag: ", tag)
-	sstForTag := sr.SSTManager.SstForTag(tag)
+// iterateOverEntriesForTag is iterateOverDataForTag keeping the expiration of entries.
+func (sr *StorageReader) iterateOverEntriesForTag(tag string, from uint64, to uint64, receiver func(memt.Entry) bool) {
+	sstForTag, _ := sr.SSTManager.ExistingSstForTag(tag)
 
-	timestampToValue := make(map[uint64][]byte)
 	var dataFromMemt []memt.Entry
+	readSst := true
+	if memtForTag, exists := sr.MemTable.ExistingMemTableForTag(tag); exists {
+		dataFromMemt = memtForTag.Retrieve(from, to)
+		//checked after reading, as evictions raise coverage before dropping entries
+		readSst = from < memtForTag.CoveredFrom()
+	}
+	dataFromMemt = sr.withUnflushed(tag, dataFromMemt, from, to, false)
+
+	var pending memt.Entry
+	hasPending := false
+	stopped := false
+	emit := func(e memt.Entry) bool {
+		if hasPending && (pending.Timestamp != e.Timestamp) && !receiver(pending) {
+			stopped = true
+			return false
+		}
+		pending = e
+		hasPending = true
+		return true
+	}
 
-	if memtForTag == nil {
-		return nil
+	memtIdx := 0
+	if readSst {
+		if sstForTag != nil {
+			sstForTag.IterateEntriesWithIndex(from, to, func(e sst.Entry) bool {
+				for (memtIdx < len(dataFromMemt)) && (dataFromMemt[memtIdx].Timestamp < e.Timestamp) {
+					if !emit(dataFromMemt[memtIdx]) {
+						return false
+					}
+					memtIdx++
+				}
+				if (memtIdx < len(dataFromMemt)) && (dataFromMemt[memtIdx].Timestamp == e.Timestamp) {
+					return true
+				}
+				return emit(memt.Entry{Timestamp: e.Timestamp, ExpiresAt: e.ExpiresAt, Value: e.Value})
+			})
+		}
 	}
 
-	availMemtFrom, availMemtTo := memtForTag.Availability()
+	for ; !stopped && (memtIdx < len(dataFromMemt)); memtIdx++ {
+		emit(dataFromMemt[memtIdx])
+	}
+	if !stopped && hasPending {
+		receiver(pending)
+	}
+}
 
-	if (availMemtFrom != 0) && (availMemtTo != 0) {
-		dataFromMemt = memtForTag.Retrieve(from, to)
+// RetrieveDescending returns up to limit measurements of a tag in [from, to], newest first.
+// To fetch the next page, repeat the call with to set just below the oldest returned timestamp.
+func (sr *StorageReader) RetrieveDescending(tag string, from uint64, to uint64, limit int) []dto.Measurement {
+	ans := make([]dto.Measurement, 0, memt.DefaultSlicePreassignedMem)
+	if limit <= 0 {
+		return ans
 	}
+	sr.iterateOverDataForTagDescending(tag, from, to, func(m dto.Measurement) bool {
+		ans = append(ans, m)
+		return len(ans) < limit
+	})
+	return ans
+}
 
-	if (availMemtFrom > from) || (availMemtTo < to) || (availMemtFrom == 0) || (availMemtTo == 0) {
-		if sstForTag != nil {
-			dataFromSst := sstForTag.GetEntriesWithIndex(from, to)
+// iterateOverDataForTagDescending is the newest-first counterpart of iterateOverDataForTag; receiver returns false to stop.
+func (sr *StorageReader) iterateOverDataForTagDescending(tag string, from uint64, to uint64, receiver func(dto.Measurement) bool) {
+	sstForTag, _ := sr.SSTManager.ExistingSstForTag(tag)
 
-			// fmt.Println(sstForTag.FileName)
-			for _, dfs := range dataFromSst {
-				timestampToValue[dfs.Timestamp] = dfs.Value
-			}
+	var dataFromMemt []memt.Entry
+	readSst := true
+	if memtForTag, exists := sr.MemTable.ExistingMemTableForTag(tag); exists {
+		dataFromMemt = memtForTag.RetrieveDescending(from, to)
+		readSst = from < memtForTag.CoveredFrom()
+	}
+	dataFromMemt = sr.withUnflushed(tag, dataFromMemt, from, to, true)
+	//the cache only drops expired entries periodically; they still hide older versions on disk
+	now := utils.GetNowMillis()
+	fromMemt := func(e memt.Entry) bool {
+		if (e.ExpiresAt != 0) && (e.ExpiresAt < now) {
+			return true
 		}
+		return receiver(dto.Measurement{Timestamp: e.Timestamp, Value: e.Value})
 	}
 
-	for _, dfm := range dataFromMemt {
-		timestampToValue[dfm.Timestamp] = dfm.Value
+	memtIdx := 0
+	stopped := false
+	if readSst {
+		if sstForTag != nil {
+			sstForTag.IterateEntriesDescending(from, to, func(e sst.Entry) bool {
+				for (memtIdx < len(dataFromMemt)) && (dataFromMemt[memtIdx].Timestamp > e.Timestamp) {
+					if !fromMemt(dataFromMemt[memtIdx]) {
+						stopped = true
+						return false
+					}
+					memtIdx++
+				}
+				if (memtIdx < len(dataFromMemt)) && (dataFromMemt[memtIdx].Timestamp == e.Timestamp) {
+					return true
+				}
+				if !receiver(dto.Measurement{Timestamp: e.Timestamp, Value: e.Value}) {
+					stopped = true
+					return false
+				}
+				return true
+			})
+		}
 	}
 
-	ans := make([]dto.Measurement, len(timestampToValue))
-	i := 0
-	for k, v := range timestampToValue {
-		ans[i] = dto.Measurement{Timestamp: k, Value: v}
-		i++
+	for ; !stopped && (memtIdx < len(dataFromMemt)); memtIdx++ {
+		if !fromMemt(dataFromMemt[memtIdx]) {
+			return
+		}
 	}
-
-	sort.Slice(ans, func(i, j int) bool {
-		return ans[i].Timestamp < ans[j].Timestamp
-	})
-
-	return ans
 }
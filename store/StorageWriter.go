@@ -1,55 +1,160 @@
 package store
 
 import (
+	"errors"
+	"fmt"
 	"lsmstore/commitlog"
 	"lsmstore/dto"
 	"lsmstore/memt"
+	"lsmstore/schema"
+	"lsmstore/series"
+	"lsmstore/utils"
 	"lsmstore/writer"
 	"sync"
 )
 
+// MaxMeasurementBytes bounds tag and value together, as a commitlog record carries a 16-bit length
+// covering key length, timestamps and checksum as well.
+const MaxMeasurementBytes = 1<<16 - 1 - 18 - utils.ChecksumSize
+
 type StorageWriter struct {
 	DiskWriter *writer.DiskWriter
 	MemTable   *memt.Manager
-	mutex      *sync.Mutex
+	// WriteBuffer, if set, keeps written entries readable until the DiskWriter has flushed them to SST
+	WriteBuffer *memt.WriteBuffer
+	Catalog     *schema.Catalog
+	Series      *series.Index
+	Tags        *TagIndex
+	// Tail, if set, keeps the newest records synced to the commitlog for DB.Follow
+	Tail  *commitlog.Tail
+	mutex *sync.Mutex
 }
 
+// Init makes the entries the DiskWriter syncs readable; nothing is readable before it is on disk.
 func (sw *StorageWriter) Init() {
 	sw.mutex = &sync.Mutex{}
+	sw.DiskWriter.Paused(func() {
+		afterStore := sw.DiskWriter.AfterStore
+		sw.DiskWriter.AfterStore = func(first uint64, entries []commitlog.Entry) {
+			sw.publish(entries)
+			if afterStore != nil {
+				afterStore(first, entries)
+			}
+		}
+	})
 }
 
-func (sw *StorageWriter) Store(data dto.TaggedMeasurement, expiresAt uint64) {
-	entry := commitlog.Entry{Key: []byte(data.Tag), Timestamp: data.Timestamp, ExpiresAt: expiresAt, Value: data.Value}
-	sw.DiskWriter.Store(entry)
-	// sw.MemTable.StoreCommitlogEntry(data.Tag, entry)
+func (sw *StorageWriter) Store(data dto.TaggedMeasurement, expiresAt uint64) error {
+	if err := sw.validate(data.Tag, data.Value); err != nil {
+		return err
+	}
+	return sw.DiskWriter.Store(commitlog.Entry{Key: []byte(data.Tag), Timestamp: data.Timestamp, ExpiresAt: expiresAt, Value: data.Value})
 }
 
-func (sw *StorageWriter) StoreMultiple(data map[string][]dto.Measurement, expiresAt uint64) {
+func (sw *StorageWriter) StoreMultiple(data map[string][]dto.Measurement, expiresAt uint64) error {
+	entries := make([]commitlog.Entry, 0)
 	for tag, values := range data {
-		entries := make([]commitlog.Entry, len(values))
-		for i, value := range values {
-			e := commitlog.Entry{Key: []byte(tag), Timestamp: value.Timestamp, ExpiresAt: expiresAt, Value: value.Value}
-			entries[i] = e
+		for _, value := range values {
+			if err := sw.validate(tag, value.Value); err != nil {
+				return err
+			}
+			entries = append(entries, commitlog.Entry{Key: []byte(tag), Timestamp: value.Timestamp, ExpiresAt: expiresAt, Value: value.Value})
+		}
+	}
+	return sw.DiskWriter.StoreMultiple(entries)
+}
+
+func (sw *StorageWriter) StoreBatch(data []dto.TaggedMeasurement, expiresAt uint64) error {
+	entries := make([]commitlog.Entry, len(data))
+	for i, m := range data {
+		if err := sw.validate(m.Tag, m.Value); err != nil {
+			return err
+		}
+		entries[i] = commitlog.Entry{Key: []byte(m.Tag), Timestamp: m.Timestamp, ExpiresAt: expiresAt, Value: m.Value}
+	}
+	return sw.DiskWriter.StoreMultiple(entries)
+}
+
+// Apply stores entries as another store wrote them to its commitlog, without validating them again.
+func (sw *StorageWriter) Apply(entries []commitlog.Entry) error {
+	return sw.DiskWriter.StoreMultiple(entries)
+}
+
+// publish is called by the DiskWriter with its mutex held, once entries are synced and before they can be flushed,
+// so a flush never removes entries from the buffer before they are added. The cache is written before the flush
+// too, as a cache created after a flush only covers points above the SST.
+func (sw *StorageWriter) publish(entries []commitlog.Entry) {
+	previousTag := ""
+	for _, e := range entries {
+		if tag := string(e.Key); tag != previousTag {
+			sw.addTag(tag)
+			previousTag = tag
 		}
-		sw.DiskWriter.StoreMultiple(entries)
-		sw.MemTable.MergeWithCommitlogForTag(tag, entries)
 	}
+	if sw.WriteBuffer != nil {
+		sw.WriteBuffer.Add(entries)
+	}
+	sw.MemTable.MergeWithCommitlog(entries)
+}
+
+// ValidationError rejects a write for what it holds, so sending it again unchanged fails again; writes failing
+// with any other error failed on the disk and are worth retrying.
+type ValidationError struct {
+	Err error
 }
 
-func (sw *StorageWriter) StoreBatch(data []dto.TaggedMeasurement, expiresAt uint64) {
-	entriesPerTag := make(map[string][]commitlog.Entry)
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
+}
+
+func IsValidationError(err error) bool {
+	var validationErr *ValidationError
+	return errors.As(err, &validationErr)
+}
+
+func invalid(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ValidationError{Err: err}
+}
 
-	for _, entry := range data {
-		entries, exists := entriesPerTag[entry.Tag]
-		if !exists {
-			entriesPerTag[entry.Tag] = make([]commitlog.Entry, 0, len(data))
-			entries = entriesPerTag[entry.Tag]
+// ValidateBatch checks measurements received from outside for what the storage can't represent:
+// an empty tag, timestamp 0, which marks empty SST slots, or a record too long for the commitlog.
+func ValidateBatch(data []dto.TaggedMeasurement) error {
+	if len(data) == 0 {
+		return invalid(errors.New("no measurements"))
+	}
+	for i, m := range data {
+		if err := validateMeasurement(m); err != nil {
+			return invalid(fmt.Errorf("measurement %d %v", i, err))
 		}
-		entriesPerTag[entry.Tag] = append(entries, commitlog.Entry{Key: []byte(entry.Tag), Timestamp: entry.Timestamp, ExpiresAt: expiresAt, Value: entry.Value})
 	}
+	return nil
+}
+
+func validateMeasurement(m dto.TaggedMeasurement) error {
+	if m.Tag == "" {
+		return errors.New("has no tag")
+	}
+	if m.Timestamp == 0 {
+		return errors.New("has no timestamp")
+	}
+	if len(m.Tag)+len(m.Value) > MaxMeasurementBytes {
+		return fmt.Errorf("exceeds %d bytes of tag and value", MaxMeasurementBytes)
+	}
+	return nil
+}
+
+func (sw *StorageWriter) addTag(tag string) {
+	if sw.Tags != nil {
+		sw.Tags.Add(tag)
+	}
+}
 
-	for tag, entries := range entriesPerTag {
-		sw.DiskWriter.StoreMultiple(entries)
-		sw.MemTable.MergeWithCommitlogForTag(tag, entries)
+func (sw *StorageWriter) validate(tag string, value []byte) error {
+	if sw.Catalog == nil {
+		return nil
 	}
+	return invalid(sw.Catalog.Validate(tag, value))
 }
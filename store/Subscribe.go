@@ -0,0 +1,92 @@
+package store
+
+import (
+	"errors"
+	"lsmstore/commitlog"
+	"strings"
+)
+
+type SlowConsumerPolicy int
+
+const (
+	// BlockSlowConsumer makes events wait for room in the buffer. Writes are never held up: a subscriber falling
+	// behind the records kept in memory is served from the commitlogs, until they no longer have its records either.
+	BlockSlowConsumer SlowConsumerPolicy = iota
+	// DropSlowConsumer ends the subscription with ErrSlowConsumer once its buffer is full.
+	DropSlowConsumer
+)
+
+const DefaultSubscriptionBuffer = 1000
+
+var ErrSlowConsumer = errors.New("subscriber did not keep up with its buffer")
+
+var errSubscriptionEnded = errors.New("subscription ended")
+
+// Filter selects the writes a subscription delivers. FromSequence resumes after an earlier subscription, with the
+// sequence following the last event handled; 0 delivers only writes made from now on. Closing Done ends the
+// subscription.
+type Filter struct {
+	TagPrefix    string
+	FromSequence uint64
+	// BufferSize bounds events delivered but not received yet; 0 means DefaultSubscriptionBuffer
+	BufferSize   int
+	SlowConsumer SlowConsumerPolicy
+	Done         <-chan struct{}
+}
+
+// Event is a measurement once synced to the commitlog on disk. The last event before the channel is closed carries
+// the error ending the subscription, if any, and the sequence to resume from.
+type Event struct {
+	Sequence  uint64
+	Tag       string
+	Timestamp uint64
+	ExpiresAt uint64
+	Value     []byte
+	Err       error
+}
+
+// Subscribe delivers every write of a tag matching the filter, in the order of the commitlog.
+func (db *DB) Subscribe(filter Filter) <-chan Event {
+	size := filter.BufferSize
+	if size <= 0 {
+		size = DefaultSubscriptionBuffer
+	}
+	//one more for the event ending the subscription, which never has to wait then
+	events := make(chan Event, size+1)
+	next := filter.FromSequence
+	if next == 0 {
+		next = db.Writer.DiskWriter.ClManager.Sequence() + 1
+	}
+
+	go func() {
+		defer close(events)
+		err := db.Follow(next, filter.Done, func(records []commitlog.Record) error {
+			for _, r := range records {
+				tag := string(r.Entry.Key)
+				if !strings.HasPrefix(tag, filter.TagPrefix) {
+					next = r.Sequence + 1
+					continue
+				}
+				if (filter.SlowConsumer == DropSlowConsumer) && (len(events) >= size) {
+					events <- Event{Sequence: r.Sequence, Err: ErrSlowConsumer}
+					return errSubscriptionEnded
+				}
+				select {
+				case events <- Event{Sequence: r.Sequence, Tag: tag, Timestamp: r.Entry.Timestamp, ExpiresAt: r.Entry.ExpiresAt, Value: r.Entry.Value}:
+					next = r.Sequence + 1
+				case <-filter.Done:
+					return errSubscriptionEnded
+				}
+			}
+			return nil
+		})
+		if (err == nil) || (err == errSubscriptionEnded) {
+			return
+		}
+		select {
+		case events <- Event{Sequence: next, Err: err}:
+		case <-filter.Done:
+		}
+	}()
+	return events
+}
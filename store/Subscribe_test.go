@@ -0,0 +1,128 @@
+package store
+
+import (
+	"lsmstore/dto"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_SubscribeDeliversWritesOfTagPrefixInOrder(t *testing.T) {
+	//given
+	db := openSubscribeTestDB(0)
+	assert.Nil(t, db.Writer.Store(dto.TaggedMeasurement{Tag: "cpu.before", Timestamp: 1, Value: []byte{0}}, 0))
+	done := make(chan struct{})
+	events := db.Subscribe(Filter{TagPrefix: "cpu.", Done: done})
+
+	//when
+	assert.Nil(t, db.Writer.Store(dto.TaggedMeasurement{Tag: "cpu.a", Timestamp: 1000, Value: []byte{1}}, 0))
+	assert.Nil(t, db.Writer.Store(dto.TaggedMeasurement{Tag: "mem.a", Timestamp: 1000, Value: []byte{2}}, 0))
+	db.Writer.DiskWriter.Flush()
+	assert.Nil(t, db.Writer.Store(dto.TaggedMeasurement{Tag: "cpu.b", Timestamp: 2000, Value: []byte{3}}, 5000))
+	first := nextEvent(t, events)
+	second := nextEvent(t, events)
+	close(done)
+
+	//then
+	assert.Equal(t, Event{Sequence: 2, Tag: "cpu.a", Timestamp: 1000, Value: []byte{1}}, first)
+	assert.Equal(t, Event{Sequence: 4, Tag: "cpu.b", Timestamp: 2000, ExpiresAt: 5000, Value: []byte{3}}, second)
+	assertClosed(t, events)
+}
+
+func TestDB_SlowSubscriberIsDroppedAndResumesFromSequence(t *testing.T) {
+	//given
+	db := openSubscribeTestDB(0)
+	done := make(chan struct{})
+	defer close(done)
+	events := db.Subscribe(Filter{BufferSize: 2, SlowConsumer: DropSlowConsumer, Done: done})
+
+	//when
+	storeCounterPoints(t, db, 1, 5)
+	//not received meanwhile, the buffer fills up with two events and the one ending the subscription
+	for deadline := time.Now().Add(5 * time.Second); (len(events) < 3) && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	delivered := []Event{nextEvent(t, events), nextEvent(t, events), nextEvent(t, events)}
+	assertClosed(t, events)
+	resumed := db.Subscribe(Filter{FromSequence: delivered[2].Sequence, Done: done})
+
+	//then
+	assert.Equal(t, uint64(1), delivered[0].Timestamp)
+	assert.Equal(t, uint64(2), delivered[1].Timestamp)
+	assert.Equal(t, ErrSlowConsumer, delivered[2].Err)
+	assert.Equal(t, uint64(3), delivered[2].Sequence)
+	for ts := uint64(3); ts <= 5; ts++ {
+		assert.Equal(t, ts, nextEvent(t, resumed).Timestamp)
+	}
+}
+
+func TestDB_BlockedSubscriberCatchesUpFromCommitlogWithoutHoldingUpWrites(t *testing.T) {
+	//given
+	db := openSubscribeTestDB(2)
+	done := make(chan struct{})
+	defer close(done)
+	events := db.Subscribe(Filter{BufferSize: 1, SlowConsumer: BlockSlowConsumer, Done: done})
+
+	//when
+	storeCounterPoints(t, db, 1, 20)
+
+	//then
+	for ts := uint64(1); ts <= 20; ts++ {
+		e := nextEvent(t, events)
+		assert.Nil(t, e.Err)
+		assert.Equal(t, ts, e.Timestamp)
+	}
+}
+
+func TestDB_SubscriberBehindFlushedRecordsGetsError(t *testing.T) {
+	//given
+	db := openSubscribeTestDB(2)
+	storeCounterPoints(t, db, 1, 5)
+	db.Writer.DiskWriter.Flush()
+
+	//when
+	events := db.Subscribe(Filter{FromSequence: 1})
+
+	//then
+	e := nextEvent(t, events)
+	assert.Equal(t, ErrTooFarBehind, e.Err)
+	assert.Equal(t, uint64(1), e.Sequence)
+	assertClosed(t, events)
+}
+
+func openSubscribeTestDB(tailRecords int) *DB {
+	return Open(Options{
+		CommitlogPath:        checkpointTestDir("commitlog"),
+		EntriesPerCommitlog:  1000,
+		PeriodBetweenFlushes: time.Hour,
+		SSTPath:              checkpointTestDir("sstm"),
+		MemtMaxEntriesPerTag: 10,
+		TailRecords:          tailRecords,
+	})
+}
+
+func storeCounterPoints(t *testing.T, db *DB, from uint64, to uint64) {
+	for ts := from; ts <= to; ts++ {
+		assert.Nil(t, db.Writer.Store(dto.TaggedMeasurement{Tag: "counter", Timestamp: ts, Value: []byte{byte(ts)}}, 0))
+	}
+}
+
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event delivered")
+		return Event{}
+	}
+}
+
+func assertClosed(t *testing.T, events <-chan Event) {
+	select {
+	case e, open := <-events:
+		assert.False(t, open, "unexpected event %v", e)
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription not ended")
+	}
+}
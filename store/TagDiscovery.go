@@ -0,0 +1,88 @@
+package store
+
+import (
+	"errors"
+	"lsmstore/dto"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const DefaultTagsLimit = 1000
+
+type TagQuery struct {
+	Prefix string
+	After  string
+	Limit  int
+	Glob   string
+	Regex  string
+}
+
+func (sr *StorageReader) ListTags(prefix string, after string, limit int) []string {
+	tags, _ := sr.FindTags(TagQuery{Prefix: prefix, After: after, Limit: limit})
+	return tags
+}
+
+// FindTags returns up to Limit tags in sorted order, strictly after After, matching all the given filters.
+// Pass the last returned tag as After to fetch the next page.
+func (sr *StorageReader) FindTags(q TagQuery) ([]string, error) {
+	if sr.Tags == nil {
+		return nil, errors.New("tag index is not configured")
+	}
+	if q.Limit <= 0 {
+		q.Limit = DefaultTagsLimit
+	}
+	if (q.Glob != "") && (q.Regex != "") {
+		return nil, errors.New("glob and regex cannot be combined")
+	}
+	var re *regexp.Regexp
+	if q.Regex != "" {
+		compiled, err := regexp.Compile(q.Regex)
+		if err != nil {
+			return nil, err
+		}
+		re = compiled
+	}
+	prefix := q.Prefix
+	if q.Glob != "" {
+		if _, err := path.Match(q.Glob, ""); err != nil {
+			return nil, err
+		}
+		if globPrefix := literalPrefixOfGlob(q.Glob); strings.HasPrefix(globPrefix, prefix) {
+			prefix = globPrefix
+		}
+	}
+
+	ans := make([]string, 0)
+	sr.Tags.Ascend(prefix, q.After, func(tag string) bool {
+		if !strings.HasPrefix(tag, q.Prefix) {
+			return true
+		}
+		if q.Glob != "" {
+			if matched, _ := path.Match(q.Glob, tag); !matched {
+				return true
+			}
+		}
+		if (re != nil) && !re.MatchString(tag) {
+			return true
+		}
+		ans = append(ans, tag)
+		return len(ans) < q.Limit
+	})
+	return ans, nil
+}
+
+// TagInfo is a lighter view of TagStats; the point count is approximate as overwrites of
+// flushed points held in memtable are counted twice.
+func (sr *StorageReader) TagInfo(tag string) dto.TagInfo {
+	stats := sr.TagStats(tag)
+	return dto.TagInfo{Tag: tag, First: stats.First, Last: stats.Last, ApproxPoints: stats.Points, DiskBytes: stats.DiskBytes}
+}
+
+func literalPrefixOfGlob(glob string) string {
+	idx := strings.IndexAny(glob, `*?[\`)
+	if idx < 0 {
+		return glob
+	}
+	return glob[:idx]
+}
@@ -0,0 +1,60 @@
+package store
+
+import (
+	"fmt"
+	"lsmstore/dto"
+	"lsmstore/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLSM_TagDiscoveryWorks(t *testing.T) {
+	//given
+	sstPath := fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	commitlogPath := fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	storageReader, storageWriter := InitStorage(commitlogPath, 10, 1*time.Second, 10*time.Second, 10*time.Second, sstPath, 9999)
+	batch := make([]dto.TaggedMeasurement, 0)
+	for i := 0; i < 20; i++ {
+		for ts := uint64(1337); ts < 1347; ts++ {
+			batch = append(batch, dto.TaggedMeasurement{Tag: fmt.Sprintf("host-%02d.cpu", i), Timestamp: ts, Value: make([]byte, 4)})
+			batch = append(batch, dto.TaggedMeasurement{Tag: fmt.Sprintf("host-%02d.mem", i), Timestamp: ts, Value: make([]byte, 4)})
+		}
+	}
+
+	//when
+	storageWriter.StoreBatch(batch, 0)
+	storageReader.Retrieve(toList("not-written"), 0, 2000)
+	firstPage := storageReader.ListTags("host-1", "", 4)
+	secondPage := storageReader.ListTags("host-1", firstPage[len(firstPage)-1], 4)
+	globbed, errGlob := storageReader.FindTags(TagQuery{Glob: "host-1?.cpu", Limit: 3})
+	matched, errRegex := storageReader.FindTags(TagQuery{Regex: `-0[0-2]\.mem$`})
+	_, errBadRegex := storageReader.FindTags(TagQuery{Regex: `(`})
+
+	//then
+	assert.Equal(t, []string{"host-10.cpu", "host-10.mem", "host-11.cpu", "host-11.mem"}, firstPage)
+	assert.Equal(t, []string{"host-12.cpu", "host-12.mem", "host-13.cpu", "host-13.mem"}, secondPage)
+	assert.Nil(t, errGlob)
+	assert.Equal(t, []string{"host-10.cpu", "host-11.cpu", "host-12.cpu"}, globbed)
+	assert.Nil(t, errRegex)
+	assert.Equal(t, []string{"host-00.mem", "host-01.mem", "host-02.mem"}, matched)
+	assert.NotNil(t, errBadRegex)
+	assert.Equal(t, 0, len(storageReader.ListTags("not-written", "", 10)), "tag was registered by a read")
+
+	//when
+	time.Sleep(2 * time.Second)
+	info := storageReader.TagInfo("host-07.cpu")
+
+	//then
+	assert.Equal(t, uint64(1337), info.First, "first ts incorrect")
+	assert.Equal(t, uint64(1346), info.Last, "last ts incorrect")
+	assert.Equal(t, 10, info.ApproxPoints, "points count incorrect")
+	assert.Equal(t, int64(utils.RecordsHeaderSize+10*(2+16+4+utils.ChecksumSize)), info.DiskBytes, "disk size incorrect")
+
+	//given
+	storageReader, _ = InitStorage(commitlogPath, 10, 1*time.Second, 10*time.Second, 0, sstPath, 9999)
+
+	//then
+	assert.Equal(t, 40, len(storageReader.ListTags("", "", 0)), "tags lost after reopening")
+}
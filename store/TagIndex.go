@@ -0,0 +1,62 @@
+package store
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/google/btree"
+)
+
+type TagIndex struct {
+	tags  *btree.BTree
+	mutex *sync.RWMutex
+}
+
+type tagItem string
+
+func (t tagItem) Less(than btree.Item) bool {
+	return t < than.(tagItem)
+}
+
+func (ti *TagIndex) Init() {
+	ti.tags = btree.New(16)
+	ti.mutex = &sync.RWMutex{}
+}
+
+func (ti *TagIndex) Add(tag string) {
+	ti.mutex.RLock()
+	exists := ti.tags.Has(tagItem(tag))
+	ti.mutex.RUnlock()
+	if exists {
+		return
+	}
+	ti.mutex.Lock()
+	ti.tags.ReplaceOrInsert(tagItem(tag))
+	ti.mutex.Unlock()
+}
+
+func (ti *TagIndex) Len() int {
+	ti.mutex.RLock()
+	defer ti.mutex.RUnlock()
+	return ti.tags.Len()
+}
+
+// Ascend walks tags starting with prefix in sorted order, beginning right after the given tag.
+func (ti *TagIndex) Ascend(prefix string, after string, receiver func(string) bool) {
+	pivot := prefix
+	if after >= pivot {
+		pivot = after
+	}
+	ti.mutex.RLock()
+	defer ti.mutex.RUnlock()
+	ti.tags.AscendGreaterOrEqual(tagItem(pivot), func(i btree.Item) bool {
+		tag := string(i.(tagItem))
+		if !strings.HasPrefix(tag, prefix) {
+			return false
+		}
+		if (after != "") && (tag == after) {
+			return true
+		}
+		return receiver(tag)
+	})
+}
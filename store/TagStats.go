@@ -0,0 +1,41 @@
+package store
+
+import (
+	"lsmstore/dto"
+	"lsmstore/memt"
+)
+
+// TagStats combines counters kept up to date by the SST and memtable of a tag, so it neither scans files nor
+// sweeps the index unless some entry has actually expired since the last call.
+func (sr *StorageReader) TagStats(tag string) dto.TagStats {
+	ans := dto.TagStats{Tag: tag}
+	if sstForTag, exists := sr.SSTManager.ExistingSstForTag(tag); exists {
+		stats := sstForTag.Stats()
+		ans.First = stats.First
+		ans.Last = stats.Last
+		ans.Points = stats.Points
+		ans.DiskBytes = stats.Bytes
+		ans.ExpiredNotCompacted = stats.ExpiredNotCompacted
+	}
+	//points newer than the SST are counted once, whether cached, unflushed or both
+	sstLast := ans.Last
+	var newerThanSst []memt.Entry
+	if memtForTag, exists := sr.MemTable.ExistingMemTableForTag(tag); exists {
+		memtFrom, memtTo := memtForTag.Availability()
+		ans.MemtablePoints = memtForTag.Len()
+		newerThanSst = memtForTag.Retrieve(sstLast+1, ^uint64(0))
+		ans.First = minNotZero(ans.First, memtFrom)
+		ans.Last = maxNotZero(ans.Last, memtTo)
+	}
+	if sr.WriteBuffer != nil {
+		if buffer, exists := sr.WriteBuffer.ExistingBufferForTag(tag); exists {
+			bufferFrom, bufferTo := buffer.Availability()
+			ans.UnflushedPoints = buffer.Len()
+			newerThanSst = mergeEntries(buffer.Retrieve(sstLast+1, ^uint64(0)), newerThanSst, false)
+			ans.First = minNotZero(ans.First, bufferFrom)
+			ans.Last = maxNotZero(ans.Last, bufferTo)
+		}
+	}
+	ans.Points += len(newerThanSst)
+	return ans
+}
@@ -0,0 +1,34 @@
+package store
+
+import (
+	"fmt"
+	"lsmstore/dto"
+	"lsmstore/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLSM_TagStatsWork(t *testing.T) {
+	//given
+	storageReader, storageWriter := InitStorage(
+		fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		10,
+		1*time.Second,
+		10*time.Second,
+		10*time.Second,
+		fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		5)
+	const tagName = "whatever"
+
+	//when
+	storageWriter.StoreBatch(sliceAndToBatch(buildDummyData(20), tagName, 0, 20), 0)
+	time.Sleep(2 * time.Second)
+	storageWriter.StoreBatch([]dto.TaggedMeasurement{{Tag: tagName, Timestamp: 1400, Value: make([]byte, 4)}}, 0)
+	stats := storageReader.TagStats(tagName)
+
+	//then
+	assert.Equal(t, dto.TagStats{Tag: tagName, First: 1337, Last: 1400, Points: 21, DiskBytes: utils.RecordsHeaderSize + 20*(22+utils.ChecksumSize), MemtablePoints: 5, UnflushedPoints: 1}, stats)
+	assert.Equal(t, dto.TagStats{Tag: "unknown"}, storageReader.TagStats("unknown"))
+}
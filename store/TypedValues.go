@@ -0,0 +1,123 @@
+package store
+
+import (
+	"fmt"
+	"lsmstore/dto"
+	"lsmstore/schema"
+)
+
+func (sw *StorageWriter) StoreFloat(tag string, timestamp uint64, value float64, expiresAt uint64) error {
+	return sw.storeTyped(tag, schema.Float64, timestamp, schema.EncodeFloat64(value), expiresAt)
+}
+
+func (sw *StorageWriter) StoreInt(tag string, timestamp uint64, value int64, expiresAt uint64) error {
+	return sw.storeTyped(tag, schema.Int64, timestamp, schema.EncodeInt64(value), expiresAt)
+}
+
+func (sw *StorageWriter) StoreBool(tag string, timestamp uint64, value bool, expiresAt uint64) error {
+	return sw.storeTyped(tag, schema.Bool, timestamp, schema.EncodeBool(value), expiresAt)
+}
+
+func (sw *StorageWriter) StoreString(tag string, timestamp uint64, value string, expiresAt uint64) error {
+	return sw.storeTyped(tag, schema.String, timestamp, schema.EncodeString(value), expiresAt)
+}
+
+func (sw *StorageWriter) StoreBytes(tag string, timestamp uint64, value []byte, expiresAt uint64) error {
+	return sw.storeTyped(tag, schema.Bytes, timestamp, value, expiresAt)
+}
+
+func (sw *StorageWriter) storeTyped(tag string, vt schema.ValueType, timestamp uint64, value []byte, expiresAt uint64) error {
+	if sw.Catalog != nil {
+		if err := checkValueType(tag, sw.Catalog.TypeOf(tag), vt); err != nil {
+			return invalid(err)
+		}
+	}
+	return sw.StoreBatch([]dto.TaggedMeasurement{{Tag: tag, Timestamp: timestamp, Value: value}}, expiresAt)
+}
+
+func (sr *StorageReader) RetrieveFloat(tag string, from uint64, to uint64) ([]dto.FloatMeasurement, error) {
+	data, err := sr.retrieveTyped(tag, schema.Float64, from, to)
+	if err != nil {
+		return nil, err
+	}
+	ans := make([]dto.FloatMeasurement, len(data))
+	for i, m := range data {
+		v, err := schema.DecodeFloat64(m.Value)
+		if err != nil {
+			return nil, decodingError(tag, m, err)
+		}
+		ans[i] = dto.FloatMeasurement{Timestamp: m.Timestamp, Value: v}
+	}
+	return ans, nil
+}
+
+func (sr *StorageReader) RetrieveInt(tag string, from uint64, to uint64) ([]dto.IntMeasurement, error) {
+	data, err := sr.retrieveTyped(tag, schema.Int64, from, to)
+	if err != nil {
+		return nil, err
+	}
+	ans := make([]dto.IntMeasurement, len(data))
+	for i, m := range data {
+		v, err := schema.DecodeInt64(m.Value)
+		if err != nil {
+			return nil, decodingError(tag, m, err)
+		}
+		ans[i] = dto.IntMeasurement{Timestamp: m.Timestamp, Value: v}
+	}
+	return ans, nil
+}
+
+func (sr *StorageReader) RetrieveBool(tag string, from uint64, to uint64) ([]dto.BoolMeasurement, error) {
+	data, err := sr.retrieveTyped(tag, schema.Bool, from, to)
+	if err != nil {
+		return nil, err
+	}
+	ans := make([]dto.BoolMeasurement, len(data))
+	for i, m := range data {
+		v, err := schema.DecodeBool(m.Value)
+		if err != nil {
+			return nil, decodingError(tag, m, err)
+		}
+		ans[i] = dto.BoolMeasurement{Timestamp: m.Timestamp, Value: v}
+	}
+	return ans, nil
+}
+
+func (sr *StorageReader) RetrieveString(tag string, from uint64, to uint64) ([]dto.StringMeasurement, error) {
+	data, err := sr.retrieveTyped(tag, schema.String, from, to)
+	if err != nil {
+		return nil, err
+	}
+	ans := make([]dto.StringMeasurement, len(data))
+	for i, m := range data {
+		v, err := schema.DecodeString(m.Value)
+		if err != nil {
+			return nil, decodingError(tag, m, err)
+		}
+		ans[i] = dto.StringMeasurement{Timestamp: m.Timestamp, Value: v}
+	}
+	return ans, nil
+}
+
+// RetrieveBytes returns values as stored, for tags registered as bytes or not registered at all.
+func (sr *StorageReader) RetrieveBytes(tag string, from uint64, to uint64) ([]dto.Measurement, error) {
+	return sr.retrieveTyped(tag, schema.Bytes, from, to)
+}
+
+func (sr *StorageReader) retrieveTyped(tag string, vt schema.ValueType, from uint64, to uint64) ([]dto.Measurement, error) {
+	if err := checkValueType(tag, sr.valueTypeOf(tag), vt); err != nil {
+		return nil, err
+	}
+	return sr.retrieveDataForTag(tag, from, to), nil
+}
+
+func checkValueType(tag string, registered schema.ValueType, requested schema.ValueType) error {
+	if (registered != schema.Untyped) && (registered != requested) {
+		return fmt.Errorf("tag %s holds %s values, not %s", tag, registered, requested)
+	}
+	return nil
+}
+
+func decodingError(tag string, m dto.Measurement, err error) error {
+	return fmt.Errorf("cannot decode value of tag %s at %d: %v", tag, m.Timestamp, err)
+}
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"fmt"
+	"lsmstore/dto"
+	"lsmstore/schema"
+	"lsmstore/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLSM_TypedValuesWork(t *testing.T) {
+	//given
+	storageReader, storageWriter := InitStorage(
+		fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		10,
+		5*time.Second,
+		10*time.Second,
+		10*time.Second,
+		fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		9999)
+	assert.Nil(t, storageWriter.Catalog.Register("temperature", schema.Float64))
+	assert.Nil(t, storageWriter.Catalog.Register("name", schema.String))
+	assert.Nil(t, storageWriter.Catalog.Register("payload", schema.Bytes))
+
+	//when
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, storageWriter.StoreFloat("temperature", 1337+uint64(i), float64(i)/2, 0))
+	}
+	assert.Nil(t, storageWriter.StoreString("name", 1337, "kitchen", 0))
+	assert.Nil(t, storageWriter.StoreBytes("payload", 1337, []byte{0xff, 0x00}, 0))
+	errWrongType := storageWriter.StoreInt("temperature", 1400, 42, 0)
+	errWrongSize := storageWriter.Store(dto.TaggedMeasurement{Tag: "temperature", Timestamp: 1401, Value: make([]byte, 4)}, 0)
+	errWrongBatch := storageWriter.StoreBatch([]dto.TaggedMeasurement{
+		{Tag: "temperature", Timestamp: 1402, Value: schema.EncodeFloat64(1)},
+		{Tag: "name", Timestamp: 1402, Value: []byte{0xff}},
+	}, 0)
+
+	floats, errFloats := storageReader.RetrieveFloat("temperature", 0, 2000)
+	strings, errStrings := storageReader.RetrieveString("name", 0, 2000)
+	payloads, errPayloads := storageReader.RetrieveBytes("payload", 0, 2000)
+	_, errRetrieveWrongType := storageReader.RetrieveBool("temperature", 0, 2000)
+	errBytesForFloat := storageWriter.StoreBytes("temperature", 1403, schema.EncodeFloat64(1), 0)
+	_, errRetrieveFloatAsBytes := storageReader.RetrieveBytes("temperature", 0, 2000)
+
+	//then
+	assert.NotNil(t, errWrongType, "int accepted for float tag")
+	assert.NotNil(t, errWrongSize, "malformed float accepted")
+	assert.NotNil(t, errWrongBatch, "batch with malformed string accepted")
+	assert.NotNil(t, errRetrieveWrongType, "float tag retrieved as bool")
+	assert.NotNil(t, errBytesForFloat, "bytes accepted for float tag")
+	assert.NotNil(t, errRetrieveFloatAsBytes, "float tag retrieved as bytes")
+	assert.Nil(t, errFloats)
+	assert.Nil(t, errStrings)
+	assert.Equal(t, 5, len(floats), "rejected writes were stored")
+	for i, f := range floats {
+		assert.Equal(t, 1337+uint64(i), f.Timestamp, "measurement timestamp incorrect")
+		assert.Equal(t, float64(i)/2, f.Value, "measurement value incorrect")
+	}
+	assert.Equal(t, []dto.StringMeasurement{{Timestamp: 1337, Value: "kitchen"}}, strings)
+	assert.Nil(t, errPayloads)
+	assert.Equal(t, []dto.Measurement{{Timestamp: 1337, Value: []byte{0xff, 0x00}}}, payloads)
+}
@@ -0,0 +1,104 @@
+package store
+
+import (
+	"fmt"
+	"lsmstore/commitlog"
+	"lsmstore/dto"
+	"lsmstore/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLSM_WriteBufferKeepsUnflushedDataReadable(t *testing.T) {
+	//given
+	commitlogPath := fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	sstPath := fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())
+	opts := Options{
+		CommitlogPath:        commitlogPath,
+		EntriesPerCommitlog:  100000,
+		PeriodBetweenFlushes: time.Hour,
+		SSTPath:              sstPath,
+		MemtMaxEntriesPerTag: 2,
+	}
+	storageReader, storageWriter := InitStorageWithOptions(opts)
+	expiresAt := utils.GetNowMillis() + 3600000
+	storageWriter.StoreBatch(sliceAndToBatch(buildDummyData(50), "tag", 0, 50), expiresAt)
+
+	//when
+	beforeFlush := storageReader.Retrieve([]string{"tag"}, 0, 2000)
+	statsBeforeFlush := storageReader.TagStats("tag")
+	storageWriter.DiskWriter.Flush()
+	afterFlush := storageReader.Retrieve([]string{"tag"}, 0, 2000)
+	statsAfterFlush := storageReader.TagStats("tag")
+
+	//then
+	assert.Equal(t, 50, len(beforeFlush["tag"]), "points evicted from cache before flush were lost")
+	assert.Equal(t, 50, statsBeforeFlush.UnflushedPoints)
+	assert.Equal(t, 50, statsBeforeFlush.Points)
+	assert.Equal(t, 2, statsBeforeFlush.MemtablePoints)
+	assert.Equal(t, beforeFlush, afterFlush)
+	assert.Equal(t, 0, statsAfterFlush.UnflushedPoints, "flushed points were kept in write buffer")
+	assert.Equal(t, 50, statsAfterFlush.Points)
+
+	//given
+	opts.MemtPrefetchSeconds = 10 * time.Millisecond
+	opts.MemtMaxEntriesPerTag = 0
+	opts.MemtMaxAgePerTag = 5 * time.Millisecond
+	reopenedReader, _ := InitStorageWithOptions(opts)
+
+	//when
+	memtForTag, exists := reopenedReader.MemTable.ExistingMemTableForTag("tag")
+
+	//then
+	assert.True(t, exists, "nothing was prefetched")
+	cached := memtForTag.RetrieveAll()
+	assert.Equal(t, 6, len(cached), "cache policy was not applied to prefetched points")
+	assert.Equal(t, uint64(1381), cached[0].Timestamp)
+	assert.Equal(t, expiresAt, cached[0].ExpiresAt, "prefetched points got a synthetic expiration")
+}
+
+func TestLSM_BatchIsSyncedOnceAndReadableOnlyOnceWritten(t *testing.T) {
+	//given
+	storageReader, storageWriter := InitStorageWithOptions(Options{
+		CommitlogPath:        fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		EntriesPerCommitlog:  100000,
+		PeriodBetweenFlushes: time.Hour,
+		SSTPath:              fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx()),
+		MemtMaxEntriesPerTag: 10,
+	})
+	syncs := 0
+	storageWriter.DiskWriter.Paused(func() {
+		afterStore := storageWriter.DiskWriter.AfterStore
+		storageWriter.DiskWriter.AfterStore = func(first uint64, entries []commitlog.Entry) {
+			syncs++
+			afterStore(first, entries)
+		}
+	})
+	batch := []dto.TaggedMeasurement{
+		{Tag: "tag1", Timestamp: 1337, Value: []byte{1}},
+		{Tag: "tag2", Timestamp: 1337, Value: []byte{2}},
+		{Tag: "tag3", Timestamp: 1337, Value: []byte{3}},
+	}
+
+	//when
+	err := storageWriter.StoreBatch(batch, 0)
+
+	//then
+	assert.Nil(t, err)
+	assert.Equal(t, 1, syncs, "every tag of the batch was synced on its own")
+	assert.Equal(t, 3, len(storageReader.Retrieve([]string{"tag1", "tag2", "tag3"}, 0, 2000)))
+
+	//given
+	assert.Nil(t, storageWriter.DiskWriter.ClManager.Close())
+
+	//when
+	err = storageWriter.StoreBatch([]dto.TaggedMeasurement{{Tag: "tag4", Timestamp: 1337, Value: []byte{4}}, {Tag: "tag1", Timestamp: 1338, Value: []byte{5}}}, 0)
+
+	//then
+	assert.NotNil(t, err)
+	assert.Equal(t, map[string][]dto.Measurement{"tag1": {{Timestamp: 1337, Value: []byte{1}}}, "tag4": {}}, storageReader.Retrieve([]string{"tag1", "tag4"}, 0, 2000), "points of a failed write are readable")
+	assert.Equal(t, 3, storageWriter.WriteBuffer.Len(), "points of a failed write are kept in write buffer")
+	assert.NotContains(t, storageReader.GetTags(), "tag4")
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"io"
+	"os"
+)
+
+// CopyFile copies src into a new file dst and syncs it.
+func CopyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// LinkOrCopy hard links src as dst, falling back to a copy where links are not possible, e.g. across file systems.
+func LinkOrCopy(src string, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return CopyFile(src, dst)
+}
+
+// WriteFileSynced writes content into a new or truncated file at path and syncs it.
+func WriteFileSynced(path string, content []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// SyncDir makes the entries of dir durable, e.g. files created, linked or renamed into it.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
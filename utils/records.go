@@ -0,0 +1,205 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// Files of records, as SSTs and commitlogs are, start with a header of RecordsHeaderSize bytes telling their version.
+// Each record is prefixed with its length as uint16 little endian and ends with a CRC-32C of the rest of it, which the
+// length includes. Version 1 files have neither header nor checksums; the header starts with two zero bytes, which
+// no version 1 file does, as it would be a record of no bytes.
+const RecordsVersion = 2
+const RecordsHeaderSize = 8
+const ChecksumSize = 4
+
+var recordsMagic = []byte{0, 0, 'L', 'S', 'M', 'R'}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+func RecordsHeader() []byte {
+	header := make([]byte, RecordsHeaderSize)
+	copy(header, recordsMagic)
+	binary.LittleEndian.PutUint16(header[len(recordsMagic):], RecordsVersion)
+	return header
+}
+
+// ReadRecordsVersion tells the version of a file from its first bytes; a file without a header is of version 1.
+func ReadRecordsVersion(r io.ReaderAt) (int, error) {
+	header := make([]byte, RecordsHeaderSize)
+	n, err := r.ReadAt(header, 0)
+	if (err != nil) && (err != io.EOF) {
+		return 0, err
+	}
+	if (n < RecordsHeaderSize) || !bytes.Equal(header[:len(recordsMagic)], recordsMagic) {
+		return 1, nil
+	}
+	return int(binary.LittleEndian.Uint16(header[len(recordsMagic):])), nil
+}
+
+// EncodeRecord prefixes payload with the length and appends the checksum.
+func EncodeRecord(payload []byte) []byte {
+	record := make([]byte, 2+len(payload)+ChecksumSize)
+	binary.LittleEndian.PutUint16(record, uint16(len(payload)+ChecksumSize))
+	copy(record[2:], payload)
+	binary.LittleEndian.PutUint32(record[2+len(payload):], crc32.Checksum(payload, castagnoli))
+	return record
+}
+
+// PayloadOf strips the checksum off a record read without its length prefix, without verifying it.
+func PayloadOf(record []byte) []byte {
+	return record[:len(record)-ChecksumSize]
+}
+
+// VerifiedPayloadOf strips the checksum off a record read without its length prefix once it matches.
+func VerifiedPayloadOf(record []byte) ([]byte, error) {
+	if len(record) < ChecksumSize {
+		return nil, fmt.Errorf("%d bytes are too short for a checksum", len(record))
+	}
+	payload := PayloadOf(record)
+	if binary.LittleEndian.Uint32(record[len(payload):]) != crc32.Checksum(payload, castagnoli) {
+		return nil, errChecksumMismatch
+	}
+	return payload, nil
+}
+
+// RecordsReport describes a file of records. Damage is detected by checksums, and by records failing their format
+// check, which is all there is for files of version 1.
+type RecordsReport struct {
+	FileName  string
+	FileBytes int64
+	Version   int
+	Records   int
+	Dropped   int
+	// TornTail is the number of bytes at the end of the file that do not make a whole record
+	TornTail int64
+	Problems []string
+}
+
+func (r *RecordsReport) Clean() bool {
+	return (r.Dropped == 0) && (r.TornTail == 0)
+}
+
+// ScanRecords passes the payload of every record accepted by check to receiver, with its offset, and reports
+// the others. check may keep state, it is called once per record with a matching checksum, in file order.
+func ScanRecords(fileName string, check func([]byte) error, receiver func([]byte, int64)) (RecordsReport, error) {
+	report := RecordsReport{FileName: fileName}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return report, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return report, err
+	}
+	report.FileBytes = info.Size()
+	if report.Version, err = ReadRecordsVersion(file); err != nil {
+		return report, err
+	}
+	if report.Version > RecordsVersion {
+		return report, fmt.Errorf("version %d of %s is not supported", report.Version, fileName)
+	}
+
+	reader := bufio.NewReader(file)
+	offset := int64(0)
+	if report.Version > 1 {
+		offset = RecordsHeaderSize
+		if _, err := reader.Discard(RecordsHeaderSize); err != nil {
+			return report, err
+		}
+	}
+	sizeBuf := make([]byte, 2)
+	for offset < report.FileBytes {
+		if _, err := io.ReadFull(reader, sizeBuf); err != nil {
+			break
+		}
+		record := make([]byte, binary.LittleEndian.Uint16(sizeBuf))
+		if _, err := io.ReadFull(reader, record); err != nil {
+			break
+		}
+		payload := record
+		if report.Version > 1 {
+			payload, err = VerifiedPayloadOf(record)
+		}
+		if err == nil {
+			err = check(payload)
+		}
+		if err != nil {
+			report.Dropped++
+			report.Problems = append(report.Problems, fmt.Sprintf("record at offset %d: %v", offset, err))
+		} else {
+			report.Records++
+			receiver(payload, offset)
+		}
+		offset += 2 + int64(len(record))
+	}
+	if offset < report.FileBytes {
+		report.TornTail = report.FileBytes - offset
+		report.Problems = append(report.Problems, fmt.Sprintf("torn tail of %d bytes at offset %d", report.TornTail, offset))
+	}
+	return report, nil
+}
+
+// RepairRecords rewrites the file with only the records accepted by check, leaving it untouched if all are
+// and it is of the current version. The file is replaced by a rename, so it must not be open for writing by anyone.
+func RepairRecords(fileName string, check func([]byte) error) (RecordsReport, error) {
+	return rewriteRecords(fileName, check, false)
+}
+
+// MigrateRecords rewrites a file of an earlier version in the current one, as RepairRecords would, returning
+// migrated false if it was current already or does not exist.
+func MigrateRecords(fileName string, check func([]byte) error) (report RecordsReport, migrated bool, err error) {
+	file, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return RecordsReport{FileName: fileName, Version: RecordsVersion}, false, nil
+	}
+	if err != nil {
+		return RecordsReport{FileName: fileName}, false, err
+	}
+	version, err := ReadRecordsVersion(file)
+	file.Close()
+	if (err != nil) || (version == RecordsVersion) {
+		return RecordsReport{FileName: fileName, Version: version}, false, err
+	}
+	report, err = rewriteRecords(fileName, check, true)
+	return report, err == nil, err
+}
+
+func rewriteRecords(fileName string, check func([]byte) error, always bool) (RecordsReport, error) {
+	repairedName := fileName + ".repair"
+	repaired, err := os.OpenFile(repairedName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return RecordsReport{FileName: fileName}, err
+	}
+	writer := bufio.NewWriter(repaired)
+	_, writeErr := writer.Write(RecordsHeader())
+	report, err := ScanRecords(fileName, check, func(payload []byte, _ int64) {
+		if writeErr == nil {
+			_, writeErr = writer.Write(EncodeRecord(payload))
+		}
+	})
+	if err == nil {
+		err = writeErr
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = repaired.Sync()
+	}
+	repaired.Close()
+	if (err != nil) || (!always && report.Clean() && (report.Version == RecordsVersion)) {
+		os.Remove(repairedName)
+		return report, err
+	}
+	return report, os.Rename(repairedName, fileName)
+}
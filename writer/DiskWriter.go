@@ -4,8 +4,8 @@ import (
 	"fmt"
 	"lsmstore/commitlog"
 	"lsmstore/sst"
-	"lsmstore/utils"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/jeanphorn/log4go"
@@ -16,8 +16,16 @@ type DiskWriter struct {
 	ClManager            *commitlog.Manager
 	EntriesPerCommitlog  int
 	PeriodBetweenFlushes time.Duration
-	currentEntries       int
-	mutex                *sync.Mutex
+	AfterFlush           func([]commitlog.Entry)
+	// AfterStore gets entries once the commitlog holding them is synced to disk
+	AfterStore     func(uint64, []commitlog.Entry)
+	currentEntries int
+	mutex          *sync.Mutex
+	// syncMutex lets one writer sync the commitlog for every writer which stored entries meanwhile
+	syncMutex      *sync.Mutex
+	unsynced       []commitlog.Entry
+	syncedSequence uint64
+	stop           chan struct{}
 }
 
 func (dbw *DiskWriter) Init() {
@@ -25,43 +33,128 @@ func (dbw *DiskWriter) Init() {
 	dbw.ClManager.Init()
 	dbw.currentEntries = 0
 	dbw.mutex = &sync.Mutex{}
+	dbw.syncMutex = &sync.Mutex{}
+	dbw.stop = make(chan struct{})
 
-	go utils.DoEvery(dbw.PeriodBetweenFlushes, func() {
-		dbw.trySwitchCommitlog()
-	})
+	go dbw.switchPeriodically()
+}
+
+func (dbw *DiskWriter) switchPeriodically() {
+	ticker := time.NewTicker(dbw.PeriodBetweenFlushes)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			dbw.trySwitchCommitlog()
+		case <-dbw.stop:
+			return
+		}
+	}
+}
+
+// Close stops the periodic flushes and closes the commitlogs and SSTs, once what was stored is synced; entries not
+// flushed yet stay in the commitlog for the next start. Nothing may be stored afterwards.
+func (dbw *DiskWriter) Close() error {
+	close(dbw.stop)
+	dbw.mutex.Lock()
+	defer dbw.mutex.Unlock()
+	syncErr := dbw.sync()
+	clErr := dbw.ClManager.Close()
+	sstErr := dbw.SstManager.Close()
+	for _, err := range []error{syncErr, clErr, sstErr} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dbw *DiskWriter) Store(e commitlog.Entry) error {
+	return dbw.StoreMultiple([]commitlog.Entry{e})
 }
 
-func (dbw *DiskWriter) Store(e commitlog.Entry) {
+// StoreMultiple returns once the entries are synced to disk; writers storing concurrently share one sync.
+func (dbw *DiskWriter) StoreMultiple(e []commitlog.Entry) error {
 	dbw.mutex.Lock()
-	dbw.ClManager.Store(e)
-	dbw.currentEntries++
+	before := dbw.ClManager.Sequence()
+	err := dbw.ClManager.StoreMultiple(e)
+	last := dbw.ClManager.Sequence()
+	dbw.unsynced = append(dbw.unsynced, e[:last-before]...)
+	dbw.currentEntries += int(last - before)
+	full := dbw.currentEntries >= dbw.EntriesPerCommitlog
+	if full {
+		dbw.currentEntries = 0
+	}
 	dbw.mutex.Unlock()
-	if dbw.currentEntries >= dbw.EntriesPerCommitlog {
+	if err == nil {
+		err = dbw.waitSynced(last)
+	}
+
+	if full {
 		dbw.trySwitchCommitlog()
-		dbw.currentEntries = 0
 	}
+	return err
 }
 
-func (dbw *DiskWriter) StoreMultiple(e []commitlog.Entry) {
+// waitSynced returns once the commitlog is synced up to sequence, syncing it unless another writer did meanwhile.
+func (dbw *DiskWriter) waitSynced(sequence uint64) error {
+	dbw.syncMutex.Lock()
+	defer dbw.syncMutex.Unlock()
+	if sequence <= atomic.LoadUint64(&dbw.syncedSequence) {
+		return nil
+	}
 	dbw.mutex.Lock()
-	dbw.ClManager.StoreMultiple(e)
-	dbw.currentEntries += len(e)
+	defer dbw.mutex.Unlock()
+	return dbw.sync()
+}
 
-	dbw.mutex.Unlock()
-	if dbw.currentEntries >= dbw.EntriesPerCommitlog {
-		dbw.trySwitchCommitlog()
-		dbw.currentEntries = 0
+// sync gives AfterStore the entries stored since the previous sync, once they are on disk; mutex must be held.
+// Entries of a failed sync are kept for the next one, so AfterStore still gets every sequence in order.
+func (dbw *DiskWriter) sync() error {
+	if len(dbw.unsynced) == 0 {
+		return nil
+	}
+	if err := dbw.ClManager.Sync(); err != nil {
+		return err
 	}
+	sequence := dbw.ClManager.Sequence()
+	if dbw.AfterStore != nil {
+		dbw.AfterStore(sequence-uint64(len(dbw.unsynced))+1, dbw.unsynced)
+	}
+	dbw.unsynced = nil
+	atomic.StoreUint64(&dbw.syncedSequence, sequence)
+	return nil
+}
+
+// Flush sends everything written so far to SST without waiting for the next periodic switch.
+func (dbw *DiskWriter) Flush() {
+	dbw.trySwitchCommitlog()
+}
+
+// Paused runs f while nothing is written to the commitlog nor flushed to SST.
+func (dbw *DiskWriter) Paused(f func()) {
+	dbw.mutex.Lock()
+	defer dbw.mutex.Unlock()
+	f()
 }
 
 func (dbw *DiskWriter) trySwitchCommitlog() {
 	dbw.mutex.Lock()
+	//entries not synced yet would be left behind in the commitlog swapped out
+	if err := dbw.sync(); err != nil {
+		log.Error("Syncing commitlog before flushing failed: %v", err)
+		dbw.mutex.Unlock()
+		return
+	}
 	currentEntries := dbw.ClManager.RetrieveAll()
 	if len(currentEntries) > 0 {
 		log.Debug("Switching commitlogs")
 		dbw.ClManager.SwapCommitlogs()
 		dbw.ClManager.ClearPrevious()
 		dbw.SstManager.MergeWithCommitlog(currentEntries)
+		if dbw.AfterFlush != nil {
+			dbw.AfterFlush(currentEntries)
+		}
 
 		log.Debug(fmt.Sprintf("%d entries sent to SST", len(currentEntries)))
 	}
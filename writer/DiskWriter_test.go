@@ -5,6 +5,7 @@ import (
 	"lsmstore/commitlog"
 	"lsmstore/sst"
 	"lsmstore/utils"
+	"sync"
 	"testing"
 	"time"
 
@@ -45,3 +46,38 @@ func TestDiskWriter_DataIsNotLost(t *testing.T) {
 		assert.Equal(t, dummyData[i].Value, writtenData[i].Value, "entry value incorrect")
 	}
 }
+
+func TestDiskWriter_AfterStoreGetsEverySequenceOnceSynced(t *testing.T) {
+	//given
+	clm := commitlog.Manager{Path: fmt.Sprintf("/tmp/golsm_test/diskwriter/commitlog-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())}
+	sstm := sst.Manager{RootDir: fmt.Sprintf("/tmp/golsm_test/diskwriter/sstm-%d-%d", utils.GetNowMillis(), utils.GetTestIdx())}
+	diskWriter := DiskWriter{SstManager: &sstm, ClManager: &clm, EntriesPerCommitlog: 50, PeriodBetweenFlushes: time.Hour}
+	sequences := make([]uint64, 0)
+	diskWriter.AfterStore = func(first uint64, entries []commitlog.Entry) {
+		for i := range entries {
+			sequences = append(sequences, first+uint64(i))
+		}
+	}
+	diskWriter.Init()
+	const writers, entriesPerWriter = 8, 40
+
+	//when
+	wg := sync.WaitGroup{}
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < entriesPerWriter; i++ {
+				e := commitlog.Entry{Key: []byte(fmt.Sprintf("tag%d", w)), Timestamp: uint64(1000 + i), Value: []byte{1}}
+				assert.Nil(t, diskWriter.Store(e))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	//then
+	assert.Equal(t, writers*entriesPerWriter, len(sequences))
+	for i, s := range sequences {
+		assert.Equal(t, uint64(i+1), s, "sequences are not handed over in order")
+	}
+}